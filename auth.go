@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+type Role string
+
+const (
+	RoleOwner    Role = "owner"
+	RoleStaff    Role = "staff"
+	RoleReadOnly Role = "read-only"
+)
+
+var (
+	readRoles  = []Role{RoleOwner, RoleStaff, RoleReadOnly}
+	writeRoles = []Role{RoleOwner, RoleStaff}
+	ownerRoles = []Role{RoleOwner}
+)
+
+type Principal struct {
+	Subject string `json:"sub"`
+	Role    Role   `json:"role"`
+	Expires int64  `json:"exp"`
+}
+
+type Authenticator struct {
+	apiKeys   map[string]Principal
+	jwtSecret []byte
+}
+
+func newAuthenticator(config AdminConfig) (*Authenticator, error) {
+	apiKeys, err := parseAPIKeys(config.APIKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authenticator{
+		apiKeys:   apiKeys,
+		jwtSecret: []byte(config.JWTSecret),
+	}, nil
+}
+
+// API keys are a comma separated list of role:key pairs,
+// e.g. "owner:abc123,staff:def456,read-only:ghi789".
+func parseAPIKeys(value string) (map[string]Principal, error) {
+	apiKeys := map[string]Principal{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		role, key, found := strings.Cut(entry, ":")
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid admin API key entry %q, expected role:key", entry)
+		}
+		if !validRole(Role(role)) {
+			return nil, fmt.Errorf("invalid role %q in admin API keys", role)
+		}
+
+		apiKeys[key] = Principal{Subject: "apikey:" + role, Role: Role(role)}
+	}
+
+	return apiKeys, nil
+}
+
+func validRole(role Role) bool {
+	return role == RoleOwner || role == RoleStaff || role == RoleReadOnly
+}
+
+func (a *Authenticator) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		principal, err := a.authenticate(c)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		c.Locals("principal", principal)
+
+		return c.Next()
+	}
+}
+
+func (a *Authenticator) authenticate(c *fiber.Ctx) (Principal, error) {
+	if key := c.Get("X-API-Key"); key != "" {
+		for candidate, principal := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+				return principal, nil
+			}
+		}
+		return Principal{}, errors.New("invalid API key")
+	}
+
+	token, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !found || token == "" {
+		return Principal{}, errors.New("missing credentials")
+	}
+
+	return a.verifyJWT(token, time.Now())
+}
+
+// Only HS256 tokens are accepted. The payload must carry "sub", "role" and "exp".
+func (a *Authenticator) verifyJWT(token string, now time.Time) (Principal, error) {
+	if len(a.jwtSecret) == 0 {
+		return Principal{}, errors.New("JWT authentication is not configured")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return Principal{}, errors.New("unsupported token header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, errors.New("malformed token signature")
+	}
+
+	mac := hmac.New(sha256.New, a.jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return Principal{}, errors.New("invalid token signature")
+	}
+
+	var principal Principal
+	if err := decodeJWTPart(parts[1], &principal); err != nil {
+		return Principal{}, errors.New("malformed token payload")
+	}
+
+	if principal.Expires == 0 || now.Unix() >= principal.Expires {
+		return Principal{}, errors.New("token expired")
+	}
+
+	if principal.Subject == "" || !validRole(principal.Role) {
+		return Principal{}, errors.New("invalid token claims")
+	}
+
+	return principal, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func signJWT(secret []byte, principal Principal) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payloadJSON, _ := json.Marshal(principal)
+	payload := base64.RawURLEncoding.EncodeToString(payloadJSON)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(header + "." + payload))
+
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func currentPrincipal(c *fiber.Ctx) (Principal, bool) {
+	principal, ok := c.Locals("principal").(Principal)
+	return principal, ok
+}
+
+func requireRole(roles ...Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		principal, ok := currentPrincipal(c)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "missing credentials",
+			})
+		}
+
+		for _, role := range roles {
+			if principal.Role == role {
+				return c.Next()
+			}
+		}
+
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": fmt.Sprintf("role %q is not allowed to perform this action", principal.Role),
+		})
+	}
+}
+
+// auditLog records every admin request with its outcome. It is mounted
+// before the authenticator so rejected credentials are recorded too, without
+// an actor.
+func auditLog(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+
+		principal, _ := currentPrincipal(c)
+		status := c.Response().StatusCode()
+		if err != nil {
+			if fiberErr, ok := err.(*fiber.Error); ok {
+				status = fiberErr.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+		}
+
+		// The query string is left out: it may carry tokens or personal
+		// data.
+		entry := AuditLog{
+			Actor:  principal.Subject,
+			Role:   string(principal.Role),
+			Method: c.Method(),
+			Path:   c.Path(),
+			Route:  c.Route().Path,
+			Status: status,
+			IP:     c.IP(),
+		}
+		if result := db.WithContext(c.UserContext()).Create(&entry); result.Error != nil {
+			slog.ErrorContext(c.UserContext(), "audit log failed", "error", result.Error)
+		}
+
+		return err
+	}
+}
+
+func (s *LLMService) getAuditLogs(c *fiber.Ctx) error {
+	var entries []AuditLog
+	err := s.db.Order("id desc").Limit(c.QueryInt("limit", 100)).Find(&entries).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(entries)
+}
+
+type tokenRequest struct {
+	Subject string `json:"subject"`
+	Role    Role   `json:"role"`
+	TTL     string `json:"ttl"`
+}
+
+func (a *Authenticator) issueToken(c *fiber.Ctx) error {
+	request := new(tokenRequest)
+
+	if err := c.BodyParser(request); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	if len(a.jwtSecret) == 0 {
+		return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{
+			"error": "JWT authentication is not configured",
+		})
+	}
+
+	if request.Subject == "" || !validRole(request.Role) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "subject and a valid role are required",
+		})
+	}
+
+	ttl := 24 * time.Hour
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil || parsed <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid ttl",
+			})
+		}
+		ttl = parsed
+	}
+
+	expires := time.Now().Add(ttl)
+	token := signJWT(a.jwtSecret, Principal{Subject: request.Subject, Role: request.Role, Expires: expires.Unix()})
+
+	return c.JSON(fiber.Map{
+		"token":      token,
+		"expires_at": expires,
+	})
+}
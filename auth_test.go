@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func newTestAdminApp(t *testing.T) (*fiber.App, *gorm.DB, *Authenticator) {
+	db := newTestDB(t, &AuditLog{})
+
+	auth := &Authenticator{
+		apiKeys: map[string]Principal{
+			"owner-key":    {Subject: "apikey:owner", Role: RoleOwner},
+			"readonly-key": {Subject: "apikey:read-only", Role: RoleReadOnly},
+		},
+		jwtSecret: []byte("secret"),
+	}
+
+	app := fiber.New()
+	admin := app.Group("/admin", auditLog(db), auth.Middleware())
+	admin.Get("/things", requireRole(readRoles...), func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	})
+	admin.Delete("/things/:id", requireRole(ownerRoles...), func(c *fiber.Ctx) error {
+		return c.SendString("deleted")
+	})
+
+	return app, db, auth
+}
+
+func TestAdminRoutesRequireCredentials(t *testing.T) {
+	app, db, _ := newTestAdminApp(t)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/admin/things", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("Status is not correct: %d", resp.StatusCode)
+	}
+
+	// Rejected attempts are audited as well.
+	req := httptest.NewRequest("DELETE", "/admin/things/1", nil)
+	req.Header.Set("X-API-Key", "stolen-key")
+	app.Test(req)
+	var entries []AuditLog
+	db.Order("id").Find(&entries)
+	if len(entries) != 2 || entries[1].Status != fiber.StatusUnauthorized || entries[1].Method != "DELETE" || entries[1].Actor != "" {
+		t.Errorf("Denied attempts were not audited: %+v", entries)
+	}
+}
+
+func TestAdminRoutesEnforceRoles(t *testing.T) {
+	app, db, _ := newTestAdminApp(t)
+
+	req := httptest.NewRequest("DELETE", "/admin/things/1", nil)
+	req.Header.Set("X-API-Key", "readonly-key")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("Status is not correct for read-only delete: %d", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest("DELETE", "/admin/things/1?token=secret", nil)
+	req.Header.Set("X-API-Key", "owner-key")
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("Status is not correct for owner delete: %d", resp.StatusCode)
+	}
+
+	var entries []AuditLog
+	db.Order("id").Find(&entries)
+	if len(entries) != 2 {
+		t.Fatalf("Audit log entries is not correct: %d", len(entries))
+	}
+	if entries[0].Status != fiber.StatusForbidden || entries[1].Actor != "apikey:owner" {
+		t.Errorf("Audit log entries are not correct: %+v", entries)
+	}
+	if entries[1].Path != "/admin/things/1" || entries[1].Route != "/admin/things/:id" {
+		t.Errorf("Audit log should keep the path and route without the query: %q, %q", entries[1].Path, entries[1].Route)
+	}
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	app, _, auth := newTestAdminApp(t)
+
+	token := signJWT(auth.jwtSecret, Principal{Subject: "maria", Role: RoleReadOnly, Expires: time.Now().Add(time.Hour).Unix()})
+	req := httptest.NewRequest("GET", "/admin/things", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("Status is not correct for valid token: %d", resp.StatusCode)
+	}
+
+	expired := signJWT(auth.jwtSecret, Principal{Subject: "maria", Role: RoleReadOnly, Expires: time.Now().Add(-time.Hour).Unix()})
+	if _, err := auth.verifyJWT(expired, time.Now()); err == nil {
+		t.Errorf("Expired token was accepted")
+	}
+
+	forged := signJWT([]byte("other"), Principal{Subject: "maria", Role: RoleOwner, Expires: time.Now().Add(time.Hour).Unix()})
+	if _, err := auth.verifyJWT(forged, time.Now()); err == nil {
+		t.Errorf("Forged token was accepted")
+	}
+}
@@ -2,105 +2,156 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
 	"time"
 
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
-	"google.golang.org/api/tasks/v1"
 )
 
-func googleCalendar() {
-	CalendarId := os.Getenv("GOOGLE_MED_CALENDAR")
-	jsonKey, err := os.ReadFile("credentials.json")
-	if err != nil {
-		log.Fatalf("unable to read json key file: %v", err)
+type CalendarEvent struct {
+	Summary     string
+	Description string
+	Start       time.Time
+	End         time.Time
+}
+
+// ErrEventNotFound is returned by DeleteEvent when the event does not exist
+// anymore, e.g. because it was deleted before.
+var ErrEventNotFound = errors.New("calendar event not found")
+
+// Calendar is where pickups and consultations are booked.
+type Calendar interface {
+	CreateEvent(ctx context.Context, event CalendarEvent) (string, error)
+	UpdateEvent(ctx context.Context, id string, event CalendarEvent) error
+	DeleteEvent(ctx context.Context, id string) error
+	// IsAvailable reports whether no event but the ignored one (the
+	// event of the order being moved, or "") overlaps the slot.
+	IsAvailable(ctx context.Context, start, end time.Time, ignore string) (bool, error)
+}
+
+func newCalendar(ctx context.Context, config GoogleConfig) (Calendar, error) {
+	if config.CalendarID == "" {
+		return noopCalendar{}, nil
 	}
 
-	creds, err := google.CredentialsFromJSON(context.Background(), jsonKey, calendar.CalendarScope, tasks.TasksScope)
+	return newGoogleCalendar(ctx, config)
+}
+
+// noopCalendar is used when no calendar is configured: every slot is free
+// and events are not stored anywhere.
+type noopCalendar struct{}
+
+func (noopCalendar) CreateEvent(ctx context.Context, event CalendarEvent) (string, error) {
+	return "", nil
+}
+
+func (noopCalendar) UpdateEvent(ctx context.Context, id string, event CalendarEvent) error {
+	return nil
+}
+
+func (noopCalendar) DeleteEvent(ctx context.Context, id string) error {
+	return nil
+}
+
+func (noopCalendar) IsAvailable(ctx context.Context, start, end time.Time, ignore string) (bool, error) {
+	return true, nil
+}
+
+type googleCalendar struct {
+	calendarID string
+	service    *calendar.Service
+}
+
+func newGoogleCalendar(ctx context.Context, config GoogleConfig) (*googleCalendar, error) {
+	jsonKey, err := os.ReadFile(config.CredentialsFile)
 	if err != nil {
-		log.Fatalf("unable to parse client secret file to config: %v", err)
+		return nil, fmt.Errorf("unable to read json key file: %w", err)
 	}
 
-	ctx := context.Background()
-	calendarService, err := calendar.NewService(ctx, option.WithCredentials(creds))
+	creds, err := google.CredentialsFromJSON(ctx, jsonKey, calendar.CalendarScope)
 	if err != nil {
-		log.Fatalf("Unable to retrieve Calendar client: %v", err)
+		return nil, fmt.Errorf("unable to parse client secret file to config: %w", err)
 	}
 
-	t := time.Now().Format(time.RFC3339)
-	events, err := calendarService.Events.List(CalendarId).ShowDeleted(false).
-		SingleEvents(true).TimeMin(t).MaxResults(10).OrderBy("startTime").Do()
+	calendarService, err := calendar.NewService(ctx, option.WithCredentials(creds))
 	if err != nil {
-		log.Printf("Unable to retrieve next ten of the user's events. %v: %v", err, events)
+		return nil, fmt.Errorf("unable to retrieve Calendar client: %w", err)
 	}
 
-	fmt.Println("Upcoming events:")
-	if events == nil || len(events.Items) == 0 {
-		fmt.Println("No upcoming events found.")
-	} else {
-		for _, item := range events.Items {
-			date := item.Start.DateTime
-			if date == "" {
-				date = item.Start.Date
-			}
-			fmt.Printf("%v (%v)\n", item.Summary, date)
-		}
-	}
+	return &googleCalendar{calendarID: config.CalendarID, service: calendarService}, nil
+}
 
-	tasksService, err := tasks.NewService(ctx, option.WithCredentials(creds))
-	if err != nil {
-		log.Fatalf("Unable to retrieve Tasks client: %v", err)
+func toGoogleEvent(event CalendarEvent) *calendar.Event {
+	return &calendar.Event{
+		Summary:     event.Summary,
+		Description: event.Description,
+		Start: &calendar.EventDateTime{
+			DateTime: event.Start.Format(time.RFC3339),
+			TimeZone: event.Start.Location().String(),
+		},
+		End: &calendar.EventDateTime{
+			DateTime: event.End.Format(time.RFC3339),
+			TimeZone: event.End.Location().String(),
+		},
 	}
+}
 
-	taskLists, err := tasksService.Tasklists.List().Do()
+func (g *googleCalendar) CreateEvent(ctx context.Context, event CalendarEvent) (string, error) {
+	newEvent, err := g.service.Events.Insert(g.calendarID, toGoogleEvent(event)).Context(ctx).Do()
 	if err != nil {
-		log.Fatalf("Unable to retrieve task lists: %v", err)
+		return "", err
 	}
 
-	if len(taskLists.Items) == 0 {
-		fmt.Println("No task lists found.")
-		return
-	}
-	fmt.Println("Task lists:")
-	for _, item := range taskLists.Items {
-		fmt.Printf("%v (%v)\n", item.Title, item.Id)
-	}
+	return newEvent.Id, nil
+}
 
-	tasks, err := tasksService.Tasks.List(taskLists.Items[0].Id).Do()
-	if err != nil {
-		log.Fatalf("Unable to retrieve tasks: %v", err)
-	}
+func (g *googleCalendar) UpdateEvent(ctx context.Context, id string, event CalendarEvent) error {
+	_, err := g.service.Events.Patch(g.calendarID, id, toGoogleEvent(event)).Context(ctx).Do()
+	return err
+}
 
-	if len(tasks.Items) == 0 {
-		fmt.Println("No tasks found.")
-		return
-	}
-	fmt.Println("Tasks:")
-	for _, item := range tasks.Items {
-		fmt.Printf("%v (%v)\n", item.Title, item.Id)
+func (g *googleCalendar) DeleteEvent(ctx context.Context, id string) error {
+	err := g.service.Events.Delete(g.calendarID, id).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && (apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusGone) {
+		return fmt.Errorf("%w: %s", ErrEventNotFound, id)
 	}
+	return err
+}
 
-	event := &calendar.Event{
-		Summary:  "Google I/O 2025",
-		Location: "800 Howard St., San Francisco, CA 94103",
-		Start: &calendar.EventDateTime{
-			DateTime: time.Now().Add(time.Hour * 24).Format(time.RFC3339),
-			TimeZone: "America/Los_Angeles",
-		},
-		End: &calendar.EventDateTime{
-			DateTime: time.Now().Add(time.Hour * 26).Format(time.RFC3339),
-			TimeZone: "America/Los_Angeles",
-		},
+// deleteEvent deletes the event, treating an event already gone as deleted.
+// It reports whether the event was still there.
+func deleteEvent(ctx context.Context, calendar Calendar, id string) (bool, error) {
+	err := calendar.DeleteEvent(ctx, id)
+	if errors.Is(err, ErrEventNotFound) {
+		return false, nil
 	}
+	return err == nil, err
+}
 
-	newEvent, err := calendarService.Events.Insert(CalendarId, event).Do()
+// IsAvailable lists the events overlapping the slot instead of querying
+// free/busy, which merges busy intervals and can not leave one event out.
+func (g *googleCalendar) IsAvailable(ctx context.Context, start, end time.Time, ignore string) (bool, error) {
+	events, err := g.service.Events.List(g.calendarID).
+		TimeMin(start.Format(time.RFC3339)).
+		TimeMax(end.Format(time.RFC3339)).
+		SingleEvents(true).
+		Context(ctx).Do()
 	if err != nil {
-		log.Fatalf("Unable to create event: %v: %v", err, newEvent)
+		return false, err
 	}
-	fmt.Printf("Event created: %s\n", newEvent.HtmlLink)
 
+	for _, event := range events.Items {
+		// Free ("transparent") events do not block the slot.
+		if event.Id != ignore && event.Status != "cancelled" && event.Transparency != "transparent" {
+			return false, nil
+		}
+	}
+	return true, nil
 }
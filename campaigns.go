@@ -0,0 +1,697 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	openai "github.com/sashabaranov/go-openai"
+	"gorm.io/gorm"
+)
+
+// JobKindCampaignBatch sends the next batch of a campaign's messages.
+const JobKindCampaignBatch = "campaign_batch"
+
+const (
+	CampaignStatusDraft     = "draft"
+	CampaignStatusScheduled = "scheduled"
+	CampaignStatusSending   = "sending"
+	CampaignStatusSent      = "sent"
+	CampaignStatusCancelled = "cancelled"
+)
+
+const (
+	RecipientStatusPending   = "pending"
+	RecipientStatusSent      = "sent"
+	RecipientStatusFailed    = "failed"
+	RecipientStatusSkipped   = "skipped"
+	RecipientStatusCancelled = "cancelled"
+)
+
+// campaignOptOutFooter is appended to every campaign message. Replying "sair"
+// is classified as an opt out.
+const campaignOptOutFooter = "\n\nPara não receber mais novidades, responda SAIR."
+
+// CampaignSegment selects the contacts a campaign is sent to. Empty fields
+// match every contact; contacts without marketing consent never match.
+type CampaignSegment struct {
+	// Tags matches contacts tagged with any of the tags.
+	Tags []string `json:"tags"`
+	// Category matches contacts who ordered a product of the category.
+	Category string `json:"category"`
+	// The contact's last message must be within these bounds.
+	LastInteractionAfter  *time.Time `json:"last_interaction_after"`
+	LastInteractionBefore *time.Time `json:"last_interaction_before"`
+}
+
+// Campaign is a message sent to a segment of the contacts, rendered for each
+// contact from Template (a text/template, see campaignData).
+type Campaign struct {
+	gorm.Model
+	Tenant   string          `json:"tenant" gorm:"index"`
+	Name     string          `json:"name"`
+	Template string          `json:"template"`
+	Segment  CampaignSegment `json:"segment" gorm:"serializer:json"`
+	Status   string          `json:"status" gorm:"index"`
+	SendAt   *time.Time      `json:"send_at"`
+	Stats    *CampaignStats  `json:"stats,omitempty" gorm:"-"`
+}
+
+// CampaignRecipient tracks the message of a campaign to one contact.
+// OutboundID is sent along with the message so the channel can report its
+// delivery on POST /channels/status.
+type CampaignRecipient struct {
+	gorm.Model
+	CampaignID  uint       `json:"campaign_id" gorm:"index"`
+	ContactID   uint       `json:"contact_id" gorm:"index"`
+	Channel     string     `json:"channel" gorm:"index"`
+	OutboundID  string     `json:"outbound_id" gorm:"index"`
+	Status      string     `json:"status" gorm:"index"`
+	Error       string     `json:"error"`
+	SentAt      *time.Time `json:"sent_at" gorm:"index"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+	ReadAt      *time.Time `json:"read_at"`
+	RepliedAt   *time.Time `json:"replied_at"`
+}
+
+type CampaignStats struct {
+	Recipients int64 `json:"recipients"`
+	Pending    int64 `json:"pending"`
+	Sent       int64 `json:"sent"`
+	Failed     int64 `json:"failed"`
+	Skipped    int64 `json:"skipped"`
+	Delivered  int64 `json:"delivered"`
+	Read       int64 `json:"read"`
+	Replied    int64 `json:"replied"`
+}
+
+// campaignData is what campaign templates are rendered with, e.g.
+// "Oi {{.FirstName}}! Chegou {{.Flavor}} de novo na {{.Shop}}".
+type campaignData struct {
+	Name      string
+	FirstName string
+	// Flavor is the contact's favorite flavor, the first one they asked for.
+	Flavor   string
+	Flavors  []string
+	Products []string
+	Shop     string
+}
+
+func (s *LLMService) campaignData(contact *Contact) campaignData {
+	data := campaignData{
+		Name:     contact.Name,
+		Flavors:  contact.PreferredFlavors,
+		Products: contact.PreferredProducts,
+		Shop:     s.config.Shop.Name,
+	}
+	if fields := strings.Fields(contact.Name); len(fields) > 0 {
+		data.FirstName = fields[0]
+	}
+	if len(contact.PreferredFlavors) > 0 {
+		data.Flavor = contact.PreferredFlavors[0]
+	}
+	return data
+}
+
+func parseCampaignTemplate(text string) (*template.Template, error) {
+	return template.New("campaign").Option("missingkey=error").Parse(text)
+}
+
+// renderCampaign renders the campaign message for the contact.
+func (s *LLMService) renderCampaign(tmpl *template.Template, contact *Contact) (string, error) {
+	var text strings.Builder
+	if err := tmpl.Execute(&text, s.campaignData(contact)); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(text.String()) + campaignOptOutFooter, nil
+}
+
+// canReceiveCampaigns reports whether the contact agreed to receive
+// marketing messages and did not opt out since.
+func canReceiveCampaigns(contact *Contact) bool {
+	return contact.MarketingConsent && !containsString(contact.Tags, "opt-out")
+}
+
+// segmentContacts returns the contacts of the tenant in the segment that can
+// receive campaigns.
+func (s *LLMService) segmentContacts(ctx context.Context, tenant string, segment CampaignSegment) ([]Contact, error) {
+	contacts, err := s.repos.Contacts.Search(ctx, ContactFilter{Tenant: tenant, OtherTenants: s.otherTenants()})
+	if err != nil {
+		return nil, err
+	}
+
+	var ordered map[uint]bool
+	if segment.Category != "" {
+		ordered, err = s.repos.Orders.ContactsOrdering(ctx, segment.Category)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var matched []Contact
+	for _, contact := range contacts {
+		if !canReceiveCampaigns(&contact) {
+			continue
+		}
+		if len(segment.Tags) > 0 && !hasAnyTag(&contact, segment.Tags) {
+			continue
+		}
+		if segment.Category != "" && !ordered[contact.ID] {
+			continue
+		}
+		matched = append(matched, contact)
+	}
+	if segment.LastInteractionAfter == nil && segment.LastInteractionBefore == nil {
+		return matched, nil
+	}
+
+	ids := make([]uint, len(matched))
+	for i := range matched {
+		ids[i] = matched[i].ID
+	}
+	interactions, err := s.repos.Messages.LastInteractions(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	active := matched[:0]
+	for _, contact := range matched {
+		last, ok := interactions[contact.ID]
+		if !ok ||
+			segment.LastInteractionAfter != nil && last.Before(*segment.LastInteractionAfter) ||
+			segment.LastInteractionBefore != nil && !last.Before(*segment.LastInteractionBefore) {
+			continue
+		}
+		active = append(active, contact)
+	}
+	return active, nil
+}
+
+func hasAnyTag(contact *Contact, tags []string) bool {
+	for _, tag := range tags {
+		if containsString(contact.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelRate returns how many campaign messages a minute the channel takes.
+func (s *LLMService) channelRate(channel string) int {
+	if rate, ok := s.config.Campaigns.ChannelRates[channel]; ok {
+		return rate
+	}
+	return s.config.Campaigns.RatePerMinute
+}
+
+// startCampaign resolves the campaign's segment into its recipients.
+func (s *LLMService) startCampaign(ctx context.Context, campaign *Campaign) error {
+	contacts, err := s.segmentContacts(ctx, campaign.Tenant, campaign.Segment)
+	if err != nil {
+		return err
+	}
+
+	recipients := make([]CampaignRecipient, 0, len(contacts))
+	for i := range contacts {
+		recipient := CampaignRecipient{CampaignID: campaign.ID, ContactID: contacts[i].ID, Status: RecipientStatusPending}
+		channel, _, ok := contactAddress(&contacts[i])
+		if ok {
+			recipient.Channel = channel
+		} else {
+			recipient.Status = RecipientStatusSkipped
+			recipient.Error = "contact has no channel to be reached on"
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(recipients) > 0 {
+			if err := tx.CreateInBatches(recipients, 100).Error; err != nil {
+				return err
+			}
+		}
+		campaign.Status = CampaignStatusSending
+		return tx.Model(campaign).Update("status", campaign.Status).Error
+	})
+}
+
+// sendCampaignBatch sends the campaign's pending messages the channels'
+// rates allow this minute, and schedules the next batch while some are left.
+func (s *LLMService) sendCampaignBatch(ctx context.Context, job *Job) error {
+	id, err := strconv.ParseUint(job.Payload, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid campaign id %q", job.Payload)
+	}
+	campaign := &Campaign{}
+	if err := s.db.WithContext(ctx).First(campaign, id).Error; err != nil {
+		return err
+	}
+
+	switch campaign.Status {
+	case CampaignStatusScheduled:
+		if err := s.startCampaign(ctx, campaign); err != nil {
+			return err
+		}
+	case CampaignStatusSending:
+	default:
+		return nil
+	}
+
+	tmpl, err := parseCampaignTemplate(campaign.Template)
+	if err != nil {
+		return err
+	}
+
+	var pending []CampaignRecipient
+	err = s.db.WithContext(ctx).Where("campaign_id = ? AND status = ?", campaign.ID, RecipientStatusPending).Order("id").Find(&pending).Error
+	if err != nil {
+		return err
+	}
+
+	// Rates are shared by every campaign sending on the channel.
+	now := s.scheduler.now()
+	budgets := map[string]int{}
+	left := 0
+	for _, recipient := range pending {
+		budget, ok := budgets[recipient.Channel]
+		if !ok {
+			var sent int64
+			err := s.db.WithContext(ctx).Model(&CampaignRecipient{}).
+				Where("channel = ? AND sent_at > ?", recipient.Channel, now.Add(-time.Minute)).
+				Count(&sent).Error
+			if err != nil {
+				return err
+			}
+			budget = s.channelRate(recipient.Channel) - int(sent)
+		}
+		if budget <= 0 {
+			budgets[recipient.Channel] = 0
+			left++
+			continue
+		}
+		budgets[recipient.Channel] = budget - 1
+
+		if err := s.sendCampaignMessage(ctx, campaign, tmpl, &recipient, now); err != nil {
+			return err
+		}
+	}
+
+	if left > 0 {
+		return s.scheduler.Schedule(ctx, &Job{Kind: JobKindCampaignBatch, RunAt: now.Add(time.Minute), Payload: job.Payload})
+	}
+	slog.InfoContext(ctx, "campaign sent", "campaign_id", campaign.ID)
+	return s.db.WithContext(ctx).Model(campaign).Update("status", CampaignStatusSent).Error
+}
+
+// sendCampaignMessage sends the campaign to one recipient. Failing to reach
+// the contact is recorded on the recipient; only storage errors are returned.
+func (s *LLMService) sendCampaignMessage(ctx context.Context, campaign *Campaign, tmpl *template.Template, recipient *CampaignRecipient, now time.Time) error {
+	update := func(values map[string]interface{}) error {
+		return s.db.WithContext(ctx).Model(recipient).Updates(values).Error
+	}
+
+	contact, err := s.repos.Contacts.Get(ctx, recipient.ContactID)
+	if errors.Is(err, ErrNotFound) {
+		return update(map[string]interface{}{"status": RecipientStatusSkipped, "error": "contact was deleted"})
+	}
+	if err != nil {
+		return err
+	}
+	// The contact may have opted out since the campaign started.
+	if !canReceiveCampaigns(contact) {
+		return update(map[string]interface{}{"status": RecipientStatusSkipped, "error": "contact opted out"})
+	}
+	channel, address, ok := contactAddress(contact)
+	if !ok {
+		return update(map[string]interface{}{"status": RecipientStatusSkipped, "error": "contact has no channel to be reached on"})
+	}
+
+	text, err := s.renderCampaign(tmpl, contact)
+	if err != nil {
+		return update(map[string]interface{}{"status": RecipientStatusFailed, "error": err.Error()})
+	}
+
+	outboundID := fmt.Sprintf("campaign-%d-%d", campaign.ID, recipient.ID)
+	if err := s.sender.Send(withOutboundID(ctx, outboundID), channel, address, text); err != nil {
+		slog.WarnContext(ctx, "send campaign message failed", "campaign_id", campaign.ID, "contact_id", contact.ID, "error", err)
+		return update(map[string]interface{}{"status": RecipientStatusFailed, "error": err.Error(), "channel": channel})
+	}
+
+	if err := update(map[string]interface{}{"status": RecipientStatusSent, "sent_at": now, "outbound_id": outboundID, "channel": channel}); err != nil {
+		return err
+	}
+	// The message is part of the conversation, so replies have its context.
+	return s.repos.Messages.Create(ctx, &Message{Content: text, Role: openai.ChatMessageRoleAssistant, ContactID: contact.ID, Channel: channel, Tenant: contact.Tenant})
+}
+
+// recordCampaignReply attributes a message of the contact to the last
+// campaign sent to them within the reply window.
+func (s *LLMService) recordCampaignReply(ctx context.Context, contactID uint, now time.Time) error {
+	window, _ := time.ParseDuration(s.config.Campaigns.ReplyWindow)
+
+	var recipients []CampaignRecipient
+	err := s.db.WithContext(ctx).
+		Where("contact_id = ? AND status = ? AND sent_at > ?", contactID, RecipientStatusSent, now.Add(-window)).
+		Order("sent_at desc").Limit(1).Find(&recipients).Error
+	if err != nil || len(recipients) == 0 || recipients[0].RepliedAt != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Model(&recipients[0]).Update("replied_at", now).Error
+}
+
+// recordDelivery applies a delivery receipt of the channel to the campaign
+// message it reports on. Read messages were delivered too. It returns
+// ErrNotFound when the message is not from a campaign.
+func (s *LLMService) recordDelivery(ctx context.Context, outboundID, status, reason string, now time.Time) error {
+	var recipients []CampaignRecipient
+	if err := s.db.WithContext(ctx).Where("outbound_id = ?", outboundID).Limit(1).Find(&recipients).Error; err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return ErrNotFound
+	}
+	recipient := &recipients[0]
+
+	values := map[string]interface{}{}
+	switch status {
+	case "read":
+		if recipient.ReadAt == nil {
+			values["read_at"] = now
+		}
+		fallthrough
+	case "delivered":
+		if recipient.DeliveredAt == nil {
+			values["delivered_at"] = now
+		}
+	case "failed":
+		values["status"] = RecipientStatusFailed
+		values["error"] = reason
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return s.db.WithContext(ctx).Model(recipient).Updates(values).Error
+}
+
+func (s *LLMService) campaignStats(ctx context.Context, campaignID uint) (*CampaignStats, error) {
+	stats := &CampaignStats{}
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	err := s.db.WithContext(ctx).Model(&CampaignRecipient{}).Select("status, count(*) as count").
+		Where("campaign_id = ?", campaignID).Group("status").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		stats.Recipients += row.Count
+		switch row.Status {
+		case RecipientStatusPending:
+			stats.Pending = row.Count
+		case RecipientStatusSent:
+			stats.Sent = row.Count
+		case RecipientStatusFailed:
+			stats.Failed = row.Count
+		case RecipientStatusSkipped, RecipientStatusCancelled:
+			stats.Skipped += row.Count
+		}
+	}
+
+	for column, count := range map[string]*int64{"delivered_at": &stats.Delivered, "read_at": &stats.Read, "replied_at": &stats.Replied} {
+		err := s.db.WithContext(ctx).Model(&CampaignRecipient{}).
+			Where("campaign_id = ? AND "+column+" IS NOT NULL", campaignID).Count(count).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// tenantCampaign loads the campaign of the :id param, if it belongs to the
+// tenant of the request.
+func (s *LLMService) tenantCampaign(c *fiber.Ctx) (*Campaign, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return nil, ErrNotFound
+	}
+	var campaigns []Campaign
+	err = s.db.WithContext(c.UserContext()).Where("id = ? AND tenant = ?", id, tenantID(c)).Limit(1).Find(&campaigns).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(campaigns) == 0 {
+		return nil, ErrNotFound
+	}
+	return &campaigns[0], nil
+}
+
+func campaignError(c *fiber.Ctx, err error) error {
+	status := fiber.StatusInternalServerError
+	if errors.Is(err, ErrNotFound) {
+		status = fiber.StatusNotFound
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
+
+func (s *LLMService) createCampaign(c *fiber.Ctx) error {
+	campaign := new(Campaign)
+	if err := c.BodyParser(campaign); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if strings.TrimSpace(campaign.Name) == "" || strings.TrimSpace(campaign.Template) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "name and template are required",
+		})
+	}
+	// Unknown fields only fail when the template is executed.
+	tmpl, err := parseCampaignTemplate(campaign.Template)
+	if err == nil {
+		_, err = s.renderCampaign(tmpl, &Contact{Name: "Maria Silva", PreferredFlavors: []string{"morango"}, PreferredProducts: []string{"pod"}})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid template: " + err.Error(),
+		})
+	}
+
+	campaign.Model = gorm.Model{}
+	campaign.Tenant = tenantID(c)
+	campaign.Status = CampaignStatusDraft
+	campaign.SendAt = nil
+	campaign.Stats = nil
+	if err := s.db.WithContext(c.UserContext()).Create(campaign).Error; err != nil {
+		return campaignError(c, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(campaign)
+}
+
+func (s *LLMService) getCampaigns(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	var campaigns []Campaign
+	if err := s.db.WithContext(ctx).Where("tenant = ?", tenantID(c)).Order("id desc").Find(&campaigns).Error; err != nil {
+		return campaignError(c, err)
+	}
+	for i := range campaigns {
+		stats, err := s.campaignStats(ctx, campaigns[i].ID)
+		if err != nil {
+			return campaignError(c, err)
+		}
+		campaigns[i].Stats = stats
+	}
+
+	return c.JSON(campaigns)
+}
+
+func (s *LLMService) getCampaign(c *fiber.Ctx) error {
+	campaign, err := s.tenantCampaign(c)
+	if err != nil {
+		return campaignError(c, err)
+	}
+	if campaign.Stats, err = s.campaignStats(c.UserContext(), campaign.ID); err != nil {
+		return campaignError(c, err)
+	}
+
+	return c.JSON(campaign)
+}
+
+// previewCampaign handles GET /admin/campaigns/:id/preview: how many contacts
+// the segment matches now and the message a few of them would get.
+func (s *LLMService) previewCampaign(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	campaign, err := s.tenantCampaign(c)
+	if err != nil {
+		return campaignError(c, err)
+	}
+	tmpl, err := parseCampaignTemplate(campaign.Template)
+	if err != nil {
+		return campaignError(c, err)
+	}
+	contacts, err := s.segmentContacts(ctx, campaign.Tenant, campaign.Segment)
+	if err != nil {
+		return campaignError(c, err)
+	}
+
+	samples := []fiber.Map{}
+	for i := 0; i < len(contacts) && i < c.QueryInt("samples", 5); i++ {
+		text, err := s.renderCampaign(tmpl, &contacts[i])
+		if err != nil {
+			return campaignError(c, err)
+		}
+		samples = append(samples, fiber.Map{"contact_id": contacts[i].ID, "text": text})
+	}
+
+	return c.JSON(fiber.Map{
+		"recipients": len(contacts),
+		"samples":    samples,
+	})
+}
+
+// sendCampaign handles POST /admin/campaigns/:id/send. The segment is
+// resolved when sending starts, at send_at or right away.
+func (s *LLMService) sendCampaign(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	campaign, err := s.tenantCampaign(c)
+	if err != nil {
+		return campaignError(c, err)
+	}
+	if campaign.Status != CampaignStatusDraft {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "campaign was already " + campaign.Status,
+		})
+	}
+
+	var body struct {
+		SendAt *time.Time `json:"send_at"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	sendAt := s.scheduler.now()
+	if body.SendAt != nil && body.SendAt.After(sendAt) {
+		sendAt = *body.SendAt
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(campaign).Where("status = ?", CampaignStatusDraft).
+			Updates(map[string]interface{}{"status": CampaignStatusScheduled, "send_at": sendAt})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("campaign is not a draft anymore")
+		}
+		return tx.Create(&Job{Kind: JobKindCampaignBatch, RunAt: sendAt, Payload: strconv.FormatUint(uint64(campaign.ID), 10), Status: JobStatusPending}).Error
+	})
+	if err != nil {
+		return campaignError(c, err)
+	}
+	campaign.Status = CampaignStatusScheduled
+	campaign.SendAt = &sendAt
+
+	return c.Status(fiber.StatusAccepted).JSON(campaign)
+}
+
+// cancelCampaign handles POST /admin/campaigns/:id/cancel. Messages already
+// sent stay sent; the pending ones are not sent.
+func (s *LLMService) cancelCampaign(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	campaign, err := s.tenantCampaign(c)
+	if err != nil {
+		return campaignError(c, err)
+	}
+	if campaign.Status == CampaignStatusSent || campaign.Status == CampaignStatusCancelled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "campaign was already " + campaign.Status,
+		})
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(campaign).Update("status", CampaignStatusCancelled).Error; err != nil {
+			return err
+		}
+		return tx.Model(&CampaignRecipient{}).Where("campaign_id = ? AND status = ?", campaign.ID, RecipientStatusPending).
+			Update("status", RecipientStatusCancelled).Error
+	})
+	if err != nil {
+		return campaignError(c, err)
+	}
+	campaign.Status = CampaignStatusCancelled
+
+	return c.JSON(campaign)
+}
+
+type deliveryReceipt struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// receiptSignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the
+// receipt body keyed with channels.status_secret.
+const receiptSignatureHeader = "X-Signature-256"
+
+// validReceiptSignature reports whether the signature header matches the body.
+func validReceiptSignature(secret string, body []byte, header string) bool {
+	signature, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if secret == "" || err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+// channelStatus handles POST /channels/status, the delivery receipts of the
+// channel gateways for the messages we sent with an id. The route is outside
+// the admin API, so receipts must be signed with the channel status secret.
+func (s *LLMService) channelStatus(c *fiber.Ctx) error {
+	if !validReceiptSignature(s.config.Channels.StatusSecret, c.Body(), c.Get(receiptSignatureHeader)) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "invalid or missing " + receiptSignatureHeader + " header",
+		})
+	}
+
+	receipt := new(deliveryReceipt)
+	if err := c.BodyParser(receipt); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if receipt.ID == "" || (receipt.Status != "delivered" && receipt.Status != "read" && receipt.Status != "failed") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "id and a status of delivered, read or failed are required",
+		})
+	}
+
+	err := s.recordDelivery(c.UserContext(), receipt.ID, receipt.Status, receipt.Error, s.scheduler.now())
+	if errors.Is(err, ErrNotFound) {
+		// Receipts of messages that are not from campaigns are ignored.
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
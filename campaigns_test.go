@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func TestCampaignSegmentAndRateLimit(t *testing.T) {
+	ctx := context.Background()
+	s, clock, sender, _ := newTestService(t, time.Date(2023, 8, 9, 9, 0, 0, 0, time.UTC))
+	s.config.Shop.Name = "Loja"
+	s.config.Campaigns.RatePerMinute = 2
+
+	pod := &Products{Product: "pod", Flavor: "morango", Quantity: 10, Category: "descartáveis"}
+	s.repos.Products.Create(ctx, pod)
+
+	var contacts []*Contact
+	for i, c := range []struct {
+		name    string
+		consent bool
+		tags    []string
+		orders  bool
+	}{
+		{"Ana Souza", true, []string{"vip"}, true},
+		{"Bia", true, []string{"vip"}, true},
+		{"Carla", true, []string{"vip"}, true},
+		{"Duda", false, []string{"vip"}, true},          // no consent
+		{"Eva", true, []string{"vip", "opt-out"}, true}, // opted out
+		{"Fabi", true, []string{"atacado"}, true},       // not tagged
+		{"Gabi", true, []string{"vip"}, false},          // never ordered
+	} {
+		contact := &Contact{Tenant: defaultTenant, Name: c.name, MarketingConsent: c.consent, Tags: c.tags, PreferredFlavors: []string{"uva"},
+			Identities: []ContactIdentity{{Tenant: defaultTenant, Channel: "whatsapp", ExternalID: "+55119999900" + string(rune('0'+i))}}}
+		s.repos.Contacts.Create(ctx, contact)
+		if c.orders {
+			s.repos.Orders.Create(ctx, &Order{ContactID: contact.ID, Status: OrderStatusCompleted, Items: []OrderItem{{Item: "pod", ProductID: pod.ID, Quantity: 1}}})
+		}
+		contacts = append(contacts, contact)
+	}
+
+	campaign := &Campaign{Tenant: defaultTenant, Name: "Uva voltou", Template: "Oi {{.FirstName}}! {{.Flavor}} chegou na {{.Shop}}.",
+		Segment: CampaignSegment{Tags: []string{"vip"}, Category: "Descartáveis"}, Status: CampaignStatusScheduled}
+	s.db.Create(campaign)
+	s.scheduler.Schedule(ctx, &Job{Kind: JobKindCampaignBatch, RunAt: clock.Now(), Payload: "1"})
+
+	s.scheduler.RunDue(ctx)
+	sent := sender.Sent()
+	if len(sent) != 2 || sent[0].Text != "Oi Ana! uva chegou na Loja."+campaignOptOutFooter {
+		t.Fatalf("First batch is not correct: %+v", sent)
+	}
+
+	// Carla opts out before the next batch.
+	contacts[2].MarketingConsent = false
+	s.repos.Contacts.Update(ctx, contacts[2])
+
+	clock.Advance(30 * time.Second)
+	if n, _ := s.scheduler.RunDue(ctx); n != 0 {
+		t.Errorf("Next batch ran before a minute: %d", n)
+	}
+	clock.Advance(30 * time.Second)
+	s.scheduler.RunDue(ctx)
+	if sent := sender.Sent(); len(sent) != 2 {
+		t.Errorf("Opted out contact got the campaign: %+v", sent)
+	}
+
+	stats, err := s.campaignStats(ctx, campaign.ID)
+	if err != nil || *stats != (CampaignStats{Recipients: 3, Sent: 2, Skipped: 1}) {
+		t.Errorf("Stats are not correct: %+v, %v", stats, err)
+	}
+	s.db.First(campaign, campaign.ID)
+	if campaign.Status != CampaignStatusSent {
+		t.Errorf("Campaign status is not correct: %s", campaign.Status)
+	}
+
+	history, _ := s.repos.Messages.ListByContact(ctx, contacts[0].ID)
+	if len(history) != 1 || history[0].Role != "assistant" {
+		t.Errorf("Campaign message was not stored: %+v", history)
+	}
+}
+
+func TestCampaignSegmentByTenantAndLastInteraction(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 8, 9, 9, 0, 0, 0, time.UTC)
+	s, _, _, _ := newTestService(t, now)
+	s.repos = newGormRepositories(s.db, nil)
+	s.config.Tenants["clinic"] = TenantConfig{}
+
+	var ids []uint
+	for _, c := range []struct {
+		tenant string
+		last   time.Time
+		role   string
+	}{
+		{defaultTenant, now.AddDate(0, 0, -1), "user"},
+		{defaultTenant, now.AddDate(0, 0, -30), "user"},     // inactive
+		{"clinic", now.AddDate(0, 0, -1), "user"},           // other tenant
+		{defaultTenant, now.AddDate(0, 0, -1), "assistant"}, // never wrote to us
+		{"unknown", now.AddDate(0, 0, -1), "user"},          // tenant without settings
+		{"", now.AddDate(0, 0, -1), "user"},                 // no tenant
+	} {
+		contact := &Contact{Tenant: c.tenant, Name: "Ana", MarketingConsent: true}
+		s.repos.Contacts.Create(ctx, contact)
+		s.db.Create(&Message{Tenant: c.tenant, ContactID: contact.ID, Role: c.role, Content: "oi", Model: gorm.Model{CreatedAt: c.last}})
+		ids = append(ids, contact.ID)
+	}
+	s.db.Create(&Message{Tenant: defaultTenant, ContactID: ids[1], Role: "assistant", Content: "volte sempre", Model: gorm.Model{CreatedAt: now}})
+	s.db.Model(&Contact{}).Where("id = ?", ids[5]).Update("tenant", nil)
+
+	// Contacts of tenants without settings, or without a tenant, belong to
+	// the default tenant, as they do for the retention purge.
+	after := now.AddDate(0, 0, -7)
+	contacts, err := s.segmentContacts(ctx, defaultTenant, CampaignSegment{LastInteractionAfter: &after})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 3 || contacts[0].ID != ids[0] || contacts[1].ID != ids[4] || contacts[2].ID != ids[5] {
+		t.Errorf("Default tenant segment is not correct: %+v", contacts)
+	}
+	contacts, err = s.segmentContacts(ctx, "clinic", CampaignSegment{LastInteractionAfter: &after})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0].ID != ids[2] {
+		t.Errorf("Other tenant segment is not correct: %+v", contacts)
+	}
+}
+
+func TestCampaignSegmentByCategory(t *testing.T) {
+	ctx := context.Background()
+	s, _, _, _ := newTestService(t, time.Now())
+	s.repos = newGormRepositories(s.db, nil)
+
+	pod := &Products{Product: "pod", Quantity: 10, Category: "descartáveis"}
+	coil := &Products{Product: "coil", Quantity: 10, Category: "acessórios"}
+	s.repos.Products.Create(ctx, pod)
+	s.repos.Products.Create(ctx, coil)
+
+	var ids []uint
+	for _, order := range []Order{
+		{Status: OrderStatusCompleted, Items: []OrderItem{{Item: "coil", ProductID: coil.ID}, {Item: "pod", ProductID: pod.ID}}},
+		{Status: OrderStatusCompleted, Items: []OrderItem{{Item: "coil", ProductID: coil.ID}}}, // other category
+		{Status: OrderStatusCancelled, Items: []OrderItem{{Item: "pod", ProductID: pod.ID}}},   // cancelled
+		{Status: OrderStatusPending, Items: []OrderItem{{Item: "Descartáveis"}}},               // matched by name
+	} {
+		contact := &Contact{Tenant: defaultTenant, Name: "Ana", MarketingConsent: true}
+		s.repos.Contacts.Create(ctx, contact)
+		order.ContactID = contact.ID
+		s.repos.Orders.Create(ctx, &order)
+		ids = append(ids, contact.ID)
+	}
+
+	contacts, err := s.segmentContacts(ctx, defaultTenant, CampaignSegment{Category: "Descartáveis"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 2 || contacts[0].ID != ids[0] || contacts[1].ID != ids[3] {
+		t.Errorf("Segment is not correct: %+v", contacts)
+	}
+}
+
+func TestCampaignMetrics(t *testing.T) {
+	ctx := context.Background()
+	s, clock, _, _ := newTestService(t, time.Now())
+
+	contact := &Contact{Tenant: defaultTenant, Name: "Ana", MarketingConsent: true,
+		Identities: []ContactIdentity{{Tenant: defaultTenant, Channel: "whatsapp", ExternalID: "+5511999999999"}}}
+	s.repos.Contacts.Create(ctx, contact)
+
+	app := fiber.New()
+	s.RegisterRoutes(app)
+	admin := app.Group("/admin", func(c *fiber.Ctx) error {
+		c.Locals("principal", Principal{Subject: "owner", Role: RoleOwner})
+		return c.Next()
+	})
+	s.RegisterAdminRoutes(admin)
+
+	request := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := request("POST", "/admin/campaigns", `{"name": "x", "template": "Oi {{.Nome}}"}`); status != fiber.StatusBadRequest {
+		t.Errorf("Invalid template was accepted: %d", status)
+	}
+	if status := request("POST", "/admin/campaigns", `{"name": "Novidades", "template": "Oi {{.Name}}, temos sabores novos!"}`); status != fiber.StatusCreated {
+		t.Fatalf("Campaign was not created: %d", status)
+	}
+	if status := request("POST", "/admin/campaigns/1/send", ``); status != fiber.StatusAccepted {
+		t.Fatalf("Campaign was not sent: %d", status)
+	}
+	if status := request("POST", "/admin/campaigns/1/send", ``); status != fiber.StatusConflict {
+		t.Errorf("Campaign was sent twice: %d", status)
+	}
+	s.scheduler.RunDue(ctx)
+
+	s.config.Channels.StatusSecret = "receipts"
+	receipt := func(body, secret string) int {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		req := httptest.NewRequest("POST", "/channels/status", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(receiptSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	if status := request("POST", "/channels/status", `{"id": "campaign-1-1", "status": "failed"}`); status != fiber.StatusUnauthorized {
+		t.Errorf("Unsigned receipt was accepted: %d", status)
+	}
+	if status := receipt(`{"id": "campaign-1-1", "status": "failed"}`, "guessed"); status != fiber.StatusUnauthorized {
+		t.Errorf("Receipt with a wrong signature was accepted: %d", status)
+	}
+	if status := receipt(`{"id": "campaign-1-1", "status": "read"}`, "receipts"); status != fiber.StatusNoContent {
+		t.Errorf("Receipt was not accepted: %d", status)
+	}
+	if status := receipt(`{"id": "other", "status": "delivered"}`, "receipts"); status != fiber.StatusNoContent {
+		t.Errorf("Unknown receipt was not ignored: %d", status)
+	}
+
+	clock.Advance(time.Hour)
+	if _, err := s.processMessage(ctx, &Message{Tenant: defaultTenant, Channel: "whatsapp", Sender: "+5511999999999", Content: "sair"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := s.campaignStats(ctx, 1)
+	if err != nil || *stats != (CampaignStats{Recipients: 1, Sent: 1, Delivered: 1, Read: 1, Replied: 1}) {
+		t.Errorf("Stats are not correct: %+v, %v", stats, err)
+	}
+	updated, _ := s.repos.Contacts.Get(ctx, contact.ID)
+	if canReceiveCampaigns(updated) {
+		t.Errorf("Contact did not opt out: %+v", updated)
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	CatalogFormatCSV  = "csv"
+	CatalogFormatJSON = "json"
+
+	CatalogActionCreate    = "create"
+	CatalogActionUpdate    = "update"
+	CatalogActionUnchanged = "unchanged"
+
+	maxSKULength = 64
+)
+
+// catalogColumns are the columns of a catalog file, in export order.
+var catalogColumns = []string{"id", "sku", "product", "flavor", "category", "quantity", "description"}
+
+// CatalogRow is a product in a catalog file. Products are matched by SKU;
+// the ID only assigns a SKU to a product that has none yet.
+type CatalogRow struct {
+	ID          uint   `json:"id,omitempty"`
+	SKU         string `json:"sku"`
+	Product     string `json:"product"`
+	Flavor      string `json:"flavor"`
+	Category    string `json:"category"`
+	Quantity    int    `json:"quantity"`
+	Description string `json:"description"`
+}
+
+type CatalogRowError struct {
+	Row   int    `json:"row"`
+	SKU   string `json:"sku,omitempty"`
+	Field string `json:"field,omitempty"`
+	Error string `json:"error"`
+}
+
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+type CatalogChange struct {
+	Row       int                    `json:"row"`
+	SKU       string                 `json:"sku"`
+	Action    string                 `json:"action"`
+	ProductID uint                   `json:"product_id,omitempty"`
+	Fields    map[string]FieldChange `json:"fields,omitempty"`
+}
+
+// CatalogImport is the diff of a catalog file against the products. It is
+// only applied when the file has no errors and it is not a dry run.
+type CatalogImport struct {
+	DryRun    bool              `json:"dry_run"`
+	Applied   bool              `json:"applied"`
+	Created   int               `json:"created"`
+	Updated   int               `json:"updated"`
+	Unchanged int               `json:"unchanged"`
+	Changes   []CatalogChange   `json:"changes"`
+	Errors    []CatalogRowError `json:"errors"`
+}
+
+// catalogRecord is a row as read from the file, before validation.
+type catalogRecord struct {
+	row    int
+	fields map[string]string
+}
+
+func (e CatalogRowError) String() string {
+	message := fmt.Sprintf("row %d", e.Row)
+	if e.Field != "" {
+		message += " " + e.Field
+	}
+	return message + ": " + e.Error
+}
+
+// readCatalog reads the records of a CSV or JSON catalog. Rows are numbered
+// as the owner sees them: CSV rows by their line in the spreadsheet, with the
+// header on line 1, and JSON rows by their position in the array.
+func readCatalog(format string, r io.Reader) ([]catalogRecord, error) {
+	switch format {
+	case CatalogFormatCSV:
+		return readCatalogCSV(r)
+	case CatalogFormatJSON:
+		return readCatalogJSON(r)
+	}
+	return nil, fmt.Errorf("unknown catalog format %q", format)
+}
+
+func readCatalogCSV(r io.Reader) ([]catalogRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("catalog file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		// Spreadsheets save UTF-8 files with a byte order mark.
+		header[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff")))
+	}
+	for _, column := range []string{"sku", "product", "quantity"} {
+		if !containsString(header, column) {
+			return nil, fmt.Errorf("catalog file has no %s column", column)
+		}
+	}
+
+	var records []catalogRecord
+	for {
+		values, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(strings.Join(values, "")) == "" {
+			continue
+		}
+
+		row, _ := reader.FieldPos(0)
+		record := catalogRecord{row: row, fields: map[string]string{}}
+		for i, value := range values {
+			if i < len(header) {
+				record.fields[header[i]] = value
+			}
+		}
+		records = append(records, record)
+	}
+}
+
+func readCatalogJSON(r io.Reader) ([]catalogRecord, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	var objects []map[string]interface{}
+	if err := decoder.Decode(&objects); err != nil {
+		return nil, fmt.Errorf("catalog file is not a JSON array of products: %w", err)
+	}
+
+	records := make([]catalogRecord, len(objects))
+	for i, object := range objects {
+		record := catalogRecord{row: i + 1, fields: map[string]string{}}
+		for key, value := range object {
+			switch v := value.(type) {
+			case string:
+				record.fields[strings.ToLower(key)] = v
+			case json.Number:
+				record.fields[strings.ToLower(key)] = v.String()
+			case nil:
+			default:
+				// Kept as is so validation reports it as invalid.
+				record.fields[strings.ToLower(key)] = fmt.Sprint(v)
+			}
+		}
+		records[i] = record
+	}
+	return records, nil
+}
+
+// validateCatalog normalizes the records like POST /productsdb does and
+// reports every invalid field, so the owner can fix the whole file at once.
+func validateCatalog(records []catalogRecord) ([]CatalogRow, []int, []CatalogRowError) {
+	var rows []CatalogRow
+	var lines []int
+	var rowErrors []CatalogRowError
+	seen := map[string]int{}
+
+	for _, record := range records {
+		row := CatalogRow{
+			SKU:         strings.TrimSpace(record.fields["sku"]),
+			Product:     strings.ToLower(strings.TrimSpace(record.fields["product"])),
+			Flavor:      strings.ToLower(strings.TrimSpace(record.fields["flavor"])),
+			Category:    strings.ToLower(strings.TrimSpace(record.fields["category"])),
+			Description: strings.TrimSpace(record.fields["description"]),
+		}
+		fail := func(field, message string) {
+			rowErrors = append(rowErrors, CatalogRowError{Row: record.row, SKU: row.SKU, Field: field, Error: message})
+		}
+		before := len(rowErrors)
+
+		switch {
+		case row.SKU == "":
+			fail("sku", "is required")
+		case len(row.SKU) > maxSKULength:
+			fail("sku", fmt.Sprintf("is longer than %d characters", maxSKULength))
+		case seen[row.SKU] > 0:
+			fail("sku", fmt.Sprintf("is repeated from row %d", seen[row.SKU]))
+		default:
+			seen[row.SKU] = record.row
+		}
+		if row.Product == "" {
+			fail("product", "is required")
+		}
+
+		quantity := strings.TrimSpace(record.fields["quantity"])
+		if quantity == "" {
+			fail("quantity", "is required")
+		} else if parsed, err := strconv.Atoi(quantity); err != nil || parsed < 0 {
+			fail("quantity", fmt.Sprintf("%q is not a whole number of units", quantity))
+		} else {
+			row.Quantity = parsed
+		}
+
+		if id := strings.TrimSpace(record.fields["id"]); id != "" {
+			parsed, err := strconv.ParseUint(id, 10, 64)
+			if err != nil || parsed == 0 {
+				fail("id", fmt.Sprintf("%q is not a product ID", id))
+			}
+			row.ID = uint(parsed)
+		}
+
+		if len(rowErrors) == before {
+			rows = append(rows, row)
+			lines = append(lines, record.row)
+		}
+	}
+	return rows, lines, rowErrors
+}
+
+// skuTaken reports whether a product other than id already has the SKU.
+func (s *LLMService) skuTaken(ctx context.Context, sku string, id uint) (bool, error) {
+	if sku == "" {
+		return false, nil
+	}
+	products, err := s.repos.Products.List(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, product := range products {
+		if product.SKU == sku && product.ID != id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func skuConflict(c *fiber.Ctx, sku string, err error) error {
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error": fmt.Sprintf("sku %q is already used by another product", sku),
+	})
+}
+
+func productChanges(product *Products, row CatalogRow) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	compare := func(field string, from, to interface{}) {
+		if from != to {
+			changes[field] = FieldChange{From: from, To: to}
+		}
+	}
+	compare("sku", product.SKU, row.SKU)
+	compare("product", product.Product, row.Product)
+	compare("flavor", product.Flavor, row.Flavor)
+	compare("category", product.Category, row.Category)
+	compare("quantity", product.Quantity, row.Quantity)
+	compare("description", product.Description, row.Description)
+	return changes
+}
+
+// importCatalog upserts the products of a catalog file by SKU. A file with
+// errors is not applied at all. Quantities are recorded as stock adjustments
+// made by actor.
+func (s *LLMService) importCatalog(ctx context.Context, format string, r io.Reader, dryRun bool, actor string) (*CatalogImport, error) {
+	records, err := readCatalog(format, r)
+	if err != nil {
+		return nil, err
+	}
+	rows, lines, rowErrors := validateCatalog(records)
+
+	products, err := s.repos.Products.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bySKU := map[string]*Products{}
+	byID := map[uint]*Products{}
+	for i := range products {
+		if products[i].SKU != "" {
+			bySKU[products[i].SKU] = &products[i]
+		}
+		byID[products[i].ID] = &products[i]
+	}
+
+	report := &CatalogImport{DryRun: dryRun, Changes: []CatalogChange{}, Errors: rowErrors}
+	matched := make([]*Products, len(rows))
+	for i, row := range rows {
+		product := bySKU[row.SKU]
+		if row.ID > 0 {
+			owner, ok := byID[row.ID]
+			switch {
+			case !ok:
+				report.Errors = append(report.Errors, CatalogRowError{Row: lines[i], SKU: row.SKU, Field: "id", Error: fmt.Sprintf("product %d does not exist", row.ID)})
+				continue
+			case product != nil && product.ID != row.ID:
+				report.Errors = append(report.Errors, CatalogRowError{Row: lines[i], SKU: row.SKU, Field: "id", Error: fmt.Sprintf("sku belongs to product %d", product.ID)})
+				continue
+			case product == nil && owner.SKU != "":
+				report.Errors = append(report.Errors, CatalogRowError{Row: lines[i], SKU: row.SKU, Field: "sku", Error: fmt.Sprintf("product %d has sku %q", row.ID, owner.SKU)})
+				continue
+			}
+			product = owner
+		}
+		matched[i] = product
+
+		change := CatalogChange{Row: lines[i], SKU: row.SKU, Action: CatalogActionCreate}
+		if product != nil {
+			change.ProductID = product.ID
+			change.Fields = productChanges(product, row)
+			change.Action = CatalogActionUpdate
+			if len(change.Fields) == 0 {
+				change.Action = CatalogActionUnchanged
+			}
+		}
+		switch change.Action {
+		case CatalogActionCreate:
+			report.Created++
+		case CatalogActionUpdate:
+			report.Updated++
+		default:
+			report.Unchanged++
+		}
+		report.Changes = append(report.Changes, change)
+	}
+	sort.SliceStable(report.Errors, func(i, j int) bool { return report.Errors[i].Row < report.Errors[j].Row })
+
+	if dryRun || len(report.Errors) > 0 {
+		return report, nil
+	}
+
+	// The rows are applied in one transaction: a failing row leaves the
+	// catalog as it was.
+	previous := make([]int, len(rows))
+	err = s.transaction(ctx, func(tx *gorm.DB, repos Repositories) error {
+		for i, row := range rows {
+			product := matched[i]
+			if product == nil {
+				product = &Products{}
+				matched[i] = product
+			} else if report.Changes[i].Action == CatalogActionUnchanged {
+				continue
+			}
+
+			product.SKU, product.Product, product.Flavor, product.Category = row.SKU, row.Product, row.Flavor, row.Category
+			product.Description = row.Description
+
+			if product.ID == 0 {
+				if err := repos.Products.Create(ctx, product); err != nil {
+					return fmt.Errorf("row %d: %w", report.Changes[i].Row, err)
+				}
+				report.Changes[i].ProductID = product.ID
+			}
+			var err error
+			if previous[i], err = s.adjustStock(ctx, tx, repos, product, row.Quantity, actor, "catalog import"); err != nil {
+				return fmt.Errorf("row %d: %w", report.Changes[i].Row, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, product := range matched {
+		if report.Changes[i].Action != CatalogActionUnchanged {
+			s.alertRestock(ctx, product, previous[i])
+		}
+	}
+	report.Applied = true
+
+	slog.InfoContext(ctx, "catalog imported", "created", report.Created, "updated", report.Updated, "unchanged", report.Unchanged)
+	return report, nil
+}
+
+// exportCatalog writes every product in the format importCatalog reads.
+func (s *LLMService) exportCatalog(ctx context.Context, format string, w io.Writer) error {
+	products, err := s.repos.Products.List(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+
+	rows := make([]CatalogRow, len(products))
+	for i, product := range products {
+		rows[i] = CatalogRow{ID: product.ID, SKU: product.SKU, Product: product.Product, Flavor: product.Flavor,
+			Category: product.Category, Quantity: product.Quantity, Description: product.Description}
+	}
+
+	switch format {
+	case CatalogFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	case CatalogFormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(catalogColumns); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			err := writer.Write([]string{strconv.FormatUint(uint64(row.ID), 10), row.SKU, row.Product, row.Flavor,
+				row.Category, strconv.Itoa(row.Quantity), row.Description})
+			if err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	return fmt.Errorf("unknown catalog format %q", format)
+}
+
+func catalogFormat(name string) string {
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		return CatalogFormatJSON
+	}
+	return CatalogFormatCSV
+}
+
+// importProducts handles POST /admin/productsdb/import?format=csv|json&dry_run=true.
+// The file is the request body or the "file" field of a multipart form.
+func (s *LLMService) importProducts(c *fiber.Ctx) error {
+	format := c.Query("format")
+	var body io.Reader = bytes.NewReader(c.Body())
+
+	if header, err := c.FormFile("file"); err == nil {
+		file, err := header.Open()
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		defer file.Close()
+		body = file
+		if format == "" {
+			format = catalogFormat(header.Filename)
+		}
+	}
+	if format == "" {
+		format = CatalogFormatCSV
+		if strings.Contains(c.Get(fiber.HeaderContentType), "json") {
+			format = CatalogFormatJSON
+		}
+	}
+
+	principal, _ := currentPrincipal(c)
+	report, err := s.importCatalog(c.UserContext(), format, body, c.QueryBool("dry_run"), principal.Subject)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if len(report.Errors) > 0 {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(report)
+	}
+
+	return c.JSON(report)
+}
+
+// exportProducts handles GET /admin/productsdb/export?format=csv|json.
+func (s *LLMService) exportProducts(c *fiber.Ctx) error {
+	format := c.Query("format", CatalogFormatCSV)
+	if format != CatalogFormatCSV && format != CatalogFormatJSON {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("unknown catalog format %q", format),
+		})
+	}
+
+	var buffer bytes.Buffer
+	if err := s.exportCatalog(c.UserContext(), format, &buffer); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if format == CatalogFormatJSON {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	} else {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	}
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="catalog.%s"`, format))
+	return c.Send(buffer.Bytes())
+}
+
+func runCatalogCommand(ctx context.Context, s *LLMService, args []string, stdout io.Writer) error {
+	usage := errors.New("usage: catalog import [-dry-run] [-format csv|json] <file> | export [-format csv|json] [file]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	flags := flag.NewFlagSet("catalog "+args[0], flag.ContinueOnError)
+	format := flags.String("format", "", "csv or json, by default from the file extension")
+	dryRun := flags.Bool("dry-run", false, "show the changes without applying them")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "import":
+		if flags.NArg() != 1 {
+			return usage
+		}
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if *format == "" {
+			*format = catalogFormat(file.Name())
+		}
+
+		report, err := s.importCatalog(ctx, *format, file, *dryRun, "cli")
+		if err != nil {
+			return err
+		}
+		for _, change := range report.Changes {
+			if change.Action == CatalogActionUnchanged {
+				continue
+			}
+			fmt.Fprintf(stdout, "%s %s (row %d)\n", change.Action, change.SKU, change.Row)
+			fields := make([]string, 0, len(change.Fields))
+			for field := range change.Fields {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				fmt.Fprintf(stdout, "\t%s: %v -> %v\n", field, change.Fields[field].From, change.Fields[field].To)
+			}
+		}
+		for _, rowError := range report.Errors {
+			fmt.Fprintln(stdout, rowError)
+		}
+		fmt.Fprintf(stdout, "%d to create, %d to update, %d unchanged, %d errors\n", report.Created, report.Updated, report.Unchanged, len(report.Errors))
+
+		if len(report.Errors) > 0 {
+			return errors.New("catalog was not imported: fix the rows with errors")
+		}
+		if report.Applied {
+			fmt.Fprintln(stdout, "Catalog imported.")
+		}
+		return nil
+	case "export":
+		if flags.NArg() > 1 {
+			return usage
+		}
+		w := stdout
+		if flags.NArg() == 1 {
+			file, err := os.Create(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			w = file
+			if *format == "" {
+				*format = catalogFormat(file.Name())
+			}
+		}
+		if *format == "" {
+			*format = CatalogFormatCSV
+		}
+		return s.exportCatalog(ctx, *format, w)
+	}
+	return usage
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCatalogImport(t *testing.T) {
+	ctx := context.Background()
+	s, _, _, _ := newTestService(t, time.Now())
+	s.repos.Products.Create(ctx, &Products{Product: "pod", Flavor: "uva", Quantity: 3})
+	s.repos.Products.Create(ctx, &Products{SKU: "SWAG-01", Product: "swag kit", Quantity: 5, Category: "kits"})
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("principal", Principal{Subject: "staff", Role: RoleStaff})
+		return c.Next()
+	})
+	s.RegisterAdminRoutes(app)
+	post := func(query, contentType, body string) (int, CatalogImport) {
+		req := httptest.NewRequest("POST", "/productsdb/import"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report CatalogImport
+		json.NewDecoder(resp.Body).Decode(&report)
+		return resp.StatusCode, report
+	}
+
+	file := "id,sku,product,flavor,category,quantity,description\n" +
+		"1,POD-UVA,Pod,Uva,pods,3,\n" +
+		",SWAG-01,SWAG Kit,,kits,12,pod recarregável\n" +
+		",COIL-X,Coil X,,coils,dez,\n" +
+		",NIC-MOR,Nicsalt,Morango,juices,10,\n"
+	status, report := post("", "text/csv", file)
+	if status != fiber.StatusUnprocessableEntity || len(report.Errors) != 1 || report.Errors[0].Row != 4 || report.Errors[0].Field != "quantity" {
+		t.Fatalf("Row errors are not correct: %d, %+v", status, report.Errors)
+	}
+	if report.Applied || report.Created != 1 || report.Updated != 2 {
+		t.Errorf("Import with errors is not correct: %+v", report)
+	}
+	if product, _ := s.repos.Products.Get(ctx, 2); product.Quantity != 5 {
+		t.Errorf("Import with errors was applied: %+v", product)
+	}
+
+	file = strings.Replace(file, "dez", "10", 1)
+	status, report = post("?dry_run=true", "text/csv", file)
+	if status != fiber.StatusOK || report.Applied || report.Created != 2 || report.Updated != 2 {
+		t.Fatalf("Dry run is not correct: %d, %+v", status, report)
+	}
+	if change := report.Changes[1]; change.ProductID != 2 || change.Fields["quantity"].To != float64(12) || change.Fields["description"].To != "pod recarregável" || len(change.Fields) != 2 {
+		t.Errorf("Diff is not correct: %+v", change)
+	}
+	if products, _ := s.repos.Products.List(ctx); len(products) != 2 {
+		t.Errorf("Dry run was applied: %+v", products)
+	}
+
+	status, report = post("", "text/csv", file)
+	if status != fiber.StatusOK || !report.Applied {
+		t.Fatalf("Catalog was not imported: %d, %+v", status, report)
+	}
+	products, _ := s.repos.Products.List(ctx)
+	if len(products) != 4 || products[0].SKU != "POD-UVA" || products[1].Quantity != 12 || products[3].Flavor != "morango" {
+		t.Errorf("Products were not upserted: %+v", products)
+	}
+
+	// An export imports back without changes.
+	var exported bytes.Buffer
+	if err := runCatalogCommand(ctx, s, []string{"export", "-format", "json"}, &exported); err != nil {
+		t.Fatal(err)
+	}
+	status, report = post("?format=json", "application/octet-stream", exported.String())
+	if status != fiber.StatusOK || report.Unchanged != 4 {
+		t.Errorf("Exported catalog does not import back: %d, %+v", status, report)
+	}
+
+	req := httptest.NewRequest("GET", "/productsdb/export?format=csv", nil)
+	resp, _ := app.Test(req)
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(string(body), "id,sku,product,flavor,category,quantity,description\n1,POD-UVA,pod,uva,pods,3,\n") {
+		t.Errorf("CSV export is not correct: %s", body)
+	}
+
+	req = httptest.NewRequest("PATCH", "/productsdb/1", strings.NewReader(`{"sku": "SWAG-01"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, _ := app.Test(req); resp.StatusCode != fiber.StatusConflict {
+		t.Errorf("Duplicate SKU was accepted: %d", resp.StatusCode)
+	}
+}
+
+func TestCatalogRowErrors(t *testing.T) {
+	ctx := context.Background()
+	s, _, _, _ := newTestService(t, time.Now())
+
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	os.WriteFile(path, []byte(`[
+		{"sku": "A", "product": "pod", "quantity": 1},
+		{"sku": "A", "product": "", "quantity": -1},
+		{"product": "coil", "quantity": "2", "id": 7}
+	]`), 0o600)
+
+	var out bytes.Buffer
+	err := runCatalogCommand(ctx, s, []string{"import", path}, &out)
+	if err == nil {
+		t.Fatal("Catalog with errors was imported")
+	}
+	for _, want := range []string{"row 2 sku: is repeated from row 1", "row 2 product: is required", "row 2 quantity:", "row 3 sku: is required", "1 to create"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Output has no %q:\n%s", want, out.String())
+		}
+	}
+	if products, _ := s.repos.Products.List(ctx); len(products) != 0 {
+		t.Errorf("Catalog with errors was applied: %+v", products)
+	}
+}
+
+func TestCatalogImportRollsBack(t *testing.T) {
+	ctx := context.Background()
+	s, _, _, _ := newTestService(t, time.Now())
+	if err := s.db.AutoMigrate(&Products{}); err != nil {
+		t.Fatal(err)
+	}
+	s.repos = newGormRepositories(s.db, nil)
+	// The second row fails once the first one was written.
+	s.db.Exec("CREATE TRIGGER fail_stock BEFORE INSERT ON stock_movements WHEN NEW.quantity = 7 BEGIN SELECT RAISE(ABORT, 'disk full'); END")
+
+	file := "sku,product,quantity\nPOD-UVA,pod,3\nCOIL-X,coil,7\n"
+	if _, err := s.importCatalog(ctx, CatalogFormatCSV, strings.NewReader(file), false, "staff"); err == nil || !strings.Contains(err.Error(), "row 3") {
+		t.Fatalf("Import should fail on row 3: %v", err)
+	}
+	var products, movements int64
+	s.db.Model(&Products{}).Count(&products)
+	s.db.Model(&StockMovement{}).Count(&movements)
+	if products != 0 || movements != 0 {
+		t.Errorf("Failed import was partly applied: %d products, %d movements", products, movements)
+	}
+
+	// SKUs are unique among the products that have one.
+	s.db.Exec("DROP TRIGGER fail_stock")
+	for _, product := range []*Products{{Product: "pod"}, {Product: "coil"}, {SKU: "POD-UVA", Product: "pod"}} {
+		if err := s.repos.Products.Create(ctx, product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.repos.Products.Create(ctx, &Products{SKU: "POD-UVA", Product: "pod"}); err == nil {
+		t.Error("Duplicate SKU was stored")
+	}
+}
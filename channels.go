@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// OutboundSender delivers a bot initiated message (reminders, campaigns) to
+// a contact through the channel the contact talks to us on.
+type OutboundSender interface {
+	Send(ctx context.Context, channel, recipient, text string) error
+}
+
+type outboundPayload struct {
+	ID        string `json:"id,omitempty"`
+	Channel   string `json:"channel"`
+	Recipient string `json:"recipient"`
+	Text      string `json:"text"`
+}
+
+type outboundIDKey struct{}
+
+// withOutboundID sets the ID sent along with the outbound message. Channels
+// report its delivery and read receipts on POST /channels/status.
+func withOutboundID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, outboundIDKey{}, id)
+}
+
+func outboundIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(outboundIDKey{}).(string)
+	return id
+}
+
+// webhookSender posts outbound messages to the webhook configured for the
+// channel, e.g. a WhatsApp gateway. Channels without a webhook (like the
+// plain HTTP API) only get the message logged; clients read it from the
+// stored conversation.
+type webhookSender struct {
+	webhooks map[string]string
+	client   *http.Client
+}
+
+func newWebhookSender(config ChannelsConfig) *webhookSender {
+	return &webhookSender{
+		webhooks: config.Webhooks,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (w *webhookSender) Send(ctx context.Context, channel, recipient, text string) error {
+	url, ok := w.webhooks[channel]
+	if !ok {
+		slog.InfoContext(ctx, "outbound message not sent, no webhook configured", "channel", channel, "content", text)
+		return nil
+	}
+
+	body, err := json.Marshal(outboundPayload{ID: outboundIDFrom(ctx), Channel: channel, Recipient: recipient, Text: text})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// The channel can continue the trace of the reply.
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s webhook returned status %d", channel, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// contactAddress picks the channel and recipient to reach a contact on,
+// preferring the most recently created identity.
+func contactAddress(contact *Contact) (string, string, bool) {
+	if len(contact.Identities) > 0 {
+		identity := contact.Identities[len(contact.Identities)-1]
+		return identity.Channel, identity.ExternalID, true
+	}
+	if contact.Phone != "" {
+		return "whatsapp", contact.Phone, true
+	}
+	return "", "", false
+}
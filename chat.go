@@ -1,65 +1,61 @@
 package main
 
 import (
-	"fmt"
+	"context"
 
-	"github.com/gofiber/fiber/v2"
 	openai "github.com/sashabaranov/go-openai"
 )
 
-func getMessages(s *LLMService) ([]LLMMessage, error) {
-	var messages []Message
-	result := s.db.Find(&messages)
-
-	if result.Error != nil {
-		return nil, result.Error
-	}
-
-	fmt.Println(result)
-
-	var LLMMessages []LLMMessage
-	for _, message := range messages {
-		LLMMessages = append(LLMMessages, LLMMessage{Role: message.Role, Content: message.Content})
+// chatHistory builds the prompt for a message: the system message, the
+// context of the conversation (see conversationContext) and the message.
+func (s *LLMService) chatHistory(ctx context.Context, contact *Contact, message *Message) []openai.ChatCompletionMessage {
+	systemMessage := openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleSystem,
+		Content: `Você é um chatbot que auxilia profissionais liberais a agendarem suas consultas,
+		devendo responder prontamente e com polidez e ânimo a perguntas sobre o serviço prestado. Responda
+		com respostas concisas, curtas e objetivas. As pessoas irão fazer perguntas sobre serviços de medicina,
+		odontologia e nutrição. Responda com respostas curtas e objetivas. Para perguntas que fujam do escopo
+		mencionado, apenas responda com polidez dizendo que não está apto a responder perguntas de áreas que não
+		sejam medicina, odontologia e nutrição.`,
 	}
 
-	return LLMMessages, nil
+	chatHistory := append([]openai.ChatCompletionMessage{systemMessage}, s.conversationContext(ctx, contact, message.Content)...)
+	return append(chatHistory, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: message.Content,
+	})
 }
 
-func chatHistory(c *fiber.Ctx, s *LLMService, message *Message) ([]openai.ChatCompletionMessage, error) {
-	previousChat, err := getMessages(s)
-	if err != nil {
-		fmt.Printf("Get previous chat error: %v\n", err)
-		return nil, err
-	}
-
-	// Convert previousChat to a slice of openai.ChatCompletionMessage
-	var chatHistory []openai.ChatCompletionMessage
-	for _, chatMessage := range previousChat {
-		chatHistory = append(chatHistory, openai.ChatCompletionMessage{
-			Role:    chatMessage.Role,
-			Content: chatMessage.Content,
+// extractArguments asks the LLM to extract the ordered products and the
+// pickup date from the message. It returns the raw function call arguments.
+// The contact profile, when known, is sent as a system message, followed by
+// the history of the conversation.
+func (s *LLMService) extractArguments(ctx context.Context, content, profile string, history []openai.ChatCompletionMessage) (string, error) {
+	var messages []openai.ChatCompletionMessage
+	if profile != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: profile,
 		})
 	}
-
-	// Append the user's new message to chatHistory
-	chatHistory = append(chatHistory, openai.ChatCompletionMessage{
+	messages = append(messages, history...)
+	chatMessage := append(messages, openai.ChatCompletionMessage{
 		Role:    openai.ChatMessageRoleUser,
-		Content: message.Content,
+		Content: content,
 	})
 
-	// Include the system message at the beginning
-	systemMessage := openai.ChatCompletionMessage{
-		Role: openai.ChatMessageRoleSystem,
-		Content: `Você é um chatbot que auxilia profissionais liberais a agendarem suas consultas,
-		devendo responder prontamente e com polidez e ânimo a perguntas sobre o serviço prestado. Responda
-		com respostas concisas, curtas e objetivas. As pessoas irão fazer perguntas sobre serviços de medicina,
-		odontologia e nutrição. Responda com respostas curtas e objetivas. Para perguntas que fujam do escopo
-		mencionado, apenas responda com polidez dizendo que não está apto a responder perguntas de áreas que não
-		sejam medicina, odontologia e nutrição.`,
+	today := s.scheduler.now().In(s.config.Location())
+	resp, err := s.llm.complete(ctx, "extract", openai.ChatCompletionRequest{
+		Messages:  chatMessage,
+		Functions: []openai.FunctionDefinition{getProductsAndDate(today)},
+	})
+	if err != nil {
+		return "", err
 	}
 
-	// Add system message at the beginning of the chat
-	chatHistory = append([]openai.ChatCompletionMessage{systemMessage}, chatHistory...)
+	if resp.Choices[0].Message.Content == "" && resp.Choices[0].Message.FunctionCall != nil {
+		return resp.Choices[0].Message.FunctionCall.Arguments, nil
+	}
 
-	return chatHistory, nil
+	return resp.Choices[0].Message.Content, nil
 }
@@ -0,0 +1,831 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/arthurborgesdev/relationship-bot/pii"
+)
+
+type Config struct {
+	Port       int              `json:"port"`
+	Timezone   string           `json:"timezone"`
+	Database   DatabaseConfig   `json:"database"`
+	OpenAI     OpenAIConfig     `json:"openai"`
+	Milvus     MilvusConfig     `json:"milvus"`
+	Google     GoogleConfig     `json:"google"`
+	Admin      AdminConfig      `json:"admin"`
+	Reminders  ReminderConfig   `json:"reminders"`
+	Channels   ChannelsConfig   `json:"channels"`
+	Intents    IntentConfig     `json:"intents"`
+	Shop       ShopConfig       `json:"shop"`
+	Encryption EncryptionConfig `json:"encryption"`
+	Retention  RetentionConfig  `json:"retention"`
+	Metrics    MetricsConfig    `json:"metrics"`
+	Logging    LoggingConfig    `json:"logging"`
+	Tracing    TracingConfig    `json:"tracing"`
+	Inbound    InboundConfig    `json:"inbound"`
+	Debounce   DebounceConfig   `json:"debounce"`
+	Context    ContextConfig    `json:"context"`
+	Campaigns  CampaignConfig   `json:"campaigns"`
+	// Tenants holds per tenant settings keyed by the tenant ID. Channel
+	// webhooks are the tenant whose WebhookToken they carry; admin requests
+	// pick one with the X-Tenant-ID header. The "default" tenant applies to
+	// every other tenant.
+	Tenants map[string]TenantConfig `json:"tenants"`
+}
+
+type DatabaseConfig struct {
+	Driver      string `json:"driver"`
+	DSN         string `json:"dsn"`
+	AutoMigrate bool   `json:"auto_migrate"`
+}
+
+type OpenAIConfig struct {
+	AuthToken string `json:"auth_token"`
+	Model     string `json:"model"`
+	// Prices by model name, used to compute the cost of each call. Models
+	// are also matched by prefix ("gpt-4" prices "gpt-4-0613").
+	Prices map[string]ModelPrice `json:"prices"`
+	// Timeout is the deadline of each attempt. Rate limits and server errors
+	// are retried MaxRetries times before falling back to the next model.
+	Timeout    string          `json:"timeout"`
+	MaxRetries int             `json:"max_retries"`
+	Fallbacks  []FallbackModel `json:"fallbacks"`
+	Breaker    BreakerConfig   `json:"breaker"`
+}
+
+// FallbackModel is tried, in order, when the models before it fail. BaseURL
+// and AuthToken point it to another OpenAI compatible provider; when empty
+// the primary provider is used.
+type FallbackModel struct {
+	Model     string `json:"model"`
+	BaseURL   string `json:"base_url"`
+	AuthToken string `json:"auth_token"`
+}
+
+// BreakerConfig opens the circuit of a model after Failures consecutive
+// failures; it is skipped until Cooldown has passed.
+type BreakerConfig struct {
+	Failures int    `json:"failures"`
+	Cooldown string `json:"cooldown"`
+}
+
+// ModelPrice is the price in USD per 1000 tokens.
+type ModelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+type MilvusConfig struct {
+	Enabled bool   `json:"enabled"`
+	Address string `json:"address"`
+}
+
+type GoogleConfig struct {
+	CalendarID      string `json:"calendar_id"`
+	CredentialsFile string `json:"credentials_file"`
+}
+
+type AdminConfig struct {
+	APIKeys   string `json:"api_keys"`
+	JWTSecret string `json:"jwt_secret"`
+}
+
+type ReminderConfig struct {
+	Enabled           bool     `json:"enabled"`
+	Offsets           []string `json:"offsets"`
+	PollInterval      string   `json:"poll_interval"`
+	DefaultPickupTime string   `json:"default_pickup_time"`
+	// Workers is how many background jobs (reminders, summaries, campaign
+	// batches, purges) run at the same time.
+	Workers int `json:"workers"`
+}
+
+// Webhooks maps a channel name (e.g. "whatsapp") to the URL outbound
+// messages for that channel are posted to. StatusSecret signs the delivery
+// receipts the gateways post back; receipts are refused while it is empty.
+type ChannelsConfig struct {
+	Webhooks     map[string]string `json:"webhooks"`
+	StatusSecret string            `json:"status_secret"`
+}
+
+// Messages the rules classify below ConfidenceThreshold are sent to the LLM
+// when LLMFallback is enabled.
+type IntentConfig struct {
+	ConfidenceThreshold float64 `json:"confidence_threshold"`
+	LLMFallback         bool    `json:"llm_fallback"`
+}
+
+// FAQ is free text (opening hours, address, payment methods...) the bot uses
+// to answer customer questions.
+type ShopConfig struct {
+	Name string `json:"name"`
+	FAQ  string `json:"faq"`
+}
+
+// KeyFile enables encryption at rest of message content and contact
+// fields. See loadKeyFile for its format.
+type EncryptionConfig struct {
+	KeyFile string `json:"key_file"`
+}
+
+// RetentionConfig controls the background purger. The retention periods
+// themselves are set per tenant.
+type RetentionConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+}
+
+// MetricsConfig controls the Prometheus /metrics endpoint. When Token is set
+// scrapers must send it as a bearer token.
+type MetricsConfig struct {
+	Enabled bool   `json:"enabled"`
+	Token   string `json:"token"`
+}
+
+// Message content (inbound text, replies and extracted arguments) is left out
+// of the logs unless Content is set.
+type LoggingConfig struct {
+	Level   string `json:"level"`
+	Format  string `json:"format"`
+	Content bool   `json:"content"`
+}
+
+func (c LoggingConfig) level() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return 0, fmt.Errorf("log level must be debug, info, warn or error, got %q", c.Level)
+	}
+	return level, nil
+}
+
+// InboundConfig makes POST /messages acknowledge messages right away and
+// answer them from a pool of Workers, through the channel webhooks. Messages
+// failing MaxAttempts times are moved to the dead letters.
+type InboundConfig struct {
+	Async        bool   `json:"async"`
+	Workers      int    `json:"workers"`
+	PollInterval string `json:"poll_interval"`
+	MaxAttempts  int    `json:"max_attempts"`
+}
+
+// DebounceConfig aggregates the messages a contact sends in a row into one
+// turn, answered once the contact has been quiet for Window or MaxWait after
+// the first message. An empty Window answers every message on its own.
+type DebounceConfig struct {
+	Window  string `json:"window"`
+	MaxWait string `json:"max_wait"`
+}
+
+// ContextConfig bounds the conversation sent to the LLM, in tokens. Prompts
+// get the summary of older turns, up to Memories retrieved messages and the
+// most recent turns, within MaxTokens. Once the turns not summarized yet
+// exceed SummarizeAfter, all but the newest RecentTokens are folded into the
+// summary, itself capped at SummaryTokens.
+type ContextConfig struct {
+	MaxTokens      int `json:"max_tokens"`
+	SummarizeAfter int `json:"summarize_after"`
+	RecentTokens   int `json:"recent_tokens"`
+	SummaryTokens  int `json:"summary_tokens"`
+	Memories       int `json:"memories"`
+}
+
+// CampaignConfig limits campaigns to RatePerMinute messages a minute on each
+// channel, unless ChannelRates sets the channel's own rate. A message of the
+// contact within ReplyWindow of a campaign message counts as a reply to it.
+type CampaignConfig struct {
+	RatePerMinute int            `json:"rate_per_minute"`
+	ChannelRates  map[string]int `json:"channel_rates"`
+	ReplyWindow   string         `json:"reply_window"`
+}
+
+// Spans are exported with OTLP/HTTP to Endpoint (e.g. http://localhost:4318)
+// when it is set.
+type TracingConfig struct {
+	Endpoint    string `json:"endpoint"`
+	ServiceName string `json:"service_name"`
+}
+
+// RetentionPolicy sets how long each kind of data is kept, as a duration
+// like "720h" or a number of days ("90d") or years ("5y"). Empty keeps the
+// data forever.
+type RetentionPolicy struct {
+	Messages   string `json:"messages"`
+	Orders     string `json:"orders"`
+	Embeddings string `json:"embeddings"`
+}
+
+type TenantConfig struct {
+	Redaction pii.Policy      `json:"redaction"`
+	Retention RetentionPolicy `json:"retention"`
+	Budget    BudgetConfig    `json:"budget"`
+	// WebhookToken authenticates the tenant's channel webhooks, sent in the
+	// X-Webhook-Token header. Webhooks without a token belong to the default
+	// tenant, unless it has a token itself.
+	WebhookToken string `json:"webhook_token"`
+}
+
+const (
+	BudgetModeCheaperModel = "cheaper_model"
+	BudgetModeFAQOnly      = "faq_only"
+)
+
+// BudgetConfig caps the monthly LLM spend (USD) of a tenant. Once it is
+// exhausted the bot switches to CheaperModel or, in FAQ only mode, stops
+// calling the LLM. Zero means no budget.
+type BudgetConfig struct {
+	Monthly      float64 `json:"monthly"`
+	Mode         string  `json:"mode"`
+	CheaperModel string  `json:"cheaper_model"`
+}
+
+func (b BudgetConfig) validate() error {
+	if b.Monthly < 0 {
+		return fmt.Errorf("monthly budget can not be negative, got %v", b.Monthly)
+	}
+	if b.Monthly == 0 {
+		return nil
+	}
+	switch b.Mode {
+	case BudgetModeFAQOnly:
+		return nil
+	case BudgetModeCheaperModel:
+		if b.CheaperModel == "" {
+			return errors.New("cheaper_model is required in cheaper_model mode")
+		}
+		return nil
+	default:
+		return fmt.Errorf("mode must be %s or %s, got %q", BudgetModeCheaperModel, BudgetModeFAQOnly, b.Mode)
+	}
+}
+
+const defaultTenant = "default"
+
+// Tenant returns the settings of the tenant, falling back to the default tenant.
+func (c *Config) Tenant(id string) TenantConfig {
+	if tenant, ok := c.Tenants[id]; ok {
+		return tenant
+	}
+	return c.Tenants[defaultTenant]
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:     3000,
+		Timezone: "America/Sao_Paulo",
+		Reminders: ReminderConfig{
+			Enabled:           true,
+			Offsets:           []string{"24h", "1h"},
+			PollInterval:      "30s",
+			DefaultPickupTime: "10:00",
+			Workers:           4,
+		},
+		Intents:   IntentConfig{ConfidenceThreshold: 0.7, LLMFallback: true},
+		Retention: RetentionConfig{Enabled: true, Interval: "24h"},
+		Metrics:   MetricsConfig{Enabled: true},
+		Logging:   LoggingConfig{Level: "info", Format: "json"},
+		Tracing:   TracingConfig{ServiceName: "relationship-bot"},
+		Inbound:   InboundConfig{Workers: 4, PollInterval: "1s", MaxAttempts: 5},
+		Debounce:  DebounceConfig{MaxWait: "15s"},
+		Context:   ContextConfig{MaxTokens: 2000, SummarizeAfter: 1500, RecentTokens: 600, SummaryTokens: 300, Memories: 3},
+		Campaigns: CampaignConfig{RatePerMinute: 30, ReplyWindow: "72h"},
+		OpenAI: OpenAIConfig{
+			Timeout:    "20s",
+			MaxRetries: 2,
+			Breaker:    BreakerConfig{Failures: 5, Cooldown: "30s"},
+			Prices: map[string]ModelPrice{
+				"gpt-3.5-turbo":          {Prompt: 0.0015, Completion: 0.002},
+				"gpt-3.5-turbo-16k":      {Prompt: 0.003, Completion: 0.004},
+				"gpt-4":                  {Prompt: 0.03, Completion: 0.06},
+				"gpt-4-32k":              {Prompt: 0.06, Completion: 0.12},
+				"text-embedding-ada-002": {Prompt: 0.0001},
+			},
+		},
+		Tenants: map[string]TenantConfig{
+			defaultTenant: {
+				Redaction: pii.Policy{Enabled: true},
+				Retention: RetentionPolicy{Messages: "90d", Orders: "5y", Embeddings: "1y"},
+				Budget:    BudgetConfig{Mode: BudgetModeCheaperModel, CheaperModel: "gpt-3.5-turbo"},
+			},
+		},
+		Database: DatabaseConfig{Driver: "sqlite", DSN: "test.db", AutoMigrate: true},
+		Milvus:   MilvusConfig{Address: "localhost:19530"},
+		Google:   GoogleConfig{CredentialsFile: "credentials.json"},
+	}
+}
+
+// mergeTenants applies each tenant of the config file over the default tenant
+// settings. json.Unmarshal starts every tenant from a zero TenantConfig, so a
+// tenant that only sets a budget would turn PII redaction off.
+func mergeTenants(config *Config, data []byte) error {
+	var file struct {
+		Tenants map[string]json.RawMessage `json:"tenants"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	if config.Tenants == nil {
+		config.Tenants = defaultConfig().Tenants
+	}
+	for id, raw := range file.Tenants {
+		tenant := defaultConfig().Tenants[defaultTenant]
+		if err := json.Unmarshal(raw, &tenant); err != nil {
+			return fmt.Errorf("tenant %q: %w", id, err)
+		}
+		config.Tenants[id] = tenant
+	}
+	return nil
+}
+
+// loadConfig builds the configuration with the following precedence, from
+// lowest to highest: defaults, config file, environment variables, flags.
+// The config file is a JSON document given by -config or CONFIG_FILE.
+// Positional arguments left after the flags (subcommands) are returned as is.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, []string, error) {
+	config := defaultConfig()
+
+	flags := flag.NewFlagSet("relationship-bot", flag.ContinueOnError)
+	configFile := flags.String("config", "", "path to a JSON config file")
+	port := flags.Int("port", 0, "HTTP port to listen on")
+	databaseDriver := flags.String("db-driver", "", "database driver: sqlite, postgres or mysql")
+	databaseDSN := flags.String("db-dsn", "", "database DSN (a file path for sqlite)")
+	openAIModel := flags.String("openai-model", "", "OpenAI model used for chat completions")
+	milvusAddress := flags.String("milvus-address", "", "Milvus address (host:port)")
+	milvusEnabled := flags.Bool("milvus", false, "enable the Milvus vector DB routes")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configFile == "" {
+		*configFile, _ = lookupEnv("CONFIG_FILE")
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, nil, fmt.Errorf("parsing config file %s: %w", *configFile, err)
+		}
+		if err := mergeTenants(&config, data); err != nil {
+			return nil, nil, fmt.Errorf("parsing config file %s: %w", *configFile, err)
+		}
+	}
+
+	envStrings := map[string]*string{
+		"TIMEZONE":                    &config.Timezone,
+		"DATABASE_DRIVER":             &config.Database.Driver,
+		"DATABASE_DSN":                &config.Database.DSN,
+		"OPENAI_AUTH_TOKEN":           &config.OpenAI.AuthToken,
+		"OPENAI_MODEL_ID":             &config.OpenAI.Model,
+		"OPENAI_TIMEOUT":              &config.OpenAI.Timeout,
+		"DEBOUNCE_WINDOW":             &config.Debounce.Window,
+		"DEBOUNCE_MAX_WAIT":           &config.Debounce.MaxWait,
+		"MILVUS_ADDRESS":              &config.Milvus.Address,
+		"GOOGLE_MED_CALENDAR":         &config.Google.CalendarID,
+		"GOOGLE_CREDENTIALS_FILE":     &config.Google.CredentialsFile,
+		"ADMIN_API_KEYS":              &config.Admin.APIKeys,
+		"ADMIN_JWT_SECRET":            &config.Admin.JWTSecret,
+		"SHOP_NAME":                   &config.Shop.Name,
+		"SHOP_FAQ":                    &config.Shop.FAQ,
+		"ENCRYPTION_KEY_FILE":         &config.Encryption.KeyFile,
+		"METRICS_TOKEN":               &config.Metrics.Token,
+		"CHANNEL_STATUS_SECRET":       &config.Channels.StatusSecret,
+		"LOG_LEVEL":                   &config.Logging.Level,
+		"LOG_FORMAT":                  &config.Logging.Format,
+		"OTEL_EXPORTER_OTLP_ENDPOINT": &config.Tracing.Endpoint,
+		"OTEL_SERVICE_NAME":           &config.Tracing.ServiceName,
+	}
+	for name, field := range envStrings {
+		if value, ok := lookupEnv(name); ok {
+			*field = value
+		}
+	}
+
+	var errs []error
+
+	if value, ok := lookupEnv("PORT"); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("PORT must be a number, got %q", value))
+		}
+		config.Port = parsed
+	}
+
+	if value, ok := lookupEnv("DATABASE_AUTO_MIGRATE"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DATABASE_AUTO_MIGRATE must be a boolean, got %q", value))
+		}
+		config.Database.AutoMigrate = parsed
+	}
+
+	if value, ok := lookupEnv("OPENAI_MAX_RETRIES"); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("OPENAI_MAX_RETRIES must be a number, got %q", value))
+		}
+		config.OpenAI.MaxRetries = parsed
+	}
+
+	// OPENAI_FALLBACK_MODELS is a comma separated list of models on the
+	// primary provider.
+	if value, ok := lookupEnv("OPENAI_FALLBACK_MODELS"); ok {
+		config.OpenAI.Fallbacks = nil
+		for _, model := range splitList(value) {
+			config.OpenAI.Fallbacks = append(config.OpenAI.Fallbacks, FallbackModel{Model: model})
+		}
+	}
+
+	if value, ok := lookupEnv("REMINDERS_ENABLED"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("REMINDERS_ENABLED must be a boolean, got %q", value))
+		}
+		config.Reminders.Enabled = parsed
+	}
+
+	if value, ok := lookupEnv("REMINDER_OFFSETS"); ok {
+		config.Reminders.Offsets = splitList(value)
+	}
+
+	if value, ok := lookupEnv("JOB_WORKERS"); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("JOB_WORKERS must be a number, got %q", value))
+		}
+		config.Reminders.Workers = parsed
+	}
+
+	// CHANNEL_WEBHOOKS is a comma separated list of channel=url pairs.
+	if value, ok := lookupEnv("CHANNEL_WEBHOOKS"); ok {
+		config.Channels.Webhooks = map[string]string{}
+		for _, entry := range splitList(value) {
+			channel, url, found := strings.Cut(entry, "=")
+			if !found {
+				errs = append(errs, fmt.Errorf("CHANNEL_WEBHOOKS entry %q must be channel=url", entry))
+				continue
+			}
+			config.Channels.Webhooks[channel] = url
+		}
+	}
+
+	if value, ok := lookupEnv("INTENT_CONFIDENCE_THRESHOLD"); ok {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("INTENT_CONFIDENCE_THRESHOLD must be a number, got %q", value))
+		}
+		config.Intents.ConfidenceThreshold = parsed
+	}
+
+	if value, ok := lookupEnv("INTENT_LLM_FALLBACK"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("INTENT_LLM_FALLBACK must be a boolean, got %q", value))
+		}
+		config.Intents.LLMFallback = parsed
+	}
+
+	// PII_REDACTION and PII_REDACTION_KINDS configure the default tenant.
+	if value, ok := lookupEnv("PII_REDACTION"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("PII_REDACTION must be a boolean, got %q", value))
+		}
+		tenant := config.Tenants[defaultTenant]
+		tenant.Redaction.Enabled = parsed
+		config.Tenants[defaultTenant] = tenant
+	}
+
+	if value, ok := lookupEnv("WEBHOOK_TOKEN"); ok {
+		tenant := config.Tenants[defaultTenant]
+		tenant.WebhookToken = value
+		config.Tenants[defaultTenant] = tenant
+	}
+
+	if value, ok := lookupEnv("PII_REDACTION_KINDS"); ok {
+		tenant := config.Tenants[defaultTenant]
+		tenant.Redaction.Kinds = nil
+		for _, kind := range splitList(value) {
+			tenant.Redaction.Kinds = append(tenant.Redaction.Kinds, pii.Kind(kind))
+		}
+		config.Tenants[defaultTenant] = tenant
+	}
+
+	if value, ok := lookupEnv("LLM_MONTHLY_BUDGET"); ok {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("LLM_MONTHLY_BUDGET must be a number, got %q", value))
+		}
+		tenant := config.Tenants[defaultTenant]
+		tenant.Budget.Monthly = parsed
+		config.Tenants[defaultTenant] = tenant
+	}
+	if value, ok := lookupEnv("LLM_BUDGET_MODE"); ok {
+		tenant := config.Tenants[defaultTenant]
+		tenant.Budget.Mode = value
+		config.Tenants[defaultTenant] = tenant
+	}
+	if value, ok := lookupEnv("LLM_BUDGET_CHEAPER_MODEL"); ok {
+		tenant := config.Tenants[defaultTenant]
+		tenant.Budget.CheaperModel = value
+		config.Tenants[defaultTenant] = tenant
+	}
+
+	if value, ok := lookupEnv("RETENTION_ENABLED"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("RETENTION_ENABLED must be a boolean, got %q", value))
+		}
+		config.Retention.Enabled = parsed
+	}
+
+	if value, ok := lookupEnv("LOG_CONTENT"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("LOG_CONTENT must be a boolean, got %q", value))
+		}
+		config.Logging.Content = parsed
+	}
+
+	if value, ok := lookupEnv("METRICS_ENABLED"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("METRICS_ENABLED must be a boolean, got %q", value))
+		}
+		config.Metrics.Enabled = parsed
+	}
+
+	if value, ok := lookupEnv("INBOUND_ASYNC"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("INBOUND_ASYNC must be a boolean, got %q", value))
+		}
+		config.Inbound.Async = parsed
+	}
+
+	if value, ok := lookupEnv("CONTEXT_MAX_TOKENS"); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("CONTEXT_MAX_TOKENS must be a number, got %q", value))
+		}
+		config.Context.MaxTokens = parsed
+	}
+
+	if value, ok := lookupEnv("CONTEXT_SUMMARIZE_AFTER"); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("CONTEXT_SUMMARIZE_AFTER must be a number, got %q", value))
+		}
+		config.Context.SummarizeAfter = parsed
+	}
+
+	if value, ok := lookupEnv("CAMPAIGN_RATE_PER_MINUTE"); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("CAMPAIGN_RATE_PER_MINUTE must be a number, got %q", value))
+		}
+		config.Campaigns.RatePerMinute = parsed
+	}
+
+	if value, ok := lookupEnv("INBOUND_WORKERS"); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("INBOUND_WORKERS must be a number, got %q", value))
+		}
+		config.Inbound.Workers = parsed
+	}
+
+	if value, ok := lookupEnv("MILVUS_ENABLED"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MILVUS_ENABLED must be a boolean, got %q", value))
+		}
+		config.Milvus.Enabled = parsed
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			config.Port = *port
+		case "db-driver":
+			config.Database.Driver = *databaseDriver
+		case "db-dsn":
+			config.Database.DSN = *databaseDSN
+		case "openai-model":
+			config.OpenAI.Model = *openAIModel
+		case "milvus-address":
+			config.Milvus.Address = *milvusAddress
+		case "milvus":
+			config.Milvus.Enabled = *milvusEnabled
+		}
+	})
+
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return &config, flags.Args(), nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be between 1 and 65535, got %d", c.Port))
+	}
+	switch c.Database.Driver {
+	case "sqlite", "postgres", "mysql":
+	default:
+		errs = append(errs, fmt.Errorf("database driver must be sqlite, postgres or mysql, got %q", c.Database.Driver))
+	}
+	if c.Database.DSN == "" {
+		errs = append(errs, errors.New("database DSN is required (DATABASE_DSN or -db-dsn)"))
+	}
+	if c.OpenAI.AuthToken == "" {
+		errs = append(errs, errors.New("OpenAI auth token is required (OPENAI_AUTH_TOKEN)"))
+	}
+	if c.OpenAI.Model == "" {
+		errs = append(errs, errors.New("OpenAI model is required (OPENAI_MODEL_ID or -openai-model)"))
+	}
+	if d, err := time.ParseDuration(c.OpenAI.Timeout); err != nil || d <= 0 {
+		errs = append(errs, fmt.Errorf("OpenAI timeout %q must be a positive duration like 20s (OPENAI_TIMEOUT)", c.OpenAI.Timeout))
+	}
+	if c.OpenAI.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("OpenAI max retries can not be negative, got %d", c.OpenAI.MaxRetries))
+	}
+	for i, fallback := range c.OpenAI.Fallbacks {
+		if fallback.Model == "" {
+			errs = append(errs, fmt.Errorf("OpenAI fallback %d has no model", i+1))
+		}
+		if fallback.BaseURL != "" && !strings.HasPrefix(fallback.BaseURL, "http://") && !strings.HasPrefix(fallback.BaseURL, "https://") {
+			errs = append(errs, fmt.Errorf("OpenAI fallback %q base URL must be an http(s) URL, got %q", fallback.Model, fallback.BaseURL))
+		}
+	}
+	if c.OpenAI.Breaker.Failures < 0 {
+		errs = append(errs, fmt.Errorf("circuit breaker failures can not be negative, got %d", c.OpenAI.Breaker.Failures))
+	}
+	if d, err := time.ParseDuration(c.OpenAI.Breaker.Cooldown); err != nil || d <= 0 {
+		errs = append(errs, fmt.Errorf("circuit breaker cooldown %q must be a positive duration like 30s", c.OpenAI.Breaker.Cooldown))
+	}
+	if c.Milvus.Enabled && c.Milvus.Address == "" {
+		errs = append(errs, errors.New("Milvus address is required when Milvus is enabled (MILVUS_ADDRESS)"))
+	}
+	if _, err := parseAPIKeys(c.Admin.APIKeys); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		errs = append(errs, fmt.Errorf("invalid timezone %q (TIMEZONE)", c.Timezone))
+	}
+	for _, offset := range c.Reminders.Offsets {
+		if d, err := time.ParseDuration(offset); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("reminder offset %q must be a positive duration like 24h (REMINDER_OFFSETS)", offset))
+		}
+	}
+	if d, err := time.ParseDuration(c.Reminders.PollInterval); err != nil || d <= 0 {
+		errs = append(errs, fmt.Errorf("reminder poll interval %q must be a positive duration like 30s", c.Reminders.PollInterval))
+	}
+	tokens := map[string]string{}
+	for id, tenant := range c.Tenants {
+		if tenant.WebhookToken == "" {
+			continue
+		}
+		if other, ok := tokens[tenant.WebhookToken]; ok {
+			errs = append(errs, fmt.Errorf("tenants %q and %q share a webhook token", min(id, other), max(id, other)))
+		}
+		tokens[tenant.WebhookToken] = id
+	}
+	if c.Reminders.Workers < 1 {
+		errs = append(errs, fmt.Errorf("job workers must be at least 1, got %d (JOB_WORKERS)", c.Reminders.Workers))
+	}
+	if _, err := time.Parse("15:04", c.Reminders.DefaultPickupTime); err != nil {
+		errs = append(errs, fmt.Errorf("default pickup time %q must be in the hh:mm format", c.Reminders.DefaultPickupTime))
+	}
+	if c.Intents.ConfidenceThreshold < 0 || c.Intents.ConfidenceThreshold > 1 {
+		errs = append(errs, fmt.Errorf("intent confidence threshold must be between 0 and 1, got %v", c.Intents.ConfidenceThreshold))
+	}
+	if _, ok := c.Tenants[defaultTenant]; !ok {
+		errs = append(errs, fmt.Errorf("tenants must include the %q tenant", defaultTenant))
+	}
+	for id, tenant := range c.Tenants {
+		if err := tenant.Redaction.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q redaction: %w", id, err))
+		}
+		for kind, period := range map[string]string{"messages": tenant.Retention.Messages, "orders": tenant.Retention.Orders, "embeddings": tenant.Retention.Embeddings} {
+			if _, err := parseRetention(period); err != nil {
+				errs = append(errs, fmt.Errorf("tenant %q %s retention: %w", id, kind, err))
+			}
+		}
+		if err := tenant.Budget.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q budget: %w", id, err))
+		}
+	}
+	if d, err := time.ParseDuration(c.Retention.Interval); err != nil || d <= 0 {
+		errs = append(errs, fmt.Errorf("retention interval %q must be a positive duration like 24h", c.Retention.Interval))
+	}
+	if _, err := c.Logging.level(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Logging.Format != "json" && c.Logging.Format != "text" {
+		errs = append(errs, fmt.Errorf("log format must be json or text, got %q", c.Logging.Format))
+	}
+	if c.Tracing.Endpoint != "" && !strings.HasPrefix(c.Tracing.Endpoint, "http://") && !strings.HasPrefix(c.Tracing.Endpoint, "https://") {
+		errs = append(errs, fmt.Errorf("tracing endpoint must be an http(s) URL, got %q", c.Tracing.Endpoint))
+	}
+	if c.Inbound.Workers < 1 {
+		errs = append(errs, fmt.Errorf("inbound workers must be at least 1, got %d (INBOUND_WORKERS)", c.Inbound.Workers))
+	}
+	if d, err := time.ParseDuration(c.Inbound.PollInterval); err != nil || d <= 0 {
+		errs = append(errs, fmt.Errorf("inbound poll interval %q must be a positive duration like 1s", c.Inbound.PollInterval))
+	}
+	if c.Inbound.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("inbound max attempts must be at least 1, got %d", c.Inbound.MaxAttempts))
+	}
+	if c.Context.MaxTokens < 1 || c.Context.SummarizeAfter < 1 || c.Context.SummaryTokens < 1 {
+		errs = append(errs, fmt.Errorf("context max tokens, summarize after and summary tokens must be positive, got %d, %d and %d (CONTEXT_MAX_TOKENS, CONTEXT_SUMMARIZE_AFTER)",
+			c.Context.MaxTokens, c.Context.SummarizeAfter, c.Context.SummaryTokens))
+	}
+	if c.Context.RecentTokens < 0 || c.Context.RecentTokens >= c.Context.SummarizeAfter {
+		errs = append(errs, fmt.Errorf("context recent tokens must be between 0 and summarize after, got %d", c.Context.RecentTokens))
+	}
+	if c.Context.Memories < 0 {
+		errs = append(errs, fmt.Errorf("context memories can not be negative, got %d", c.Context.Memories))
+	}
+	if c.Debounce.Window != "" {
+		window, err := time.ParseDuration(c.Debounce.Window)
+		if err != nil || window <= 0 {
+			errs = append(errs, fmt.Errorf("debounce window %q must be a positive duration like 3s (DEBOUNCE_WINDOW)", c.Debounce.Window))
+		}
+		if maxWait, err := time.ParseDuration(c.Debounce.MaxWait); err != nil || maxWait < window {
+			errs = append(errs, fmt.Errorf("debounce max wait %q must be a duration of at least the window (DEBOUNCE_MAX_WAIT)", c.Debounce.MaxWait))
+		}
+	}
+	if c.Campaigns.RatePerMinute < 1 {
+		errs = append(errs, fmt.Errorf("campaign rate per minute must be at least 1, got %d (CAMPAIGN_RATE_PER_MINUTE)", c.Campaigns.RatePerMinute))
+	}
+	for channel, rate := range c.Campaigns.ChannelRates {
+		if rate < 1 {
+			errs = append(errs, fmt.Errorf("campaign rate of channel %q must be at least 1, got %d", channel, rate))
+		}
+	}
+	if d, err := time.ParseDuration(c.Campaigns.ReplyWindow); err != nil || d <= 0 {
+		errs = append(errs, fmt.Errorf("campaign reply window %q must be a positive duration like 72h", c.Campaigns.ReplyWindow))
+	}
+	for channel, url := range c.Channels.Webhooks {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			errs = append(errs, fmt.Errorf("webhook for channel %q must be an http(s) URL, got %q", channel, url))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+func (c *Config) Address() string {
+	return ":" + strconv.Itoa(c.Port)
+}
+
+// Location must only be called on a validated config.
+func (c *Config) Location() *time.Location {
+	location, _ := time.LoadLocation(c.Timezone)
+	return location
+}
+
+// durations parses values already checked by Validate.
+func durations(values []string) []time.Duration {
+	var parsed []time.Duration
+	for _, value := range values {
+		d, _ := time.ParseDuration(value)
+		parsed = append(parsed, d)
+	}
+	return parsed
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
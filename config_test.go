@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func fakeEnv(values map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(configFile, []byte(`{
+		"port": 4000,
+		"database": {"driver": "sqlite", "dsn": "file.db"},
+		"openai": {"auth_token": "file-token", "model": "file-model"}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := fakeEnv(map[string]string{
+		"CONFIG_FILE":     configFile,
+		"OPENAI_MODEL_ID": "env-model",
+		"PORT":            "5000",
+	})
+
+	config, args, err := loadConfig([]string{"-port", "6000", "migrate", "status"}, env)
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+
+	if config.Database.DSN != "file.db" || !config.Database.AutoMigrate {
+		t.Errorf("Database config is not correct: %+v", config.Database)
+	}
+	if config.OpenAI.AuthToken != "file-token" {
+		t.Errorf("OpenAI token is not correct: %s", config.OpenAI.AuthToken)
+	}
+	if config.OpenAI.Model != "env-model" {
+		t.Errorf("OpenAI model is not correct: %s", config.OpenAI.Model)
+	}
+	if config.Port != 6000 {
+		t.Errorf("Port is not correct: %d", config.Port)
+	}
+	if config.Milvus.Address != "localhost:19530" {
+		t.Errorf("Milvus address is not correct: %s", config.Milvus.Address)
+	}
+	if len(args) != 2 || args[0] != "migrate" {
+		t.Errorf("Remaining args are not correct: %v", args)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	env := fakeEnv(map[string]string{
+		"PORT":            "70000",
+		"ADMIN_API_KEYS":  "admin:abc",
+		"DATABASE_DRIVER": "oracle",
+		"LOG_LEVEL":       "verbose",
+	})
+
+	_, _, err := loadConfig(nil, env)
+	if err == nil {
+		t.Fatal("Invalid config was accepted")
+	}
+
+	for _, expected := range []string{"port must be between", "OPENAI_AUTH_TOKEN", "OPENAI_MODEL_ID", `invalid role "admin"`, `"oracle"`, `log level`} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Error does not mention %q: %v", expected, err)
+		}
+	}
+}
+
+func TestLoadConfigTenants(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(configFile, []byte(`{
+		"tenants": {"clinic": {"redaction": {"enabled": true, "kinds": ["cpf", "health_id"]}}}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := fakeEnv(map[string]string{
+		"CONFIG_FILE":       configFile,
+		"OPENAI_AUTH_TOKEN": "token",
+		"OPENAI_MODEL_ID":   "model",
+		"PII_REDACTION":     "false",
+	})
+
+	config, _, err := loadConfig(nil, env)
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+
+	if clinic := config.Tenant("clinic"); !clinic.Redaction.Enabled || len(clinic.Redaction.Kinds) != 2 {
+		t.Errorf("Clinic tenant is not correct: %+v", clinic)
+	}
+	if other := config.Tenant("shop"); other.Redaction.Enabled {
+		t.Errorf("Unknown tenants should use the default tenant: %+v", other)
+	}
+
+	// Tenants only override the settings they set.
+	err = os.WriteFile(configFile, []byte(`{
+		"tenants": {"default": {"budget": {"monthly": 10}}, "shop": {"budget": {"monthly": 50}}}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, err = loadConfig(nil, fakeEnv(map[string]string{"CONFIG_FILE": configFile, "OPENAI_AUTH_TOKEN": "token", "OPENAI_MODEL_ID": "model"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{defaultTenant, "shop"} {
+		if tenant := config.Tenant(id); !tenant.Redaction.Enabled || tenant.Budget.Mode != BudgetModeCheaperModel || tenant.Retention.Messages != "90d" {
+			t.Errorf("Tenant %s lost the default settings: %+v", id, tenant)
+		}
+	}
+
+	os.WriteFile(configFile, []byte(`{"tenants": {"shop": {"webhook_token": "t"}, "clinic": {"webhook_token": "t"}}}`), 0o600)
+	_, _, err = loadConfig(nil, fakeEnv(map[string]string{"CONFIG_FILE": configFile, "OPENAI_AUTH_TOKEN": "token", "OPENAI_MODEL_ID": "model"}))
+	if err == nil || !strings.Contains(err.Error(), `tenants "clinic" and "shop" share a webhook token`) {
+		t.Errorf("A shared webhook token was accepted: %v", err)
+	}
+
+	os.WriteFile(configFile, []byte(`{"tenants": null}`), 0o600)
+	config, _, err = loadConfig(nil, fakeEnv(map[string]string{"CONFIG_FILE": configFile, "OPENAI_AUTH_TOKEN": "token", "OPENAI_MODEL_ID": "model", "LLM_MONTHLY_BUDGET": "20"}))
+	if err != nil || config.Tenant(defaultTenant).Budget.Monthly != 20 {
+		t.Errorf("Null tenants were not replaced by the defaults: %v", err)
+	}
+
+	env = fakeEnv(map[string]string{
+		"OPENAI_AUTH_TOKEN":   "token",
+		"OPENAI_MODEL_ID":     "model",
+		"PII_REDACTION_KINDS": "cpf,passport",
+	})
+	if _, _, err := loadConfig(nil, env); err == nil || !strings.Contains(err.Error(), `unknown PII kind "passport"`) {
+		t.Errorf("Unknown PII kinds should be rejected: %v", err)
+	}
+}
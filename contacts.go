@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultChannel = "api"
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveContact finds the contact behind an inbound message by its channel
+// identity within the tenant, creating the contact on the first message.
+func resolveContact(ctx context.Context, repos Repositories, message *Message) (*Contact, error) {
+	if message.Tenant == "" {
+		message.Tenant = defaultTenant
+	}
+	if message.Channel == "" {
+		message.Channel = defaultChannel
+	}
+	if message.Sender == "" {
+		return nil, nil
+	}
+
+	contact, err := repos.Contacts.FindByIdentity(ctx, message.Tenant, message.Channel, message.Sender)
+	if err == nil {
+		if contact.Name == "" && message.Name != "" {
+			contact.Name = message.Name
+			err = repos.Contacts.Update(ctx, contact)
+		}
+		return contact, err
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	contact = &Contact{
+		Tenant:     message.Tenant,
+		Name:       message.Name,
+		Identities: []ContactIdentity{{Tenant: message.Tenant, Channel: message.Channel, ExternalID: message.Sender}},
+	}
+	if message.Channel == "whatsapp" {
+		contact.Phone = message.Sender
+	}
+
+	if err := repos.Contacts.Create(ctx, contact); err != nil {
+		return nil, err
+	}
+
+	return contact, nil
+}
+
+// enrichContact remembers the products and flavors the contact asked for.
+func enrichContact(ctx context.Context, repos Repositories, contact *Contact, arguments Arguments) error {
+	changed := false
+	for _, extracted := range arguments.Products {
+		item := strings.ToLower(strings.TrimSpace(extracted.Item))
+		if item != "" && !containsString(contact.PreferredProducts, item) {
+			contact.PreferredProducts = append(contact.PreferredProducts, item)
+			changed = true
+		}
+
+		flavor := strings.ToLower(strings.TrimSpace(extracted.Flavor))
+		if flavor != "" && !containsString(contact.PreferredFlavors, flavor) {
+			contact.PreferredFlavors = append(contact.PreferredFlavors, flavor)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return repos.Contacts.Update(ctx, contact)
+}
+
+// contactProfilePrompt describes what we know about the contact so the LLM
+// can personalize replies, e.g. resolve "o de sempre" to a favorite flavor.
+func contactProfilePrompt(contact *Contact) string {
+	if contact == nil {
+		return ""
+	}
+
+	var profile []string
+	if contact.Name != "" {
+		profile = append(profile, "O nome do cliente é "+contact.Name+".")
+	}
+	if len(contact.PreferredProducts) > 0 {
+		profile = append(profile, "Produtos que o cliente já pediu: "+strings.Join(contact.PreferredProducts, ", ")+".")
+	}
+	if len(contact.PreferredFlavors) > 0 {
+		profile = append(profile, "Sabores preferidos do cliente: "+strings.Join(contact.PreferredFlavors, ", ")+".")
+	}
+	if len(profile) == 0 {
+		return ""
+	}
+
+	return strings.Join(append(profile, `Se o cliente pedir "o de sempre" ou não informar o sabor, use as preferências acima.`), " ")
+}
+
+func (s *LLMService) searchContacts(c *fiber.Ctx) error {
+	contacts, err := s.repos.Contacts.Search(c.UserContext(), ContactFilter{
+		Tenant:       tenantID(c),
+		OtherTenants: s.otherTenants(),
+		Query:        c.Query("q"),
+		Tag:          c.Query("tag"),
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(contacts)
+}
+
+func (s *LLMService) getContact(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid contact ID.")
+	}
+
+	contact, err := s.repos.Contacts.Get(c.UserContext(), uint(id))
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(contact)
+}
+
+// contactUpdate holds the fields staff can edit. Nil fields are left untouched.
+type contactUpdate struct {
+	Name              *string   `json:"name"`
+	Phone             *string   `json:"phone"`
+	PreferredFlavors  *[]string `json:"preferred_flavors"`
+	PreferredProducts *[]string `json:"preferred_products"`
+	MarketingConsent  *bool     `json:"marketing_consent"`
+	DataConsent       *bool     `json:"data_consent"`
+	Tags              *[]string `json:"tags"`
+	Notes             *string   `json:"notes"`
+}
+
+func (u contactUpdate) apply(contact *Contact, now time.Time) {
+	if u.Name != nil {
+		contact.Name = *u.Name
+	}
+	if u.Phone != nil {
+		contact.Phone = *u.Phone
+	}
+	if u.PreferredFlavors != nil {
+		contact.PreferredFlavors = *u.PreferredFlavors
+	}
+	if u.PreferredProducts != nil {
+		contact.PreferredProducts = *u.PreferredProducts
+	}
+	if u.MarketingConsent != nil || u.DataConsent != nil {
+		if u.MarketingConsent != nil {
+			contact.MarketingConsent = *u.MarketingConsent
+		}
+		if u.DataConsent != nil {
+			contact.DataConsent = *u.DataConsent
+		}
+		contact.ConsentUpdatedAt = &now
+	}
+	if u.Tags != nil {
+		contact.Tags = *u.Tags
+	}
+	if u.Notes != nil {
+		contact.Notes = *u.Notes
+	}
+}
+
+func (s *LLMService) updateContact(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid contact ID.")
+	}
+
+	update := new(contactUpdate)
+	if err := c.BodyParser(update); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	ctx := c.UserContext()
+	contact, err := s.repos.Contacts.Get(ctx, uint(id))
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	update.apply(contact, time.Now())
+
+	if err := s.repos.Contacts.Update(ctx, contact); err != nil {
+		slog.ErrorContext(ctx, "update contact failed", "contact_id", contact.ID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(contact)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestResolveAndEnrichContact(t *testing.T) {
+	ctx := context.Background()
+	repos := newMemoryRepositories()
+
+	message := &Message{Content: "oi", Channel: "whatsapp", Sender: "+5511999999999", Name: "Ana"}
+	contact, err := resolveContact(ctx, repos, message)
+	if err != nil {
+		t.Fatalf("Error resolving contact: %v", err)
+	}
+	if contact.Name != "Ana" || contact.Phone != "+5511999999999" {
+		t.Errorf("Contact is not correct: %+v", contact)
+	}
+
+	again, err := resolveContact(ctx, repos, &Message{Channel: "whatsapp", Sender: "+5511999999999"})
+	if err != nil || again.ID != contact.ID {
+		t.Errorf("Contact was not found again: %+v, %v", again, err)
+	}
+
+	other, err := resolveContact(ctx, repos, &Message{Tenant: "loja-2", Channel: "whatsapp", Sender: "+5511999999999"})
+	if err != nil || other.ID == contact.ID || other.Tenant != "loja-2" {
+		t.Errorf("Contact of another tenant was reused: %+v, %v", other, err)
+	}
+
+	arguments := Arguments{Products: []ExtractedProduct{{Item: "Juice", Flavor: "Morango", Quantity: 1}}}
+	if err := enrichContact(ctx, repos, contact, arguments); err != nil {
+		t.Fatalf("Error enriching contact: %v", err)
+	}
+
+	stored, _ := repos.Contacts.Get(ctx, contact.ID)
+	if !containsString(stored.PreferredFlavors, "morango") || !containsString(stored.PreferredProducts, "juice") {
+		t.Errorf("Contact preferences are not correct: %+v", stored)
+	}
+
+	profile := contactProfilePrompt(stored)
+	if !strings.Contains(profile, "Ana") || !strings.Contains(profile, "morango") {
+		t.Errorf("Contact profile is not correct: %s", profile)
+	}
+}
+
+func TestResolveContactWithoutSender(t *testing.T) {
+	contact, err := resolveContact(context.Background(), newMemoryRepositories(), &Message{Content: "oi"})
+	if contact != nil || err != nil {
+		t.Errorf("Anonymous message resolved to a contact: %+v, %v", contact, err)
+	}
+}
+
+func TestGormContactSearch(t *testing.T) {
+	ctx := context.Background()
+	repos := newGormRepositories(newTestDB(t, &Contact{}, &ContactIdentity{}), nil)
+
+	repos.Contacts.Create(ctx, &Contact{Name: "Ana", Tags: []string{"vip", "pods"}, Identities: []ContactIdentity{{Tenant: defaultTenant, Channel: "whatsapp", ExternalID: "1"}}})
+	repos.Contacts.Create(ctx, &Contact{Name: "Bruno", Tags: []string{"vipx"}})
+	repos.Contacts.Create(ctx, &Contact{Name: "Carla 100% pods", Tags: []string{"v_p"}})
+
+	contacts, err := repos.Contacts.Search(ctx, ContactFilter{Tag: "vip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0].Name != "Ana" || len(contacts[0].Identities) != 1 {
+		t.Errorf("Contacts found by tag are not correct: %+v", contacts)
+	}
+
+	// Wildcards in the query and the tag are matched literally.
+	if contacts, _ := repos.Contacts.Search(ctx, ContactFilter{Tag: "v_p"}); len(contacts) != 1 || contacts[0].Name != "Carla 100% pods" {
+		t.Errorf("Tag wildcard was not escaped: %+v", contacts)
+	}
+	if contacts, _ := repos.Contacts.Search(ctx, ContactFilter{Query: "100%"}); len(contacts) != 1 || contacts[0].Name != "Carla 100% pods" {
+		t.Errorf("Query wildcard was not escaped: %+v", contacts)
+	}
+	if contacts, _ := repos.Contacts.Search(ctx, ContactFilter{Query: "_"}); len(contacts) != 0 {
+		t.Errorf("Query wildcard matched every contact: %+v", contacts)
+	}
+
+	contact, err := repos.Contacts.FindByIdentity(ctx, defaultTenant, "whatsapp", "1")
+	if err != nil || contact.Name != "Ana" {
+		t.Errorf("Contact found by identity is not correct: %+v, %v", contact, err)
+	}
+	if _, err := repos.Contacts.FindByIdentity(ctx, "loja-2", "whatsapp", "1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Contact was found in another tenant: %v", err)
+	}
+}
+
+func TestSearchContactsByTenant(t *testing.T) {
+	ctx := context.Background()
+	s, _, _, _ := newTestService(t, time.Now())
+	s.repos = newGormRepositories(s.db, nil)
+	s.config.Tenants["loja-2"] = TenantConfig{}
+	s.repos.Contacts.Create(ctx, &Contact{Tenant: defaultTenant, Name: "Ana"})
+	s.repos.Contacts.Create(ctx, &Contact{Tenant: "loja-2", Name: "Ana Paula"})
+
+	app := fiber.New()
+	app.Get("/contacts", s.searchContacts)
+	search := func(tenant string) []Contact {
+		req := httptest.NewRequest("GET", "/contacts?q=Ana", nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant-ID", tenant)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var contacts []Contact
+		json.NewDecoder(resp.Body).Decode(&contacts)
+		return contacts
+	}
+
+	if contacts := search(""); len(contacts) != 1 || contacts[0].Name != "Ana" {
+		t.Errorf("Default tenant contacts are not correct: %+v", contacts)
+	}
+	if contacts := search("loja-2"); len(contacts) != 1 || contacts[0].Name != "Ana Paula" {
+		t.Errorf("Other tenant contacts are not correct: %+v", contacts)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/arthurborgesdev/relationship-bot/pii"
+	"github.com/arthurborgesdev/relationship-bot/vectordb"
+	openai "github.com/sashabaranov/go-openai"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// JobKindSummarizeConversation folds the older turns of a contact's
+// conversation into its summary.
+const JobKindSummarizeConversation = "summarize_conversation"
+
+// ConversationSummary is the rolling summary of a contact's conversation, up
+// to and including the message ThroughMessageID. The summary is encrypted
+// like messages.
+type ConversationSummary struct {
+	gorm.Model
+	Tenant           string `json:"tenant" gorm:"index"`
+	ContactID        uint   `json:"contact_id" gorm:"uniqueIndex"`
+	Summary          string `json:"summary"`
+	ThroughMessageID uint   `json:"through_message_id"`
+	Tokens           int    `json:"tokens"`
+}
+
+// MemoryStore retrieves the past messages of a contact most similar to a text.
+type MemoryStore interface {
+	Memories(ctx context.Context, tenant string, contactID uint, text string, limit int) ([]vectordb.Record, error)
+}
+
+type vaultKey struct{}
+
+// withVault makes the vault of the turn available to the prompt builders, so
+// the history is redacted with the same placeholders as the message.
+func withVault(ctx context.Context, vault *pii.Vault) context.Context {
+	return context.WithValue(ctx, vaultKey{}, vault)
+}
+
+func vaultFrom(ctx context.Context) *pii.Vault {
+	if vault, ok := ctx.Value(vaultKey{}).(*pii.Vault); ok {
+		return vault
+	}
+	return pii.NewVault()
+}
+
+// conversationSummary returns the contact's summary, or nil when the
+// conversation was never summarized.
+func (s *LLMService) conversationSummary(ctx context.Context, contactID uint) (*ConversationSummary, error) {
+	var summaries []ConversationSummary
+	err := s.db.WithContext(ctx).Where("contact_id = ?", contactID).Limit(1).Find(&summaries).Error
+	if err != nil || len(summaries) == 0 {
+		return nil, err
+	}
+	summary := &summaries[0]
+	if summary.Summary, err = s.crypter.Decrypt(ctx, summary.Summary); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// conversationContext returns the messages giving the LLM the context of the
+// conversation with the contact, to put before the new message: the summary
+// of the older turns, the past messages most similar to content and the
+// most recent turns, as many as fit in the token budget. Everything is
+// redacted with the vault of the turn.
+func (s *LLMService) conversationContext(ctx context.Context, contact *Contact, content string) []openai.ChatCompletionMessage {
+	if contact == nil {
+		return nil
+	}
+	vault := vaultFrom(ctx)
+	policy := s.config.Tenant(contact.Tenant).Redaction
+	budget := &tokenBudget{remaining: s.config.Context.MaxTokens}
+
+	var history []openai.ChatCompletionMessage
+	var through uint
+	summary, err := s.conversationSummary(ctx, contact.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "load conversation summary failed", "contact_id", contact.ID, "error", err)
+	}
+	if summary != nil {
+		through = summary.ThroughMessageID
+		message := openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: "Resumo da conversa com o cliente até aqui:\n" + vault.Redact(policy, summary.Summary),
+		}
+		if budget.take(message) {
+			history = append(history, message)
+		}
+	}
+
+	messages, err := s.repos.Messages.ListByContactAfter(ctx, contact.ID, through)
+	if err != nil {
+		slog.ErrorContext(ctx, "load recent messages failed", "contact_id", contact.ID, "error", err)
+	}
+
+	// A quarter of the budget is kept for the memories.
+	reserved := 0
+	if s.memories != nil && s.config.Context.Memories > 0 {
+		reserved = budget.remaining / 4
+	}
+	budget.remaining -= reserved
+	var recent []openai.ChatCompletionMessage
+	seen := map[string]bool{}
+	for i := len(messages) - 1; i >= 0; i-- {
+		message := openai.ChatCompletionMessage{Role: messages[i].Role, Content: vault.Redact(policy, messages[i].Content)}
+		if !budget.take(message) {
+			break
+		}
+		recent = append([]openai.ChatCompletionMessage{message}, recent...)
+		seen[message.Content] = true
+	}
+	budget.remaining += reserved
+
+	if reserved > 0 {
+		records, err := s.memories.Memories(ctx, contact.Tenant, contact.ID, vault.Redact(policy, content), s.config.Context.Memories)
+		if err != nil {
+			slog.ErrorContext(ctx, "retrieve memories failed", "contact_id", contact.ID, "error", err)
+		}
+		var lines []string
+		for _, record := range records {
+			if seen[record.Message] {
+				continue
+			}
+			lines = append(lines, "- "+record.Message)
+		}
+		for len(lines) > 0 {
+			message := openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: "Mensagens anteriores do cliente relacionadas:\n" + strings.Join(lines, "\n"),
+			}
+			if budget.take(message) {
+				history = append(history, message)
+				break
+			}
+			lines = lines[:len(lines)-1]
+		}
+	}
+
+	return append(history, recent...)
+}
+
+// scheduleSummary schedules the summarization of the contact's conversation
+// once the turns not summarized yet exceed the budget.
+func (s *LLMService) scheduleSummary(ctx context.Context, contactID uint) error {
+	var through uint
+	summary, err := s.conversationSummary(ctx, contactID)
+	if err != nil {
+		return err
+	}
+	if summary != nil {
+		through = summary.ThroughMessageID
+	}
+	messages, err := s.repos.Messages.ListByContactAfter(ctx, contactID, through)
+	if err != nil {
+		return err
+	}
+	if countMessageTokens(chatMessages(messages)) <= s.config.Context.SummarizeAfter {
+		return nil
+	}
+
+	var pending int64
+	err = s.db.WithContext(ctx).Model(&Job{}).
+		Where("kind = ? AND contact_id = ? AND status = ?", JobKindSummarizeConversation, contactID, JobStatusPending).
+		Count(&pending).Error
+	if err != nil || pending > 0 {
+		return err
+	}
+	return s.scheduler.Schedule(ctx, &Job{Kind: JobKindSummarizeConversation, RunAt: s.scheduler.now(), ContactID: contactID})
+}
+
+func (s *LLMService) runSummaryJob(ctx context.Context, job *Job) error {
+	_, err := s.summarizeConversation(ctx, job.ContactID)
+	return err
+}
+
+// summarizeConversation folds every turn but the newest RecentTokens into
+// the contact's summary, when the turns not summarized yet exceed the
+// budget. It reports whether the summary was updated.
+func (s *LLMService) summarizeConversation(ctx context.Context, contactID uint) (bool, error) {
+	contact, err := s.repos.Contacts.Get(ctx, contactID)
+	if err != nil {
+		return false, err
+	}
+	summary, err := s.conversationSummary(ctx, contactID)
+	if err != nil {
+		return false, err
+	}
+	if summary == nil {
+		summary = &ConversationSummary{Tenant: contact.Tenant, ContactID: contactID}
+	}
+
+	messages, err := s.repos.Messages.ListByContactAfter(ctx, contactID, summary.ThroughMessageID)
+	if err != nil {
+		return false, err
+	}
+	if countMessageTokens(chatMessages(messages)) <= s.config.Context.SummarizeAfter {
+		return false, nil
+	}
+
+	// The newest turns stay verbatim in the prompts.
+	keep, recent := 0, 0
+	for i := len(messages) - 1; i > 0; i-- {
+		recent += tokensPerMessage + countTokens(messages[i].Content)
+		if recent > s.config.Context.RecentTokens {
+			break
+		}
+		keep++
+	}
+	fold := messages[:len(messages)-keep]
+
+	vault := pii.NewVault()
+	policy := s.config.Tenant(contact.Tenant).Redaction
+	var transcript strings.Builder
+	for _, message := range fold {
+		speaker := "Cliente"
+		if message.Role == openai.ChatMessageRoleAssistant {
+			speaker = "Atendente"
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n", speaker, vault.Redact(policy, message.Content))
+	}
+	previous := "(nenhum)"
+	if summary.Summary != "" {
+		previous = vault.Redact(policy, summary.Summary)
+	}
+
+	ctx = withUsageScope(ctx, usageScope{Tenant: contact.Tenant, ContactID: contactID})
+	resp, err := s.llm.complete(ctx, "summary", openai.ChatCompletionRequest{
+		MaxTokens: s.config.Context.SummaryTokens,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: `Você resume conversas de atendimento de uma loja. Atualize o resumo anterior com as novas mensagens,
+			em português, em poucas frases. Mantenha o que importa para continuar o atendimento: pedidos, produtos, sabores,
+			quantidades, datas e horários de retirada, preferências, reclamações e pendências. Não invente nada.`},
+			{Role: openai.ChatMessageRoleUser, Content: "Resumo anterior:\n" + previous + "\n\nNovas mensagens:\n" + transcript.String()},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	text := vault.Restore(strings.TrimSpace(resp.Choices[0].Message.Content))
+	sealed, err := s.crypter.Encrypt(ctx, text)
+	if err != nil {
+		return false, err
+	}
+	summary.Summary = sealed
+	summary.ThroughMessageID = fold[len(fold)-1].ID
+	summary.Tokens = countTokens(text)
+	// Another run may have stored the contact's first summary meanwhile: the
+	// newest one wins instead of failing on the unique contact.
+	upsert := clause.OnConflict{
+		Columns:   []clause.Column{{Name: "contact_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "summary", "through_message_id", "tokens"}),
+	}
+	if err := s.db.WithContext(ctx).Clauses(upsert).Save(summary).Error; err != nil {
+		return false, err
+	}
+
+	slog.InfoContext(ctx, "conversation summarized", "contact_id", contactID, "messages", len(fold), "summary_tokens", summary.Tokens)
+	return true, nil
+}
+
+func chatMessages(messages []Message) []openai.ChatCompletionMessage {
+	chat := make([]openai.ChatCompletionMessage, len(messages))
+	for i, message := range messages {
+		chat[i] = openai.ChatCompletionMessage{Role: message.Role, Content: message.Content}
+	}
+	return chat
+}
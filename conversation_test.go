@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/pii"
+	"github.com/arthurborgesdev/relationship-bot/vectordb"
+	openai "github.com/sashabaranov/go-openai"
+	"gorm.io/gorm"
+)
+
+func TestCountTokens(t *testing.T) {
+	// Counts from OpenAI's tiktoken for cl100k_base.
+	for text, expected := range map[string]int{
+		"": 0,
+		"The quick brown fox jumps over the lazy dog.": 10,
+		"tiktoken is great!":                           6,
+		"antidisestablishmentarianism":                 6,
+		"2 + 2 = 4":                                    7,
+		"お誕生日おめでとう":                                    9,
+		"12345":                                        2,
+	} {
+		if tokens := countTokens(text); tokens != expected {
+			t.Errorf("countTokens(%q) = %d, expected %d", text, tokens, expected)
+		}
+	}
+
+	short := countMessageTokens([]openai.ChatCompletionMessage{{Role: "user", Content: "oi"}})
+	long := countMessageTokens([]openai.ChatCompletionMessage{{Role: "user", Content: "oi"}, {Role: "assistant", Content: "Olá! Tudo bem?"}})
+	if short != tokensPerReply+tokensPerMessage+countTokens("user")+countTokens("oi") || long <= short {
+		t.Errorf("Message tokens are not correct: %d, %d", short, long)
+	}
+}
+
+type fakeMemories struct {
+	records []vectordb.Record
+	queries []string
+}
+
+func (f *fakeMemories) Memories(ctx context.Context, tenant string, contactID uint, text string, limit int) ([]vectordb.Record, error) {
+	f.queries = append(f.queries, text)
+	if len(f.records) > limit {
+		return f.records[:limit], nil
+	}
+	return f.records, nil
+}
+
+func TestConversationSummary(t *testing.T) {
+	s, clock, _, _ := newTestService(t, time.Now())
+	s.config.Context = ContextConfig{MaxTokens: 120, SummarizeAfter: 100, RecentTokens: 30, SummaryTokens: 50, Memories: 2}
+	completer := &fakeCompleter{reply: "Cliente pediu 3 pods de morango, retirada amanhã às 10h."}
+	s.llm = newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: completer})
+	ctx := context.Background()
+
+	contact := &Contact{Name: "Ana", Tenant: defaultTenant}
+	s.repos.Contacts.Create(ctx, contact)
+	for i := 0; i < 10; i++ {
+		s.saveConversation(ctx, &Message{Content: fmt.Sprintf("mensagem número %d do cliente", i), Tenant: defaultTenant}, contact.ID, fmt.Sprintf("resposta número %d", i))
+	}
+
+	var jobs []Job
+	s.db.Where("kind = ?", JobKindSummarizeConversation).Find(&jobs)
+	if len(jobs) != 1 || jobs[0].ContactID != contact.ID {
+		t.Fatalf("One summary should be scheduled once the conversation is over budget: %+v", jobs)
+	}
+	if ran, err := s.scheduler.RunDue(ctx); err != nil || ran != 1 {
+		t.Fatalf("The summary job should run: %d, %v", ran, err)
+	}
+
+	summary, err := s.conversationSummary(ctx, contact.ID)
+	if err != nil || summary == nil || !strings.Contains(summary.Summary, "morango") {
+		t.Fatalf("The summary should be stored: %+v, %v", summary, err)
+	}
+	messages, _ := s.repos.Messages.ListByContactAfter(ctx, contact.ID, summary.ThroughMessageID)
+	if len(messages) == 0 || countMessageTokens(chatMessages(messages)) > s.config.Context.SummarizeAfter {
+		t.Errorf("The newest turns should be left out of the summary: %d", len(messages))
+	}
+	if folded, _ := s.summarizeConversation(ctx, contact.ID); folded {
+		t.Error("A conversation within budget should not be summarized again")
+	}
+
+	memories := &fakeMemories{records: []vectordb.Record{{Message: "prefiro sabor menta"}, {Message: messages[len(messages)-1].Content}}}
+	s.memories = memories
+	history := s.conversationContext(ctx, contact, "quero o de sempre")
+	if len(history) < 3 || !strings.Contains(history[0].Content, "morango") {
+		t.Fatalf("The prompt should start with the summary: %+v", history)
+	}
+	if !strings.Contains(history[1].Content, "menta") || strings.Count(history[1].Content, "\n- ") != 1 {
+		t.Errorf("Memories not in the recent turns should follow the summary: %q", history[1].Content)
+	}
+	if last := history[len(history)-1]; last.Content != messages[len(messages)-1].Content {
+		t.Errorf("The prompt should end with the newest turn: %+v", last)
+	}
+	if tokens := countMessageTokens(history); tokens > s.config.Context.MaxTokens+tokensPerReply {
+		t.Errorf("The history should fit in the budget: %d", tokens)
+	}
+	if len(memories.queries) != 1 || memories.queries[0] != "quero o de sempre" {
+		t.Errorf("Memories should be retrieved for the message: %v", memories.queries)
+	}
+}
+
+// racingCompleter stores a summary of the contact while it answers, like a
+// concurrent run of the summary job would.
+type racingCompleter struct {
+	*fakeCompleter
+	db        *gorm.DB
+	contactID uint
+}
+
+func (r *racingCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	r.db.Create(&ConversationSummary{Tenant: defaultTenant, ContactID: r.contactID, Summary: "resumo da outra execução"})
+	return r.fakeCompleter.CreateChatCompletion(ctx, request)
+}
+
+func TestConcurrentConversationSummaries(t *testing.T) {
+	s, clock, _, _ := newTestService(t, time.Now())
+	s.config.Context = ContextConfig{MaxTokens: 120, SummarizeAfter: 100, RecentTokens: 30, SummaryTokens: 50, Memories: 2}
+	ctx := context.Background()
+
+	contact := &Contact{Name: "Ana", Tenant: defaultTenant}
+	s.repos.Contacts.Create(ctx, contact)
+	for i := 0; i < 15; i++ {
+		s.repos.Messages.Create(ctx, &Message{Content: fmt.Sprintf("mensagem número %d do cliente", i), Tenant: defaultTenant, ContactID: contact.ID})
+	}
+	completer := &racingCompleter{fakeCompleter: &fakeCompleter{reply: "Cliente quer pods de morango."}, db: s.db, contactID: contact.ID}
+	s.llm = newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: completer})
+
+	if folded, err := s.summarizeConversation(ctx, contact.ID); err != nil || !folded {
+		t.Fatalf("The summary was not stored over the concurrent one: %v, %v", folded, err)
+	}
+	var summaries []ConversationSummary
+	s.db.Find(&summaries)
+	if len(summaries) != 1 || !strings.Contains(summaries[0].Summary, "morango") || summaries[0].ThroughMessageID == 0 {
+		t.Errorf("Summaries are not correct: %+v", summaries)
+	}
+}
+
+func TestConversationContextRedactsHistory(t *testing.T) {
+	s, _, _, _ := newTestService(t, time.Now())
+	tenant := s.config.Tenants[defaultTenant]
+	tenant.Redaction = pii.Policy{Enabled: true}
+	s.config.Tenants[defaultTenant] = tenant
+	ctx := context.Background()
+
+	contact := &Contact{Name: "Ana", Tenant: defaultTenant}
+	s.repos.Contacts.Create(ctx, contact)
+	s.saveConversation(ctx, &Message{Content: "meu email é ana@example.com", Tenant: defaultTenant}, contact.ID, "Anotado!")
+
+	vault := pii.NewVault()
+	content := vault.Redact(tenant.Redaction, "manda para ana@example.com")
+	history := s.conversationContext(withVault(ctx, vault), contact, content)
+	if len(history) != 2 || strings.Contains(history[0].Content, "ana@example.com") {
+		t.Fatalf("The history should be redacted: %+v", history)
+	}
+	if !strings.Contains(content, strings.TrimPrefix(history[0].Content, "meu email é ")) {
+		t.Errorf("The history should use the placeholders of the turn: %q, %q", history[0].Content, content)
+	}
+}
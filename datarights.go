@@ -0,0 +1,570 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/vectordb"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// VectorStore is the part of the vector database that holds personal data.
+type VectorStore interface {
+	ContactVectors(ctx context.Context, contactID uint) ([]vectordb.Record, error)
+	DeleteContactVectors(ctx context.Context, contactID uint) (int, error)
+	PurgeVectors(ctx context.Context, filter vectordb.PurgeFilter) (int, error)
+}
+
+const (
+	DataRequestExport  = "export"
+	DataRequestErasure = "erasure"
+)
+
+// DataRequest records an LGPD data subject request. Records form a hash
+// chain: each Hash covers the record and the previous Hash, so editing or
+// deleting a record breaks verification of every record after it.
+type DataRequest struct {
+	gorm.Model
+	ContactID  uint      `json:"contact_id" gorm:"index"`
+	Kind       string    `json:"kind"`
+	Actor      string    `json:"actor"`
+	Summary    string    `json:"summary"`
+	Digest     string    `json:"digest"`
+	RecordedAt time.Time `json:"recorded_at"`
+	PrevHash   string    `json:"prev_hash"`
+	Hash       string    `json:"hash"`
+}
+
+func (r *DataRequest) computeHash() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%s|%s|%s|%s|%d",
+		r.PrevHash, r.ContactID, r.Kind, r.Actor, r.Summary, r.Digest, r.RecordedAt.Unix())))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordDataRequest appends the request to the chain. Appends are serialized
+// so two requests never link to the same head: Postgres locks the table, as a
+// locking read neither blocks the first record nor sees a head committed while
+// it waited; MySQL's locking read also locks the gap after the head; SQLite
+// has a single writer.
+func (s *LLMService) recordDataRequest(ctx context.Context, request *DataRequest) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if tx.Dialector.Name() == "postgres" {
+			if err := tx.Exec("LOCK TABLE data_requests IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+				return err
+			}
+		}
+
+		var last DataRequest
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Order("id desc").First(&last).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		request.PrevHash = last.Hash
+		request.RecordedAt = s.scheduler.now().UTC().Truncate(time.Second)
+		request.Hash = request.computeHash()
+		return tx.Create(request).Error
+	})
+}
+
+// verifyDataRequests walks the chain and returns the ID of the first record
+// that does not match, or 0 when the chain is intact.
+func verifyDataRequests(db *gorm.DB) (uint, int, error) {
+	var requests []DataRequest
+	if err := db.Order("id").Find(&requests).Error; err != nil {
+		return 0, 0, err
+	}
+
+	prev := ""
+	for _, request := range requests {
+		if request.PrevHash != prev || request.computeHash() != request.Hash {
+			return request.ID, len(requests), nil
+		}
+		prev = request.Hash
+	}
+
+	return 0, len(requests), nil
+}
+
+type Appointment struct {
+	OrderID         uint      `json:"order_id"`
+	CalendarEventID string    `json:"calendar_event_id"`
+	Start           time.Time `json:"start"`
+	Status          string    `json:"status"`
+}
+
+// ContactExport is everything stored about a contact.
+type ContactExport struct {
+	Contact      *Contact          `json:"contact"`
+	Messages     []Message         `json:"messages"`
+	Orders       []Order           `json:"orders"`
+	Appointments []Appointment     `json:"appointments"`
+	Vectors      []vectordb.Record `json:"vectors"`
+	// Summary is the summary of the older turns of the conversation.
+	Summary   *ConversationSummary `json:"summary"`
+	Waitlist  []WaitlistEntry      `json:"waitlist"`
+	Campaigns []CampaignRecipient  `json:"campaigns"`
+	Usage     []LLMUsage           `json:"usage"`
+	// Queued are the messages still waiting to be answered, DeadLetters the
+	// ones that kept failing.
+	Queued      []Message `json:"queued"`
+	DeadLetters []Message `json:"dead_letters"`
+	// Responses are the responses kept to answer redelivered requests.
+	Responses []StoredResponse `json:"responses"`
+}
+
+// StoredResponse is the decrypted response of an idempotency record.
+type StoredResponse struct {
+	CreatedAt time.Time       `json:"created_at"`
+	Status    int             `json:"status"`
+	Body      json.RawMessage `json:"body,omitempty"`
+}
+
+func (s *LLMService) exportContact(ctx context.Context, contactID uint) (*ContactExport, error) {
+	contact, err := s.repos.Contacts.Get(ctx, contactID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &ContactExport{Contact: contact, Appointments: []Appointment{}, Vectors: []vectordb.Record{}}
+
+	if export.Messages, err = s.repos.Messages.ListByContact(ctx, contactID); err != nil {
+		return nil, err
+	}
+	if export.Orders, err = s.repos.Orders.ListByContact(ctx, contactID); err != nil {
+		return nil, err
+	}
+	if export.Summary, err = s.conversationSummary(ctx, contactID); err != nil {
+		return nil, err
+	}
+
+	db := s.db.WithContext(ctx)
+	for _, rows := range []interface{}{&export.Waitlist, &export.Campaigns, &export.Usage} {
+		if err := db.Where("contact_id = ?", contactID).Order("id").Find(rows).Error; err != nil {
+			return nil, err
+		}
+	}
+	if export.Queued, export.DeadLetters, err = s.exportQueuedMessages(ctx, contact); err != nil {
+		return nil, err
+	}
+	if export.Responses, err = s.exportResponses(ctx, contactID); err != nil {
+		return nil, err
+	}
+
+	for i := range export.Orders {
+		order := &export.Orders[i]
+		pickup, ok := pickupTime(order, s.config.Reminders.DefaultPickupTime, s.config.Location())
+		if !ok {
+			continue
+		}
+		export.Appointments = append(export.Appointments, Appointment{OrderID: order.ID, CalendarEventID: order.CalendarEventID, Start: pickup, Status: order.Status})
+	}
+
+	if s.vectors != nil {
+		vectors, err := s.vectors.ContactVectors(ctx, contactID)
+		if err != nil {
+			return nil, fmt.Errorf("exporting vectors: %w", err)
+		}
+		export.Vectors = append(export.Vectors, vectors...)
+	}
+
+	return export, nil
+}
+
+// exportQueuedMessages returns the contact's messages in the inbound queue
+// and the dead letters, plus the ones queued while the LLM was down.
+func (s *LLMService) exportQueuedMessages(ctx context.Context, contact *Contact) ([]Message, []Message, error) {
+	queued, dead := []Message{}, []Message{}
+	if s.inbound != nil {
+		for _, identity := range contact.Identities {
+			inbound, letters, err := s.inbound.SenderMessages(ctx, identity.Channel, identity.ExternalID)
+			if err != nil {
+				return nil, nil, fmt.Errorf("exporting queued messages: %w", err)
+			}
+			queued = append(queued, inbound...)
+			dead = append(dead, letters...)
+		}
+	}
+
+	var jobs []Job
+	err := s.db.WithContext(ctx).Where("contact_id = ? AND kind = ?", contact.ID, JobKindQueuedMessage).Order("id").Find(&jobs).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, job := range jobs {
+		payload, err := s.crypter.Decrypt(ctx, job.Payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		var message Message
+		if err := json.Unmarshal([]byte(payload), &message); err != nil {
+			return nil, nil, err
+		}
+		queued = append(queued, message)
+	}
+	return queued, dead, nil
+}
+
+// exportResponses returns the stored responses of the contact's requests.
+func (s *LLMService) exportResponses(ctx context.Context, contactID uint) ([]StoredResponse, error) {
+	var records []IdempotencyRecord
+	if err := s.db.WithContext(ctx).Where("contact_id = ?", contactID).Order("id").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	responses := make([]StoredResponse, 0, len(records))
+	for _, record := range records {
+		response := StoredResponse{CreatedAt: record.CreatedAt, Status: record.ResponseStatus}
+		if record.ResponseBody != "" {
+			body, err := s.crypter.Decrypt(ctx, record.ResponseBody)
+			if err != nil {
+				return nil, err
+			}
+			response.Body = json.RawMessage(body)
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// files splits the export into one JSON document per kind of data and a
+// manifest with the SHA-256 of each document. The manifest digest is what
+// the audit record keeps.
+func (e *ContactExport) files(exportedAt time.Time) (map[string][]byte, string, error) {
+	sections := map[string]interface{}{
+		"contact.json":      e.Contact,
+		"messages.json":     e.Messages,
+		"orders.json":       e.Orders,
+		"appointments.json": e.Appointments,
+		"vectors.json":      e.Vectors,
+		"summary.json":      e.Summary,
+		"waitlist.json":     e.Waitlist,
+		"campaigns.json":    e.Campaigns,
+		"usage.json":        e.Usage,
+		"queued.json":       e.Queued,
+		"dead_letters.json": e.DeadLetters,
+		"responses.json":    e.Responses,
+	}
+
+	files := map[string][]byte{}
+	checksums := map[string]string{}
+	for name, section := range sections {
+		data, err := json.MarshalIndent(section, "", "  ")
+		if err != nil {
+			return nil, "", err
+		}
+		sum := sha256.Sum256(data)
+		files[name] = data
+		checksums[name] = hex.EncodeToString(sum[:])
+	}
+
+	manifest, err := json.MarshalIndent(fiber.Map{
+		"contact_id":  e.Contact.ID,
+		"exported_at": exportedAt,
+		"sha256":      checksums,
+	}, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	files["manifest.json"] = manifest
+
+	sum := sha256.Sum256(manifest)
+	return files, hex.EncodeToString(sum[:]), nil
+}
+
+func zipFiles(files map[string][]byte) ([]byte, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := archive.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type ErasureReport struct {
+	Messages      int64 `json:"messages"`
+	Orders        int   `json:"orders"`
+	Appointments  int   `json:"appointments"`
+	Jobs          int64 `json:"jobs"`
+	PendingChange int64 `json:"pending_changes"`
+	Vectors       int   `json:"vectors"`
+	Inbound       int64 `json:"inbound_messages"`
+	Idempotency   int64 `json:"idempotency_records"`
+	Summaries     int64 `json:"summaries"`
+	Campaigns     int64 `json:"campaign_recipients"`
+	Waitlist      int64 `json:"waitlist_entries"`
+	Usage         int64 `json:"anonymised_usage"`
+}
+
+// eraseContact permanently deletes the contact and everything linked to it,
+// in the SQL database, the calendar and the vector store.
+func (s *LLMService) eraseContact(ctx context.Context, contactID uint) (*ErasureReport, error) {
+	contact, err := s.repos.Contacts.Get(ctx, contactID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ErasureReport{}
+
+	// Vectors go first: if the vector store is down the request fails
+	// before anything is deleted and can simply be retried.
+	if s.vectors != nil {
+		deleted, err := s.vectors.DeleteContactVectors(ctx, contactID)
+		if err != nil {
+			return nil, fmt.Errorf("erasing vectors: %w", err)
+		}
+		report.Vectors = deleted
+	}
+
+	orders, err := s.repos.Orders.ListByContact(ctx, contactID)
+	if err != nil {
+		return nil, err
+	}
+	// Events already gone, deleted by an erasure that failed later on, count
+	// as deleted so the erasure can be retried.
+	for _, order := range orders {
+		if order.CalendarEventID != "" {
+			deleted, err := deleteEvent(ctx, s.calendar, order.CalendarEventID)
+			if err != nil {
+				return nil, fmt.Errorf("deleting calendar event of order %d: %w", order.ID, err)
+			}
+			if deleted {
+				report.Appointments++
+			}
+		}
+	}
+
+	// The SQL rows go in one transaction so a failure leaves the contact
+	// whole, ready to be erased again.
+	var restocks []restock
+	err = s.transaction(ctx, func(tx *gorm.DB, repos Repositories) error {
+		for _, order := range orders {
+			// Open orders give their reserved units back before they go.
+			if order.Status == OrderStatusPending || order.Status == OrderStatusConfirmed {
+				released, err := s.releaseOrderStock(ctx, tx, repos, &order, "contact erased")
+				if err != nil {
+					return err
+				}
+				restocks = append(restocks, released...)
+			}
+			if err := repos.Orders.Delete(ctx, order.ID); err != nil {
+				return err
+			}
+			report.Orders++
+		}
+
+		for _, erased := range []struct {
+			model interface{}
+			count *int64
+		}{
+			{&Job{}, &report.Jobs},
+			{&PendingOrderChange{}, &report.PendingChange},
+			// Stored responses hold the replies sent to the contact.
+			{&IdempotencyRecord{}, &report.Idempotency},
+			{&ConversationSummary{}, &report.Summaries},
+			{&CampaignRecipient{}, &report.Campaigns},
+			{&WaitlistEntry{}, &report.Waitlist},
+		} {
+			result := tx.Unscoped().Where("contact_id = ?", contactID).Delete(erased.model)
+			if result.Error != nil {
+				return result.Error
+			}
+			*erased.count = result.RowsAffected
+		}
+
+		// Usage is kept for billing, but no longer points to the contact.
+		result := tx.Model(&LLMUsage{}).Unscoped().Where("contact_id = ?", contactID).
+			Updates(map[string]interface{}{"contact_id": 0, "correlation_id": ""})
+		if result.Error != nil {
+			return result.Error
+		}
+		report.Usage = result.RowsAffected
+
+		// The inbound queue shares the database, so it is erased in the
+		// transaction too.
+		if s.inbound != nil {
+			queue := newGormInboundQueue(tx, s.crypter)
+			for _, identity := range contact.Identities {
+				deleted, err := queue.DeleteSender(ctx, identity.Channel, identity.ExternalID)
+				if err != nil {
+					return err
+				}
+				report.Inbound += deleted
+			}
+		}
+
+		var err error
+		if report.Messages, err = repos.Messages.DeleteByContact(ctx, contactID); err != nil {
+			return err
+		}
+		return repos.Contacts.Delete(ctx, contactID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.alertRestocks(ctx, restocks)
+
+	return report, nil
+}
+
+func contactIDParam(c *fiber.Ctx) (uint, bool) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	return uint(id), err == nil && id > 0
+}
+
+// exportContactData handles GET /admin/contacts/:id/export?format=json|zip.
+func (s *LLMService) exportContactData(c *fiber.Ctx) error {
+	id, ok := contactIDParam(c)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid contact ID.")
+	}
+	ctx := c.UserContext()
+
+	export, err := s.exportContact(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	files, digest, err := export.files(s.scheduler.now())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	principal, _ := currentPrincipal(c)
+	summary, _ := json.Marshal(fiber.Map{"messages": len(export.Messages), "orders": len(export.Orders), "appointments": len(export.Appointments), "vectors": len(export.Vectors)})
+	request := &DataRequest{ContactID: id, Kind: DataRequestExport, Actor: principal.Subject, Summary: string(summary), Digest: digest}
+	if err := s.recordDataRequest(ctx, request); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set("X-Data-Request-ID", strconv.FormatUint(uint64(request.ID), 10))
+	c.Set("X-Export-Digest", digest)
+
+	if c.Query("format", "json") == "zip" {
+		archive, err := zipFiles(files)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		c.Set(fiber.HeaderContentType, "application/zip")
+		c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="contact-%d.zip"`, id))
+		return c.Send(archive)
+	}
+
+	// The JSON export holds the same documents as the archive, so every
+	// section listed in the manifest is in it.
+	body := fiber.Map{"request": request}
+	for name, data := range files {
+		body[strings.TrimSuffix(name, ".json")] = json.RawMessage(data)
+	}
+	return c.JSON(body)
+}
+
+// eraseContactData handles DELETE /admin/contacts/:id.
+func (s *LLMService) eraseContactData(c *fiber.Ctx) error {
+	id, ok := contactIDParam(c)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid contact ID.")
+	}
+	ctx := c.UserContext()
+
+	report, err := s.eraseContact(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "erase contact failed", "contact_id", id, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	principal, _ := currentPrincipal(c)
+	summary, _ := json.Marshal(report)
+	sum := sha256.Sum256(summary)
+	request := &DataRequest{ContactID: id, Kind: DataRequestErasure, Actor: principal.Subject, Summary: string(summary), Digest: hex.EncodeToString(sum[:])}
+	if err := s.recordDataRequest(ctx, request); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"request": request,
+		"erased":  report,
+	})
+}
+
+func (s *LLMService) getDataRequests(c *fiber.Ctx) error {
+	query := s.db.Order("id desc").Limit(c.QueryInt("limit", 100))
+	if contactID := c.QueryInt("contact_id"); contactID > 0 {
+		query = query.Where("contact_id = ?", contactID)
+	}
+
+	var requests []DataRequest
+	if err := query.Find(&requests).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(requests)
+}
+
+func (s *LLMService) verifyDataRequests(c *fiber.Ctx) error {
+	brokenAt, count, err := verifyDataRequests(s.db.WithContext(c.UserContext()))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	result := fiber.Map{"valid": brokenAt == 0, "records": count}
+	if brokenAt != 0 {
+		result["broken_at"] = brokenAt
+	}
+	return c.JSON(result)
+}
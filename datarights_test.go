@@ -0,0 +1,266 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/vectordb"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+type fakeVectorStore struct {
+	records map[uint][]vectordb.Record
+}
+
+func (f *fakeVectorStore) ContactVectors(ctx context.Context, contactID uint) ([]vectordb.Record, error) {
+	return f.records[contactID], nil
+}
+
+func (f *fakeVectorStore) DeleteContactVectors(ctx context.Context, contactID uint) (int, error) {
+	deleted := len(f.records[contactID])
+	delete(f.records, contactID)
+	return deleted, nil
+}
+
+func (f *fakeVectorStore) PurgeVectors(ctx context.Context, filter vectordb.PurgeFilter) (int, error) {
+	return 0, nil
+}
+
+func newDataRightsFixture(t *testing.T) (*LLMService, *fakeCalendar, *Contact) {
+	ctx := context.Background()
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	s, _, _, calendar := newTestService(t, time.Date(2023, 8, 9, 9, 0, 0, 0, location))
+
+	contact := &Contact{Tenant: defaultTenant, Name: "Ana", Identities: []ContactIdentity{{Tenant: defaultTenant, Channel: "whatsapp", ExternalID: "+5511999999999"}}}
+	if err := s.repos.Contacts.Create(ctx, contact); err != nil {
+		t.Fatal(err)
+	}
+	other := &Contact{Name: "Bia"}
+	if err := s.repos.Contacts.Create(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	s.vectors = &fakeVectorStore{records: map[uint][]vectordb.Record{
+		contact.ID: {{ID: 10, Message: "quero 2 pods de menta", Sender: "user"}},
+	}}
+
+	s.repos.Messages.Create(ctx, &Message{Content: "quero 2 pods de menta", ContactID: contact.ID})
+	s.repos.Messages.Create(ctx, &Message{Content: "oi", ContactID: other.ID})
+
+	order := &Order{ContactID: contact.ID, Status: OrderStatusPending, PickupDate: "2023-08-10", PickupTime: "14:00",
+		Items: []OrderItem{{Item: "pod", Flavor: "menta", Quantity: 2}}}
+	if err := s.repos.Orders.Create(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.scheduleOrderFollowUps(ctx, order, contact); err != nil {
+		t.Fatal(err)
+	}
+	s.db.Create(&ConversationSummary{Tenant: defaultTenant, ContactID: contact.ID, Summary: "Ana prefere pods de menta."})
+	s.db.Create(&LLMUsage{Tenant: defaultTenant, ContactID: contact.ID, Operation: "chat", Cost: 0.01, CorrelationID: "req-1"})
+
+	return s, calendar, contact
+}
+
+func TestExportContact(t *testing.T) {
+	ctx := context.Background()
+	s, _, contact := newDataRightsFixture(t)
+	s.inbound = newGormInboundQueue(s.db, s.crypter)
+	s.db.Create(&WaitlistEntry{Tenant: defaultTenant, ContactID: contact.ID, Product: "pod", Flavor: "menta", Status: WaitlistStatusWaiting})
+	s.db.Create(&CampaignRecipient{CampaignID: 1, ContactID: contact.ID, Channel: "whatsapp", Status: "sent"})
+	s.inbound.Enqueue(ctx, &Message{Content: "ainda na fila", Channel: "whatsapp", Sender: "+5511999999999"}, time.Now())
+	s.inbound.BuryMessage(ctx, &Message{Content: "falhou", Channel: "whatsapp", Sender: "+5511999999999"}, 3, time.Now(), errors.New("boom"))
+	if err := s.queueMessage(ctx, &Message{Content: "durante a queda", Channel: "whatsapp", Sender: "+5511999999999"}); err != nil {
+		t.Fatal(err)
+	}
+	record, _, _ := s.beginRequest(ctx, "k", defaultTenant, time.Now())
+	s.finishRequest(ctx, record, fiber.StatusOK, fiber.Map{"reply": "Olá, Ana!"}, contact.ID)
+
+	export, err := s.exportContact(ctx, contact.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Messages) != 1 || len(export.Orders) != 1 || len(export.Appointments) != 1 || len(export.Vectors) != 1 {
+		t.Errorf("Export is not complete: %+v", export)
+	}
+	if len(export.Waitlist) != 1 || len(export.Campaigns) != 1 || len(export.Usage) != 1 {
+		t.Errorf("Export misses waitlist, campaigns or usage: %+v", export)
+	}
+	if len(export.Queued) != 2 || export.Queued[0].Content != "ainda na fila" || export.Queued[1].Content != "durante a queda" ||
+		len(export.DeadLetters) != 1 || export.DeadLetters[0].Content != "falhou" {
+		t.Errorf("Export misses queued messages: %+v, %+v", export.Queued, export.DeadLetters)
+	}
+	if len(export.Responses) != 1 || !strings.Contains(string(export.Responses[0].Body), "Olá, Ana!") {
+		t.Errorf("Export misses stored responses: %+v", export.Responses)
+	}
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("principal", Principal{Subject: "dpo", Role: RoleOwner})
+		return c.Next()
+	})
+	s.RegisterAdminRoutes(app)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/contacts/1/export", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported struct {
+		Manifest struct {
+			SHA256 map[string]string `json:"sha256"`
+		} `json:"manifest"`
+		Summary   *ConversationSummary `json:"summary"`
+		Waitlist  []WaitlistEntry      `json:"waitlist"`
+		Responses []StoredResponse     `json:"responses"`
+	}
+	data, _ := io.ReadAll(resp.Body)
+	json.Unmarshal(data, &exported)
+	if exported.Summary == nil || exported.Summary.Summary != "Ana prefere pods de menta." {
+		t.Errorf("JSON export has no summary: %+v", exported.Summary)
+	}
+	if len(exported.Waitlist) != 1 || len(exported.Responses) != 1 {
+		t.Errorf("JSON export misses waitlist or responses: %+v, %+v", exported.Waitlist, exported.Responses)
+	}
+	var sections map[string]json.RawMessage
+	json.Unmarshal(data, &sections)
+	if len(exported.Manifest.SHA256) != 12 {
+		t.Errorf("Manifest should list 12 sections, got %d", len(exported.Manifest.SHA256))
+	}
+	for name := range exported.Manifest.SHA256 {
+		if _, ok := sections[strings.TrimSuffix(name, ".json")]; !ok {
+			t.Errorf("JSON export misses the %s section of the manifest", name)
+		}
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/contacts/1/export?format=zip", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Export is not a ZIP: %v", err)
+	}
+	if len(archive.File) != 13 {
+		t.Errorf("ZIP should have 13 files, got %d", len(archive.File))
+	}
+
+	var requests []DataRequest
+	s.db.Order("id desc").Find(&requests)
+	if len(requests) != 2 || requests[0].Kind != DataRequestExport || requests[0].Actor != "dpo" || requests[0].Digest != resp.Header.Get("X-Export-Digest") {
+		t.Errorf("Export was not audited: %+v", requests)
+	}
+}
+
+func TestEraseContact(t *testing.T) {
+	ctx := context.Background()
+	s, calendar, contact := newDataRightsFixture(t)
+	s.repos.Products.Create(ctx, &Products{Product: "pod", Flavor: "menta", Quantity: 10})
+	if _, _, _, err := s.placeReservedOrder(ctx, contact.ID, "", Arguments{Products: []ExtractedProduct{{Item: "pod", Flavor: "menta", Quantity: 3}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.eraseContact(ctx, contact.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Messages != 1 || report.Orders != 2 || report.Appointments != 1 || report.Vectors != 1 || report.Jobs == 0 || report.Usage != 1 {
+		t.Errorf("Erasure report is not correct: %+v", report)
+	}
+
+	if _, err := s.repos.Contacts.Get(ctx, contact.ID); err != ErrNotFound {
+		t.Errorf("Contact was not erased: %v", err)
+	}
+	if orders, _ := s.repos.Orders.ListByContact(ctx, contact.ID); len(orders) != 0 {
+		t.Errorf("Orders were not erased: %+v", orders)
+	}
+	if messages, _ := s.repos.Messages.List(ctx); len(messages) != 1 || messages[0].Content != "oi" {
+		t.Errorf("Only the contact's messages should be erased: %+v", messages)
+	}
+	if len(calendar.events) != 0 {
+		t.Errorf("Calendar events were not erased: %+v", calendar.events)
+	}
+	if product, _ := s.repos.Products.Get(ctx, 1); product.Quantity != 10 {
+		t.Errorf("Reserved stock was not given back: %d", product.Quantity)
+	}
+	var jobs int64
+	s.db.Unscoped().Model(&Job{}).Where("contact_id = ?", contact.ID).Count(&jobs)
+	if jobs != 0 {
+		t.Errorf("Jobs were not erased: %d", jobs)
+	}
+	var usage []LLMUsage
+	s.db.Find(&usage)
+	if len(usage) != 1 || usage[0].ContactID != 0 || usage[0].CorrelationID != "" || usage[0].Cost != 0.01 {
+		t.Errorf("Usage was not anonymised: %+v", usage)
+	}
+}
+
+func TestDataRequestChain(t *testing.T) {
+	ctx := context.Background()
+	s, _, _, _ := newTestService(t, time.Now())
+
+	for i := uint(1); i <= 3; i++ {
+		if err := s.recordDataRequest(ctx, &DataRequest{ContactID: i, Kind: DataRequestErasure, Summary: "{}"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if brokenAt, count, err := verifyDataRequests(s.db); err != nil || brokenAt != 0 || count != 3 {
+		t.Errorf("Chain should be valid: broken at %d, %d records, %v", brokenAt, count, err)
+	}
+
+	s.db.Model(&DataRequest{}).Where("id = ?", 2).Update("contact_id", 7)
+	if brokenAt, _, _ := verifyDataRequests(s.db); brokenAt != 2 {
+		t.Errorf("Tampering should be detected at record 2, got %d", brokenAt)
+	}
+}
+
+func TestEraseContactAfterCancel(t *testing.T) {
+	ctx := context.Background()
+	s, calendar, contact := newDataRightsFixture(t)
+	orders, _ := s.repos.Orders.ListByContact(ctx, contact.ID)
+	order := &orders[0]
+	if err := s.cancelOrder(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := s.repos.Orders.Get(ctx, order.ID); stored.CalendarEventID != "" || len(calendar.events) != 0 {
+		t.Fatalf("The cancelled order kept its deleted event: %q", stored.CalendarEventID)
+	}
+
+	// A second booking whose erasure fails after its event was deleted.
+	booked := &Order{ContactID: contact.ID, Status: OrderStatusPending, PickupDate: "2023-08-11", PickupTime: "10:00"}
+	s.repos.Orders.Create(ctx, booked)
+	if err := s.scheduleOrderFollowUps(ctx, booked, contact); err != nil {
+		t.Fatal(err)
+	}
+	failRelease := func(db *gorm.DB) {
+		if _, ok := db.Statement.Model.(*StockMovement); ok {
+			db.AddError(errors.New("disk full"))
+		}
+	}
+	if err := s.db.Callback().Row().Before("gorm:row").Register("test:fail_release", failRelease); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.eraseContact(ctx, contact.ID); err == nil {
+		t.Fatal("The failed erasure was not reported")
+	}
+	s.db.Callback().Row().Remove("test:fail_release")
+	if len(calendar.events) != 0 {
+		t.Fatalf("The event was not deleted by the failed erasure: %+v", calendar.events)
+	}
+
+	report, err := s.eraseContact(ctx, contact.ID)
+	if err != nil {
+		t.Fatalf("The erasure could not be retried: %v", err)
+	}
+	if remaining, _ := s.repos.Orders.ListByContact(ctx, contact.ID); len(remaining) != 0 || report.Appointments != 0 {
+		t.Errorf("Erasure report is not correct: %+v", report)
+	}
+}
@@ -1,30 +1,53 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-func setupDatabase() (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
-	if err != nil {
-		log.Fatalf("failed to connect database: %v", err)
-		return nil, err
+func openDatabase(config DatabaseConfig) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+
+	switch config.Driver {
+	case "sqlite":
+		dialector = sqlite.Open(config.DSN)
+	case "postgres":
+		dialector = postgres.Open(config.DSN)
+	case "mysql":
+		dialector = mysql.Open(config.DSN)
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", config.Driver)
 	}
 
-	err = db.AutoMigrate(&Message{})
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
-		log.Fatalf("failed to migrate database: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("failed to connect database: %w", err)
 	}
 
-	err = db.AutoMigrate(&Products{})
+	return db, nil
+}
+
+func setupDatabase(config DatabaseConfig) (*gorm.DB, error) {
+	db, err := openDatabase(config)
 	if err != nil {
-		log.Fatalf("failed to migrate database: %v", err)
 		return nil, err
 	}
 
+	if config.AutoMigrate {
+		applied, err := migrateUp(db)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate database: %w", err)
+		}
+
+		for _, m := range applied {
+			slog.Info("applied migration", "version", m.Version, "name", m.Name)
+		}
+	}
+
 	return db, nil
 }
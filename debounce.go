@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// pendingTurn is the burst of messages of a contact waiting to be answered,
+// with the idempotency records of the messages that had a key. The records
+// stay in processing until the turn is answered.
+type pendingTurn struct {
+	key      string
+	messages []Message
+	records  []*IdempotencyRecord
+	first    time.Time
+	last     time.Time
+}
+
+// message merges the burst into one message: the contents are joined in the
+// order they arrived and the rest comes from the last message.
+func (t *pendingTurn) message() *Message {
+	merged := t.messages[len(t.messages)-1]
+	contents := make([]string, 0, len(t.messages))
+	for _, message := range t.messages {
+		contents = append(contents, message.Content)
+	}
+	merged.Content = strings.Join(contents, "\n")
+	return &merged
+}
+
+// debouncer aggregates the messages a contact sends in a row ("oi", "queria
+// 3 pods", "de morango") into one turn. A turn is answered once the contact
+// has been quiet for window, or maxWait after its first message when they
+// keep typing. Turns live in memory: a contact whose messages reach
+// different instances gets one turn per instance, and the turns of a crashed
+// instance are processed again when the provider redelivers them, as their
+// idempotency records were never finished.
+type debouncer struct {
+	mu       sync.Mutex
+	window   time.Duration
+	maxWait  time.Duration
+	interval time.Duration
+	now      func() time.Time
+	handle   func(ctx context.Context, message *Message, records []*IdempotencyRecord)
+	turns    map[string]*pendingTurn
+	inFlight map[string]bool
+	wg       sync.WaitGroup
+}
+
+func newDebouncer(config DebounceConfig, handle func(ctx context.Context, message *Message, records []*IdempotencyRecord)) *debouncer {
+	window, _ := time.ParseDuration(config.Window)
+	maxWait, _ := time.ParseDuration(config.MaxWait)
+	interval := window / 4
+	if interval < 50*time.Millisecond {
+		interval = 50 * time.Millisecond
+	}
+	return &debouncer{
+		window:   window,
+		maxWait:  maxWait,
+		interval: interval,
+		now:      time.Now,
+		handle:   handle,
+		turns:    map[string]*pendingTurn{},
+		inFlight: map[string]bool{},
+	}
+}
+
+// Add buffers the message, and its idempotency record when it has one, in its
+// contact's turn and returns how many messages the turn holds.
+func (d *debouncer) Add(message *Message, record *IdempotencyRecord) int {
+	key := message.Tenant + "\x00" + message.Channel + "\x00" + message.Sender
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	turn, ok := d.turns[key]
+	if !ok {
+		turn = &pendingTurn{key: key, first: now}
+		d.turns[key] = turn
+	}
+	turn.messages = append(turn.messages, *message)
+	if record != nil {
+		turn.records = append(turn.records, record)
+	}
+	turn.last = now
+	return len(turn.messages)
+}
+
+// due removes the turns ready to be answered. A turn waits while the previous
+// turn of the contact is still being answered, so replies keep their order.
+func (d *debouncer) due(all bool) []*pendingTurn {
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var turns []*pendingTurn
+	for key, turn := range d.turns {
+		if d.inFlight[key] {
+			continue
+		}
+		if all || now.Sub(turn.last) >= d.window || now.Sub(turn.first) >= d.maxWait {
+			turns = append(turns, turn)
+			delete(d.turns, key)
+			d.inFlight[key] = true
+		}
+	}
+	return turns
+}
+
+// FlushDue answers the turns that are ready, in parallel, and returns how
+// many it started.
+func (d *debouncer) FlushDue(ctx context.Context) int {
+	return d.flush(ctx, false)
+}
+
+func (d *debouncer) flush(ctx context.Context, all bool) int {
+	turns := d.due(all)
+	for _, turn := range turns {
+		d.wg.Add(1)
+		go func(turn *pendingTurn) {
+			defer func() {
+				d.mu.Lock()
+				delete(d.inFlight, turn.key)
+				d.mu.Unlock()
+				d.wg.Done()
+			}()
+			if len(turn.messages) > 1 {
+				slog.InfoContext(ctx, "messages aggregated", "messages", len(turn.messages), "waited", turn.last.Sub(turn.first))
+			}
+			d.handle(ctx, turn.message(), turn.records)
+		}(turn)
+	}
+	return len(turns)
+}
+
+// Wait blocks until the turns being answered are done.
+func (d *debouncer) Wait() {
+	d.wg.Wait()
+}
+
+// Start answers turns as they become due until the context is cancelled,
+// then answers the ones still buffered.
+func (d *debouncer) Start(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// The turns are answered without the cancelled context.
+			for {
+				d.Wait()
+				if d.flush(context.WithoutCancel(ctx), true) == 0 {
+					return
+				}
+			}
+		case <-ticker.C:
+			d.FlushDue(ctx)
+		}
+	}
+}
+
+// answerTurn answers an aggregated turn through the channel it came from.
+// When the LLM is down the turn is queued like any other message. Once the
+// turn is answered or durably queued the idempotency records of its messages
+// are finished; when it fails they are released so redeliveries process the
+// messages again.
+func (s *LLMService) answerTurn(ctx context.Context, message *Message, records []*IdempotencyRecord) {
+	err := s.deliverTurn(ctx, message)
+	if err != nil {
+		slog.ErrorContext(ctx, "answer aggregated message failed", "error", err)
+	}
+
+	for _, record := range records {
+		if err != nil {
+			if err := s.abandonRequest(ctx, record); err != nil {
+				slog.ErrorContext(ctx, "release idempotency key failed", "error", err)
+			}
+			continue
+		}
+		if err := s.finishRequest(ctx, record, fiber.StatusAccepted, fiber.Map{"debounced": true}, 0); err != nil {
+			slog.ErrorContext(ctx, "store response for replay failed", "error", err)
+		}
+	}
+}
+
+func (s *LLMService) deliverTurn(ctx context.Context, message *Message) error {
+	if s.config.Inbound.Async {
+		if _, err := s.inbound.Enqueue(ctx, message, s.debouncer.now()); err != nil {
+			return err
+		}
+		s.workers.Notify()
+		return nil
+	}
+
+	err := s.handleInbound(ctx, &QueuedMessage{Attempts: 1, Message: *message})
+	if errors.Is(err, errLLMUnavailable) {
+		return s.queueMessage(ctx, message)
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestDebouncerAggregatesBursts(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	var mu sync.Mutex
+	var handled []string
+	d := newDebouncer(DebounceConfig{Window: "3s", MaxWait: "5s"}, func(ctx context.Context, message *Message, records []*IdempotencyRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, message.Sender+": "+message.Content)
+	})
+	d.now = clock.Now
+	ctx := context.Background()
+
+	for _, content := range []string{"oi", "queria 3 pods", "de morango"} {
+		d.Add(&Message{Content: content, Channel: "whatsapp", Sender: "a"}, nil)
+		clock.Advance(time.Second)
+	}
+	d.Add(&Message{Content: "oi", Channel: "whatsapp", Sender: "b"}, nil)
+
+	if flushed := d.FlushDue(ctx); flushed != 0 {
+		t.Errorf("Nothing should be answered while the contacts type: %d", flushed)
+	}
+	clock.Advance(2 * time.Second)
+	if flushed := d.FlushDue(ctx); flushed != 1 {
+		t.Errorf("The burst should be answered after the window: %d", flushed)
+	}
+	d.Wait()
+	if len(handled) != 1 || handled[0] != "a: oi\nqueria 3 pods\nde morango" {
+		t.Errorf("The burst should be answered as one message: %q", handled)
+	}
+
+	clock.Advance(time.Second)
+	d.FlushDue(ctx)
+	d.Wait()
+
+	// A contact that keeps typing is answered after the max wait.
+	handled = nil
+	for i := 0; i < 4; i++ {
+		d.Add(&Message{Content: "mais", Channel: "whatsapp", Sender: "c"}, nil)
+		d.FlushDue(ctx)
+		d.Wait()
+		clock.Advance(2 * time.Second)
+	}
+	if len(handled) != 1 || handled[0] != "c: mais\nmais\nmais\nmais" {
+		t.Errorf("A long burst should be answered after the max wait: %q", handled)
+	}
+}
+
+func TestDebouncerKeepsTurnsInOrder(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var handled []string
+	d := newDebouncer(DebounceConfig{Window: "1s", MaxWait: "5s"}, func(ctx context.Context, message *Message, records []*IdempotencyRecord) {
+		if message.Content == "primeira" {
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, message.Content)
+	})
+	d.now = clock.Now
+	ctx := context.Background()
+
+	d.Add(&Message{Content: "primeira", Sender: "a"}, nil)
+	clock.Advance(time.Second)
+	d.FlushDue(ctx)
+	d.Add(&Message{Content: "segunda", Sender: "a"}, nil)
+	clock.Advance(time.Second)
+	if flushed := d.FlushDue(ctx); flushed != 0 {
+		t.Errorf("A turn should wait for the previous one of the contact: %d", flushed)
+	}
+
+	close(release)
+	d.Wait()
+	if flushed := d.FlushDue(ctx); flushed != 1 {
+		t.Errorf("The next turn should be answered: %d", flushed)
+	}
+	d.Wait()
+	if strings.Join(handled, ",") != "primeira,segunda" {
+		t.Errorf("Turns should be answered in order: %v", handled)
+	}
+}
+
+func TestDebouncerDrainsOnShutdown(t *testing.T) {
+	var mu sync.Mutex
+	var handled []string
+	d := newDebouncer(DebounceConfig{Window: "1m", MaxWait: "5m"}, func(ctx context.Context, message *Message, records []*IdempotencyRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, message.Content)
+	})
+	d.Add(&Message{Content: "oi", Sender: "a"}, nil)
+	d.Add(&Message{Content: "quero 1 pod", Sender: "b"}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	drained := make(chan struct{})
+	go func() {
+		d.Start(ctx)
+		close(drained)
+	}()
+	cancel()
+	<-drained
+
+	if len(handled) != 2 {
+		t.Errorf("Buffered turns should be answered on shutdown: %q", handled)
+	}
+}
+
+func TestChatDebounce(t *testing.T) {
+	s, clock, sender, _ := newTestService(t, time.Now())
+	completer := &fakeCompleter{reply: "Abrimos às 9h."}
+	s.llm = newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: completer})
+	s.debouncer = newDebouncer(DebounceConfig{Window: "3s", MaxWait: "15s"}, s.answerTurn)
+	s.debouncer.now = clock.Now
+
+	app := fiber.New()
+	s.RegisterRoutes(app)
+	for _, content := range []string{"oi", "qual o horário", "de funcionamento?"} {
+		body := `{"content": "` + content + `", "channel": "whatsapp", "sender": "+5511988887777"}`
+		req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusAccepted {
+			t.Fatalf("Messages should be acknowledged while the contact types: %d", resp.StatusCode)
+		}
+		clock.Advance(time.Second)
+	}
+
+	clock.Advance(3 * time.Second)
+	if flushed := s.debouncer.FlushDue(context.Background()); flushed != 1 {
+		t.Fatalf("The burst should be answered once: %d", flushed)
+	}
+	s.debouncer.Wait()
+
+	if calls := completer.calls(); len(calls) != 1 {
+		t.Errorf("The burst should make one completion: %v", calls)
+	}
+	sent := sender.Sent()
+	if len(sent) != 1 || sent[0].Text != "Abrimos às 9h." || sent[0].Recipient != "+5511988887777" {
+		t.Errorf("The reply should be sent through the channel: %+v", sent)
+	}
+	messages, _ := s.repos.Messages.List(context.Background())
+	if len(messages) != 2 || messages[0].Content != "oi\nqual o horário\nde funcionamento?" {
+		t.Errorf("The burst should be stored as one turn: %+v", messages)
+	}
+}
+
+func TestChatDebounceFinishesIdempotencyWhenAnswered(t *testing.T) {
+	s, clock, sender, _ := newTestService(t, time.Now())
+	s.llm = newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: &fakeCompleter{reply: "Abrimos às 9h."}})
+	s.debouncer = newDebouncer(DebounceConfig{Window: "3s", MaxWait: "15s"}, s.answerTurn)
+	s.debouncer.now = clock.Now
+
+	app := fiber.New()
+	s.RegisterRoutes(app)
+	post := func() int {
+		body := `{"content": "qual o horário?", "channel": "whatsapp", "sender": "+5511988887777", "message_id": "wamid.1"}`
+		req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := post(); status != fiber.StatusAccepted {
+		t.Fatalf("The message should be acknowledged: %d", status)
+	}
+	if status := post(); status != fiber.StatusConflict {
+		t.Errorf("A redelivery of a buffered message should wait for its turn: %d", status)
+	}
+
+	// The instance crashed with the turn buffered: once the lock times out a
+	// redelivery processes the message again.
+	s.db.Model(&IdempotencyRecord{}).Where("1 = 1").Update("updated_at", time.Now().Add(-idempotencyLockTimeout))
+	s.debouncer = newDebouncer(DebounceConfig{Window: "3s", MaxWait: "15s"}, s.answerTurn)
+	s.debouncer.now = clock.Now
+	if status := post(); status != fiber.StatusAccepted {
+		t.Fatalf("A redelivery after a crash should be buffered again: %d", status)
+	}
+
+	clock.Advance(3 * time.Second)
+	s.debouncer.FlushDue(context.Background())
+	s.debouncer.Wait()
+	if sent := sender.Sent(); len(sent) != 1 {
+		t.Errorf("The turn should be answered once: %+v", sent)
+	}
+	if status := post(); status != fiber.StatusAccepted {
+		t.Errorf("A redelivery after the turn was answered should replay the response: %d", status)
+	}
+	if sent := sender.Sent(); len(sent) != 1 {
+		t.Errorf("A replayed message should not be answered again: %+v", sent)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// KeyManager wraps and unwraps data keys with master keys it never hands
+// out, like a KMS. Master keys are identified by ID so values encrypted with
+// a retired key can still be read after a rotation.
+type KeyManager interface {
+	CurrentKeyID() string
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// keyFile is a KeyManager backed by a local JSON file:
+//
+//	{"current": "2023-08", "keys": {"2023-08": "<base64 32 bytes>"}, "index_key": "<base64 32 bytes>"}
+//
+// Rotating means adding a key, pointing "current" to it and running the
+// rotate-keys command. The index key is used for blind indexes and cannot
+// be rotated without rebuilding them.
+type keyFile struct {
+	current  string
+	keys     map[string][]byte
+	indexKey []byte
+}
+
+func loadKeyFile(path string) (*keyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+
+	var raw struct {
+		Current  string            `json:"current"`
+		Keys     map[string]string `json:"keys"`
+		IndexKey string            `json:"index_key"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing key file %s: %w", path, err)
+	}
+
+	decode := func(name, value string) ([]byte, error) {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %q in %s must be 32 bytes encoded in base64", name, path)
+		}
+		return key, nil
+	}
+
+	k := &keyFile{current: raw.Current, keys: map[string][]byte{}}
+	for id, value := range raw.Keys {
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("key ID %q in %s must not contain ':'", id, path)
+		}
+		if k.keys[id], err = decode(id, value); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := k.keys[k.current]; !ok {
+		return nil, fmt.Errorf("current key %q is not in %s", k.current, path)
+	}
+	if k.indexKey, err = decode("index_key", raw.IndexKey); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (k *keyFile) CurrentKeyID() string {
+	return k.current
+}
+
+func (k *keyFile) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	wrapped, err := seal(k.keys[k.current], dataKey)
+	return k.current, wrapped, err
+}
+
+func (k *keyFile) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", keyID)
+	}
+	return open(key, wrapped)
+}
+
+func seal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+const encryptedPrefix = "enc:v1:"
+
+// FieldCrypter encrypts single column values with envelope encryption: each
+// value gets its own data key, wrapped by the current master key and stored
+// next to the ciphertext as enc:v1:<key id>:<wrapped key>:<ciphertext>.
+// Values without the prefix are legacy plaintext and are read as is.
+//
+// A nil FieldCrypter leaves values untouched, so repositories work the same
+// with encryption disabled.
+type FieldCrypter struct {
+	keys     KeyManager
+	indexKey []byte
+}
+
+func newFieldCrypter(config EncryptionConfig) (*FieldCrypter, error) {
+	if config.KeyFile == "" {
+		return nil, nil
+	}
+
+	keys, err := loadKeyFile(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &FieldCrypter{keys: keys, indexKey: keys.indexKey}, nil
+}
+
+func (f *FieldCrypter) Encrypt(ctx context.Context, plaintext string) (string, error) {
+	if f == nil || plaintext == "" {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	keyID, wrapped, err := f.keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + keyID + ":" + base64.StdEncoding.EncodeToString(wrapped) + ":" + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (f *FieldCrypter) Decrypt(ctx context.Context, value string) (string, error) {
+	if f == nil || !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := f.keys.UnwrapKey(ctx, parts[0], wrapped)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// NeedsRotation reports whether the value is plaintext or was encrypted with
+// a master key other than the current one.
+func (f *FieldCrypter) NeedsRotation(value string) bool {
+	if f == nil || value == "" {
+		return false
+	}
+	return !strings.HasPrefix(value, encryptedPrefix+f.keys.CurrentKeyID()+":")
+}
+
+func (f *FieldCrypter) mac(value string) string {
+	h := hmac.New(sha256.New, f.indexKey)
+	h.Write([]byte(value))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// BlindIndex returns a keyed hash of the value for exact match lookups.
+func (f *FieldCrypter) BlindIndex(value string) string {
+	if f == nil || value == "" {
+		return ""
+	}
+	return f.mac(normalizeText(value))
+}
+
+// WordIndex returns the sorted, space delimited keyed hashes of the words in
+// the text, so encrypted text can be searched by whole words.
+func (f *FieldCrypter) WordIndex(texts ...string) string {
+	if f == nil {
+		return ""
+	}
+
+	seen := map[string]bool{}
+	for _, text := range texts {
+		for _, word := range words(normalizeText(text)) {
+			seen[f.mac(word)[:16]] = true
+		}
+	}
+	if len(seen) == 0 {
+		return ""
+	}
+
+	tokens := make([]string, 0, len(seen))
+	for token := range seen {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return " " + strings.Join(tokens, " ") + " "
+}
+
+// WordTokens returns the LIKE patterns matching rows whose word index
+// contains every word of the query.
+func (f *FieldCrypter) WordTokens(query string) []string {
+	var patterns []string
+	for _, word := range words(normalizeText(query)) {
+		patterns = append(patterns, "% "+f.mac(word)[:16]+" %")
+	}
+	return patterns
+}
+
+// sealedColumns are the columns encrypted with the FieldCrypter outside the
+// message and contact repositories, which rotateEncryption re-encrypts as
+// is. Only the payloads of queued message jobs are encrypted.
+var sealedColumns = []struct {
+	model  interface{}
+	column string
+	where  string
+}{
+	{&ConversationSummary{}, "summary", ""},
+	{&Job{}, "payload", "kind = '" + JobKindQueuedMessage + "'"},
+	{&InboundMessage{}, "payload", ""},
+	{&DeadLetter{}, "payload", ""},
+	{&IdempotencyRecord{}, "response_body", ""},
+}
+
+// rotateEncryption re-encrypts every message, contact and other encrypted
+// column (see sealedColumns) that is still in plaintext or encrypted with a
+// retired master key, and rebuilds the blind indexes of messages and
+// contacts. It returns how many rows were updated.
+func rotateEncryption(ctx context.Context, db *gorm.DB, crypter *FieldCrypter) (int, error) {
+	if crypter == nil {
+		return 0, errors.New("encryption is not configured (ENCRYPTION_KEY_FILE)")
+	}
+
+	repos := &gormMessageRepository{db: db, crypter: crypter}
+	contacts := &gormContactRepository{db: db, crypter: crypter}
+	updated := 0
+
+	var messages []Message
+	err := db.WithContext(ctx).FindInBatches(&messages, 200, func(tx *gorm.DB, batch int) error {
+		for _, message := range messages {
+			if !crypter.NeedsRotation(message.Content) {
+				continue
+			}
+			if err := repos.open(ctx, &message); err != nil {
+				return fmt.Errorf("message %d: %w", message.ID, err)
+			}
+			sealed, err := repos.seal(ctx, message)
+			if err != nil {
+				return err
+			}
+			if err := db.WithContext(ctx).Model(&Message{}).Where("id = ?", message.ID).
+				Updates(map[string]interface{}{"content": sealed.Content, "content_index": sealed.ContentIndex}).Error; err != nil {
+				return err
+			}
+			updated++
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return updated, err
+	}
+
+	var batch []Contact
+	err = db.WithContext(ctx).FindInBatches(&batch, 200, func(tx *gorm.DB, n int) error {
+		for _, contact := range batch {
+			if !crypter.NeedsRotation(contact.Name) && !crypter.NeedsRotation(contact.Phone) && !crypter.NeedsRotation(contact.Notes) {
+				continue
+			}
+			if err := contacts.open(ctx, &contact); err != nil {
+				return fmt.Errorf("contact %d: %w", contact.ID, err)
+			}
+			sealed, err := contacts.seal(ctx, contact)
+			if err != nil {
+				return err
+			}
+			if err := db.WithContext(ctx).Model(&Contact{}).Where("id = ?", contact.ID).Updates(map[string]interface{}{
+				"name": sealed.Name, "phone": sealed.Phone, "notes": sealed.Notes,
+				"phone_index": sealed.PhoneIndex, "search_index": sealed.SearchIndex,
+			}).Error; err != nil {
+				return err
+			}
+			updated++
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return updated, err
+	}
+
+	for _, sealed := range sealedColumns {
+		n, err := rotateColumn(ctx, db, crypter, sealed.model, sealed.column, sealed.where)
+		updated += n
+		if err != nil {
+			return updated, err
+		}
+	}
+
+	return updated, nil
+}
+
+// rotateColumn re-encrypts the values of one column with the current key.
+func rotateColumn(ctx context.Context, db *gorm.DB, crypter *FieldCrypter, model interface{}, column, where string) (int, error) {
+	query := db.WithContext(ctx).Model(model).Select("id, " + column + " AS value")
+	if where != "" {
+		query = query.Where(where)
+	}
+
+	updated := 0
+	var rows []struct {
+		ID    uint
+		Value string
+	}
+	err := query.FindInBatches(&rows, 200, func(tx *gorm.DB, batch int) error {
+		for _, row := range rows {
+			if !crypter.NeedsRotation(row.Value) {
+				continue
+			}
+			plaintext, err := crypter.Decrypt(ctx, row.Value)
+			if err != nil {
+				return fmt.Errorf("%s %d: %w", tx.Statement.Table, row.ID, err)
+			}
+			sealed, err := crypter.Encrypt(ctx, plaintext)
+			if err != nil {
+				return err
+			}
+			if err := db.WithContext(ctx).Model(model).Where("id = ?", row.ID).Update(column, sealed).Error; err != nil {
+				return err
+			}
+			updated++
+		}
+		return nil
+	}).Error
+
+	return updated, err
+}
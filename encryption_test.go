@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeKeyFile(t *testing.T, path, current string, keys map[string]string, indexKey string) *FieldCrypter {
+	data, _ := json.Marshal(map[string]interface{}{"current": current, "keys": keys, "index_key": indexKey})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	crypter, err := newFieldCrypter(EncryptionConfig{KeyFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypter
+}
+
+func randomKey() string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestEncryptedRepositories(t *testing.T) {
+	ctx := context.Background()
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	crypter := writeKeyFile(t, keyPath, "k1", map[string]string{"k1": randomKey()}, randomKey())
+
+	db := newTestDB(t, &Message{}, &Contact{}, &ContactIdentity{})
+	repos := newGormRepositories(db, crypter)
+
+	contact := &Contact{Name: "Ana Souza", Phone: "+5511999999999", Notes: "prefere retirar de manhã"}
+	if err := repos.Contacts.Create(ctx, contact); err != nil {
+		t.Fatal(err)
+	}
+	repos.Messages.Create(ctx, &Message{Content: "Quero dois pods de Menta", ContactID: contact.ID})
+	repos.Messages.Create(ctx, &Message{Content: "Qual o horário?", ContactID: contact.ID})
+
+	var raw Message
+	db.First(&raw)
+	if !strings.HasPrefix(raw.Content, "enc:v1:k1:") || strings.Contains(raw.ContentIndex, "menta") {
+		t.Errorf("Message content is not encrypted: %+v", raw)
+	}
+	var rawContact Contact
+	db.First(&rawContact)
+	if strings.Contains(rawContact.Name+rawContact.Phone+rawContact.Notes, "Ana") || strings.Contains(rawContact.Phone, "5511") {
+		t.Errorf("Contact fields are not encrypted: %+v", rawContact)
+	}
+
+	messages, err := repos.Messages.List(ctx)
+	if err != nil || len(messages) != 2 || messages[0].Content != "Quero dois pods de Menta" {
+		t.Errorf("Messages are not decrypted: %+v, %v", messages, err)
+	}
+
+	found, err := repos.Messages.Search(ctx, MessageFilter{Query: "menta pods"})
+	if err != nil || len(found) != 1 || found[0].Content != "Quero dois pods de Menta" {
+		t.Errorf("Blind index search is not correct: %+v, %v", found, err)
+	}
+
+	byPhone, err := repos.Contacts.FindByPhone(ctx, "+5511999999999")
+	if err != nil || byPhone.Name != "Ana Souza" {
+		t.Errorf("Phone lookup is not correct: %+v, %v", byPhone, err)
+	}
+	contacts, err := repos.Contacts.Search(ctx, ContactFilter{Query: "souza"})
+	if err != nil || len(contacts) != 1 || contacts[0].Notes != "prefere retirar de manhã" {
+		t.Errorf("Contact search is not correct: %+v, %v", contacts, err)
+	}
+
+	byPhone.Notes = "cliente VIP"
+	if err := repos.Contacts.Update(ctx, byPhone); err != nil {
+		t.Fatal(err)
+	}
+	if contacts, _ := repos.Contacts.Search(ctx, ContactFilter{Query: "vip"}); len(contacts) != 1 {
+		t.Errorf("Search index was not updated: %+v", contacts)
+	}
+}
+
+func TestRotateEncryption(t *testing.T) {
+	ctx := context.Background()
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	k1, indexKey := randomKey(), randomKey()
+	crypter := writeKeyFile(t, keyPath, "k1", map[string]string{"k1": k1}, indexKey)
+
+	db := newTestDB(t, &Message{}, &Contact{}, &ContactIdentity{}, &ConversationSummary{}, &Job{}, &InboundMessage{}, &DeadLetter{}, &IdempotencyRecord{})
+	newGormRepositories(db, crypter).Messages.Create(ctx, &Message{Content: "pod de uva"})
+	// A row written before encryption was enabled.
+	newGormRepositories(db, nil).Contacts.Create(ctx, &Contact{Name: "Bia", Phone: "+5511888888888"})
+
+	rotated := writeKeyFile(t, keyPath, "k2", map[string]string{"k1": k1, "k2": randomKey()}, indexKey)
+	updated, err := rotateEncryption(ctx, db, rotated)
+	if err != nil || updated != 2 {
+		t.Fatalf("Rotation is not correct: %d rows, %v", updated, err)
+	}
+
+	var raw Message
+	db.First(&raw)
+	if !strings.HasPrefix(raw.Content, "enc:v1:k2:") {
+		t.Errorf("Message was not re-encrypted with the new key: %s", raw.Content)
+	}
+
+	repos := newGormRepositories(db, rotated)
+	if messages, _ := repos.Messages.List(ctx); len(messages) != 1 || messages[0].Content != "pod de uva" {
+		t.Errorf("Rotated message is not readable: %+v", messages)
+	}
+	if contact, err := repos.Contacts.FindByPhone(ctx, "+5511888888888"); err != nil || contact.Name != "Bia" {
+		t.Errorf("Legacy contact was not encrypted and indexed: %+v, %v", contact, err)
+	}
+
+	if updated, _ := rotateEncryption(ctx, db, rotated); updated != 0 {
+		t.Errorf("Nothing should be left to rotate, got %d", updated)
+	}
+}
+
+func TestRotateEncryptedColumns(t *testing.T) {
+	ctx := context.Background()
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	k1, indexKey := randomKey(), randomKey()
+	crypter := writeKeyFile(t, keyPath, "k1", map[string]string{"k1": k1}, indexKey)
+
+	db := newTestDB(t, &Message{}, &Contact{}, &ContactIdentity{}, &ConversationSummary{}, &Job{}, &InboundMessage{}, &DeadLetter{}, &IdempotencyRecord{})
+	seal := func(text string) string {
+		sealed, err := crypter.Encrypt(ctx, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sealed
+	}
+	db.Create(&ConversationSummary{ContactID: 1, Summary: seal("Ana prefere menta.")})
+	db.Create(&Job{Kind: JobKindQueuedMessage, Payload: seal(`{"content":"oi"}`)})
+	db.Create(&Job{Kind: JobKindOrderReminder, Payload: "day_before"})
+	db.Create(&InboundMessage{Payload: seal(`{"content":"quero um pod"}`)})
+	db.Create(&DeadLetter{Payload: seal(`{"content":"cancela"}`)})
+	db.Create(&IdempotencyRecord{RequestKey: "k", ResponseBody: seal(`{"reply":"ok"}`)})
+
+	k2 := randomKey()
+	rotated := writeKeyFile(t, keyPath, "k2", map[string]string{"k1": k1, "k2": k2}, indexKey)
+	updated, err := rotateEncryption(ctx, db, rotated)
+	if err != nil || updated != 5 {
+		t.Fatalf("Rotation is not correct: %d rows, %v", updated, err)
+	}
+
+	// Once rotated, the retired key can be removed from the key file.
+	current := writeKeyFile(t, keyPath, "k2", map[string]string{"k2": k2}, indexKey)
+	for _, check := range []struct {
+		model  interface{}
+		column string
+		want   string
+	}{
+		{&ConversationSummary{}, "summary", "Ana prefere menta."},
+		{&Job{}, "payload", `{"content":"oi"}`},
+		{&InboundMessage{}, "payload", `{"content":"quero um pod"}`},
+		{&DeadLetter{}, "payload", `{"content":"cancela"}`},
+		{&IdempotencyRecord{}, "response_body", `{"reply":"ok"}`},
+	} {
+		var value string
+		db.Model(check.model).Order("id").Limit(1).Pluck(check.column, &value)
+		plaintext, err := current.Decrypt(ctx, value)
+		if !strings.HasPrefix(value, "enc:v1:k2:") || err != nil || plaintext != check.want {
+			t.Errorf("%T.%s was not rotated: %s, %v", check.model, check.column, value, err)
+		}
+	}
+
+	var reminder Job
+	db.Where("kind = ?", JobKindOrderReminder).First(&reminder)
+	if reminder.Payload != "day_before" {
+		t.Errorf("Plaintext job payload was encrypted: %s", reminder.Payload)
+	}
+}
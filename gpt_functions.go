@@ -1,40 +1,59 @@
 package main
 
 import (
+	"strings"
 	"time"
 
 	openai "github.com/sashabaranov/go-openai"
 	"github.com/sashabaranov/go-openai/jsonschema"
 )
 
-var getProductsAndDate = openai.FunctionDefinition{
-	Name:        "getProductsAndDate",
-	Description: "Get products from user based on his queries and date of delivery",
-	Parameters: jsonschema.Definition{
-		Type: "object",
-		Properties: map[string]jsonschema.Definition{
-			"products": {
-				Type: "array",
-				Description: `O usuário informará os vapes, pods, coils e juices que ele quer comprar.
+// weekdays are the names customers use for the days of the week.
+var weekdays = [...]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"}
+
+// upcomingDays lists the next week as "sexta-feira é 2023-08-11", so the
+// model can resolve a weekday to a date.
+func upcomingDays(today time.Time) string {
+	days := make([]string, 0, 7)
+	for i := 1; i <= 7; i++ {
+		day := today.AddDate(0, 0, i)
+		days = append(days, weekdays[day.Weekday()]+" é "+day.Format("2006-01-02"))
+	}
+	return strings.Join(days, ", ")
+}
+
+// getProductsAndDate describes the extraction function. It is built for each
+// call so the model knows today's date and weekday.
+func getProductsAndDate(today time.Time) openai.FunctionDefinition {
+	date := today.Format("2006-01-02")
+	return openai.FunctionDefinition{
+		Name:        "getProductsAndDate",
+		Description: "Get products from user based on his queries and date of delivery",
+		Parameters: jsonschema.Definition{
+			Type: "object",
+			Properties: map[string]jsonschema.Definition{
+				"products": {
+					Type: "array",
+					Description: `O usuário informará os vapes, pods, coils e juices que ele quer comprar.
 				Ele pode informar a marca ou modelo destes.
 				Exemplos: "SMOK Nord 2, SWAG Kit, SWAG PX80" no caso de PODs, "Freebase" no caso de Juices para Vapes, etc.
 				Para cada item informado, retorne o item, o sabor, a quantidade e o volume.
 				Se algum desses campos não for informado, retorne valor vazio.
 				Exemplo: "Quero um juice de morango de 30ml". Resposta: "juice", "morango", "1", "30".
 				Outro exemplo: "Quero um vape". Resposta: "vape", "", "1", "0".`,
-				Items: &jsonschema.Definition{
-					Type: "object",
-					Properties: map[string]jsonschema.Definition{
-						"item": {
-							Type: "string",
-							Description: `O usuário informará os vapes, pods, coils e juices que ele quer comprar. 
+					Items: &jsonschema.Definition{
+						Type: "object",
+						Properties: map[string]jsonschema.Definition{
+							"item": {
+								Type: "string",
+								Description: `O usuário informará os vapes, pods, coils e juices que ele quer comprar. 
 							Ele pode informar a marca ou modelo destes. 
 							Exemplos: "SMOK Nord 2, SWAG Kit, SWAG PX80" no caso de PODs, "Freebase" no caso de Juices para Vapes, etc.
 							Outro exemplo: "Vou querer um pod SWAG Kit de morango." Retorne: "SWAG Kit"`,
-						},
-						"flavor": {
-							Type: "string",
-							Description: `Se o usuário informar que quer comprar um Juice como produto, ele poderá informar os sabores.
+							},
+							"flavor": {
+								Type: "string",
+								Description: `Se o usuário informar que quer comprar um Juice como produto, ele poderá informar os sabores.
 							Aqui os sabores podem ser tanto de juices quanto de nicsalts.
 							Juice é para Vape e Nicsalt é para POD. 
 							Exemplo: "Freebase de morango", "Nicsalt de uva". Salve apenas os sabores.
@@ -42,38 +61,60 @@ var getProductsAndDate = openai.FunctionDefinition{
 							Se o usuário não informar item "juice" ou "nicsalt", retorne valor vazio. 
 							Exemplo: "Vou querer um vape e um pod". Resposta: ""
 							Exemplo: "Amanhã não é um bom dia pra mim, mas vou buscar próxima segunda-feira as 14h00". Resposta: ""`,
-						},
-						"quantity": {
-							Type: "integer",
-							Description: `O usuário informará a quantidade de itens que ele quer comprar. 
+							},
+							"quantity": {
+								Type: "integer",
+								Description: `O usuário informará a quantidade de itens que ele quer comprar. 
 							Ele pode informar diferentes quantidades, para cada item diferente. 
 							Exemplos: "2 Freebase de morango", "3 vapes de menta". Retorne apenas a quantidade.
 							Exemplo: "Vou querer um juice de morango". Resposta: "1"`,
-						},
-						"volume": {
-							Type: "string",
-							Description: `Retorne a quantidade de ml do produto em numeral.
+							},
+							"volume": {
+								Type: "string",
+								Description: `Retorne a quantidade de ml do produto em numeral.
 							"Exemplo: "Vou querer um juice de morango de 30ml". Resposta: "30".
 							"Retorne "0" se o usuário não informar o volume. Exemplo: "Vou querer um juice de morango". Resposta: "0"`,
-							Enum: []string{"0", "15", "30", "60", "100"},
+								Enum: []string{"0", "15", "30", "60", "100"},
+							},
 						},
+						Required: []string{"product", "flavor", "quantity", "volume"},
 					},
-					Required: []string{"product", "flavor", "quantity", "volume"},
 				},
-			},
-			"date": {
-				Type: "string",
-				Description: `Hoje é ` + date + `. Então amanhã é ` + time.Now().AddDate(0, 0, 1).Format("2006-01-02") + `. Depois de amanhã é ` + time.Now().AddDate(0, 0, 2).Format("2006-01-02") + `. E assim por diante.
+				"date": {
+					Type: "string",
+					Description: `Hoje é ` + weekdays[today.Weekday()] + `, ` + date + `. Então amanhã é ` + today.AddDate(0, 0, 1).Format("2006-01-02") + `. Depois de amanhã é ` + today.AddDate(0, 0, 2).Format("2006-01-02") + `. E assim por diante.
+				Nos próximos dias, ` + upcomingDays(today) + `. Se o usuário informar só o dia da semana, retorne a próxima data desse dia.
 				Se o usuário não informar data, retorne a data de hoje. Exemplo: "Vou querer um juice de morango e um vape". Resposta: "` + date + `"`,
-			},
-			"time": {
-				Type: "string",
-				Description: `Retorne a hora informada pelo usuário no formato hh:mm.
+				},
+				"time": {
+					Type: "string",
+					Description: `Retorne a hora informada pelo usuário no formato hh:mm.
 				Use ":" para separar hora de minutos.
 				Exemplo: "Vou buscar aí amanhã as 14h30", retorne: "14:30".
 				Exemplo: "Vou buscar aí amanhã as 13h10", retorne: "13:10". 
 				Retorne a hora nesse formato: "hh:mm" Se o usuário não infomar hora, retorne "". 
 				Exemplo: "Vou querer um juice de morango e um vape". Resposta: ""`,
+				},
+			},
+		},
+	}
+}
+
+var getRecommendations = openai.FunctionDefinition{
+	Name: "getRecommendations",
+	Description: `Sugere produtos em estoque para o cliente, com base no que outros clientes compram juntos,
+	nos sabores preferidos do cliente e em produtos parecidos. Use quando o cliente pedir uma sugestão
+	ou perguntar o que combina com um produto.`,
+	Parameters: jsonschema.Definition{
+		Type: "object",
+		Properties: map[string]jsonschema.Definition{
+			"product": {
+				Type:        "string",
+				Description: `O produto que o cliente está comprando ou sobre o qual perguntou, se houver. Exemplo: "SWAG Kit".`,
+			},
+			"flavor": {
+				Type:        "string",
+				Description: `O sabor desse produto, se informado. Exemplo: "morango".`,
 			},
 		},
 	},
@@ -2,178 +2,103 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"os"
-	"testing"
-
 	"encoding/json"
-
+	"reflect"
+	"strings"
+	"testing"
 	"time"
 
-	"github.com/sashabaranov/go-openai"
+	openai "github.com/sashabaranov/go-openai"
 )
 
-func gptCall(message string) (Arguments, error) {
-	client := openai.NewClient(os.Getenv("OPENAI_AUTH_TOKEN"))
-
-	var messages []openai.ChatCompletionMessage
-	chatMessage := append(messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
-		Content: message,
-	})
-
-	weekday = time.Now().Weekday()
-	weekdayStr = weekday.String()
-	date = time.Now().Format("2006-01-02")
-
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model:     os.Getenv("OPENAI_MODEL_ID"),
-			Messages:  chatMessage,
-			Functions: []openai.FunctionDefinition{getProductsAndDate},
-		},
-	)
-	if err != nil {
-		fmt.Printf("ChatCompletion error: %v\n", err)
-	}
-
-	var arguments Arguments
-
-	incommingArguments := ""
-
-	if resp.Choices[0].Message.Content == "" {
-		incommingArguments = resp.Choices[0].Message.FunctionCall.Arguments
-	} else {
-		incommingArguments = resp.Choices[0].Message.Content
-	}
-
-	json.Unmarshal([]byte(incommingArguments), &arguments)
-
-	fmt.Printf("ChatCompletion response: %v\n", arguments)
-	fmt.Printf("Date: %v\n", arguments.Date)
-	fmt.Printf("Time: %v\n", arguments.Time)
-
-	for i, product := range arguments.Products {
-		fmt.Printf("Product %d:\n", i+1)
-		fmt.Printf("\tItem: %s\n", product.Item)
-		fmt.Printf("\tFlavor: %s\n", product.Flavor)
-		fmt.Printf("\tQuantity: %d\n", product.Quantity)
-		fmt.Printf("\tVolume: %s\n", product.Volume)
-	}
-
-	argumentsJSON, err := json.Marshal(arguments)
-	if err != nil {
-		fmt.Printf("Error marshaling arguments: %v\n", err)
-		return arguments, err
-	}
-
-	// Print the JSON string
-	fmt.Printf("ChatCompletion response in JSON format: %s\n", argumentsJSON)
-	return arguments, nil
+// functionCompleter answers every request with a getProductsAndDate call
+// with the given arguments.
+type functionCompleter struct {
+	arguments string
+	requests  []openai.ChatCompletionRequest
 }
 
-func TestGPTFunction(t *testing.T) {
-	message := "Vou querer um juice de morango e um vape. Vou buscar aí amanhã as 14h00"
-	fmt.Printf("TestMessage: %s\n", message)
-
-	arguments, err := gptCall(message)
-	if err != nil {
-		fmt.Printf("Error calling GPT: %v\n", err)
-		return
+func (f *functionCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	f.requests = append(f.requests, request)
+	message := openai.ChatCompletionMessage{
+		Role:         openai.ChatMessageRoleAssistant,
+		FunctionCall: &openai.FunctionCall{Name: "getProductsAndDate", Arguments: f.arguments},
 	}
+	return openai.ChatCompletionResponse{Choices: []openai.ChatCompletionChoice{{Message: message}}}, nil
+}
 
-	foundVape := false
-	foundJuice := false
-	for _, product := range arguments.Products {
-		if product.Item == "vape" {
-			foundVape = true
-			if product.Quantity != 1 {
-				t.Errorf("Quantity is not correct for vape: %d", product.Quantity)
-			}
+func TestExtractArguments(t *testing.T) {
+	// A Wednesday.
+	now := time.Date(2023, 8, 9, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		message   string
+		arguments string
+		// described is the date the function description gives the model to
+		// resolve the message.
+		described string
+		want      Arguments
+	}{
+		{
+			message:   "Vou querer um juice de morango e um vape. Vou buscar aí amanhã as 14h00",
+			arguments: `{"products": [{"item": "juice", "flavor": "morango", "quantity": 1, "volume": "0"}, {"item": "vape", "flavor": "", "quantity": 1, "volume": "0"}], "date": "2023-08-10", "time": "14:00"}`,
+			described: "Então amanhã é 2023-08-10",
+			want: Arguments{Products: []ExtractedProduct{{Item: "juice", Flavor: "morango", Quantity: 1, Volume: "0"}, {Item: "vape", Quantity: 1, Volume: "0"}},
+				Date: "2023-08-10", Time: "14:00"},
+		},
+		{
+			message:   "Amanhã não é um bom dia pra mim, mas vou buscar próxima segunda-feira às 14h25",
+			arguments: `{"products": [], "date": "2023-08-14", "time": "14:25"}`,
+			described: "segunda-feira é 2023-08-14",
+			want:      Arguments{Products: []ExtractedProduct{}, Date: "2023-08-14", Time: "14:25"},
+		},
+		{
+			message:   "Vou querer um juice de morango de 40ml",
+			arguments: `{"products": [{"item": "juice", "flavor": "morango", "quantity": 1, "volume": "40"}], "date": "2023-08-09", "time": ""}`,
+			described: "Hoje é quarta-feira, 2023-08-09",
+			want:      Arguments{Products: []ExtractedProduct{{Item: "juice", Flavor: "morango", Quantity: 1, Volume: "40"}}, Date: "2023-08-09"},
+		},
+	} {
+		s, _, _, _ := newTestService(t, now)
+		completer := &functionCompleter{arguments: test.arguments}
+		s.llm = newTestLLM(time.Now, &llmProvider{model: "gpt-4", client: completer})
+
+		raw, err := s.extractArguments(context.Background(), test.message, "", nil)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if product.Item == "juice" {
-			foundJuice = true
-			if product.Flavor != "morango" {
-				t.Errorf("Flavor is not correct for juice: %s", product.Flavor)
-			}
+		var arguments Arguments
+		if err := json.Unmarshal([]byte(raw), &arguments); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(arguments, test.want) {
+			t.Errorf("Arguments of %q are not correct: %+v", test.message, arguments)
 		}
-	}
-
-	if !foundVape {
-		t.Errorf("Vape product not found")
-	}
-	if !foundJuice {
-		t.Errorf("Juice product not found")
-	}
-
-	if arguments.Date != time.Now().Add(time.Hour*24).Format("2006-01-02") {
-		t.Errorf("Date is not correct: %s", arguments.Date)
-	}
-
-	if arguments.Time != "14:00" {
-		t.Errorf("Time is not correct: %s", arguments.Time)
-	}
-}
-func TestGPTFunctionDates(t *testing.T) {
-	message := "Vou buscar aí amanhã às 13h10"
-	fmt.Printf("TestMessage: %s\n", message)
-
-	arguments, err := gptCall(message)
-	if err != nil {
-		fmt.Printf("Error calling GPT: %v\n", err)
-		return
-	}
-
-	if arguments.Date != time.Now().Add(time.Hour*24).Format("2006-01-02") {
-		t.Errorf("Date is not correct: %s", arguments.Date)
-	}
-
-	if arguments.Time != "13:10" {
-		t.Errorf("Time is not correct: %s", arguments.Time)
-	}
-}
-
-func TestGPTFunctionWeekdays(t *testing.T) {
-	message := "Amanhã não é um bom dia pra mim, mas vou buscar próxima segunda-feira às 14h25"
-	fmt.Printf("TestMessage: %s\n", message)
-
-	arguments, err := gptCall(message)
-	if err != nil {
-		fmt.Printf("Error calling GPT: %v\n", err)
-		return
-	}
-
-	if arguments.Date != time.Now().Add(time.Hour*24*6).Format("2006-01-02") {
-		t.Errorf("Date is not correct: %s", arguments.Date)
-	}
 
-	if arguments.Time != "14:25" {
-		t.Errorf("Time is not correct: %s", arguments.Time)
+		request := completer.requests[0]
+		last := request.Messages[len(request.Messages)-1]
+		if last.Role != openai.ChatMessageRoleUser || last.Content != test.message {
+			t.Errorf("Message was not sent: %+v", last)
+		}
+		if len(request.Functions) != 1 || request.Functions[0].Name != "getProductsAndDate" {
+			t.Fatalf("Extraction function was not sent: %+v", request.Functions)
+		}
+		parameters, _ := json.Marshal(request.Functions[0].Parameters)
+		if !strings.Contains(string(parameters), test.described) {
+			t.Errorf("Function description does not give %q: %s", test.described, parameters)
+		}
 	}
 }
 
-func TestGPTFunctionVolume(t *testing.T) {
-	message := "Vou querer um juice de morango de 40ml"
-	fmt.Printf("TestMessage: %s\n", message)
-
-	arguments, err := gptCall(message)
-	if err != nil {
-		fmt.Printf("Error calling GPT: %v\n", err)
-		return
-	}
-
-	product := arguments.Products[0]
-
-	if product.Item != "juice" {
-		t.Errorf("Item is not correct: %s", product.Item)
-	}
-
-	if product.Flavor != "morango" {
-		t.Errorf("Flavor is not correct: %s", product.Flavor)
-	}
+func TestExtractArgumentsFromContent(t *testing.T) {
+	s, _, _, _ := newTestService(t, time.Now())
+	completer := &fakeCompleter{reply: `{"products": [], "date": "", "time": ""}`}
+	s.llm = newTestLLM(time.Now, &llmProvider{model: "gpt-4", client: completer})
 
-	if product.Volume != "40" {
-		t.Errorf("Volume is not correct: %s", product.Volume)
+	// Models that answer with the arguments as text instead of a function
+	// call are read the same way.
+	raw, err := s.extractArguments(context.Background(), "oi", "", nil)
+	if err != nil || raw != completer.reply {
+		t.Errorf("Arguments are not correct: %q, %v", raw, err)
 	}
 }
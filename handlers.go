@@ -2,109 +2,454 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
-	"fmt"
-	"os"
+	"errors"
+	"log/slog"
 	"strings"
 	"time"
 
+	"github.com/arthurborgesdev/relationship-bot/pii"
 	"github.com/gofiber/fiber/v2"
 	openai "github.com/sashabaranov/go-openai"
 )
 
+// Customer facing routes (channel webhooks). These are not authenticated.
 func (s *LLMService) RegisterRoutes(router fiber.Router) {
 	router.Post("/messages", s.chat)
-	router.Get("/messagesdb", s.getMessagesRelational)
-	router.Post("/messagesdb", s.insertMessageRelational)
-	router.Get("/productsdb", s.getProductsRelational)
-	router.Post("/productsdb", s.insertProductsRelational)
-
-	router.Delete("/productsdb/:id", s.deleteProduct)
+	router.Post("/channels/status", s.channelStatus)
 }
 
-var weekday time.Weekday
-var weekdayStr string
-var date string
+// Management routes. The router is expected to be authenticated and audited.
+func (s *LLMService) RegisterAdminRoutes(router fiber.Router) {
+	router.Get("/messagesdb", requireRole(readRoles...), s.getMessagesRelational)
+	router.Post("/messagesdb", requireRole(writeRoles...), s.insertMessageRelational)
+	router.Get("/productsdb", requireRole(readRoles...), s.getProductsRelational)
+	router.Post("/productsdb", requireRole(writeRoles...), s.insertProductsRelational)
+	router.Patch("/productsdb/:id", requireRole(writeRoles...), s.updateProduct)
+	router.Post("/productsdb/import", requireRole(writeRoles...), s.importProducts)
+	router.Get("/productsdb/export", requireRole(readRoles...), s.exportProducts)
+	router.Post("/productsdb/:id/archive", requireRole(writeRoles...), s.archiveProduct(true))
+	router.Post("/productsdb/:id/unarchive", requireRole(writeRoles...), s.archiveProduct(false))
+	router.Get("/stock/movements", requireRole(readRoles...), s.getStockMovements)
+	router.Post("/stock/movements", requireRole(writeRoles...), s.createStockMovement)
+	router.Get("/stock/report", requireRole(readRoles...), s.getStockReport)
+	router.Get("/waitlist", requireRole(readRoles...), s.getWaitlist)
+	router.Get("/recommendations", requireRole(readRoles...), s.getRecommendations)
+	router.Get("/ordersdb", requireRole(readRoles...), s.getOrders)
+	router.Post("/ordersdb/:id/complete", requireRole(writeRoles...), s.completeOrderHandler)
+	router.Get("/jobs", requireRole(readRoles...), s.getJobs)
+	router.Get("/contacts", requireRole(readRoles...), s.searchContacts)
+	router.Get("/contacts/:id", requireRole(readRoles...), s.getContact)
+	router.Patch("/contacts/:id", requireRole(writeRoles...), s.updateContact)
+	router.Get("/auditlogs", requireRole(ownerRoles...), s.getAuditLogs)
+	router.Get("/contacts/:id/export", requireRole(ownerRoles...), s.exportContactData)
+	router.Get("/datarequests", requireRole(ownerRoles...), s.getDataRequests)
+	router.Get("/datarequests/verify", requireRole(ownerRoles...), s.verifyDataRequests)
+	router.Get("/retention/reports", requireRole(ownerRoles...), s.getPurgeReports)
+	router.Post("/retention/run", requireRole(ownerRoles...), s.runPurge)
+	router.Get("/usage", requireRole(readRoles...), s.getUsage)
+	router.Get("/usage/budgets", requireRole(readRoles...), s.getBudgets)
+	router.Get("/inbound/stuck", requireRole(readRoles...), s.getStuckMessages)
+	router.Get("/inbound/deadletters", requireRole(ownerRoles...), s.getDeadLetters)
+	router.Post("/inbound/deadletters/:id/requeue", requireRole(ownerRoles...), s.requeueDeadLetter)
+	router.Get("/campaigns", requireRole(readRoles...), s.getCampaigns)
+	router.Post("/campaigns", requireRole(writeRoles...), s.createCampaign)
+	router.Get("/campaigns/:id", requireRole(readRoles...), s.getCampaign)
+	router.Get("/campaigns/:id/preview", requireRole(readRoles...), s.previewCampaign)
+	router.Post("/campaigns/:id/send", requireRole(ownerRoles...), s.sendCampaign)
+	router.Post("/campaigns/:id/cancel", requireRole(writeRoles...), s.cancelCampaign)
+
+	router.Delete("/productsdb/:id", requireRole(ownerRoles...), s.deleteProduct)
+	router.Delete("/contacts/:id", requireRole(ownerRoles...), s.eraseContactData)
+}
 
 func (s *LLMService) chat(c *fiber.Ctx) error {
 	message := new(Message)
 
 	if err := c.BodyParser(message); err != nil {
-		fmt.Printf("Bodyparsing error: %v\n", err)
+		slog.WarnContext(c.UserContext(), "invalid message body", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 	}
 
-	// chatHistory, err := chatHistory(c, s, message)
-	// if err != nil {
-	// 	fmt.Printf("chatHistory fetching resulted in error: %v", err)
-	// 	c.Status(fiber.StatusInternalServerError).SendString(err.Error())
-	// }
+	ctx := c.UserContext()
+	tenant, ok := s.webhookTenant(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "invalid webhook token",
+		})
+	}
+	message.Tenant = tenant
+
+	// Providers redeliver webhooks: a message already answered gets the
+	// stored response and is not processed again.
+	message.IdempotencyKey = idempotencyKey(c, message)
+	var record *IdempotencyRecord
+	if message.IdempotencyKey != "" {
+		var done bool
+		var err error
+		record, done, err = s.beginRequest(ctx, message.IdempotencyKey, message.Tenant, time.Now())
+		if errors.Is(err, errRequestInFlight) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "idempotency check failed", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if done {
+			slog.InfoContext(ctx, "duplicate message, replaying response", "message_id", message.ExternalID)
+			return s.replayResponse(c, record)
+		}
+	}
+	respond := func(status int, body interface{}, contactID uint) error {
+		if record != nil {
+			if err := s.finishRequest(ctx, record, status, body, contactID); err != nil {
+				slog.ErrorContext(ctx, "store response for replay failed", "error", err)
+			}
+		}
+		return c.Status(status).JSON(body)
+	}
+	fail := func(err error) error {
+		if record != nil {
+			if err := s.abandonRequest(ctx, record); err != nil {
+				slog.ErrorContext(ctx, "release idempotency key failed", "error", err)
+			}
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 
-	var messages []openai.ChatCompletionMessage
-	chatMessage := append(messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
-		Content: message.Content,
-	})
+	orderFunnel.WithLabelValues(stageMessageReceived).Inc()
+
+	// Messages sent in a row are answered together once the contact stops
+	// typing, through the channel. The idempotency record is finished when
+	// the turn is answered: until then redeliveries get 409, and after a
+	// crash they take the record over and process the message again.
+	if s.debouncer != nil && message.Sender != "" {
+		buffered := s.debouncer.Add(message, record)
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"debounced": true,
+			"messages":  buffered,
+		})
+	}
+
+	if s.config.Inbound.Async {
+		id, err := s.inbound.Enqueue(ctx, message, time.Now())
+		if err != nil {
+			slog.ErrorContext(ctx, "enqueue message failed", "error", err)
+			return fail(err)
+		}
+		s.workers.Notify()
+		return respond(fiber.StatusAccepted, fiber.Map{
+			"queued": true,
+			"id":     id,
+		}, 0)
+	}
 
-	weekday = time.Now().Weekday()
-	weekdayStr = weekday.String()
-	date = time.Now().Format("2006-01-02")
+	response, err := s.processMessage(ctx, message)
+	if errors.Is(err, errLLMUnavailable) {
+		// The customer gets an apology right away and the message is
+		// answered by a job once the LLM is back.
+		slog.ErrorContext(ctx, "llm unavailable, message queued", "error", err)
+		if err := s.queueMessage(ctx, message); err != nil {
+			slog.ErrorContext(ctx, "queue message failed", "error", err)
+		}
+		return respond(fiber.StatusOK, fiber.Map{
+			"reply":  llmApology,
+			"queued": true,
+		}, 0)
+	}
+	if err != nil {
+		return fail(err)
+	}
 
-	resp, err := s.llmClient.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model:     os.Getenv("OPENAI_MODEL_ID"),
-			Messages:  chatMessage,
-			Functions: []openai.FunctionDefinition{getProductsAndDate},
-		},
-	)
+	return respond(response.status, response.body, response.contactID)
+}
+
+// chatResponse is the response to an inbound message: the HTTP status and
+// body, and the text to send the customer when the message is answered
+// outside of the request.
+type chatResponse struct {
+	status    int
+	body      interface{}
+	reply     string
+	contactID uint
+}
+
+// processMessage answers an inbound message. Nothing is stored when it fails
+// with errLLMUnavailable, so the message can be processed again later.
+func (s *LLMService) processMessage(ctx context.Context, message *Message) (chatResponse, error) {
+	// Personal data is replaced with placeholders before the text reaches
+	// the LLM and put back in the replies.
+	vault := pii.NewVault()
+	content := vault.Redact(s.config.Tenant(message.Tenant).Redaction, message.Content)
+	if vault.Len() > 0 {
+		slog.DebugContext(ctx, "personal data redacted", "values", vault.Len())
+	}
+
+	contact, err := resolveContact(ctx, s.repos, message)
 	if err != nil {
-		fmt.Printf("ChatCompletion error: %v\n", err)
-		return c.SendString(err.Error())
+		slog.ErrorContext(ctx, "resolve contact failed", "error", err)
+	}
+	var contactID uint
+	if contact != nil {
+		contactID = contact.ID
+		if err := s.recordCampaignReply(ctx, contactID, s.scheduler.now()); err != nil {
+			slog.ErrorContext(ctx, "record campaign reply failed", "contact_id", contactID, "error", err)
+		}
 	}
 
+	// LLM calls are billed to the tenant and the contact. Once the tenant's
+	// monthly budget is exhausted the bot switches to a cheaper model or to
+	// FAQ only mode, where the LLM is not called at all.
+	scope := usageScope{Tenant: message.Tenant, ContactID: contactID}
+	budget, err := s.budgetStatus(ctx, message.Tenant)
+	if err != nil {
+		slog.ErrorContext(ctx, "budget check failed", "error", err)
+	}
+	faqOnly := false
+	if budget.Exhausted {
+		slog.WarnContext(ctx, "llm budget exhausted", "tenant", budget.Tenant, "spent", budget.Spent, "mode", budget.Mode)
+		switch budget.Mode {
+		case BudgetModeCheaperModel:
+			scope.Model = s.config.Tenant(budget.Tenant).Budget.CheaperModel
+		case BudgetModeFAQOnly:
+			faqOnly = true
+		}
+	}
+	ctx = withUsageScope(withVault(ctx, vault), scope)
+
+	classifier := s.intents
+	if faqOnly {
+		classifier = ruleClassifier{}
+	}
+	intent, err := classifier.Classify(ctx, content)
+	if err != nil {
+		slog.ErrorContext(ctx, "intent classification failed", "error", err)
+		intent = IntentResult{Intent: IntentOrder, Source: "default"}
+	}
+	slog.InfoContext(ctx, "message classified", "intent", intent.Intent, "confidence", intent.Confidence, "source", intent.Source, "contact_id", contactID)
+	message.Intent = string(intent.Intent)
+	message.IntentConfidence = intent.Confidence
+
+	if contact != nil {
+		// The "sim"/"não" answering a waitlist offer.
+		reply, handled, err := s.handleWaitlistReply(ctx, contact, content)
+		if err != nil {
+			slog.ErrorContext(ctx, "waitlist reply failed", "contact_id", contactID, "error", err)
+			return chatResponse{}, err
+		}
+		if handled {
+			reply = vault.Restore(reply)
+			s.saveConversation(ctx, message, contactID, reply)
+			return chatResponse{status: fiber.StatusOK, body: fiber.Map{
+				"reply": reply,
+			}, reply: reply, contactID: contactID}, nil
+		}
+
+		// A pending confirmation ("sim"/"não") always goes to the order change flow.
+		pending, err := s.pendingOrderChange(ctx, contactID)
+		if err != nil {
+			slog.ErrorContext(ctx, "pending order change lookup failed", "contact_id", contactID, "error", err)
+		}
+
+		if pending != nil || (intent.Intent == IntentSchedule && !faqOnly) {
+			reply, order, handled, err := s.handleOrderChange(ctx, contact, content)
+			if err != nil {
+				slog.ErrorContext(ctx, "order change failed", "contact_id", contactID, "error", err)
+				return chatResponse{}, err
+			}
+			if handled {
+				reply = vault.Restore(reply)
+				s.saveConversation(ctx, message, contactID, reply)
+				return chatResponse{status: fiber.StatusOK, body: fiber.Map{
+					"reply": reply,
+					"order": order,
+				}, reply: reply, contactID: contactID}, nil
+			}
+		}
+	}
+
+	replies := map[Intent]func(ctx context.Context, contact *Contact, content string) (string, error){
+		IntentFAQ:       s.replyFAQ,
+		IntentSmallTalk: s.replySmallTalk,
+		IntentComplaint: s.replyComplaint,
+		IntentHandoff:   s.replyHandoff,
+		IntentOptOut:    s.replyOptOut,
+	}
+	if faqOnly {
+		replies[IntentFAQ] = s.replyStaticFAQ
+		replies[IntentOrder] = s.replyLLMUnavailable
+		replies[IntentSchedule] = s.replyLLMUnavailable
+	}
+	if replyTo, ok := replies[intent.Intent]; ok {
+		reply, err := replyTo(ctx, contact, content)
+		if err != nil {
+			slog.ErrorContext(ctx, "reply failed", "intent", intent.Intent, "error", err)
+			return chatResponse{}, err
+		}
+		reply = vault.Restore(reply)
+		s.saveConversation(ctx, message, contactID, reply)
+		return chatResponse{status: fiber.StatusOK, body: fiber.Map{
+			"reply":  reply,
+			"intent": intent.Intent,
+		}, reply: reply, contactID: contactID}, nil
+	}
+
+	// Orders, and schedule requests that are not about an existing order
+	// (booking a new pickup), go through the product extraction.
+	return s.takeOrder(ctx, message, contact, content, vault)
+}
+
+// takeOrder extracts the products from the redacted content and places the order.
+func (s *LLMService) takeOrder(ctx context.Context, message *Message, contact *Contact, content string, vault *pii.Vault) (chatResponse, error) {
+	var contactID uint
+	if contact != nil {
+		contactID = contact.ID
+	}
+
+	orderFunnel.WithLabelValues(stageExtractionStarted).Inc()
+	profile := vault.Redact(s.config.Tenant(message.Tenant).Redaction, contactProfilePrompt(contact))
+	incommingArguments, err := s.extractArguments(ctx, content, profile, s.conversationContext(ctx, contact, content))
+	if err != nil {
+		extractions.WithLabelValues("error").Inc()
+		slog.ErrorContext(ctx, "product extraction failed", "error", err)
+		return chatResponse{}, err
+	}
+	incommingArguments = vault.Restore(incommingArguments)
+
 	var arguments Arguments
 
-	incommingArguments := ""
+	// Save entries in Message DB to build a history -> Useful for medical scenario (not vape)
+	s.saveConversation(ctx, message, contactID, incommingArguments)
 
-	if resp.Choices[0].Message.Content == "" {
-		incommingArguments = resp.Choices[0].Message.FunctionCall.Arguments
+	if err := json.Unmarshal([]byte(incommingArguments), &arguments); err != nil {
+		extractions.WithLabelValues("invalid").Inc()
+		slog.WarnContext(ctx, "invalid extracted arguments", "arguments", incommingArguments, "error", err)
+	} else if len(arguments.Products) == 0 {
+		extractions.WithLabelValues("empty").Inc()
 	} else {
-		incommingArguments = resp.Choices[0].Message.Content
+		extractions.WithLabelValues("success").Inc()
+		orderFunnel.WithLabelValues(stageProductsExtracted).Inc()
 	}
 
-	// Save entries in Message DB to build a history -> Useful for medical scenario (not vape)
-	s.db.Create(&Message{Content: message.Content, Role: openai.ChatMessageRoleUser})
-	s.db.Create(&Message{Content: incommingArguments, Role: openai.ChatMessageRoleAssistant})
+	if contact != nil {
+		if err := enrichContact(ctx, s.repos, contact, arguments); err != nil {
+			slog.ErrorContext(ctx, "enrich contact failed", "contact_id", contactID, "error", err)
+		}
+	}
 
-	json.Unmarshal([]byte(incommingArguments), &arguments)
+	order, product, placed, err := s.placeReservedOrder(ctx, contactID, message.IdempotencyKey, arguments)
+	if errors.Is(err, ErrNoProducts) || errors.Is(err, ErrNotFound) {
+		return chatResponse{status: fiber.StatusNotFound, body: fiber.Map{
+			"error": err.Error(),
+		}, reply: orderNotFoundText, contactID: contactID}, nil
+	}
+	if errors.Is(err, ErrOutOfStock) {
+		reply, err := s.offerWaitlist(ctx, contact, product)
+		if err != nil {
+			return chatResponse{}, err
+		}
+		return chatResponse{status: fiber.StatusOK, body: fiber.Map{
+			"reply":        reply,
+			"product":      product,
+			"out_of_stock": true,
+		}, reply: reply, contactID: contactID}, nil
+	}
+	if err != nil {
+		return chatResponse{}, err
+	}
 
-	var product Products
+	if placed {
+		orderFunnel.WithLabelValues(stageOrderPlaced).Inc()
 
-	result := s.db.Where("product = ? OR flavor = ? OR quantity = ?", arguments.Products[0].Item, arguments.Products[0].Flavor, arguments.Products[0].Quantity).First(&product)
-	if result.Error != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": result.Error,
-		})
+		if err := s.scheduleOrderFollowUps(ctx, order, contact); err != nil {
+			slog.ErrorContext(ctx, "schedule order follow ups failed", "order_id", order.ID, "error", err)
+		}
+	} else {
+		slog.InfoContext(ctx, "order already placed for this message", "order_id", order.ID)
 	}
 
-	fmt.Println(product)
+	reply := s.orderPlacedText(order)
+	if placed {
+		if suggestion := s.orderSuggestion(ctx, contact, order); suggestion != "" {
+			reply += " " + suggestion
+		}
+	}
 
-	return c.JSON(product)
+	return chatResponse{status: fiber.StatusOK, body: product, reply: reply, contactID: contactID}, nil
 }
 
+// tenantID returns the tenant an admin request is made for, from the
+// X-Tenant-ID header. Only authenticated routes may use it: channel webhooks
+// get their tenant from webhookTenant.
+func tenantID(c *fiber.Ctx) string {
+	if id := c.Get("X-Tenant-ID"); id != "" {
+		return id
+	}
+	return defaultTenant
+}
+
+// webhookTenant returns the tenant of a channel webhook, the one whose
+// webhook token it carries in the X-Webhook-Token header. A webhook without
+// a token is the default tenant's, unless that tenant has a token. It
+// reports false when the webhook is not authenticated.
+func (s *LLMService) webhookTenant(c *fiber.Ctx) (string, bool) {
+	token := c.Get("X-Webhook-Token")
+	if token == "" {
+		return defaultTenant, s.config.Tenant(defaultTenant).WebhookToken == ""
+	}
+	for id, tenant := range s.config.Tenants {
+		if tenant.WebhookToken != "" && subtle.ConstantTimeCompare([]byte(tenant.WebhookToken), []byte(token)) == 1 {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// saveConversation stores the inbound message and the bot reply.
+func (s *LLMService) saveConversation(ctx context.Context, message *Message, contactID uint, reply string) {
+	userMessage := &Message{Content: message.Content, Role: openai.ChatMessageRoleUser, ContactID: contactID, Channel: message.Channel, Sender: message.Sender,
+		Tenant: message.Tenant, Intent: message.Intent, IntentConfidence: message.IntentConfidence, ExternalID: message.ExternalID}
+	if err := s.repos.Messages.Create(ctx, userMessage); err != nil {
+		slog.ErrorContext(ctx, "save user message failed", "error", err)
+	}
+
+	assistantMessage := &Message{Content: reply, Role: openai.ChatMessageRoleAssistant, ContactID: contactID, Channel: message.Channel, Tenant: message.Tenant}
+	if err := s.repos.Messages.Create(ctx, assistantMessage); err != nil {
+		slog.ErrorContext(ctx, "save assistant message failed", "error", err)
+	}
+
+	if contactID != 0 {
+		if err := s.scheduleSummary(ctx, contactID); err != nil {
+			slog.ErrorContext(ctx, "schedule conversation summary failed", "contact_id", contactID, "error", err)
+		}
+	}
+}
+
+// getMessagesRelational lists the messages, optionally filtered by
+// ?contact_id= and searched with ?q=.
 func (s *LLMService) getMessagesRelational(c *fiber.Ctx) error {
-	var messages []Message
-	result := s.db.Find(&messages)
+	filter := MessageFilter{ContactID: uint(c.QueryInt("contact_id")), Query: c.Query("q"), Limit: c.QueryInt("limit")}
 
-	if result.Error != nil {
+	var messages []Message
+	var err error
+	if filter == (MessageFilter{}) {
+		messages, err = s.repos.Messages.List(c.UserContext())
+	} else {
+		messages, err = s.repos.Messages.Search(c.UserContext(), filter)
+	}
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": result.Error,
+			"error": err.Error(),
 		})
 	}
 
-	fmt.Println(result)
-
 	return c.JSON(messages)
 }
 
@@ -115,43 +460,44 @@ func (s *LLMService) insertMessageRelational(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 	}
 
-	resp, err := s.llmClient.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: os.Getenv("OPENAI_MODEL_ID"),
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: message.Content,
-				},
+	ctx := withUsageScope(c.UserContext(), usageScope{Tenant: tenantID(c)})
+	vault := pii.NewVault()
+	resp, err := s.llm.complete(ctx, "chat", openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: vault.Redact(s.config.Tenant(tenantID(c)).Redaction, message.Content),
 			},
 		},
-	)
+	})
 	if err != nil {
-		fmt.Printf("ChatCompletion error: %v\n", err)
-		return c.SendString(err.Error())
+		slog.ErrorContext(ctx, "chat completion failed", "error", err)
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": err.Error(),
+		})
 	}
+	reply := vault.Restore(resp.Choices[0].Message.Content)
 
-	s.db.Create(&Message{Content: message.Content, Role: openai.ChatMessageRoleUser})
-	s.db.Create(&Message{Content: resp.Choices[0].Message.Content, Role: openai.ChatMessageRoleAssistant})
+	if err := s.repos.Messages.Create(ctx, &Message{Content: message.Content, Role: openai.ChatMessageRoleUser}); err != nil {
+		slog.ErrorContext(ctx, "save user message failed", "error", err)
+	}
+	if err := s.repos.Messages.Create(ctx, &Message{Content: reply, Role: openai.ChatMessageRoleAssistant}); err != nil {
+		slog.ErrorContext(ctx, "save assistant message failed", "error", err)
+	}
 
-	fmt.Println(resp.Choices[0].Message.Content)
+	slog.DebugContext(ctx, "chat reply", "reply", reply)
 
-	return c.SendString(resp.Choices[0].Message.Content)
+	return c.SendString(reply)
 }
 
 func (s *LLMService) getProductsRelational(c *fiber.Ctx) error {
-	var products []Products
-	result := s.db.Find(&products)
-
-	if result.Error != nil {
+	products, err := s.repos.Products.List(c.UserContext())
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": result.Error,
+			"error": err.Error(),
 		})
 	}
 
-	fmt.Println(result)
-
 	return c.JSON(products)
 }
 
@@ -162,26 +508,55 @@ func (s *LLMService) insertProductsRelational(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 	}
 
-	s.db.Create(&Products{Product: strings.ToLower(product.Product), Flavor: strings.ToLower(product.Flavor), Quantity: product.Quantity})
+	sku := strings.TrimSpace(product.SKU)
+	if taken, err := s.skuTaken(c.UserContext(), sku, 0); err != nil || taken {
+		return skuConflict(c, sku, err)
+	}
+
+	created := &Products{SKU: sku, Product: strings.ToLower(product.Product), Flavor: strings.ToLower(product.Flavor), Category: strings.ToLower(product.Category), Description: product.Description}
+	if err := s.repos.Products.Create(c.UserContext(), created); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	principal, _ := currentPrincipal(c)
+	if err := s.setStock(c.UserContext(), created, product.Quantity, principal.Subject, "initial stock"); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 
 	return c.SendString("Produto salvo com sucesso!")
 }
 
 func (s *LLMService) deleteProduct(c *fiber.Ctx) error {
-	id := c.Params("id")
-	result := s.db.Unscoped().Delete(&Products{}, id)
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid product ID.")
+	}
 
-	if result.Error != nil {
+	deleted, err := s.repos.Products.Delete(c.UserContext(), uint(id))
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": result.Error,
+			"error": err.Error(),
 		})
 	}
 
-	if result.RowsAffected > 0 {
-		fmt.Println("Record deleted successfully.")
+	if deleted {
 		return c.SendString("Record deleted successfully.")
 	} else {
-		fmt.Println("No record found with the provided ID.")
 		return c.SendString("No record found with the provided ID.")
 	}
 }
+
+func (s *LLMService) getOrders(c *fiber.Ctx) error {
+	orders, err := s.repos.Orders.List(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(orders)
+}
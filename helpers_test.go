@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestDB(t *testing.T, models ...interface{}) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	return db
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type sentMessage struct {
+	Channel   string
+	Recipient string
+	Text      string
+}
+
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []sentMessage
+}
+
+func (f *fakeSender) Send(ctx context.Context, channel, recipient, text string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, sentMessage{Channel: channel, Recipient: recipient, Text: text})
+	return nil
+}
+
+func (f *fakeSender) Sent() []sentMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]sentMessage(nil), f.sent...)
+}
+
+type fakeCalendar struct {
+	events map[string]CalendarEvent
+	busy   []CalendarEvent
+	// fail is returned by UpdateEvent and DeleteEvent when set.
+	fail error
+}
+
+func (f *fakeCalendar) CreateEvent(ctx context.Context, event CalendarEvent) (string, error) {
+	id := "event-" + event.Start.Format("200601021504")
+	f.events[id] = event
+	return id, nil
+}
+
+func (f *fakeCalendar) UpdateEvent(ctx context.Context, id string, event CalendarEvent) error {
+	if f.fail != nil {
+		return f.fail
+	}
+	f.events[id] = event
+	return nil
+}
+
+func (f *fakeCalendar) DeleteEvent(ctx context.Context, id string) error {
+	if f.fail != nil {
+		return f.fail
+	}
+	if _, ok := f.events[id]; !ok {
+		return ErrEventNotFound
+	}
+	delete(f.events, id)
+	return nil
+}
+
+// IsAvailable reports the slot busy when it overlaps a busy interval or an
+// event other than ignore.
+func (f *fakeCalendar) IsAvailable(ctx context.Context, start, end time.Time, ignore string) (bool, error) {
+	busy := append([]CalendarEvent(nil), f.busy...)
+	for id, event := range f.events {
+		if id != ignore {
+			busy = append(busy, event)
+		}
+	}
+	for _, event := range busy {
+		if start.Before(event.End) && end.After(event.Start) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// newTestService builds a service backed by in-memory repositories, a SQLite
+// database migrated like production, a fake clock, a fake calendar and a fake
+// outbound sender.
+func newTestService(t *testing.T, now time.Time) (*LLMService, *fakeClock, *fakeSender, *fakeCalendar) {
+	config := defaultConfig()
+	config.OpenAI = OpenAIConfig{AuthToken: "test", Model: "test"}
+
+	clock := &fakeClock{now: now}
+	sender := &fakeSender{}
+	calendar := &fakeCalendar{events: map[string]CalendarEvent{}}
+
+	db := newTestDB(t)
+	if _, err := migrateUp(db); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	s := &LLMService{
+		db:        db,
+		repos:     newMemoryRepositories(),
+		config:    &config,
+		calendar:  calendar,
+		sender:    sender,
+		scheduler: newScheduler(db, time.Second, 4),
+		usage:     &usageLedger{db: db, prices: defaultConfig().OpenAI.Prices},
+		intents:   &intentRouter{rules: ruleClassifier{}, threshold: config.Intents.ConfidenceThreshold},
+	}
+	s.scheduler.now = clock.Now
+	s.registerJobs()
+
+	return s, clock, sender, calendar
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	IdempotencyStatusProcessing = "processing"
+	IdempotencyStatusDone       = "done"
+)
+
+// idempotencyLockTimeout is how long a request in flight holds its key. A
+// redelivery after it (the instance died) processes the message again; the
+// order key keeps it from placing a second order.
+const idempotencyLockTimeout = 5 * time.Minute
+
+// idempotencyTTL is how long responses are kept for replay. Providers stop
+// redelivering a webhook long before it.
+const idempotencyTTL = 48 * time.Hour
+
+// JobKindIdempotencyCleanup deletes the idempotency records older than
+// idempotencyTTL, every idempotencyCleanupInterval. It runs whether or not
+// the retention purge is enabled.
+const JobKindIdempotencyCleanup = "idempotency_cleanup"
+
+const idempotencyCleanupInterval = time.Hour
+
+// errRequestInFlight is returned while another request with the same key is
+// being processed.
+var errRequestInFlight = errors.New("a request with the same idempotency key is being processed")
+
+// IdempotencyRecord holds the response to an inbound message so a redelivered
+// webhook gets the same response without processing the message again.
+type IdempotencyRecord struct {
+	gorm.Model
+	RequestKey     string `json:"-" gorm:"size:64;uniqueIndex"`
+	Tenant         string `json:"tenant" gorm:"index"`
+	ContactID      uint   `json:"contact_id" gorm:"index"`
+	Status         string `json:"status"`
+	ResponseStatus int    `json:"response_status"`
+	ResponseBody   string `json:"-"`
+}
+
+// idempotencyKey identifies an inbound request by the Idempotency-Key header
+// or, failing that, by the message ID given by the channel. It is empty when
+// the request has neither.
+func idempotencyKey(c *fiber.Ctx, message *Message) string {
+	var key string
+	if header := c.Get("Idempotency-Key"); header != "" {
+		key = message.Tenant + "\x00header\x00" + header
+	} else if message.ExternalID != "" {
+		channel := message.Channel
+		if channel == "" {
+			channel = defaultChannel
+		}
+		key = message.Tenant + "\x00" + channel + "\x00" + message.ExternalID
+	} else {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// beginRequest claims the key for this request. It returns the stored record
+// with done set when the request was already answered, and errRequestInFlight
+// when another request holds the key.
+func (s *LLMService) beginRequest(ctx context.Context, key, tenant string, now time.Time) (record *IdempotencyRecord, done bool, err error) {
+	record = &IdempotencyRecord{RequestKey: key, Tenant: tenant, Status: IdempotencyStatusProcessing}
+	result := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return record, false, nil
+	}
+
+	existing := &IdempotencyRecord{}
+	if err := s.db.WithContext(ctx).Where("request_key = ?", key).First(existing).Error; err != nil {
+		return nil, false, err
+	}
+	if existing.Status == IdempotencyStatusDone {
+		return existing, true, nil
+	}
+	if now.Sub(existing.UpdatedAt) < idempotencyLockTimeout {
+		return nil, false, errRequestInFlight
+	}
+
+	// The request holding the key never finished: take it over.
+	takeover := s.db.WithContext(ctx).Model(&IdempotencyRecord{}).
+		Where("id = ? AND status = ? AND updated_at = ?", existing.ID, IdempotencyStatusProcessing, existing.UpdatedAt).
+		Update("updated_at", now)
+	if takeover.Error != nil {
+		return nil, false, takeover.Error
+	}
+	if takeover.RowsAffected == 0 {
+		return nil, false, errRequestInFlight
+	}
+	return existing, false, nil
+}
+
+// finishRequest stores the response for replay. The body is encrypted as it
+// may hold the reply to the customer.
+func (s *LLMService) finishRequest(ctx context.Context, record *IdempotencyRecord, status int, body interface{}, contactID uint) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.crypter.Encrypt(ctx, string(data))
+	if err != nil {
+		return err
+	}
+
+	return s.db.WithContext(ctx).Model(record).Updates(map[string]interface{}{
+		"status":          IdempotencyStatusDone,
+		"response_status": status,
+		"response_body":   sealed,
+		"contact_id":      contactID,
+	}).Error
+}
+
+// abandonRequest releases the key of a request that failed, so a redelivery
+// processes the message again.
+func (s *LLMService) abandonRequest(ctx context.Context, record *IdempotencyRecord) error {
+	return s.db.WithContext(ctx).Unscoped().Delete(record).Error
+}
+
+// replayResponse sends the stored response of an answered request.
+func (s *LLMService) replayResponse(c *fiber.Ctx, record *IdempotencyRecord) error {
+	body, err := s.crypter.Decrypt(c.UserContext(), record.ResponseBody)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set("Idempotent-Replayed", "true")
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(record.ResponseStatus).SendString(body)
+}
+
+// deleteExpiredRequests deletes the records older than idempotencyTTL and
+// returns how many it deleted.
+func (s *LLMService) deleteExpiredRequests(ctx context.Context, now time.Time) (int64, error) {
+	result := s.db.WithContext(ctx).Unscoped().Where("created_at < ?", now.Add(-idempotencyTTL)).Delete(&IdempotencyRecord{})
+	return result.RowsAffected, result.Error
+}
+
+// scheduleIdempotencyCleanup schedules the next cleanup unless one is
+// pending.
+func (s *LLMService) scheduleIdempotencyCleanup(ctx context.Context, runAt time.Time) error {
+	return s.scheduleUnlessPending(ctx, &Job{Kind: JobKindIdempotencyCleanup, RunAt: runAt})
+}
+
+// runIdempotencyCleanup is the job handler. The next cleanup is always
+// scheduled; a failed one is retried then.
+func (s *LLMService) runIdempotencyCleanup(ctx context.Context, job *Job) error {
+	deleted, err := s.deleteExpiredRequests(ctx, s.scheduler.now())
+	if err != nil {
+		slog.ErrorContext(ctx, "idempotency cleanup failed", "error", err)
+	} else if deleted > 0 {
+		slog.InfoContext(ctx, "idempotency records expired", "deleted", deleted)
+	}
+
+	return s.scheduler.Schedule(ctx, &Job{Kind: JobKindIdempotencyCleanup, RunAt: s.scheduler.now().Add(idempotencyCleanupInterval)})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestChatDeduplicatesRedeliveredMessages(t *testing.T) {
+	s, clock, _, _ := newTestService(t, time.Now())
+	completer := &fakeCompleter{reply: "Abrimos às 9h."}
+	s.llm = newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: completer})
+
+	app := fiber.New()
+	s.RegisterRoutes(app)
+	post := func(body string, header map[string]string) (int, string, string) {
+		req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data), resp.Header.Get("Idempotent-Replayed")
+	}
+
+	body := `{"content": "Qual o horário de funcionamento?", "channel": "whatsapp", "sender": "+5511988887777", "message_id": "wamid.1"}`
+	status, first, replayed := post(body, nil)
+	if status != fiber.StatusOK || !strings.Contains(first, "Abrimos") || replayed != "" {
+		t.Fatalf("The message should be answered: %d %s", status, first)
+	}
+	status, second, replayed := post(body, nil)
+	if status != fiber.StatusOK || second != first || replayed != "true" {
+		t.Errorf("A redelivered message should get the stored response: %d %s", status, second)
+	}
+	if calls := completer.calls(); len(calls) != 1 {
+		t.Errorf("A redelivered message should not call the LLM again: %v", calls)
+	}
+	messages, _ := s.repos.Messages.List(context.Background())
+	if len(messages) != 2 {
+		t.Errorf("A redelivered message should not be stored again: %+v", messages)
+	}
+	if messages[0].ExternalID != "wamid.1" {
+		t.Errorf("The channel message ID should be stored: %+v", messages[0])
+	}
+
+	// The same message ID on another channel is another message.
+	post(strings.Replace(body, "whatsapp", "telegram", 1), nil)
+	if calls := completer.calls(); len(calls) != 2 {
+		t.Errorf("Message IDs should be scoped to the channel: %v", calls)
+	}
+
+	header := map[string]string{"Idempotency-Key": "retry-1"}
+	body = `{"content": "Qual o horário de funcionamento?", "channel": "whatsapp", "sender": "+5511988887777"}`
+	post(body, header)
+	if _, _, replayed := post(body, header); replayed != "true" {
+		t.Error("The Idempotency-Key header should deduplicate requests")
+	}
+	if calls := completer.calls(); len(calls) != 3 {
+		t.Errorf("Repeated keys should not call the LLM again: %v", calls)
+	}
+}
+
+func TestBeginRequest(t *testing.T) {
+	now := time.Now()
+	s, _, _, _ := newTestService(t, now)
+	ctx := context.Background()
+
+	record, done, err := s.beginRequest(ctx, "key", defaultTenant, now)
+	if err != nil || done {
+		t.Fatalf("A new key should be claimed: %v", err)
+	}
+	if _, _, err := s.beginRequest(ctx, "key", defaultTenant, now.Add(time.Minute)); err != errRequestInFlight {
+		t.Errorf("A key in flight should not be claimed again: %v", err)
+	}
+
+	// The instance processing the request died.
+	if _, done, err := s.beginRequest(ctx, "key", defaultTenant, now.Add(idempotencyLockTimeout+time.Minute)); err != nil || done {
+		t.Errorf("A stale key should be taken over: %v", err)
+	}
+
+	if err := s.finishRequest(ctx, record, fiber.StatusAccepted, fiber.Map{"queued": true}, 7); err != nil {
+		t.Fatal(err)
+	}
+	stored, done, err := s.beginRequest(ctx, "key", defaultTenant, now)
+	if err != nil || !done || stored.ResponseStatus != fiber.StatusAccepted || stored.ContactID != 7 {
+		t.Errorf("An answered key should be replayed: %+v, %v", stored, err)
+	}
+
+	if err := s.abandonRequest(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, done, err := s.beginRequest(ctx, "key", defaultTenant, now); err != nil || done {
+		t.Errorf("An abandoned key should be claimed again: %v", err)
+	}
+}
+
+func TestIdempotencyRecordsExpire(t *testing.T) {
+	ctx := context.Background()
+	s, clock, _, _ := newTestService(t, time.Now())
+	s.config.Retention.Enabled = false
+
+	if _, _, err := s.beginRequest(ctx, "old", defaultTenant, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(idempotencyTTL)
+	if _, _, err := s.beginRequest(ctx, "recent", defaultTenant, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	s.db.Model(&IdempotencyRecord{}).Where("request_key = ?", "old").Update("created_at", clock.Now().Add(-idempotencyTTL-time.Second))
+
+	if err := s.scheduleIdempotencyCleanup(ctx, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	s.scheduleIdempotencyCleanup(ctx, clock.Now())
+	if ran, _ := s.scheduler.RunDue(ctx); ran != 1 {
+		t.Fatalf("Cleanup was not run once: %d", ran)
+	}
+	var keys []string
+	s.db.Model(&IdempotencyRecord{}).Pluck("request_key", &keys)
+	if len(keys) != 1 || keys[0] != "recent" {
+		t.Errorf("Expired records were not deleted: %v", keys)
+	}
+
+	// The next cleanup is scheduled.
+	clock.Advance(idempotencyCleanupInterval)
+	if ran, _ := s.scheduler.RunDue(ctx); ran != 1 {
+		t.Errorf("Next cleanup was not scheduled: %d", ran)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/telemetry"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+const (
+	InboundStatusPending    = "pending"
+	InboundStatusProcessing = "processing"
+)
+
+// inboundLockTimeout is how long a claimed message stays locked. Messages
+// still processing after it (the worker died) are claimed again.
+const inboundLockTimeout = 5 * time.Minute
+
+// InboundMessage is a message received on a channel waiting to be processed.
+// It is deleted once processed, or moved to the dead letters.
+type InboundMessage struct {
+	gorm.Model
+	Tenant string `json:"tenant" gorm:"index"`
+	// ContactKey groups the messages of a sender; it is a blind index when
+	// encryption is enabled.
+	ContactKey  string     `json:"contact_key" gorm:"index"`
+	Payload     string     `json:"-"`
+	Status      string     `json:"status" gorm:"index"`
+	Attempts    int        `json:"attempts"`
+	RunAt       time.Time  `json:"run_at" gorm:"index"`
+	LockedUntil *time.Time `json:"locked_until"`
+	LastError   string     `json:"last_error"`
+}
+
+// DeadLetter is an inbound message that kept failing. It can be put back in
+// the queue from the admin API.
+type DeadLetter struct {
+	gorm.Model
+	Tenant     string    `json:"tenant" gorm:"index"`
+	ContactKey string    `json:"contact_key" gorm:"index"`
+	Payload    string    `json:"-"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// QueuedMessage is a claimed inbound message.
+type QueuedMessage struct {
+	ID       uint
+	Attempts int
+	Message  Message
+}
+
+// InboundQueue stores inbound messages until a worker processes them. Claim
+// never hands out a message while an older one of the same contact is
+// pending or processing, so each contact's messages are processed in order.
+type InboundQueue interface {
+	Enqueue(ctx context.Context, message *Message, now time.Time) (uint, error)
+	Claim(ctx context.Context, now time.Time, limit int) ([]QueuedMessage, error)
+	Complete(ctx context.Context, id uint) error
+	Retry(ctx context.Context, id uint, runAt time.Time, cause error) error
+	Bury(ctx context.Context, id uint, cause error) error
+	// BuryMessage stores a message that failed outside of the queue, e.g.
+	// in a queued message job, as a dead letter.
+	BuryMessage(ctx context.Context, message *Message, attempts int, receivedAt time.Time, cause error) error
+	Stuck(ctx context.Context, now time.Time, olderThan time.Duration) ([]InboundMessage, error)
+	DeadLetters(ctx context.Context) ([]DeadLetter, error)
+	Requeue(ctx context.Context, deadLetterID uint, now time.Time) error
+	// SenderMessages returns the queued messages and dead letters of a
+	// sender (right of access).
+	SenderMessages(ctx context.Context, channel, sender string) (queued, dead []Message, err error)
+	// DeleteSender deletes the queued messages and dead letters of a sender
+	// (right to erasure).
+	DeleteSender(ctx context.Context, channel, sender string) (int64, error)
+}
+
+// gormInboundQueue is the SQL backed InboundQueue. Payloads are encrypted
+// when crypter is not nil.
+type gormInboundQueue struct {
+	db      *gorm.DB
+	crypter *FieldCrypter
+}
+
+func newGormInboundQueue(db *gorm.DB, crypter *FieldCrypter) *gormInboundQueue {
+	return &gormInboundQueue{db: db, crypter: crypter}
+}
+
+// contactKey identifies the sender of a message. Messages without a sender
+// get a key of their own.
+func (q *gormInboundQueue) contactKey(message *Message) string {
+	if message.Sender == "" {
+		return "anonymous-" + telemetry.NewID(8)
+	}
+	key := message.Channel + ":" + message.Sender
+	if index := q.crypter.BlindIndex(key); index != "" {
+		return index
+	}
+	return key
+}
+
+func (q *gormInboundQueue) Enqueue(ctx context.Context, message *Message, now time.Time) (uint, error) {
+	if message.Channel == "" {
+		message.Channel = defaultChannel
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return 0, err
+	}
+	sealed, err := q.crypter.Encrypt(ctx, string(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	inbound := &InboundMessage{
+		Tenant:     message.Tenant,
+		ContactKey: q.contactKey(message),
+		Payload:    sealed,
+		Status:     InboundStatusPending,
+		RunAt:      now,
+	}
+	if err := q.db.WithContext(ctx).Create(inbound).Error; err != nil {
+		return 0, err
+	}
+	return inbound.ID, nil
+}
+
+func (q *gormInboundQueue) Claim(ctx context.Context, now time.Time, limit int) ([]QueuedMessage, error) {
+	// The oldest message of each contact is the only one that can run.
+	heads := q.db.Model(&InboundMessage{}).Select("MIN(id)").Group("contact_key")
+
+	var candidates []InboundMessage
+	err := q.db.WithContext(ctx).
+		Where("id IN (?)", heads).
+		Where("(status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?)", InboundStatusPending, now, InboundStatusProcessing, now).
+		Order("id").
+		Limit(limit).
+		Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var claimed []QueuedMessage
+	lockedUntil := now.Add(inboundLockTimeout)
+	for _, candidate := range candidates {
+		// Claim the message so another instance polling the same database skips it.
+		claim := q.db.WithContext(ctx).Model(&InboundMessage{}).
+			Where("id = ? AND status = ? AND attempts = ?", candidate.ID, candidate.Status, candidate.Attempts).
+			Updates(map[string]interface{}{"status": InboundStatusProcessing, "locked_until": lockedUntil, "attempts": candidate.Attempts + 1})
+		if claim.Error != nil {
+			return claimed, claim.Error
+		}
+		if claim.RowsAffected == 0 {
+			continue
+		}
+
+		message, err := q.open(ctx, candidate.Payload)
+		if err != nil {
+			if err := q.Bury(ctx, candidate.ID, err); err != nil {
+				return claimed, err
+			}
+			continue
+		}
+		claimed = append(claimed, QueuedMessage{ID: candidate.ID, Attempts: candidate.Attempts + 1, Message: message})
+	}
+
+	return claimed, nil
+}
+
+func (q *gormInboundQueue) open(ctx context.Context, payload string) (Message, error) {
+	var message Message
+	plaintext, err := q.crypter.Decrypt(ctx, payload)
+	if err != nil {
+		return message, err
+	}
+	err = json.Unmarshal([]byte(plaintext), &message)
+	return message, err
+}
+
+func (q *gormInboundQueue) Complete(ctx context.Context, id uint) error {
+	return q.db.WithContext(ctx).Unscoped().Delete(&InboundMessage{}, id).Error
+}
+
+func (q *gormInboundQueue) Retry(ctx context.Context, id uint, runAt time.Time, cause error) error {
+	return q.db.WithContext(ctx).Model(&InboundMessage{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":       InboundStatusPending,
+		"run_at":       runAt,
+		"locked_until": nil,
+		"last_error":   cause.Error(),
+	}).Error
+}
+
+func (q *gormInboundQueue) Bury(ctx context.Context, id uint, cause error) error {
+	return q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var inbound InboundMessage
+		if err := tx.First(&inbound, id).Error; err != nil {
+			return err
+		}
+		dead := &DeadLetter{
+			Tenant:     inbound.Tenant,
+			ContactKey: inbound.ContactKey,
+			Payload:    inbound.Payload,
+			Attempts:   inbound.Attempts,
+			LastError:  cause.Error(),
+			ReceivedAt: inbound.CreatedAt,
+		}
+		if err := tx.Create(dead).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&inbound).Error
+	})
+}
+
+func (q *gormInboundQueue) BuryMessage(ctx context.Context, message *Message, attempts int, receivedAt time.Time, cause error) error {
+	if message.Channel == "" {
+		message.Channel = defaultChannel
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	sealed, err := q.crypter.Encrypt(ctx, string(payload))
+	if err != nil {
+		return err
+	}
+
+	return q.db.WithContext(ctx).Create(&DeadLetter{
+		Tenant:     message.Tenant,
+		ContactKey: q.contactKey(message),
+		Payload:    sealed,
+		Attempts:   attempts,
+		LastError:  cause.Error(),
+		ReceivedAt: receivedAt,
+	}).Error
+}
+
+// Stuck lists the messages that failed at least once, are locked by a worker
+// that stopped, or have been due for longer than olderThan.
+func (q *gormInboundQueue) Stuck(ctx context.Context, now time.Time, olderThan time.Duration) ([]InboundMessage, error) {
+	var messages []InboundMessage
+	err := q.db.WithContext(ctx).
+		Where("attempts > 0 AND status = ?", InboundStatusPending).
+		Or("status = ? AND locked_until < ?", InboundStatusProcessing, now).
+		Or("run_at < ?", now.Add(-olderThan)).
+		Order("id").
+		Find(&messages).Error
+	return messages, err
+}
+
+func (q *gormInboundQueue) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := q.db.WithContext(ctx).Order("id desc").Find(&letters).Error
+	return letters, err
+}
+
+// Requeue puts a dead letter back at the end of the queue.
+func (q *gormInboundQueue) Requeue(ctx context.Context, deadLetterID uint, now time.Time) error {
+	return q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var dead DeadLetter
+		if err := tx.First(&dead, deadLetterID).Error; err != nil {
+			return notFound(err)
+		}
+		inbound := &InboundMessage{
+			Tenant:     dead.Tenant,
+			ContactKey: dead.ContactKey,
+			Payload:    dead.Payload,
+			Status:     InboundStatusPending,
+			RunAt:      now,
+		}
+		if err := tx.Create(inbound).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&dead).Error
+	})
+}
+
+func (q *gormInboundQueue) SenderMessages(ctx context.Context, channel, sender string) ([]Message, []Message, error) {
+	if channel == "" {
+		channel = defaultChannel
+	}
+	key := q.contactKey(&Message{Channel: channel, Sender: sender})
+
+	var inbound []InboundMessage
+	if err := q.db.WithContext(ctx).Where("contact_key = ?", key).Order("id").Find(&inbound).Error; err != nil {
+		return nil, nil, err
+	}
+	var letters []DeadLetter
+	if err := q.db.WithContext(ctx).Where("contact_key = ?", key).Order("id").Find(&letters).Error; err != nil {
+		return nil, nil, err
+	}
+
+	queued := make([]Message, 0, len(inbound))
+	for _, message := range inbound {
+		opened, err := q.open(ctx, message.Payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		queued = append(queued, opened)
+	}
+	dead := make([]Message, 0, len(letters))
+	for _, letter := range letters {
+		opened, err := q.open(ctx, letter.Payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		dead = append(dead, opened)
+	}
+	return queued, dead, nil
+}
+
+func (q *gormInboundQueue) DeleteSender(ctx context.Context, channel, sender string) (int64, error) {
+	if channel == "" {
+		channel = defaultChannel
+	}
+	key := q.contactKey(&Message{Channel: channel, Sender: sender})
+
+	var deleted int64
+	for _, model := range []interface{}{&InboundMessage{}, &DeadLetter{}} {
+		result := q.db.WithContext(ctx).Unscoped().Where("contact_key = ?", key).Delete(model)
+		if result.Error != nil {
+			return deleted, result.Error
+		}
+		deleted += result.RowsAffected
+	}
+	return deleted, nil
+}
+
+// inboundWorkers processes queued messages with a pool of workers. Failed
+// messages are retried with a growing delay and buried after maxAttempts.
+type inboundWorkers struct {
+	queue       InboundQueue
+	handle      func(ctx context.Context, message *QueuedMessage) error
+	workers     int
+	interval    time.Duration
+	maxAttempts int
+	now         func() time.Time
+	wake        chan struct{}
+}
+
+func newInboundWorkers(queue InboundQueue, handle func(ctx context.Context, message *QueuedMessage) error, config InboundConfig) *inboundWorkers {
+	interval, _ := time.ParseDuration(config.PollInterval)
+	return &inboundWorkers{
+		queue:       queue,
+		handle:      handle,
+		workers:     config.Workers,
+		interval:    interval,
+		maxAttempts: config.MaxAttempts,
+		now:         time.Now,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the workers up after a message is enqueued.
+func (w *inboundWorkers) Notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start processes messages until the context is cancelled, then waits for
+// the messages in flight.
+func (w *inboundWorkers) Start(ctx context.Context) {
+	slots := make(chan struct{}, w.workers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if free := cap(slots) - len(slots); free > 0 {
+			messages, err := w.queue.Claim(ctx, w.now(), free)
+			if err != nil {
+				slog.ErrorContext(ctx, "claim inbound messages failed", "error", err)
+			}
+			for i := range messages {
+				slots <- struct{}{}
+				wg.Add(1)
+				go func(message QueuedMessage) {
+					defer func() {
+						<-slots
+						wg.Done()
+						w.Notify()
+					}()
+					w.process(ctx, &message)
+				}(messages[i])
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+// RunDue claims the due messages, one per worker, processes them in parallel
+// and returns how many were processed.
+func (w *inboundWorkers) RunDue(ctx context.Context) (int, error) {
+	messages, err := w.queue.Claim(ctx, w.now(), w.workers)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for i := range messages {
+		wg.Add(1)
+		go func(message *QueuedMessage) {
+			defer wg.Done()
+			w.process(ctx, message)
+		}(&messages[i])
+	}
+	wg.Wait()
+
+	return len(messages), nil
+}
+
+func (w *inboundWorkers) process(ctx context.Context, message *QueuedMessage) {
+	ctx, span := telemetry.Start(telemetry.WithCorrelationID(ctx, fmt.Sprintf("inbound-%d", message.ID)), "inbound message", telemetry.KindInternal,
+		attribute.Int("inbound.id", int(message.ID)),
+		attribute.Int("inbound.attempts", message.Attempts),
+	)
+
+	err := w.handle(ctx, message)
+	telemetry.End(span, err)
+	if err == nil {
+		if err := w.queue.Complete(ctx, message.ID); err != nil {
+			slog.ErrorContext(ctx, "complete inbound message failed", "inbound_id", message.ID, "error", err)
+		}
+		return
+	}
+
+	slog.ErrorContext(ctx, "inbound message failed", "inbound_id", message.ID, "attempts", message.Attempts, "error", err)
+	if message.Attempts >= w.maxAttempts {
+		err = w.queue.Bury(ctx, message.ID, err)
+	} else {
+		err = w.queue.Retry(ctx, message.ID, w.now().Add(time.Duration(message.Attempts*message.Attempts)*10*time.Second), err)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "update inbound message failed", "inbound_id", message.ID, "error", err)
+	}
+}
+
+// handleInbound answers a queued message and sends the reply through the
+// channel it came from.
+func (s *LLMService) handleInbound(ctx context.Context, queued *QueuedMessage) error {
+	message := &queued.Message
+	response, err := s.processMessage(ctx, message)
+	if errors.Is(err, errLLMUnavailable) && queued.Attempts == 1 {
+		// Let the customer know the answer is delayed; the message is retried.
+		if err := s.sender.Send(ctx, message.Channel, message.Sender, llmApology); err != nil {
+			slog.ErrorContext(ctx, "send apology failed", "error", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if response.reply == "" {
+		return nil
+	}
+
+	// The message is processed (and stored) at this point: a failed send is
+	// not retried, so orders are not placed twice.
+	if err := s.sender.Send(ctx, message.Channel, message.Sender, response.reply); err != nil {
+		slog.ErrorContext(ctx, "send reply failed", "channel", message.Channel, "error", err)
+	}
+	return nil
+}
+
+// getStuckMessages lists the inbound messages that failed or have waited
+// longer than ?older_than= (default 5m).
+func (s *LLMService) getStuckMessages(c *fiber.Ctx) error {
+	olderThan, err := time.ParseDuration(c.Query("older_than", "5m"))
+	if err != nil || olderThan <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "older_than must be a positive duration like 5m",
+		})
+	}
+
+	messages, err := s.inbound.Stuck(c.UserContext(), time.Now(), olderThan)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(messages)
+}
+
+func (s *LLMService) getDeadLetters(c *fiber.Ctx) error {
+	letters, err := s.inbound.DeadLetters(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(letters)
+}
+
+func (s *LLMService) requeueDeadLetter(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid dead letter id",
+		})
+	}
+
+	err = s.inbound.Requeue(c.UserContext(), uint(id), time.Now())
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if s.workers != nil {
+		s.workers.Notify()
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestInboundQueueOrdersMessagesPerContact(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	crypter := writeKeyFile(t, keyPath, "k1", map[string]string{"k1": randomKey()}, randomKey())
+	db := newTestDB(t, &InboundMessage{}, &DeadLetter{})
+	queue := newGormInboundQueue(db, crypter)
+
+	for _, message := range []Message{
+		{Content: "primeira", Channel: "whatsapp", Sender: "+5511911111111"},
+		{Content: "segunda", Channel: "whatsapp", Sender: "+5511911111111"},
+		{Content: "outra", Channel: "whatsapp", Sender: "+5511922222222"},
+	} {
+		if _, err := queue.Enqueue(ctx, &message, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stored InboundMessage
+	db.First(&stored)
+	if strings.Contains(stored.Payload, "primeira") || strings.Contains(stored.ContactKey, "5511911111111") {
+		t.Errorf("Queued messages should be encrypted: %+v", stored)
+	}
+
+	claimed, err := queue.Claim(ctx, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 2 || claimed[0].Message.Content != "primeira" || claimed[1].Message.Content != "outra" {
+		t.Fatalf("Only the oldest message of each contact should be claimed: %+v", claimed)
+	}
+	if again, _ := queue.Claim(ctx, now, 10); len(again) != 0 {
+		t.Errorf("Messages of a contact in flight should wait: %+v", again)
+	}
+
+	queue.Complete(ctx, claimed[0].ID)
+	claimed, _ = queue.Claim(ctx, now, 10)
+	if len(claimed) != 1 || claimed[0].Message.Content != "segunda" {
+		t.Errorf("The next message of the contact should be claimed: %+v", claimed)
+	}
+
+	// A worker that died leaves its message locked until the lock expires.
+	if stuck, _ := queue.Stuck(ctx, now, time.Hour); len(stuck) != 0 {
+		t.Errorf("No message should be stuck yet: %+v", stuck)
+	}
+	later := now.Add(inboundLockTimeout + time.Second)
+	if stuck, _ := queue.Stuck(ctx, later, time.Hour); len(stuck) != 2 {
+		t.Errorf("Expired locks should be reported as stuck: %+v", stuck)
+	}
+	if claimed, _ := queue.Claim(ctx, later, 10); len(claimed) != 2 || claimed[0].Attempts != 2 {
+		t.Errorf("Expired locks should be claimed again: %+v", claimed)
+	}
+}
+
+func TestInboundWorkersDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Now()}
+	db := newTestDB(t, &InboundMessage{}, &DeadLetter{})
+	queue := newGormInboundQueue(db, nil)
+
+	var mu sync.Mutex
+	var handled []string
+	failing := true
+	workers := newInboundWorkers(queue, func(ctx context.Context, message *QueuedMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, message.Message.Content)
+		if failing && message.Message.Content == "quebrada" {
+			return errors.New("boom")
+		}
+		return nil
+	}, InboundConfig{Workers: 4, PollInterval: "1s", MaxAttempts: 2})
+	workers.now = clock.Now
+
+	queue.Enqueue(ctx, &Message{Content: "quebrada", Sender: "a"}, clock.Now())
+	queue.Enqueue(ctx, &Message{Content: "ok", Sender: "b"}, clock.Now())
+
+	if ran, err := workers.RunDue(ctx); err != nil || ran != 2 {
+		t.Fatalf("Both contacts should run in parallel: %d, %v", ran, err)
+	}
+	if ran, _ := workers.RunDue(ctx); ran != 0 {
+		t.Errorf("Failed messages should wait before they are retried: %d", ran)
+	}
+	clock.Advance(time.Minute)
+	workers.RunDue(ctx)
+
+	letters, _ := queue.DeadLetters(ctx)
+	if len(letters) != 1 || letters[0].Attempts != 2 || letters[0].LastError != "boom" {
+		t.Fatalf("The message should be buried after the last attempt: %+v", letters)
+	}
+	var left int64
+	db.Model(&InboundMessage{}).Count(&left)
+	if left != 0 {
+		t.Errorf("Processed and buried messages should leave the queue: %d", left)
+	}
+
+	failing = false
+	if err := queue.Requeue(ctx, letters[0].ID, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if ran, _ := workers.RunDue(ctx); ran != 1 {
+		t.Errorf("The requeued message should run: %d", ran)
+	}
+	if letters, _ := queue.DeadLetters(ctx); len(letters) != 0 {
+		t.Errorf("The requeued dead letter should be gone: %+v", letters)
+	}
+	if err := queue.Requeue(ctx, 99, clock.Now()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Unknown dead letters should not be found: %v", err)
+	}
+}
+
+func TestInboundQueueDeletesSenderWithoutChannel(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, &InboundMessage{}, &DeadLetter{})
+	queue := newGormInboundQueue(db, nil)
+
+	// Messages without a channel belong to the default one.
+	queue.Enqueue(ctx, &Message{Content: "na fila", Sender: "a"}, time.Now())
+	if err := queue.BuryMessage(ctx, &Message{Content: "enterrada", Sender: "a"}, 3, time.Now(), errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := queue.DeleteSender(ctx, defaultChannel, "a"); err != nil || deleted != 2 {
+		t.Errorf("Messages without a channel were not deleted: %d, %v", deleted, err)
+	}
+
+	queue.BuryMessage(ctx, &Message{Content: "enterrada", Channel: defaultChannel, Sender: "a"}, 3, time.Now(), errors.New("boom"))
+	if deleted, err := queue.DeleteSender(ctx, "", "a"); err != nil || deleted != 1 {
+		t.Errorf("Deleting without a channel missed the default one: %d, %v", deleted, err)
+	}
+}
+
+func TestChatAsync(t *testing.T) {
+	s, _, sender, _ := newTestService(t, time.Now())
+	s.config.Inbound = InboundConfig{Async: true, Workers: 2, PollInterval: "1s", MaxAttempts: 3}
+	s.inbound = newGormInboundQueue(s.db, nil)
+	s.workers = newInboundWorkers(s.inbound, s.handleInbound, s.config.Inbound)
+
+	app := fiber.New()
+	s.RegisterRoutes(app)
+	body := `{"content": "Oi", "channel": "whatsapp", "sender": "+5511988887777"}`
+	req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusAccepted {
+		t.Fatalf("Async messages should be acknowledged right away: %d", resp.StatusCode)
+	}
+	if len(sender.Sent()) != 0 {
+		t.Error("Nothing should be sent before the workers run")
+	}
+
+	if ran, err := s.workers.RunDue(context.Background()); err != nil || ran != 1 {
+		t.Fatalf("The message should be processed: %d, %v", ran, err)
+	}
+	sent := sender.Sent()
+	if len(sent) != 1 || sent[0].Recipient != "+5511988887777" || sent[0].Text == "" {
+		t.Errorf("The reply should be sent through the channel: %+v", sent)
+	}
+}
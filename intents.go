@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+type Intent string
+
+const (
+	IntentOrder     Intent = "order"
+	IntentSchedule  Intent = "schedule"
+	IntentFAQ       Intent = "faq"
+	IntentSmallTalk Intent = "small_talk"
+	IntentComplaint Intent = "complaint"
+	IntentHandoff   Intent = "handoff"
+	IntentOptOut    Intent = "opt_out"
+)
+
+// intentPriority breaks ties between rules with the same confidence.
+var intentPriority = []Intent{IntentOptOut, IntentHandoff, IntentComplaint, IntentSchedule, IntentOrder, IntentFAQ, IntentSmallTalk}
+
+type IntentResult struct {
+	Intent     Intent  `json:"intent"`
+	Confidence float64 `json:"confidence"`
+	Source     string  `json:"source"`
+}
+
+type IntentClassifier interface {
+	Classify(ctx context.Context, text string) (IntentResult, error)
+}
+
+type ruleClassifier struct{}
+
+var productTerms = []string{"pod", "vape", "juice", "coil", "nicsalt", "freebase", "kit", "essencia", "sabor", "ml"}
+
+func (ruleClassifier) Classify(ctx context.Context, text string) (IntentResult, error) {
+	normalized := normalizeText(text)
+	scores := map[Intent]float64{}
+
+	score := func(intent Intent, confidence float64) {
+		if confidence > scores[intent] {
+			scores[intent] = confidence
+		}
+	}
+
+	if containsAny(normalized, "parar de receber", "nao quero receber", "sair da lista", "descadastr", "pare de mandar", "nao me mande") ||
+		containsWord(normalized, "stop", "sair") && len(words(normalized)) <= 2 {
+		score(IntentOptOut, 0.95)
+	}
+
+	if containsAny(normalized, "atendente", "falar com alguem", "falar com uma pessoa", "gerente", "humano", "pessoa de verdade") {
+		score(IntentHandoff, 0.9)
+	}
+
+	if containsAny(normalized, "reclama", "veio errado", "defeito", "quebrad", "nao funciona", "parou de funcionar", "pessimo", "absurdo", "vazando", "insatisfeit") {
+		score(IntentComplaint, 0.85)
+	}
+
+	switch parseOrderReply(normalized) {
+	case ReplyCancel, ReplyReschedule:
+		score(IntentSchedule, 0.85)
+	case ReplyConfirm:
+		score(IntentSchedule, 0.6)
+	}
+	if containsAny(normalized, "agendar", "marcar", "buscar", "retirar", "retirada") {
+		score(IntentSchedule, 0.6)
+	}
+
+	orderVerb := containsAny(normalized, "quero", "queria", "vou querer", "comprar", "pedido", "encomendar", "separa", "reserva")
+	productMention := containsWord(normalized, productTerms...)
+	switch {
+	case orderVerb && productMention:
+		score(IntentOrder, 0.9)
+	case productMention:
+		score(IntentOrder, 0.6)
+	case orderVerb:
+		score(IntentOrder, 0.55)
+	}
+
+	if containsAny(normalized, "preco", "quanto custa", "quanto e", "valor", "funcionamento", "aberto", "abre", "fecha", "endereco", "onde fica", "entrega", "aceita", "pix", "cartao", "parcel") {
+		score(IntentFAQ, 0.8)
+	} else if strings.HasSuffix(normalized, "?") {
+		score(IntentFAQ, 0.5)
+	}
+
+	if containsAny(normalized, "bom dia", "boa tarde", "boa noite", "tudo bem", "obrigad") ||
+		containsWord(normalized, "oi", "ola", "opa", "eai", "valeu") {
+		if len(words(normalized)) <= 4 {
+			score(IntentSmallTalk, 0.9)
+		} else {
+			score(IntentSmallTalk, 0.4)
+		}
+	}
+
+	result := IntentResult{Intent: IntentSmallTalk, Source: "rules"}
+	for _, intent := range intentPriority {
+		if scores[intent] > result.Confidence {
+			result.Intent = intent
+			result.Confidence = scores[intent]
+		}
+	}
+
+	return result, nil
+}
+
+var classifyIntent = openai.FunctionDefinition{
+	Name:        "classifyIntent",
+	Description: "Classifica a intenção da mensagem de um cliente de uma loja de vapes e pods",
+	Parameters: jsonschema.Definition{
+		Type: "object",
+		Properties: map[string]jsonschema.Definition{
+			"intent": {
+				Type: "string",
+				Description: `order: o cliente quer comprar ou reservar produtos.
+				schedule: o cliente quer marcar, remarcar, confirmar ou cancelar uma retirada.
+				faq: perguntas sobre preços, horários, endereço, formas de pagamento ou produtos.
+				small_talk: cumprimentos, agradecimentos e conversa sem pedido.
+				complaint: reclamações sobre produtos ou atendimento.
+				handoff: o cliente quer falar com um atendente humano.
+				opt_out: o cliente não quer mais receber mensagens.`,
+				Enum: []string{string(IntentOrder), string(IntentSchedule), string(IntentFAQ), string(IntentSmallTalk), string(IntentComplaint), string(IntentHandoff), string(IntentOptOut)},
+			},
+			"confidence": {
+				Type:        "number",
+				Description: "Confiança da classificação, de 0 a 1.",
+			},
+		},
+		Required: []string{"intent", "confidence"},
+	},
+}
+
+type llmClassifier struct {
+	llm *resilientLLM
+}
+
+func (l *llmClassifier) Classify(ctx context.Context, text string) (IntentResult, error) {
+	resp, err := l.llm.complete(ctx, "intent", openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: text},
+		},
+		Functions:    []openai.FunctionDefinition{classifyIntent},
+		FunctionCall: map[string]string{"name": classifyIntent.Name},
+	})
+	if err != nil {
+		return IntentResult{}, err
+	}
+	if resp.Choices[0].Message.FunctionCall == nil {
+		return IntentResult{}, errors.New("intent classification returned no function call")
+	}
+
+	var result IntentResult
+	if err := json.Unmarshal([]byte(resp.Choices[0].Message.FunctionCall.Arguments), &result); err != nil {
+		return IntentResult{}, err
+	}
+	if !containsIntent(intentPriority, result.Intent) {
+		return IntentResult{}, fmt.Errorf("unknown intent %q", result.Intent)
+	}
+	result.Source = "llm"
+
+	return result, nil
+}
+
+func containsIntent(intents []Intent, intent Intent) bool {
+	for _, i := range intents {
+		if i == intent {
+			return true
+		}
+	}
+	return false
+}
+
+// intentRouter classifies with the rules first and only asks the fallback
+// classifier (the LLM) when the rules are not confident enough.
+type intentRouter struct {
+	rules     IntentClassifier
+	fallback  IntentClassifier
+	threshold float64
+}
+
+func (r *intentRouter) Classify(ctx context.Context, text string) (IntentResult, error) {
+	result, err := r.rules.Classify(ctx, text)
+	if err != nil {
+		return IntentResult{}, err
+	}
+	if result.Confidence >= r.threshold || r.fallback == nil {
+		return result, nil
+	}
+
+	fallback, err := r.fallback.Classify(ctx, text)
+	if err != nil {
+		slog.WarnContext(ctx, "intent fallback failed", "error", err)
+		return result, nil
+	}
+
+	return fallback, nil
+}
+
+// tagContact adds the tags the contact does not have yet.
+func tagContact(ctx context.Context, repos Repositories, contact *Contact, tags ...string) error {
+	changed := false
+	for _, tag := range tags {
+		if !containsString(contact.Tags, tag) {
+			contact.Tags = append(contact.Tags, tag)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return repos.Contacts.Update(ctx, contact)
+}
+
+func greetingName(contact *Contact) string {
+	if contact != nil && contact.Name != "" {
+		return ", " + contact.Name
+	}
+	return ""
+}
+
+func (s *LLMService) replySmallTalk(ctx context.Context, contact *Contact, content string) (string, error) {
+	if containsAny(normalizeText(content), "obrigad", "valeu") {
+		return "Imagina! Qualquer coisa é só chamar 😉", nil
+	}
+	return fmt.Sprintf("Olá%s! Tudo bem? Me diga o que você precisa: posso anotar seu pedido, marcar a retirada ou tirar dúvidas.", greetingName(contact)), nil
+}
+
+func (s *LLMService) replyComplaint(ctx context.Context, contact *Contact, content string) (string, error) {
+	if contact != nil {
+		if err := tagContact(ctx, s.repos, contact, "complaint", "handoff"); err != nil {
+			return "", err
+		}
+	}
+	return "Sinto muito pelo problema! Já avisei nossa equipe e um atendente vai falar com você em breve para resolver.", nil
+}
+
+func (s *LLMService) replyHandoff(ctx context.Context, contact *Contact, content string) (string, error) {
+	if contact != nil {
+		if err := tagContact(ctx, s.repos, contact, "handoff"); err != nil {
+			return "", err
+		}
+	}
+	return "Certo! Vou chamar um atendente para continuar a conversa com você. Aguarde só um instante.", nil
+}
+
+func (s *LLMService) replyOptOut(ctx context.Context, contact *Contact, content string) (string, error) {
+	if contact != nil {
+		now := time.Now()
+		contact.MarketingConsent = false
+		contact.ConsentUpdatedAt = &now
+		if !containsString(contact.Tags, "opt-out") {
+			contact.Tags = append(contact.Tags, "opt-out")
+		}
+		if err := s.repos.Contacts.Update(ctx, contact); err != nil {
+			return "", err
+		}
+	}
+	return "Pronto, você não vai mais receber nossas mensagens promocionais. Se quiser fazer um pedido, é só mandar mensagem.", nil
+}
+
+// replyFAQ answers questions with the shop FAQ and the products in stock.
+// The LLM may call getRecommendations to suggest products.
+func (s *LLMService) replyFAQ(ctx context.Context, contact *Contact, content string) (string, error) {
+	products, err := s.repos.Products.List(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var catalog []string
+	for _, product := range products {
+		if product.Quantity > 0 && product.ArchivedAt == nil {
+			catalog = append(catalog, strings.TrimSpace(product.Product+" "+product.Flavor))
+		}
+	}
+
+	shop := s.config.Shop.Name
+	if shop == "" {
+		shop = "a loja"
+	}
+	system := fmt.Sprintf(`Você é o atendente de %s, uma loja de vapes e pods. Responda de forma curta, educada e objetiva,
+	usando apenas as informações abaixo. Se não souber a resposta, diga que vai verificar com a equipe.
+
+	Informações da loja:
+	%s
+
+	Produtos em estoque:
+	%s`, shop, s.config.Shop.FAQ, strings.Join(catalog, "\n"))
+
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: system}}
+	messages = append(messages, s.conversationContext(ctx, contact, content)...)
+	messages = append(messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: content})
+
+	resp, err := s.llm.complete(ctx, "faq", openai.ChatCompletionRequest{
+		Messages:  messages,
+		Functions: []openai.FunctionDefinition{getRecommendations},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// The LLM asked for recommendations: answer with them.
+	if call := resp.Choices[0].Message.FunctionCall; call != nil && call.Name == getRecommendations.Name {
+		messages = append(messages, resp.Choices[0].Message, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleFunction,
+			Name:    call.Name,
+			Content: s.callRecommendations(ctx, contact, call.Arguments),
+		})
+		resp, err = s.llm.complete(ctx, "faq", openai.ChatCompletionRequest{
+			Messages: messages,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return resp.Choices[0].Message.Content, nil
+}
+
+// replyStaticFAQ answers questions with the shop FAQ as is, without the LLM
+// (FAQ only mode).
+func (s *LLMService) replyStaticFAQ(ctx context.Context, contact *Contact, content string) (string, error) {
+	if s.config.Shop.FAQ == "" {
+		return s.replyHandoff(ctx, contact, content)
+	}
+	return s.config.Shop.FAQ, nil
+}
+
+// replyLLMUnavailable hands orders over to the team when the LLM can not be
+// used (FAQ only mode).
+func (s *LLMService) replyLLMUnavailable(ctx context.Context, contact *Contact, content string) (string, error) {
+	if contact != nil {
+		if err := tagContact(ctx, s.repos, contact, "handoff"); err != nil {
+			return "", err
+		}
+	}
+	return "No momento não consigo anotar pedidos por aqui. Já avisei nossa equipe e um atendente vai falar com você em breve.", nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRuleClassifier(t *testing.T) {
+	cases := map[string]Intent{
+		"Quero 2 pods de menta para amanhã":       IntentOrder,
+		"Preciso cancelar meu pedido":             IntentSchedule,
+		"Dá para remarcar a retirada para sexta?": IntentSchedule,
+		"Qual o horário de funcionamento?":        IntentFAQ,
+		"Aceita pix?":                             IntentFAQ,
+		"Oi, bom dia!":                            IntentSmallTalk,
+		"O pod que comprei veio com defeito":      IntentComplaint,
+		"Quero falar com um atendente":            IntentHandoff,
+		"Não quero receber mais mensagens":        IntentOptOut,
+		"STOP":                                    IntentOptOut,
+	}
+
+	for text, expected := range cases {
+		result, err := ruleClassifier{}.Classify(context.Background(), text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Intent != expected {
+			t.Errorf("Intent for %q is not correct: %s (%.2f)", text, result.Intent, result.Confidence)
+		}
+		if result.Source != "rules" {
+			t.Errorf("Source for %q is not correct: %s", text, result.Source)
+		}
+	}
+}
+
+type fakeClassifier struct {
+	result IntentResult
+	err    error
+	calls  int
+}
+
+func (f *fakeClassifier) Classify(ctx context.Context, text string) (IntentResult, error) {
+	f.calls++
+	return f.result, f.err
+}
+
+func TestIntentRouterFallback(t *testing.T) {
+	ctx := context.Background()
+	llm := &fakeClassifier{result: IntentResult{Intent: IntentFAQ, Confidence: 0.8, Source: "llm"}}
+	router := &intentRouter{rules: ruleClassifier{}, fallback: llm, threshold: 0.7}
+
+	result, _ := router.Classify(ctx, "Oi")
+	if result.Intent != IntentSmallTalk || llm.calls != 0 {
+		t.Errorf("Confident rules should not call the LLM: %+v, %d calls", result, llm.calls)
+	}
+
+	result, _ = router.Classify(ctx, "vocês trabalham com o que?")
+	if result.Intent != IntentFAQ || result.Source != "llm" || llm.calls != 1 {
+		t.Errorf("Unsure rules should fall back to the LLM: %+v, %d calls", result, llm.calls)
+	}
+
+	llm.err = errors.New("unavailable")
+	result, err := router.Classify(ctx, "vocês trabalham com o que?")
+	if err != nil || result.Source != "rules" {
+		t.Errorf("A failing LLM should keep the rules result: %+v, %v", result, err)
+	}
+}
+
+func TestChatIntentReplies(t *testing.T) {
+	s, _, _, _ := newTestService(t, time.Now())
+	app := fiber.New()
+	s.RegisterRoutes(app)
+
+	post := func(content string) string {
+		body := `{"content": "` + content + `", "channel": "whatsapp", "sender": "+5511988887777"}`
+		req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return string(data)
+	}
+
+	if reply := post("Oi"); !strings.Contains(reply, `"intent":"small_talk"`) {
+		t.Errorf("Small talk reply is not correct: %s", reply)
+	}
+	post("Não quero receber mais promoções")
+
+	contact, err := s.repos.Contacts.FindByIdentity(context.Background(), defaultTenant, "whatsapp", "+5511988887777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact.MarketingConsent || !containsString(contact.Tags, "opt-out") {
+		t.Errorf("Opt out was not recorded: %+v", contact)
+	}
+
+	messages, _ := s.repos.Messages.List(context.Background())
+	if len(messages) != 4 || messages[0].Intent != string(IntentSmallTalk) || messages[2].Intent != string(IntentOptOut) {
+		t.Errorf("Intents were not stored with the messages: %+v", messages)
+	}
+}
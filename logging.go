@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/telemetry"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+// setupTelemetry installs the default logger and the OpenTelemetry tracing
+// (see telemetry.SetupTracing). The returned function flushes pending spans.
+func setupTelemetry(config *Config) func() {
+	level, _ := config.Logging.level()
+	slog.SetDefault(telemetry.NewLogger(os.Stderr, telemetry.LogOptions{
+		Level:   level,
+		JSON:    config.Logging.Format == "json",
+		Content: config.Logging.Content,
+	}))
+
+	shutdown, err := telemetry.SetupTracing(context.Background(), config.Tracing.Endpoint, config.Tracing.ServiceName)
+	if err != nil {
+		slog.Error("tracing disabled", "error", err)
+		return func() {}
+	}
+	if config.Tracing.Endpoint != "" {
+		slog.Info("tracing enabled", "endpoint", config.Tracing.Endpoint)
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			slog.Warn("span export failed", "error", err)
+		}
+	}
+}
+
+// fatal logs the error and exits, for startup failures.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestContext tags the request with a correlation ID (the caller's
+// X-Request-ID, or a new one) and starts its server span, continuing the
+// caller's trace when the request has a W3C traceparent header. The ID is
+// echoed back in the X-Request-ID header.
+func requestContext(c *fiber.Ctx) error {
+	id := c.Get(fiber.HeaderXRequestID)
+	if !validRequestID.MatchString(id) {
+		id = telemetry.NewID(8)
+	}
+	c.Set(fiber.HeaderXRequestID, id)
+
+	ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), requestCarrier{c})
+	ctx, span := telemetry.Start(telemetry.WithCorrelationID(ctx, id), c.Method()+" "+c.Path(), telemetry.KindServer)
+	c.SetUserContext(ctx)
+
+	err := c.Next()
+
+	// Fiber reuses the buffer behind the method, the span keeps a copy.
+	method := strings.Clone(c.Method())
+	span.SetName(method + " " + c.Route().Path)
+	span.SetAttributes(
+		attribute.String("http.method", method),
+		attribute.String("http.route", c.Route().Path),
+		attribute.Int("http.status_code", c.Response().StatusCode()),
+	)
+	telemetry.End(span, err)
+
+	return err
+}
+
+// requestCarrier reads and writes the trace context headers of a request.
+type requestCarrier struct {
+	c *fiber.Ctx
+}
+
+func (r requestCarrier) Get(key string) string {
+	return r.c.Get(key)
+}
+
+func (r requestCarrier) Set(key, value string) {
+	r.c.Request().Header.Set(key, value)
+}
+
+func (r requestCarrier) Keys() []string {
+	var keys []string
+	r.c.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// registerTracing records a span for every database write, as a child of the
+// span in the statement context (set with WithContext).
+func registerTracing(db *gorm.DB) error {
+	before := func(tx *gorm.DB) {
+		if tx.Statement.Context == nil {
+			return
+		}
+		tx.InstanceSet("telemetry:start", time.Now())
+	}
+	after := func(operation string) func(tx *gorm.DB) {
+		return func(tx *gorm.DB) {
+			start, ok := tx.InstanceGet("telemetry:start")
+			if !ok {
+				return
+			}
+			telemetry.Record(tx.Statement.Context, "db."+operation, telemetry.KindClient, start.(time.Time), tx.Error,
+				attribute.String("db.table", tx.Statement.Table),
+				attribute.Int64("db.rows_affected", tx.RowsAffected),
+			)
+		}
+	}
+
+	callbacks := db.Callback()
+	if err := callbacks.Create().Before("gorm:create").Register("telemetry:before_create", before); err != nil {
+		return err
+	}
+	if err := callbacks.Create().After("gorm:create").Register("telemetry:after_create", after("create")); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register("telemetry:before_update", before); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register("telemetry:after_update", after("update")); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("gorm:delete").Register("telemetry:before_delete", before); err != nil {
+		return err
+	}
+	return callbacks.Delete().After("gorm:delete").Register("telemetry:after_delete", after("delete"))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arthurborgesdev/relationship-bot/telemetry"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestRequestContext(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(telemetry.NewLogger(&logs, telemetry.LogOptions{Level: slog.LevelInfo}))
+	defer slog.SetDefault(defaultLogger)
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	if _, err := telemetry.SetupTracing(context.Background(), "", "bot"); err != nil {
+		t.Fatal(err)
+	}
+
+	db := newTestDB(t, &Contact{})
+	if err := registerTracing(db); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Use(requestContext)
+	app.Post("/contacts", func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		slog.InfoContext(ctx, "creating contact", "content", "Oi, sou a Ana")
+		return db.WithContext(ctx).Create(&Contact{Name: "Ana"}).Error
+	})
+
+	req := httptest.NewRequest("POST", "/contacts", nil)
+	req.Header.Set("X-Request-ID", "wa-msg-42")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("X-Request-ID") != "wa-msg-42" {
+		t.Errorf("Request ID should be echoed, got %q", resp.Header.Get("X-Request-ID"))
+	}
+	if !strings.Contains(logs.String(), "correlation_id=wa-msg-42") || strings.Contains(logs.String(), "Ana") {
+		t.Errorf("Log record is not correct: %s", logs.String())
+	}
+
+	req = httptest.NewRequest("POST", "/contacts", nil)
+	req.Header.Set("X-Request-ID", "not valid\n")
+	resp, _ = app.Test(req)
+	if id := resp.Header.Get("X-Request-ID"); id == "" || id == "not valid\n" {
+		t.Errorf("Invalid request IDs should be replaced, got %q", id)
+	}
+
+	req = httptest.NewRequest("POST", "/contacts", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	app.Test(req)
+
+	spans := recorder.Ended()
+	if len(spans) != 6 {
+		t.Fatalf("A server and a database span should be recorded per request, got %d", len(spans))
+	}
+	write, server := spans[0], spans[1]
+	if write.Name() != "db.create" || server.Name() != "POST /contacts" || write.Parent().SpanID() != server.SpanContext().SpanID() ||
+		write.SpanContext().TraceID() != server.SpanContext().TraceID() {
+		t.Errorf("Database span is not a child of the request span: %v %v", write.Name(), server.Name())
+	}
+	if caller := spans[5]; caller.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || caller.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Request span does not continue the caller's trace: %v", caller.Parent())
+	}
+}
@@ -1,37 +1,182 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/arthurborgesdev/relationship-bot/pii"
+	"github.com/arthurborgesdev/relationship-bot/vectordb"
 	"github.com/gofiber/fiber/v2"
+	"github.com/joho/godotenv"
 )
 
 func main() {
-	db, err := setupDatabase()
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		fatal("failed to load .env file", err)
+	}
+
+	config, args, err := loadConfig(os.Args[1:], os.LookupEnv)
 	if err != nil {
-		log.Fatalf("Failed to setup database: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	shutdownTelemetry := setupTelemetry(config)
+	defer shutdownTelemetry()
+
+	if len(args) > 0 && args[0] == "migrate" {
+		db, err := openDatabase(config.Database)
+		if err != nil {
+			fatal("failed to open database", err)
+		}
+		if err := runMigrateCommand(db, args[1:]); err != nil {
+			fatal("migration failed", err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "catalog" {
+		db, err := setupDatabase(config.Database)
+		if err != nil {
+			fatal("failed to setup database", err)
+		}
+		service, err := New(db, config)
+		if err != nil {
+			fatal("failed to create LLM service", err)
+		}
+		if err := runCatalogCommand(context.Background(), service, args[1:], os.Stdout); err != nil {
+			fatal("catalog command failed", err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "rotate-keys" {
+		db, err := openDatabase(config.Database)
+		if err != nil {
+			fatal("failed to open database", err)
+		}
+		crypter, err := newFieldCrypter(config.Encryption)
+		if err != nil {
+			fatal("failed to load encryption keys", err)
+		}
+		updated, err := rotateEncryption(context.Background(), db, crypter)
+		if err != nil {
+			slog.Error("rows re-encrypted before the failure", "rows", updated)
+			fatal("key rotation failed", err)
+		}
+		slog.Info("re-encrypted rows", "rows", updated)
+		return
+	}
+
+	db, err := setupDatabase(config.Database)
+	if err != nil {
+		fatal("failed to setup database", err)
+	}
+	if err := registerTracing(db); err != nil {
+		fatal("failed to register database tracing", err)
 	}
 
 	app := fiber.New()
+	app.Use(requestContext)
+	if config.Metrics.Enabled {
+		app.Use(metricsMiddleware)
+		app.Get("/metrics", metricsHandler(config.Metrics))
+	}
 
-	LLMService, err := New(db)
+	LLMService, err := New(db, config)
 	if err != nil {
-		log.Fatalf("Failed to create LLM service: %v", err)
+		fatal("failed to create LLM service", err)
 	}
 
-	// MilvusService, err := vectordb.New(LLMService.llmClient)
-	// if err != nil {
-	// 	log.Fatalf("Failed to create Milvus service: %v", err)
-	// }
+	authenticator, err := newAuthenticator(config.Admin)
+	if err != nil {
+		fatal("failed to create authenticator", err)
+	}
 
 	LLMService.RegisterRoutes(app)
-	// MilvusService.RegisterRoutes(app)
+
+	admin := app.Group("/admin", auditLog(db), authenticator.Middleware())
+	admin.Post("/tokens", requireRole(ownerRoles...), authenticator.issueToken)
+	LLMService.RegisterAdminRoutes(admin)
+
+	if config.Milvus.Enabled {
+		timeout, err := time.ParseDuration(config.OpenAI.Timeout)
+		if err != nil {
+			fatal("invalid OpenAI timeout", err)
+		}
+		MilvusService, err := vectordb.New(LLMService.llmClient, vectordb.Config{
+			Address: config.Milvus.Address,
+			Model:   config.OpenAI.Model,
+			Timeout: timeout,
+			Redaction: func(tenant string) pii.Policy {
+				return config.Tenant(tenant).Redaction
+			},
+			OnUsage: func(ctx context.Context, u vectordb.Usage) {
+				ctx = withUsageScope(ctx, usageScope{Tenant: u.Tenant, ContactID: uint(u.ContactID)})
+				LLMService.usage.record(ctx, u.Operation, u.Model, u.PromptTokens, u.CompletionTokens)
+			},
+		})
+		if err != nil {
+			fatal("failed to create Milvus service", err)
+		}
+
+		MilvusService.RegisterRoutes(admin.Group("/vectordb", requireRole(ownerRoles...)))
+		LLMService.vectors = MilvusService
+		LLMService.memories = MilvusService
+	}
 
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Hello, World 👋!")
 	})
 
-	// googleCalendar()
+	if config.Retention.Enabled {
+		if err := LLMService.scheduleRetentionPurge(context.Background(), time.Now()); err != nil {
+			fatal("failed to schedule retention purge", err)
+		}
+	}
+	if err := LLMService.scheduleIdempotencyCleanup(context.Background(), time.Now()); err != nil {
+		fatal("failed to schedule idempotency cleanup", err)
+	}
+	if err := LLMService.scheduleProductEmbeddings(context.Background(), time.Now()); err != nil {
+		fatal("failed to schedule product embeddings", err)
+	}
+
+	// The scheduler runs reminders, retention purges, idempotency cleanups,
+	// product embeddings and the messages queued while the LLM was down.
+	go LLMService.scheduler.Start(context.Background())
+
+	if config.Inbound.Async {
+		go LLMService.workers.Start(context.Background())
+	}
+
+	// On SIGINT or SIGTERM the server stops taking requests, then the turns
+	// still buffered by the debouncer are answered before the process exits.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		if err := app.Shutdown(); err != nil {
+			slog.Error("server shutdown failed", "error", err)
+		}
+	}()
 
-	app.Listen(":3000")
+	drained := make(chan struct{})
+	if LLMService.debouncer != nil {
+		go func() {
+			LLMService.debouncer.Start(ctx)
+			close(drained)
+		}()
+	} else {
+		close(drained)
+	}
+
+	if err := app.Listen(config.Address()); err != nil {
+		slog.Error("server stopped", "error", err)
+	}
+	stop()
+	<-drained
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/metrics"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Order funnel stages, in the order a message goes through them.
+const (
+	stageMessageReceived   = "message_received"
+	stageExtractionStarted = "extraction_started"
+	stageProductsExtracted = "products_extracted"
+	stageProductMatched    = "product_matched"
+	stageOrderPlaced       = "order_placed"
+	stageOrderConfirmed    = "order_confirmed"
+	stageOrderRescheduled  = "order_rescheduled"
+	stageOrderCancelled    = "order_cancelled"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route and status.",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: metrics.DefaultBuckets,
+	}, []string{"method", "route"})
+	extractions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "product_extractions_total",
+		Help: "Product extractions by result (success, empty, invalid, error).",
+	}, []string{"result"})
+	catalogMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "catalog_matches_total",
+		Help: "Catalog lookups of extracted products by result (hit, miss, error).",
+	}, []string{"result"})
+	orderFunnel = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "order_funnel_total",
+		Help: "Messages and orders reaching each stage of the order funnel.",
+	}, []string{"stage"})
+)
+
+// metricsMiddleware counts requests and their latency by route pattern (not
+// by path, which would create a series per contact id).
+func metricsMiddleware(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	if fiberErr, ok := err.(*fiber.Error); ok {
+		status = fiberErr.Code
+	} else if err != nil {
+		status = fiber.StatusInternalServerError
+	}
+
+	route := c.Route().Path
+	if status == fiber.StatusNotFound && route == "/" && c.Path() != "/" {
+		route = "unmatched"
+	}
+	// Fiber reuses the buffer behind the method, the series keeps a copy.
+	method := strings.Clone(c.Method())
+	httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// metricsHandler serves the Prometheus metrics, behind the bearer token when
+// one is configured.
+func metricsHandler(config MetricsConfig) fiber.Handler {
+	handler := adaptor.HTTPHandler(promhttp.Handler())
+	return func(c *fiber.Ctx) error {
+		if config.Token != "" {
+			token, _ := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "invalid metrics token",
+				})
+			}
+		}
+		return handler(c)
+	}
+}
@@ -0,0 +1,41 @@
+// Package metrics holds the Prometheus metrics shared by every package
+// calling OpenAI.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultBuckets are latency buckets in seconds, up to the slowest LLM calls.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	llmDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "llm_request_duration_seconds",
+		Help:    "Latency of OpenAI calls.",
+		Buckets: DefaultBuckets,
+	}, []string{"operation", "model", "status"})
+	llmTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "llm_tokens_total",
+		Help: "Tokens used by OpenAI calls.",
+	}, []string{"operation", "model", "type"})
+)
+
+// ObserveLLMCall records the latency and token usage of an OpenAI call.
+// operation names the call site, e.g. "extract" or "embedding".
+func ObserveLLMCall(operation, model string, start time.Time, promptTokens, completionTokens int, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	llmDuration.WithLabelValues(operation, model, status).Observe(time.Since(start).Seconds())
+	if promptTokens > 0 {
+		llmTokens.WithLabelValues(operation, model, "prompt").Add(float64(promptTokens))
+	}
+	if completionTokens > 0 {
+		llmTokens.WithLabelValues(operation, model, "completion").Add(float64(completionTokens))
+	}
+}
@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveLLMCall(t *testing.T) {
+	ObserveLLMCall("test", "gpt-4", time.Now(), 120, 30, nil)
+	ObserveLLMCall("test", "gpt-4", time.Now(), 80, 0, errors.New("fake"))
+
+	if tokens := testutil.ToFloat64(llmTokens.WithLabelValues("test", "gpt-4", "prompt")); tokens != 200 {
+		t.Errorf("Prompt tokens are not correct: %v", tokens)
+	}
+	if tokens := testutil.ToFloat64(llmTokens.WithLabelValues("test", "gpt-4", "completion")); tokens != 30 {
+		t.Errorf("Completion tokens are not correct: %v", tokens)
+	}
+	if calls := testutil.CollectAndCount(llmDuration, "llm_request_duration_seconds"); calls != 2 {
+		t.Errorf("There should be a latency series per status: %d", calls)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	s, _, _, _ := newTestService(t, time.Now())
+	app := fiber.New()
+	app.Use(metricsMiddleware)
+	app.Get("/metrics", metricsHandler(MetricsConfig{Token: "scrape"}))
+	s.RegisterRoutes(app)
+
+	received := testutil.ToFloat64(orderFunnel.WithLabelValues(stageMessageReceived))
+	routed := testutil.ToFloat64(httpRequests.WithLabelValues("POST", "/messages", "200"))
+
+	req := httptest.NewRequest("POST", "/messages", strings.NewReader(`{"content": "Oi", "channel": "whatsapp", "sender": "+5511977776666"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if _, err := app.Test(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if testutil.ToFloat64(orderFunnel.WithLabelValues(stageMessageReceived)) != received+1 || testutil.ToFloat64(httpRequests.WithLabelValues("POST", "/messages", "200")) != routed+1 {
+		t.Errorf("Chat request was not counted")
+	}
+
+	resp, _ := app.Test(httptest.NewRequest("GET", "/metrics", nil))
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("Metrics should require the token, got %d", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	for _, expected := range []string{
+		`http_requests_total{method="POST",route="/messages",status="200"}`,
+		`order_funnel_total{stage="message_received"}`,
+		"# TYPE go_goroutines gauge",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Metrics are missing %s:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,965 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Schema changes are applied through versioned migrations instead of
+// AutoMigrate so they can be reviewed and rolled back. Each migration
+// declares the table shapes it needs locally: never reference the live
+// models from models.go here, or old migrations would change with them.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create_messages_products_audit_logs",
+		Up: func(tx *gorm.DB) error {
+			type Message struct {
+				gorm.Model
+				Content string
+				Role    string
+			}
+			type Products struct {
+				gorm.Model
+				Product  string
+				Flavor   string
+				Quantity int
+			}
+			type AuditLog struct {
+				gorm.Model
+				Actor  string
+				Role   string
+				Method string
+				Path   string
+				Status int
+				IP     string
+			}
+
+			// Databases created before migrations existed already have these tables.
+			for _, table := range []interface{}{&Message{}, &Products{}, &AuditLog{}} {
+				if tx.Migrator().HasTable(table) {
+					continue
+				}
+				if err := tx.Migrator().CreateTable(table); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("audit_logs", "products", "messages")
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create_contacts_orders",
+		Up: func(tx *gorm.DB) error {
+			type Contact struct {
+				gorm.Model
+				Name  string
+				Phone string `gorm:"index"`
+			}
+			type Order struct {
+				gorm.Model
+				ContactID  uint `gorm:"index"`
+				Status     string
+				PickupDate string
+				PickupTime string
+			}
+			type OrderItem struct {
+				gorm.Model
+				OrderID   uint `gorm:"index"`
+				ProductID uint
+				Item      string
+				Flavor    string
+				Quantity  int
+				Volume    string
+			}
+
+			return tx.Migrator().CreateTable(&Contact{}, &Order{}, &OrderItem{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("order_items", "orders", "contacts")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add_contact_profiles",
+		Up: func(tx *gorm.DB) error {
+			type Message struct {
+				gorm.Model
+				ContactID uint `gorm:"index"`
+				Channel   string
+				Sender    string
+			}
+			type Contact struct {
+				gorm.Model
+				PreferredFlavors  string
+				PreferredProducts string
+				MarketingConsent  bool
+				DataConsent       bool
+				ConsentUpdatedAt  *time.Time
+				Tags              string
+				Notes             string
+			}
+			type ContactIdentity struct {
+				gorm.Model
+				ContactID  uint   `gorm:"index"`
+				Channel    string `gorm:"index:idx_contact_identity,unique"`
+				ExternalID string `gorm:"index:idx_contact_identity,unique"`
+			}
+
+			for _, column := range []string{"ContactID", "Channel", "Sender"} {
+				if err := tx.Migrator().AddColumn(&Message{}, column); err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().CreateIndex(&Message{}, "ContactID"); err != nil {
+				return err
+			}
+			for _, column := range []string{"PreferredFlavors", "PreferredProducts", "MarketingConsent", "DataConsent", "ConsentUpdatedAt", "Tags", "Notes"} {
+				if err := tx.Migrator().AddColumn(&Contact{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&ContactIdentity{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Message struct{}
+			type Contact struct{}
+
+			if err := tx.Migrator().DropTable("contact_identities"); err != nil {
+				return err
+			}
+			// SQLite rebuilds the table when a later migration drops a column,
+			// which loses the index.
+			if tx.Migrator().HasIndex(&Message{}, "idx_messages_contact_id") {
+				if err := tx.Migrator().DropIndex(&Message{}, "idx_messages_contact_id"); err != nil {
+					return err
+				}
+			}
+			for _, column := range []string{"contact_id", "channel", "sender"} {
+				if err := tx.Migrator().DropColumn(&Message{}, column); err != nil {
+					return err
+				}
+			}
+			for _, column := range []string{"preferred_flavors", "preferred_products", "marketing_consent", "data_consent", "consent_updated_at", "tags", "notes"} {
+				if err := tx.Migrator().DropColumn(&Contact{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create_jobs_add_order_follow_ups",
+		Up: func(tx *gorm.DB) error {
+			type Job struct {
+				gorm.Model
+				Kind      string    `gorm:"index"`
+				RunAt     time.Time `gorm:"index"`
+				OrderID   uint      `gorm:"index"`
+				ContactID uint
+				Payload   string
+				Status    string `gorm:"index"`
+				Attempts  int
+				LastError string
+			}
+			type Order struct {
+				CalendarEventID string
+				ReminderSentAt  *time.Time
+			}
+
+			for _, column := range []string{"CalendarEventID", "ReminderSentAt"} {
+				if err := tx.Migrator().AddColumn(&Order{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&Job{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Order struct{}
+
+			if err := tx.Migrator().DropTable("jobs"); err != nil {
+				return err
+			}
+			for _, column := range []string{"calendar_event_id", "reminder_sent_at"} {
+				if err := tx.Migrator().DropColumn(&Order{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create_pending_order_changes",
+		Up: func(tx *gorm.DB) error {
+			type PendingOrderChange struct {
+				gorm.Model
+				ContactID  uint `gorm:"index"`
+				OrderID    uint
+				Kind       string
+				PickupDate string
+				PickupTime string
+				ExpiresAt  time.Time
+			}
+
+			return tx.Migrator().CreateTable(&PendingOrderChange{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("pending_order_changes")
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add_message_intents",
+		Up: func(tx *gorm.DB) error {
+			type Message struct {
+				Intent           string `gorm:"index"`
+				IntentConfidence float64
+			}
+
+			for _, column := range []string{"Intent", "IntentConfidence"} {
+				if err := tx.Migrator().AddColumn(&Message{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateIndex(&Message{}, "Intent")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Message struct{}
+
+			if tx.Migrator().HasIndex(&Message{}, "idx_messages_intent") {
+				if err := tx.Migrator().DropIndex(&Message{}, "idx_messages_intent"); err != nil {
+					return err
+				}
+			}
+			for _, column := range []string{"intent", "intent_confidence"} {
+				if err := tx.Migrator().DropColumn(&Message{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create_data_requests",
+		Up: func(tx *gorm.DB) error {
+			type DataRequest struct {
+				gorm.Model
+				ContactID  uint `gorm:"index"`
+				Kind       string
+				Actor      string
+				Summary    string
+				Digest     string
+				RecordedAt time.Time
+				PrevHash   string
+				Hash       string
+			}
+
+			return tx.Migrator().CreateTable(&DataRequest{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("data_requests")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add_blind_indexes",
+		Up: func(tx *gorm.DB) error {
+			type Message struct {
+				ContentIndex string
+			}
+			type Contact struct {
+				PhoneIndex  string `gorm:"size:64;index"`
+				SearchIndex string
+			}
+
+			if err := tx.Migrator().AddColumn(&Message{}, "ContentIndex"); err != nil {
+				return err
+			}
+			for _, column := range []string{"PhoneIndex", "SearchIndex"} {
+				if err := tx.Migrator().AddColumn(&Contact{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateIndex(&Contact{}, "PhoneIndex")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Message struct{}
+			type Contact struct{}
+
+			if tx.Migrator().HasIndex(&Contact{}, "idx_contacts_phone_index") {
+				if err := tx.Migrator().DropIndex(&Contact{}, "idx_contacts_phone_index"); err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().DropColumn(&Message{}, "content_index"); err != nil {
+				return err
+			}
+			for _, column := range []string{"phone_index", "search_index"} {
+				if err := tx.Migrator().DropColumn(&Contact{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 9,
+		Name:    "add_tenants_and_purge_reports",
+		Up: func(tx *gorm.DB) error {
+			type Message struct {
+				Tenant string `gorm:"index"`
+			}
+			type Contact struct {
+				Tenant string `gorm:"index"`
+			}
+			type PurgeReport struct {
+				gorm.Model
+				Tenant   string `gorm:"index"`
+				RanAt    time.Time
+				Messages int64
+				Orders   int64
+				Vectors  int
+				Errors   string
+			}
+
+			for _, model := range []interface{}{&Message{}, &Contact{}} {
+				if err := tx.Migrator().AddColumn(model, "Tenant"); err != nil {
+					return err
+				}
+				// Existing rows belong to the default tenant.
+				if err := tx.Model(model).Where("tenant IS NULL").Update("tenant", "default").Error; err != nil {
+					return err
+				}
+				if err := tx.Migrator().CreateIndex(model, "Tenant"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&PurgeReport{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Message struct{}
+			type Contact struct{}
+
+			if err := tx.Migrator().DropTable("purge_reports"); err != nil {
+				return err
+			}
+			for _, index := range []struct {
+				model interface{}
+				name  string
+			}{
+				{&Message{}, "idx_messages_tenant"},
+				{&Contact{}, "idx_contacts_tenant"},
+			} {
+				if tx.Migrator().HasIndex(index.model, index.name) {
+					if err := tx.Migrator().DropIndex(index.model, index.name); err != nil {
+						return err
+					}
+				}
+				if err := tx.Migrator().DropColumn(index.model, "tenant"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 10,
+		Name:    "create_llm_usages",
+		Up: func(tx *gorm.DB) error {
+			type LLMUsage struct {
+				gorm.Model
+				Tenant           string `gorm:"index"`
+				ContactID        uint   `gorm:"index"`
+				Operation        string
+				LLMModel         string `gorm:"column:model"`
+				PromptTokens     int
+				CompletionTokens int
+				Cost             float64
+				CorrelationID    string
+			}
+
+			return tx.Migrator().CreateTable(&LLMUsage{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("llm_usages")
+		},
+	},
+	{
+		Version: 11,
+		Name:    "create_inbound_messages_and_dead_letters",
+		Up: func(tx *gorm.DB) error {
+			type InboundMessage struct {
+				gorm.Model
+				Tenant      string `gorm:"index"`
+				ContactKey  string `gorm:"index"`
+				Payload     string
+				Status      string `gorm:"index"`
+				Attempts    int
+				RunAt       time.Time `gorm:"index"`
+				LockedUntil *time.Time
+				LastError   string
+			}
+			type DeadLetter struct {
+				gorm.Model
+				Tenant     string `gorm:"index"`
+				ContactKey string `gorm:"index"`
+				Payload    string
+				Attempts   int
+				LastError  string
+				ReceivedAt time.Time
+			}
+
+			return tx.Migrator().CreateTable(&InboundMessage{}, &DeadLetter{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("dead_letters", "inbound_messages")
+		},
+	},
+	{
+		Version: 12,
+		Name:    "add_idempotency",
+		Up: func(tx *gorm.DB) error {
+			type Message struct {
+				ExternalID string `gorm:"index"`
+			}
+			type Order struct {
+				IdempotencyKey string `gorm:"index"`
+			}
+			type IdempotencyRecord struct {
+				gorm.Model
+				RequestKey     string `gorm:"size:64;uniqueIndex"`
+				Tenant         string `gorm:"index"`
+				ContactID      uint   `gorm:"index"`
+				Status         string
+				ResponseStatus int
+				ResponseBody   string
+			}
+
+			if err := tx.Migrator().AddColumn(&Message{}, "ExternalID"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateIndex(&Message{}, "ExternalID"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().AddColumn(&Order{}, "IdempotencyKey"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateIndex(&Order{}, "IdempotencyKey"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateTable(&IdempotencyRecord{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Message struct{}
+			type Order struct{}
+
+			if err := tx.Migrator().DropTable("idempotency_records"); err != nil {
+				return err
+			}
+			for _, index := range []struct {
+				model  interface{}
+				name   string
+				column string
+			}{
+				{&Message{}, "idx_messages_external_id", "external_id"},
+				{&Order{}, "idx_orders_idempotency_key", "idempotency_key"},
+			} {
+				if tx.Migrator().HasIndex(index.model, index.name) {
+					if err := tx.Migrator().DropIndex(index.model, index.name); err != nil {
+						return err
+					}
+				}
+				if err := tx.Migrator().DropColumn(index.model, index.column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 13,
+		Name:    "create_conversation_summaries",
+		Up: func(tx *gorm.DB) error {
+			type ConversationSummary struct {
+				gorm.Model
+				Tenant           string `gorm:"index"`
+				ContactID        uint   `gorm:"uniqueIndex"`
+				Summary          string
+				ThroughMessageID uint
+				Tokens           int
+			}
+
+			return tx.Migrator().CreateTable(&ConversationSummary{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("conversation_summaries")
+		},
+	},
+	{
+		Version: 14,
+		Name:    "create_campaigns",
+		Up: func(tx *gorm.DB) error {
+			type Products struct {
+				Category string `gorm:"index"`
+			}
+			type Campaign struct {
+				gorm.Model
+				Tenant   string `gorm:"index"`
+				Name     string
+				Template string
+				Segment  string
+				Status   string `gorm:"index"`
+				SendAt   *time.Time
+			}
+			type CampaignRecipient struct {
+				gorm.Model
+				CampaignID  uint   `gorm:"index"`
+				ContactID   uint   `gorm:"index"`
+				Channel     string `gorm:"index"`
+				OutboundID  string `gorm:"index"`
+				Status      string `gorm:"index"`
+				Error       string
+				SentAt      *time.Time `gorm:"index"`
+				DeliveredAt *time.Time
+				ReadAt      *time.Time
+				RepliedAt   *time.Time
+			}
+
+			if err := tx.Migrator().AddColumn(&Products{}, "Category"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateIndex(&Products{}, "Category"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateTable(&Campaign{}, &CampaignRecipient{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Products struct{}
+
+			if err := tx.Migrator().DropTable("campaign_recipients", "campaigns"); err != nil {
+				return err
+			}
+			if tx.Migrator().HasIndex(&Products{}, "idx_products_category") {
+				if err := tx.Migrator().DropIndex(&Products{}, "idx_products_category"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&Products{}, "category")
+		},
+	},
+	{
+		Version: 15,
+		Name:    "create_waitlist_entries",
+		Up: func(tx *gorm.DB) error {
+			type WaitlistEntry struct {
+				gorm.Model
+				Tenant     string `gorm:"index"`
+				ContactID  uint   `gorm:"index"`
+				ProductID  uint   `gorm:"index"`
+				Product    string
+				Flavor     string
+				Status     string `gorm:"index"`
+				ExpiresAt  *time.Time
+				NotifiedAt *time.Time
+			}
+
+			return tx.Migrator().CreateTable(&WaitlistEntry{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("waitlist_entries")
+		},
+	},
+	{
+		Version: 16,
+		Name:    "add_product_descriptions_and_embeddings",
+		Up: func(tx *gorm.DB) error {
+			type Products struct {
+				Description string
+			}
+			type ProductEmbedding struct {
+				gorm.Model
+				ProductID uint   `gorm:"uniqueIndex"`
+				Digest    string `gorm:"size:64"`
+				Vector    string
+			}
+
+			if err := tx.Migrator().AddColumn(&Products{}, "Description"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateTable(&ProductEmbedding{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type Products struct{}
+
+			if err := tx.Migrator().DropTable("product_embeddings"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&Products{}, "description")
+		},
+	},
+	{
+		Version: 17,
+		Name:    "add_product_skus",
+		Up: func(tx *gorm.DB) error {
+			type Products struct {
+				SKU string `gorm:"size:64;index"`
+			}
+
+			if err := tx.Migrator().AddColumn(&Products{}, "SKU"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&Products{}, "SKU")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Products struct{}
+
+			if tx.Migrator().HasIndex(&Products{}, "idx_products_sku") {
+				if err := tx.Migrator().DropIndex(&Products{}, "idx_products_sku"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&Products{}, "sku")
+		},
+	},
+	{
+		Version: 18,
+		Name:    "create_stock_movements",
+		Up: func(tx *gorm.DB) error {
+			type Products struct {
+				ID         uint
+				Quantity   int
+				ArchivedAt *time.Time `gorm:"index"`
+				DeletedAt  gorm.DeletedAt
+			}
+			type StockMovement struct {
+				ID        uint      `gorm:"primarykey"`
+				CreatedAt time.Time `gorm:"index"`
+				ProductID uint      `gorm:"index"`
+				Kind      string    `gorm:"index"`
+				Quantity  int
+				Balance   int
+				OrderID   uint `gorm:"index"`
+				Actor     string
+				Note      string
+			}
+
+			if err := tx.Migrator().AddColumn(&Products{}, "ArchivedAt"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateIndex(&Products{}, "ArchivedAt"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateTable(&StockMovement{}); err != nil {
+				return err
+			}
+
+			// The ledger starts from the quantities the products have.
+			var products []Products
+			if err := tx.Where("quantity <> 0").Find(&products).Error; err != nil {
+				return err
+			}
+			now := time.Now()
+			for _, product := range products {
+				opening := &StockMovement{CreatedAt: now, ProductID: product.ID, Kind: "adjustment", Quantity: product.Quantity, Balance: product.Quantity, Note: "opening balance"}
+				if err := tx.Create(opening).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			type Products struct{}
+
+			if err := tx.Migrator().DropTable("stock_movements"); err != nil {
+				return err
+			}
+			if tx.Migrator().HasIndex(&Products{}, "idx_products_archived_at") {
+				if err := tx.Migrator().DropIndex(&Products{}, "idx_products_archived_at"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&Products{}, "archived_at")
+		},
+	},
+	{
+		Version: 19,
+		Name:    "add_job_leases",
+		Up: func(tx *gorm.DB) error {
+			type Job struct {
+				LockedUntil *time.Time
+			}
+
+			return tx.Migrator().AddColumn(&Job{}, "LockedUntil")
+		},
+		Down: func(tx *gorm.DB) error {
+			type Job struct{}
+
+			return tx.Migrator().DropColumn(&Job{}, "locked_until")
+		},
+	},
+	{
+		Version: 20,
+		Name:    "add_contact_identity_tenants",
+		Up: func(tx *gorm.DB) error {
+			type ContactIdentity struct {
+				Tenant     string `gorm:"index:idx_contact_identity,unique"`
+				Channel    string `gorm:"index:idx_contact_identity,unique"`
+				ExternalID string `gorm:"index:idx_contact_identity,unique"`
+			}
+
+			if err := tx.Migrator().AddColumn(&ContactIdentity{}, "Tenant"); err != nil {
+				return err
+			}
+			// Identities belong to the tenant of their contact.
+			err := tx.Exec("UPDATE contact_identities SET tenant = (SELECT tenant FROM contacts WHERE contacts.id = contact_identities.contact_id)").Error
+			if err != nil {
+				return err
+			}
+			if tx.Migrator().HasIndex(&ContactIdentity{}, "idx_contact_identity") {
+				if err := tx.Migrator().DropIndex(&ContactIdentity{}, "idx_contact_identity"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateIndex(&ContactIdentity{}, "idx_contact_identity")
+		},
+		Down: func(tx *gorm.DB) error {
+			type ContactIdentity struct {
+				Channel    string `gorm:"index:idx_contact_identity,unique"`
+				ExternalID string `gorm:"index:idx_contact_identity,unique"`
+			}
+
+			if tx.Migrator().HasIndex(&ContactIdentity{}, "idx_contact_identity") {
+				if err := tx.Migrator().DropIndex(&ContactIdentity{}, "idx_contact_identity"); err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().DropColumn(&ContactIdentity{}, "tenant"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&ContactIdentity{}, "idx_contact_identity")
+		},
+	},
+	{
+		Version: 21,
+		Name:    "unique_product_skus",
+		Up: func(tx *gorm.DB) error {
+			type Products struct{}
+
+			if tx.Migrator().HasIndex(&Products{}, "idx_products_sku") {
+				if err := tx.Migrator().DropIndex(&Products{}, "idx_products_sku"); err != nil {
+					return err
+				}
+			}
+			// Products without a SKU, and deleted ones, do not take part.
+			// MySQL has no partial indexes, but leaves NULLs out of unique
+			// indexes. The expression needs functional key parts.
+			if tx.Dialector.Name() == "mysql" {
+				var version string
+				if err := tx.Raw("SELECT VERSION()").Scan(&version).Error; err != nil {
+					return err
+				}
+				if !supportsFunctionalIndexes(version) {
+					return fmt.Errorf("unique SKUs need MySQL 8.0.13 or later, the server is %s", version)
+				}
+				return tx.Exec("CREATE UNIQUE INDEX idx_products_sku ON products ((CASE WHEN sku = '' OR deleted_at IS NOT NULL THEN NULL ELSE sku END))").Error
+			}
+			return tx.Exec("CREATE UNIQUE INDEX idx_products_sku ON products (sku) WHERE sku <> '' AND deleted_at IS NULL").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			type Products struct {
+				SKU string `gorm:"size:64;index"`
+			}
+
+			if tx.Migrator().HasIndex(&Products{}, "idx_products_sku") {
+				if err := tx.Migrator().DropIndex(&Products{}, "idx_products_sku"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateIndex(&Products{}, "SKU")
+		},
+	},
+	{
+		Version: 22,
+		Name:    "add_audit_log_routes",
+		Up: func(tx *gorm.DB) error {
+			type AuditLog struct {
+				Route string
+			}
+
+			return tx.Migrator().AddColumn(&AuditLog{}, "Route")
+		},
+		Down: func(tx *gorm.DB) error {
+			type AuditLog struct{}
+
+			return tx.Migrator().DropColumn(&AuditLog{}, "route")
+		},
+	},
+}
+
+// supportsFunctionalIndexes reports whether the MySQL server version has
+// functional key parts, added in MySQL 8.0.13. MariaDB has none.
+func supportsFunctionalIndexes(version string) bool {
+	if strings.Contains(strings.ToLower(version), "mariadb") {
+		return false
+	}
+	var major, minor, patch int
+	fmt.Sscanf(version, "%d.%d.%d", &major, &minor, &patch)
+	return major > 8 || major == 8 && (minor > 0 || patch >= 13)
+}
+
+func sortedMigrations() []migration {
+	sorted := append([]migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+func appliedVersions(db *gorm.DB) (map[int]SchemaMigration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+
+	var rows []SchemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	applied := map[int]SchemaMigration{}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+
+	return applied, nil
+}
+
+func migrateUp(db *gorm.DB) ([]migration, error) {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for _, m := range sortedMigrations() {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+		}
+
+		done = append(done, m)
+	}
+
+	return done, nil
+}
+
+func migrateDown(db *gorm.DB, steps int) ([]migration, error) {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := sortedMigrations()
+
+	var done []migration
+	for i := len(sorted) - 1; i >= 0 && len(done) < steps; i-- {
+		m := sorted[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+		}
+
+		done = append(done, m)
+	}
+
+	return done, nil
+}
+
+// runMigrateCommand implements `relationship-bot migrate up|down [steps]|status`.
+func runMigrateCommand(db *gorm.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up | down [steps] | status")
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := migrateUp(db)
+		for _, m := range done {
+			fmt.Printf("Applied migration %d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("Database is up to date.")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			parsed, err := strconv.Atoi(args[1])
+			if err != nil || parsed < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+			steps = parsed
+		}
+
+		done, err := migrateDown(db, steps)
+		for _, m := range done {
+			fmt.Printf("Reverted migration %d_%s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		applied, err := appliedVersions(db)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range sortedMigrations() {
+			if row, ok := applied[m.Version]; ok {
+				fmt.Printf("%d_%s\tapplied %s\n", m.Version, m.Name, row.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Printf("%d_%s\tpending\n", m.Version, m.Name)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// TestMigrateUpAndDown runs on SQLite, or on the empty database set with
+// TEST_DATABASE_DRIVER and TEST_DATABASE_DSN (CI runs it on PostgreSQL and
+// MySQL too).
+func TestMigrateUpAndDown(t *testing.T) {
+	config := DatabaseConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "test.db")}
+	if driver := os.Getenv("TEST_DATABASE_DRIVER"); driver != "" {
+		config = DatabaseConfig{Driver: driver, DSN: os.Getenv("TEST_DATABASE_DSN")}
+	}
+	db, err := openDatabase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := migrateUp(db)
+	if err != nil {
+		t.Fatalf("Error migrating up: %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("Applied migrations is not correct: %d", len(applied))
+	}
+
+	for _, table := range []string{"messages", "products", "audit_logs"} {
+		if !db.Migrator().HasTable(table) {
+			t.Errorf("Table %s was not created", table)
+		}
+	}
+
+	for _, model := range []interface{}{&Message{}, &Products{}, &AuditLog{}, &Contact{}, &ContactIdentity{}, &Order{}, &OrderItem{}, &Job{}, &PendingOrderChange{}, &DataRequest{}, &PurgeReport{}, &LLMUsage{}, &InboundMessage{}, &DeadLetter{}, &IdempotencyRecord{}, &ConversationSummary{}, &Campaign{}, &CampaignRecipient{}, &WaitlistEntry{}, &ProductEmbedding{}, &StockMovement{}} {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !db.Migrator().HasColumn(model, field.DBName) {
+				t.Errorf("Column %s.%s is missing from the migrations", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+
+	applied, err = migrateUp(db)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("Second migrate up is not a no-op: %d, %v", len(applied), err)
+	}
+
+	// Rows written before tenants were recorded belong to the default tenant.
+	if _, err := migrateDown(db, len(migrations)-8); err != nil {
+		t.Fatalf("Error migrating down to version 8: %v", err)
+	}
+	db.Exec("INSERT INTO messages (content, created_at) VALUES ('before tenants', CURRENT_TIMESTAMP)")
+	if _, err := migrateUp(db); err != nil {
+		t.Fatalf("Error migrating up from version 8: %v", err)
+	}
+	var tenant *string
+	db.Raw("SELECT tenant FROM messages WHERE content = 'before tenants'").Scan(&tenant)
+	if tenant == nil || *tenant != defaultTenant {
+		t.Errorf("Existing messages were not given the default tenant: %v", tenant)
+	}
+
+	reverted, err := migrateDown(db, len(migrations))
+	if err != nil {
+		t.Fatalf("Error migrating down: %v", err)
+	}
+	if len(reverted) != len(migrations) {
+		t.Errorf("Reverted migrations is not correct: %d", len(reverted))
+	}
+	if db.Migrator().HasTable("messages") {
+		t.Errorf("Table messages was not dropped")
+	}
+}
+
+func TestSupportsFunctionalIndexes(t *testing.T) {
+	for version, expected := range map[string]bool{
+		"8.0.13":                  true,
+		"8.0.35-0ubuntu0.22.04.1": true,
+		"8.4.0":                   true,
+		"9.0.1":                   true,
+		"8.0.12":                  false,
+		"5.7.44-log":              false,
+		"10.11.6-MariaDB":         false,
+	} {
+		if supportsFunctionalIndexes(version) != expected {
+			t.Errorf("Functional indexes on %s should be %v", version, expected)
+		}
+	}
+}
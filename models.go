@@ -1,21 +1,114 @@
 package main
 
 import (
+	"time"
+
 	"github.com/sashabaranov/go-openai"
 	"gorm.io/gorm"
 )
 
 type Message struct {
 	gorm.Model
-	Content string `json:"content"`
-	Role    string `json:"role"`
+	Content          string  `json:"content"`
+	Role             string  `json:"role"`
+	ContactID        uint    `json:"contact_id" gorm:"index"`
+	Channel          string  `json:"channel"`
+	Sender           string  `json:"sender"`
+	Tenant           string  `json:"tenant" gorm:"index"`
+	Intent           string  `json:"intent" gorm:"index"`
+	IntentConfidence float64 `json:"intent_confidence"`
+	ContentIndex     string  `json:"-"`
+	Name             string  `json:"name" gorm:"-"`
+	// ExternalID is the message ID given by the channel, used to drop
+	// redelivered webhooks.
+	ExternalID string `json:"message_id" gorm:"index"`
+	// IdempotencyKey identifies the inbound request; an order is placed at
+	// most once per key.
+	IdempotencyKey string `json:"idempotency_key,omitempty" gorm:"-"`
 }
 
 type Products struct {
 	gorm.Model
+	// SKU identifies the product in catalog imports; it is unique when set.
+	SKU      string `json:"sku" gorm:"size:64;uniqueIndex:idx_products_sku,where:sku <> '' AND deleted_at IS NULL"`
 	Product  string `json:"product"`
 	Flavor   string `json:"flavor"`
 	Quantity int    `json:"quantity"`
+	Category string `json:"category" gorm:"index"`
+	// Description is used to recommend similar products.
+	Description string `json:"description"`
+	// ArchivedAt is set for products no longer sold; they keep their stock
+	// history but are not matched to orders nor recommended.
+	ArchivedAt *time.Time `json:"archived_at" gorm:"index"`
+}
+
+type Contact struct {
+	gorm.Model
+	Tenant            string            `json:"tenant" gorm:"index"`
+	Name              string            `json:"name"`
+	Phone             string            `json:"phone" gorm:"index"`
+	Identities        []ContactIdentity `json:"identities"`
+	PreferredFlavors  []string          `json:"preferred_flavors" gorm:"serializer:json"`
+	PreferredProducts []string          `json:"preferred_products" gorm:"serializer:json"`
+	MarketingConsent  bool              `json:"marketing_consent"`
+	DataConsent       bool              `json:"data_consent"`
+	ConsentUpdatedAt  *time.Time        `json:"consent_updated_at"`
+	Tags              []string          `json:"tags" gorm:"serializer:json"`
+	Notes             string            `json:"notes"`
+	// Blind indexes used to look up contacts when they are encrypted.
+	PhoneIndex  string `json:"-" gorm:"size:64;index"`
+	SearchIndex string `json:"-"`
+}
+
+// ContactIdentity is the sender ID of a contact on a channel of a tenant,
+// e.g. the WhatsApp phone number or the HTTP API user id.
+type ContactIdentity struct {
+	gorm.Model
+	ContactID  uint   `json:"contact_id" gorm:"index"`
+	Tenant     string `json:"tenant" gorm:"index:idx_contact_identity,unique"`
+	Channel    string `json:"channel" gorm:"index:idx_contact_identity,unique"`
+	ExternalID string `json:"external_id" gorm:"index:idx_contact_identity,unique"`
+}
+
+const (
+	OrderStatusPending   = "pending"
+	OrderStatusConfirmed = "confirmed"
+	OrderStatusCancelled = "cancelled"
+	OrderStatusCompleted = "completed"
+)
+
+type Order struct {
+	gorm.Model
+	ContactID       uint        `json:"contact_id" gorm:"index"`
+	Status          string      `json:"status"`
+	PickupDate      string      `json:"pickup_date"`
+	PickupTime      string      `json:"pickup_time"`
+	CalendarEventID string      `json:"calendar_event_id"`
+	ReminderSentAt  *time.Time  `json:"reminder_sent_at"`
+	Items           []OrderItem `json:"items"`
+	IdempotencyKey  string      `json:"-" gorm:"index"`
+}
+
+type OrderItem struct {
+	gorm.Model
+	OrderID   uint   `json:"order_id" gorm:"index"`
+	ProductID uint   `json:"product_id"`
+	Item      string `json:"item"`
+	Flavor    string `json:"flavor"`
+	Quantity  int    `json:"quantity"`
+	Volume    string `json:"volume"`
+}
+
+type AuditLog struct {
+	gorm.Model
+	Actor  string `json:"actor"`
+	Role   string `json:"role"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Route is the route pattern, e.g. /admin/contacts/:id.
+	Route  string `json:"route"`
+	Status int    `json:"status"`
+	IP     string `json:"ip"`
 }
 
 type LLMMessage struct {
@@ -26,15 +119,34 @@ type LLMMessage struct {
 type LLMService struct {
 	llmClient *openai.Client
 	db        *gorm.DB
+	repos     Repositories
+	config    *Config
+	calendar  Calendar
+	sender    OutboundSender
+	scheduler *Scheduler
+	intents   IntentClassifier
+	vectors   VectorStore
+	usage     *usageLedger
+	llm       *resilientLLM
+	inbound   InboundQueue
+	workers   *inboundWorkers
+	crypter   *FieldCrypter
+	debouncer *debouncer
+	memories  MemoryStore
+	embedder  Embedder
+	// coPurchases caches the co-purchase counts of each tenant.
+	coPurchases coPurchaseCache
+}
+
+type ExtractedProduct struct {
+	Item     string `json:"item"`
+	Flavor   string `json:"flavor"`
+	Quantity int    `json:"quantity"`
+	Volume   string `json:"volume"`
 }
 
 type Arguments struct {
-	Products []struct {
-		Item     string `json:"item"`
-		Flavor   string `json:"flavor"`
-		Quantity int    `json:"quantity"`
-		Volume   string `json:"volume"`
-	} `json:"products"`
+	Products []ExtractedProduct `json:"products"`
 
 	Date string `json:"date"`
 	Time string `json:"time"`
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+const (
+	OrderChangeCancel     = "cancel"
+	OrderChangeReschedule = "reschedule"
+
+	pendingOrderChangeTTL = 30 * time.Minute
+)
+
+// PendingOrderChange is a cancellation or reschedule the bot proposed to the
+// contact and that waits for a yes/no answer before touching the order. A
+// reschedule without PickupDate waits for the contact to give the new date.
+type PendingOrderChange struct {
+	gorm.Model
+	ContactID  uint      `json:"contact_id" gorm:"index"`
+	OrderID    uint      `json:"order_id"`
+	Kind       string    `json:"kind"`
+	PickupDate string    `json:"pickup_date"`
+	PickupTime string    `json:"pickup_time"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type OrderReply int
+
+const (
+	ReplyNone OrderReply = iota
+	ReplyConfirm
+	ReplyDeny
+	ReplyReschedule
+	ReplyCancel
+)
+
+var accentReplacer = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a",
+	"é", "e", "ê", "e", "í", "i",
+	"ó", "o", "ô", "o", "õ", "o", "ú", "u", "ç", "c",
+)
+
+func normalizeText(text string) string {
+	return accentReplacer.Replace(strings.ToLower(strings.TrimSpace(text)))
+}
+
+func words(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func containsAny(text string, terms ...string) bool {
+	for _, term := range terms {
+		if strings.Contains(text, term) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsWord(text string, terms ...string) bool {
+	for _, word := range words(text) {
+		if containsString(terms, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOrderReply classifies a message about an existing order. Cancellations
+// win over reschedules, which win over confirmations and denials
+// ("não vou conseguir, pode ser sexta?" is a reschedule).
+func parseOrderReply(text string) OrderReply {
+	normalized := normalizeText(text)
+
+	if containsAny(normalized, "cancel", "desmarc", "desist", "nao quero mais") {
+		return ReplyCancel
+	}
+	if containsAny(normalized, "remarc", "reagend", "outro dia", "outro horario", "mudar", "trocar o dia", "nao vou conseguir", "nao vou poder") {
+		return ReplyReschedule
+	}
+	if containsAny(normalized, "confirm", "combinado", "estarei", "pode ser", "👍") ||
+		containsWord(normalized, "sim", "ok", "certo", "beleza", "isso") {
+		return ReplyConfirm
+	}
+	if containsWord(normalized, "nao", "negativo", "deixa", "esquece") {
+		return ReplyDeny
+	}
+
+	return ReplyNone
+}
+
+// upcomingOrder returns the open order a contact most likely refers to: the
+// last reminded one, otherwise the one with the soonest pickup.
+func (s *LLMService) upcomingOrder(ctx context.Context, contactID uint) (*Order, error) {
+	orders, err := s.repos.Orders.ListByContact(ctx, contactID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.scheduler.now()
+	var open []Order
+	var pickups []time.Time
+	for _, order := range orders {
+		if order.Status != OrderStatusPending && order.Status != OrderStatusConfirmed {
+			continue
+		}
+		pickup, ok := pickupTime(&order, s.config.Reminders.DefaultPickupTime, s.config.Location())
+		if !ok || pickup.Before(now) {
+			continue
+		}
+		open = append(open, order)
+		pickups = append(pickups, pickup)
+	}
+	if len(open) == 0 {
+		return nil, nil
+	}
+
+	indexes := make([]int, len(open))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.Slice(indexes, func(a, b int) bool {
+		i, j := indexes[a], indexes[b]
+		if !remindedAt(open[i]).Equal(remindedAt(open[j])) {
+			return remindedAt(open[i]).After(remindedAt(open[j]))
+		}
+		return pickups[i].Before(pickups[j])
+	})
+
+	return &open[indexes[0]], nil
+}
+
+func remindedAt(order Order) time.Time {
+	if order.ReminderSentAt == nil {
+		return time.Time{}
+	}
+	return *order.ReminderSentAt
+}
+
+func (s *LLMService) pendingOrderChange(ctx context.Context, contactID uint) (*PendingOrderChange, error) {
+	var change PendingOrderChange
+	err := s.db.WithContext(ctx).Where("contact_id = ? AND expires_at > ?", contactID, s.scheduler.now()).Order("id desc").First(&change).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+func (s *LLMService) clearPendingOrderChanges(ctx context.Context, contactID uint) error {
+	return s.db.WithContext(ctx).Where("contact_id = ?", contactID).Delete(&PendingOrderChange{}).Error
+}
+
+func (s *LLMService) proposeOrderChange(ctx context.Context, change *PendingOrderChange) error {
+	if err := s.clearPendingOrderChanges(ctx, change.ContactID); err != nil {
+		return err
+	}
+	change.ExpiresAt = s.scheduler.now().Add(pendingOrderChangeTTL)
+	return s.db.WithContext(ctx).Create(change).Error
+}
+
+func formatPickup(pickup time.Time) string {
+	return pickup.Format("02/01") + " às " + pickup.Format("15:04")
+}
+
+// handleOrderChange handles reminder confirmations and cancel or reschedule
+// requests for the contact's upcoming order. Cancellations and reschedules are
+// only applied once the contact confirms them. It reports false when the
+// message is not about an existing order.
+func (s *LLMService) handleOrderChange(ctx context.Context, contact *Contact, content string) (string, *Order, bool, error) {
+	reply := parseOrderReply(content)
+
+	pending, err := s.pendingOrderChange(ctx, contact.ID)
+	if err != nil {
+		return "", nil, false, err
+	}
+	if pending != nil {
+		awaitingDate := pending.Kind == OrderChangeReschedule && pending.PickupDate == ""
+
+		// A confirmed change is cleared once it is applied, so a failure
+		// lets the contact confirm again.
+		if reply == ReplyConfirm && !awaitingDate {
+			answer, order, handled, err := s.applyOrderChange(ctx, contact, pending)
+			if err != nil {
+				return answer, order, handled, err
+			}
+			return answer, order, handled, s.clearPendingOrderChanges(ctx, contact.ID)
+		}
+		if err := s.clearPendingOrderChanges(ctx, contact.ID); err != nil {
+			return "", nil, false, err
+		}
+
+		// The contact was asked for the new pickup date: this message is the
+		// answer, even when it reads like a confirmation ("pode ser às 15h").
+		if awaitingDate && reply != ReplyDeny && reply != ReplyCancel {
+			order, err := s.repos.Orders.Get(ctx, pending.OrderID)
+			if err != nil {
+				return "", nil, true, err
+			}
+			reply, err := s.rescheduleFromMessage(ctx, contact, order, content)
+			return reply, order, true, err
+		}
+
+		if reply == ReplyDeny {
+			order, err := s.repos.Orders.Get(ctx, pending.OrderID)
+			return "Tudo bem, seu pedido continua como estava.", order, true, err
+		}
+	}
+
+	if reply == ReplyNone || reply == ReplyDeny {
+		return "", nil, false, nil
+	}
+
+	order, err := s.upcomingOrder(ctx, contact.ID)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	switch reply {
+	case ReplyConfirm:
+		// A plain "ok" only means something right after a reminder.
+		if order == nil || order.ReminderSentAt == nil || order.Status != OrderStatusPending {
+			return "", nil, false, nil
+		}
+		order.Status = OrderStatusConfirmed
+		if err := s.repos.Orders.Update(ctx, order); err != nil {
+			return "", nil, true, err
+		}
+		orderFunnel.WithLabelValues(stageOrderConfirmed).Inc()
+		return "Retirada confirmada! Até lá 😉", order, true, nil
+
+	case ReplyCancel:
+		if order == nil {
+			return "Não encontrei nenhum pedido em aberto para cancelar.", nil, true, nil
+		}
+		pickup, _ := pickupTime(order, s.config.Reminders.DefaultPickupTime, s.config.Location())
+		err := s.proposeOrderChange(ctx, &PendingOrderChange{ContactID: contact.ID, OrderID: order.ID, Kind: OrderChangeCancel})
+		if err != nil {
+			return "", nil, true, err
+		}
+		return fmt.Sprintf("Confirma o cancelamento do pedido #%d (retirada em %s)? Responda SIM ou NÃO.", order.ID, formatPickup(pickup)), order, true, nil
+
+	default:
+		if order == nil {
+			return "Não encontrei nenhum pedido em aberto para remarcar.", nil, true, nil
+		}
+
+		reply, err := s.rescheduleFromMessage(ctx, contact, order, content)
+		return reply, order, true, err
+	}
+}
+
+// rescheduleFromMessage extracts the new pickup from the message and proposes
+// it. Without a new time the order keeps its pickup time ("pode ser sexta?");
+// without a date the contact is asked for one, and their next message is
+// taken as the answer.
+func (s *LLMService) rescheduleFromMessage(ctx context.Context, contact *Contact, order *Order, content string) (string, error) {
+	raw, err := s.extractArguments(ctx, content, "", nil)
+	if err != nil {
+		return "", err
+	}
+
+	var arguments Arguments
+	if err := json.Unmarshal([]byte(raw), &arguments); err != nil || arguments.Date == "" {
+		err := s.proposeOrderChange(ctx, &PendingOrderChange{ContactID: contact.ID, OrderID: order.ID, Kind: OrderChangeReschedule})
+		return "Claro! Para qual dia e horário você quer remarcar? Ex.: remarcar para sexta às 15h", err
+	}
+
+	clock := arguments.Time
+	if clock == "" {
+		clock = order.PickupTime
+	}
+	return s.proposeReschedule(ctx, contact, order, arguments.Date, clock)
+}
+
+// checkPickupSlot returns the new pickup of the order, or the reply to send
+// when it can not be used: it did not parse, is in the past or is busy in the
+// calendar. The order's own event does not make the slot busy.
+func (s *LLMService) checkPickupSlot(ctx context.Context, order *Order, date, clock string) (time.Time, string, error) {
+	candidate := Order{PickupDate: date, PickupTime: clock}
+	pickup, ok := pickupTime(&candidate, s.config.Reminders.DefaultPickupTime, s.config.Location())
+	if !ok {
+		return pickup, "Não entendi a nova data. Pode me mandar o dia e o horário? Ex.: sexta às 15h", nil
+	}
+	if pickup.Before(s.scheduler.now()) {
+		return pickup, "Essa data já passou. Pode sugerir outro dia e horário?", nil
+	}
+
+	available, err := s.calendar.IsAvailable(ctx, pickup, pickup.Add(30*time.Minute), order.CalendarEventID)
+	if err != nil {
+		return pickup, "", err
+	}
+	if !available {
+		return pickup, fmt.Sprintf("O horário de %s não está disponível. Pode sugerir outro?", formatPickup(pickup)), nil
+	}
+	return pickup, "", nil
+}
+
+// proposeReschedule checks the new slot in the calendar and, when it is free,
+// asks the contact to confirm the new pickup.
+func (s *LLMService) proposeReschedule(ctx context.Context, contact *Contact, order *Order, date, clock string) (string, error) {
+	pickup, reply, err := s.checkPickupSlot(ctx, order, date, clock)
+	if reply != "" || err != nil {
+		return reply, err
+	}
+
+	err = s.proposeOrderChange(ctx, &PendingOrderChange{
+		ContactID:  contact.ID,
+		OrderID:    order.ID,
+		Kind:       OrderChangeReschedule,
+		PickupDate: date,
+		PickupTime: clock,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Posso remarcar a retirada do pedido #%d para %s? Responda SIM ou NÃO.", order.ID, formatPickup(pickup)), nil
+}
+
+func (s *LLMService) applyOrderChange(ctx context.Context, contact *Contact, change *PendingOrderChange) (string, *Order, bool, error) {
+	order, err := s.repos.Orders.Get(ctx, change.OrderID)
+	if err != nil {
+		return "", nil, true, err
+	}
+
+	if change.Kind == OrderChangeCancel {
+		if err := s.cancelOrder(ctx, order); err != nil {
+			return "", nil, true, err
+		}
+		orderFunnel.WithLabelValues(stageOrderCancelled).Inc()
+		return "Pedido cancelado. Se precisar de algo, é só chamar!", order, true, nil
+	}
+
+	// The slot may have been taken since it was proposed.
+	if _, reply, err := s.checkPickupSlot(ctx, order, change.PickupDate, change.PickupTime); reply != "" || err != nil {
+		return reply, order, true, err
+	}
+	if err := s.rescheduleOrder(ctx, order, contact, change.PickupDate, change.PickupTime); err != nil {
+		return "", nil, true, err
+	}
+	orderFunnel.WithLabelValues(stageOrderRescheduled).Inc()
+	pickup, _ := pickupTime(order, s.config.Reminders.DefaultPickupTime, s.config.Location())
+	return fmt.Sprintf("Pronto! Sua retirada foi remarcada para %s.", formatPickup(pickup)), order, true, nil
+}
+
+// cancelOrder marks the order cancelled, gives its reserved units back and
+// deletes its calendar event in one transaction: when the calendar fails the
+// order is left as it was. The order forgets the deleted event.
+func (s *LLMService) cancelOrder(ctx context.Context, order *Order) error {
+	status, eventID := order.Status, order.CalendarEventID
+	var restocks []restock
+	err := s.transaction(ctx, func(tx *gorm.DB, repos Repositories) error {
+		order.Status = OrderStatusCancelled
+		order.CalendarEventID = ""
+		if err := repos.Orders.Update(ctx, order); err != nil {
+			return err
+		}
+		var err error
+		restocks, err = s.releaseOrderStock(ctx, tx, repos, order, "order cancelled")
+		if err != nil {
+			return err
+		}
+		if eventID != "" {
+			_, err = deleteEvent(ctx, s.calendar, eventID)
+		}
+		return err
+	})
+	if err != nil {
+		order.Status, order.CalendarEventID = status, eventID
+		return err
+	}
+	s.alertRestocks(ctx, restocks)
+
+	return s.scheduler.CancelOrderJobs(ctx, order.ID, "")
+}
+
+// rescheduleOrder moves the pickup of the order and its calendar event in one
+// transaction, then replaces its reminders.
+func (s *LLMService) rescheduleOrder(ctx context.Context, order *Order, contact *Contact, date, clock string) error {
+	pickup, ok := pickupTime(&Order{PickupDate: date, PickupTime: clock}, s.config.Reminders.DefaultPickupTime, s.config.Location())
+	if !ok {
+		return fmt.Errorf("invalid pickup date %q %q", date, clock)
+	}
+
+	previous := *order
+	err := s.transaction(ctx, func(tx *gorm.DB, repos Repositories) error {
+		order.PickupDate = date
+		order.PickupTime = clock
+		order.Status = OrderStatusPending
+		order.ReminderSentAt = nil
+		if err := repos.Orders.Update(ctx, order); err != nil {
+			return err
+		}
+		if order.CalendarEventID != "" {
+			return s.calendar.UpdateEvent(ctx, order.CalendarEventID, orderCalendarEvent(order, contact, pickup))
+		}
+		return nil
+	})
+	if err != nil {
+		*order = previous
+		return err
+	}
+
+	return s.scheduleOrderFollowUps(ctx, order, contact)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+func TestParseOrderReply(t *testing.T) {
+	cases := map[string]OrderReply{
+		"Confirmo!":                          ReplyConfirm,
+		"sim":                                ReplyConfirm,
+		"Não":                                ReplyDeny,
+		"Quero cancelar o pedido":            ReplyCancel,
+		"não vou conseguir, pode ser sexta?": ReplyReschedule,
+		"remarcar sexta às 15h":              ReplyReschedule,
+		"qual o preço do juice?":             ReplyNone,
+		"simples assim":                      ReplyNone,
+	}
+
+	for text, expected := range cases {
+		if reply := parseOrderReply(text); reply != expected {
+			t.Errorf("Reply for %q is not correct: %d", text, reply)
+		}
+	}
+}
+
+func newOrderChangeFixture(t *testing.T) (*LLMService, *fakeClock, *fakeCalendar, *Contact, *Order) {
+	ctx := context.Background()
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	s, clock, _, calendar := newTestService(t, time.Date(2023, 8, 9, 9, 0, 0, 0, location))
+
+	contact := &Contact{Tenant: defaultTenant, Name: "Ana", Identities: []ContactIdentity{{Tenant: defaultTenant, Channel: "whatsapp", ExternalID: "+5511999999999"}}}
+	if err := s.repos.Contacts.Create(ctx, contact); err != nil {
+		t.Fatal(err)
+	}
+
+	order := &Order{ContactID: contact.ID, Status: OrderStatusPending, PickupDate: "2023-08-10", PickupTime: "14:00"}
+	if err := s.repos.Orders.Create(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.scheduleOrderFollowUps(ctx, order, contact); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, clock, calendar, contact, order
+}
+
+func TestCancelOrderAsksForConfirmation(t *testing.T) {
+	ctx := context.Background()
+	s, clock, calendar, contact, order := newOrderChangeFixture(t)
+
+	_, _, handled, err := s.handleOrderChange(ctx, contact, "Preciso cancelar meu pedido")
+	if err != nil || !handled {
+		t.Fatalf("Cancellation request was not handled: %v, %v", handled, err)
+	}
+
+	stored, _ := s.repos.Orders.Get(ctx, order.ID)
+	if stored.Status != OrderStatusPending || len(calendar.events) != 1 {
+		t.Errorf("Order changed before the confirmation: %+v", stored)
+	}
+
+	_, replied, handled, err := s.handleOrderChange(ctx, contact, "sim")
+	if err != nil || !handled || replied.Status != OrderStatusCancelled {
+		t.Errorf("Cancellation was not applied: %v, %v, %+v", handled, err, replied)
+	}
+	if len(calendar.events) != 0 {
+		t.Errorf("Calendar event was not deleted: %+v", calendar.events)
+	}
+
+	clock.Advance(48 * time.Hour)
+	if count, _ := s.scheduler.RunDue(ctx); count != 0 {
+		t.Errorf("Reminder of a cancelled order ran: %d", count)
+	}
+}
+
+func TestRescheduleOrderChecksCalendar(t *testing.T) {
+	ctx := context.Background()
+	s, _, calendar, contact, order := newOrderChangeFixture(t)
+
+	location := s.config.Location()
+	busy := time.Date(2023, 8, 11, 15, 0, 0, 0, location)
+	calendar.busy = []CalendarEvent{{Start: busy, End: busy.Add(time.Hour)}}
+
+	if _, err := s.proposeReschedule(ctx, contact, order, "2023-08-11", "15:00"); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := s.pendingOrderChange(ctx, contact.ID); pending != nil {
+		t.Errorf("Reschedule to a busy slot was proposed: %+v", pending)
+	}
+
+	if _, err := s.proposeReschedule(ctx, contact, order, "2023-08-11", "17:00"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, handled, err := s.handleOrderChange(ctx, contact, "não")
+	if err != nil || !handled {
+		t.Errorf("Denial was not handled: %v, %v", handled, err)
+	}
+	stored, _ := s.repos.Orders.Get(ctx, order.ID)
+	if stored.PickupDate != "2023-08-10" {
+		t.Errorf("Order changed after a denial: %+v", stored)
+	}
+
+	s.proposeReschedule(ctx, contact, order, "2023-08-11", "17:00")
+	_, replied, handled, err := s.handleOrderChange(ctx, contact, "Pode ser")
+	if err != nil || !handled || replied.PickupDate != "2023-08-11" || replied.PickupTime != "17:00" {
+		t.Errorf("Reschedule was not applied: %v, %v, %+v", handled, err, replied)
+	}
+
+	event := calendar.events[order.CalendarEventID]
+	if !event.Start.Equal(time.Date(2023, 8, 11, 17, 0, 0, 0, location)) {
+		t.Errorf("Calendar event was not moved: %+v", event)
+	}
+
+	var jobs []Job
+	s.db.Where("status = ?", JobStatusPending).Order("run_at").Find(&jobs)
+	if len(jobs) != 2 || !jobs[0].RunAt.Equal(time.Date(2023, 8, 10, 17, 0, 0, 0, location)) {
+		t.Errorf("Reminders were not rescheduled: %+v", jobs)
+	}
+}
+
+func TestRescheduleOrderIgnoresItsOwnEvent(t *testing.T) {
+	ctx := context.Background()
+	s, _, calendar, contact, order := newOrderChangeFixture(t)
+	location := s.config.Location()
+	if order.CalendarEventID == "" {
+		t.Fatal("The order has no calendar event")
+	}
+
+	// Another order's pickup blocks its slot.
+	other := time.Date(2023, 8, 10, 16, 0, 0, 0, location)
+	calendar.CreateEvent(ctx, CalendarEvent{Summary: "Retirada", Start: other, End: other.Add(30 * time.Minute)})
+	if reply, err := s.proposeReschedule(ctx, contact, order, "2023-08-10", "16:15"); err != nil || !strings.Contains(reply, "não está disponível") {
+		t.Errorf("Reschedule over another order's pickup was proposed: %q, %v", reply, err)
+	}
+
+	// Moving the pickup a few minutes overlaps only the order's own event.
+	if reply, err := s.proposeReschedule(ctx, contact, order, "2023-08-10", "14:15"); err != nil || !strings.Contains(reply, "10/08 às 14:15") {
+		t.Fatalf("Reschedule within the order's own slot was refused: %q, %v", reply, err)
+	}
+	_, replied, handled, err := s.handleOrderChange(ctx, contact, "sim")
+	if err != nil || !handled || replied.PickupTime != "14:15" {
+		t.Errorf("Reschedule was not applied: %v, %v, %+v", handled, err, replied)
+	}
+}
+
+// extractionCompleter answers the extraction calls with replies in order and
+// keeps the function definitions it was sent.
+type extractionCompleter struct {
+	replies   []string
+	functions []openai.FunctionDefinition
+}
+
+func (f *extractionCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	f.functions = append(f.functions, request.Functions...)
+	reply := f.replies[0]
+	f.replies = f.replies[1:]
+	return openai.ChatCompletionResponse{Choices: []openai.ChatCompletionChoice{
+		{Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, FunctionCall: &openai.FunctionCall{Name: "getProductsAndDate", Arguments: reply}}},
+	}}, nil
+}
+
+func TestRescheduleToAnotherDayKeepsPickupTime(t *testing.T) {
+	ctx := context.Background()
+	s, clock, calendar, contact, order := newOrderChangeFixture(t)
+	completer := &extractionCompleter{replies: []string{`{"products": [], "date": "2023-08-11", "time": ""}`}}
+	s.llm = newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: completer})
+
+	reply, _, handled, err := s.handleOrderChange(ctx, contact, "não vou conseguir amanhã, pode ser sexta?")
+	if err != nil || !handled || !strings.Contains(reply, "11/08 às 14:00") {
+		t.Fatalf("Reschedule to another day was not proposed: %q, %v, %v", reply, handled, err)
+	}
+	description := completer.functions[0].Parameters.(jsonschema.Definition).Properties["date"].Description
+	if !strings.Contains(description, "quarta-feira, 2023-08-09") || !strings.Contains(description, "sexta-feira é 2023-08-11") {
+		t.Errorf("The extraction does not know today's date: %s", description)
+	}
+
+	_, replied, handled, err := s.handleOrderChange(ctx, contact, "sim")
+	if err != nil || !handled || replied.PickupDate != "2023-08-11" || replied.PickupTime != "14:00" {
+		t.Errorf("Reschedule was not applied: %v, %v, %+v", handled, err, replied)
+	}
+	if event := calendar.events[order.CalendarEventID]; !event.Start.Equal(time.Date(2023, 8, 11, 14, 0, 0, 0, s.config.Location())) {
+		t.Errorf("Calendar event was not moved: %+v", event)
+	}
+}
+
+func TestRescheduleAsksForTheDate(t *testing.T) {
+	ctx := context.Background()
+	s, clock, _, contact, _ := newOrderChangeFixture(t)
+	completer := &extractionCompleter{replies: []string{
+		`{"products": [], "date": "", "time": ""}`,
+		`{"products": [], "date": "2023-08-11", "time": "15:00"}`,
+	}}
+	s.llm = newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: completer})
+
+	reply, _, handled, err := s.handleOrderChange(ctx, contact, "Preciso remarcar")
+	if err != nil || !handled || !strings.Contains(reply, "Para qual dia") {
+		t.Fatalf("The new date was not asked: %q, %v, %v", reply, handled, err)
+	}
+
+	reply, _, handled, err = s.handleOrderChange(ctx, contact, "pode ser sexta às 15h")
+	if err != nil || !handled || !strings.Contains(reply, "11/08 às 15:00") {
+		t.Fatalf("The answer with the date was not taken as the reschedule: %q, %v, %v", reply, handled, err)
+	}
+	_, replied, _, err := s.handleOrderChange(ctx, contact, "sim")
+	if err != nil || replied.PickupDate != "2023-08-11" || replied.PickupTime != "15:00" {
+		t.Errorf("Reschedule was not applied: %v, %+v", err, replied)
+	}
+}
+
+func TestCancelOrderKeepsOrderWhenCalendarFails(t *testing.T) {
+	ctx := context.Background()
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	s, _, _, calendar := newTestService(t, time.Date(2023, 8, 9, 9, 0, 0, 0, location))
+	s.repos = newGormRepositories(s.db, nil)
+
+	contact := &Contact{Tenant: defaultTenant, Name: "Ana", Identities: []ContactIdentity{{Tenant: defaultTenant, Channel: "whatsapp", ExternalID: "+5511999999999"}}}
+	if err := s.repos.Contacts.Create(ctx, contact); err != nil {
+		t.Fatal(err)
+	}
+	order := &Order{ContactID: contact.ID, Status: OrderStatusPending, PickupDate: "2023-08-10", PickupTime: "14:00"}
+	if err := s.repos.Orders.Create(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.scheduleOrderFollowUps(ctx, order, contact); err != nil {
+		t.Fatal(err)
+	}
+
+	s.handleOrderChange(ctx, contact, "Preciso cancelar meu pedido")
+	calendar.fail = errors.New("calendar unavailable")
+	if _, _, _, err := s.handleOrderChange(ctx, contact, "sim"); err == nil {
+		t.Fatal("The calendar failure was not reported")
+	}
+	stored, _ := s.repos.Orders.Get(ctx, order.ID)
+	if stored.Status != OrderStatusPending || len(calendar.events) != 1 {
+		t.Errorf("Order was cancelled without its calendar event: %+v", stored)
+	}
+
+	calendar.fail = nil
+	_, replied, _, err := s.handleOrderChange(ctx, contact, "sim")
+	if err != nil || replied.Status != OrderStatusCancelled || len(calendar.events) != 0 {
+		t.Errorf("The cancellation was not confirmed again: %v, %+v", err, replied)
+	}
+}
+
+func TestRescheduleRechecksCalendarOnConfirmation(t *testing.T) {
+	ctx := context.Background()
+	s, _, calendar, contact, order := newOrderChangeFixture(t)
+
+	if _, err := s.proposeReschedule(ctx, contact, order, "2023-08-11", "17:00"); err != nil {
+		t.Fatal(err)
+	}
+	taken := time.Date(2023, 8, 11, 17, 0, 0, 0, s.config.Location())
+	calendar.busy = []CalendarEvent{{Start: taken, End: taken.Add(time.Hour)}}
+
+	reply, _, handled, err := s.handleOrderChange(ctx, contact, "sim")
+	if err != nil || !handled || !strings.Contains(reply, "não está disponível") {
+		t.Errorf("The taken slot was not reported: %q, %v, %v", reply, handled, err)
+	}
+	if stored, _ := s.repos.Orders.Get(ctx, order.ID); stored.PickupDate != "2023-08-10" {
+		t.Errorf("Order was moved to a taken slot: %+v", stored)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrNoProducts = errors.New("no products were extracted from the message")
+
+// ErrOutOfStock is returned with the matched product when it has not enough
+// stock for the order.
+var ErrOutOfStock = errors.New("product is out of stock")
+
+// placeOrder matches the first extracted item against the catalog and stores
+// an order with every extracted item for the contact. When an order was
+// already placed for the idempotency key it is returned instead, and placed
+// is false. No order is placed when the product has fewer units than asked;
+// the check is repeated on the locked stock by placeReservedOrder.
+func placeOrder(ctx context.Context, repos Repositories, contactID uint, key string, arguments Arguments) (order *Order, product *Products, placed bool, err error) {
+	if len(arguments.Products) == 0 {
+		return nil, nil, false, ErrNoProducts
+	}
+
+	first := arguments.Products[0]
+	product, err = repos.Products.FindMatch(ctx, first.Item, first.Flavor)
+	if errors.Is(err, ErrNotFound) {
+		catalogMatches.WithLabelValues("miss").Inc()
+	} else if err != nil {
+		catalogMatches.WithLabelValues("error").Inc()
+	} else {
+		catalogMatches.WithLabelValues("hit").Inc()
+		orderFunnel.WithLabelValues(stageProductMatched).Inc()
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if key != "" {
+		existing, err := repos.Orders.FindByIdempotencyKey(ctx, key)
+		if err == nil {
+			return existing, product, false, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, nil, false, err
+		}
+	}
+	requested := first.Quantity
+	if requested <= 0 {
+		requested = 1
+	}
+	if product.Quantity < requested {
+		return nil, product, false, ErrOutOfStock
+	}
+
+	order = &Order{
+		ContactID:      contactID,
+		Status:         OrderStatusPending,
+		PickupDate:     arguments.Date,
+		PickupTime:     arguments.Time,
+		IdempotencyKey: key,
+	}
+	for _, extracted := range arguments.Products {
+		order.Items = append(order.Items, OrderItem{
+			Item:     extracted.Item,
+			Flavor:   extracted.Flavor,
+			Quantity: extracted.Quantity,
+			Volume:   extracted.Volume,
+		})
+	}
+	order.Items[0].ProductID = product.ID
+
+	if err := repos.Orders.Create(ctx, order); err != nil {
+		return nil, nil, false, err
+	}
+
+	return order, product, true, nil
+}
+
+// orderNotFoundText is sent when a queued order can not be matched against
+// the catalog.
+const orderNotFoundText = "Não encontrei esse produto no nosso catálogo. Pode me dizer de novo o que você quer?"
+
+// orderPlacedText confirms an order placed outside of the request.
+func (s *LLMService) orderPlacedText(order *Order) string {
+	var items []string
+	for _, item := range order.Items {
+		items = append(items, strings.TrimSpace(fmt.Sprintf("%dx %s %s", item.Quantity, item.Item, item.Flavor)))
+	}
+
+	text := fmt.Sprintf("Pedido #%d anotado: %s.", order.ID, strings.Join(items, ", "))
+	if pickup, ok := pickupTime(order, s.config.Reminders.DefaultPickupTime, s.config.Location()); ok {
+		text += " Retirada em " + formatPickup(pickup) + "."
+	}
+	return text
+}
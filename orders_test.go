@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPlaceOrder(t *testing.T) {
+	ctx := context.Background()
+	repos := newMemoryRepositories()
+	repos.Products.Create(ctx, &Products{Product: "swag kit", Flavor: "", Quantity: 4})
+	repos.Products.Create(ctx, &Products{Product: "juice", Flavor: "morango", Quantity: 10})
+
+	arguments := Arguments{
+		Products: []ExtractedProduct{
+			{Item: "juice", Flavor: "morango", Quantity: 2, Volume: "30"},
+			{Item: "pod", Quantity: 1, Volume: "0"},
+		},
+		Date: "2023-08-10",
+		Time: "14:00",
+	}
+
+	order, product, placed, err := placeOrder(ctx, repos, 7, "", arguments)
+	if err != nil || !placed {
+		t.Fatalf("Error placing order: %v", err)
+	}
+
+	if product.Product != "juice" || product.Flavor != "morango" {
+		t.Errorf("Matched product is not correct: %+v", product)
+	}
+	if order.ContactID != 7 || order.Status != OrderStatusPending || order.PickupDate != "2023-08-10" {
+		t.Errorf("Order is not correct: %+v", order)
+	}
+	if len(order.Items) != 2 || order.Items[0].ProductID != product.ID {
+		t.Errorf("Order items are not correct: %+v", order.Items)
+	}
+
+	orders, _ := repos.Orders.ListByContact(ctx, 7)
+	if len(orders) != 1 {
+		t.Errorf("Stored orders is not correct: %d", len(orders))
+	}
+}
+
+func TestPlaceOrderWithoutProducts(t *testing.T) {
+	_, _, _, err := placeOrder(context.Background(), newMemoryRepositories(), 0, "", Arguments{})
+	if !errors.Is(err, ErrNoProducts) {
+		t.Errorf("Error is not correct: %v", err)
+	}
+}
+
+func TestPlaceOrderWithoutCatalogMatch(t *testing.T) {
+	arguments := Arguments{Products: []ExtractedProduct{{Item: "vape", Quantity: 1}}}
+
+	_, _, _, err := placeOrder(context.Background(), newMemoryRepositories(), 0, "", arguments)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Error is not correct: %v", err)
+	}
+}
+
+func TestPlaceOrderIsReplaySafe(t *testing.T) {
+	ctx := context.Background()
+	repos := newMemoryRepositories()
+	repos.Products.Create(ctx, &Products{Product: "juice", Flavor: "morango", Quantity: 10})
+	arguments := Arguments{Products: []ExtractedProduct{{Item: "juice", Flavor: "morango", Quantity: 2}}}
+
+	first, _, placed, err := placeOrder(ctx, repos, 7, "key", arguments)
+	if err != nil || !placed {
+		t.Fatalf("Error placing order: %v", err)
+	}
+	again, product, placed, err := placeOrder(ctx, repos, 7, "key", arguments)
+	if err != nil || placed || again.ID != first.ID || product == nil {
+		t.Errorf("A replayed message should return the order already placed: %+v, %v, %v", again, placed, err)
+	}
+
+	orders, _ := repos.Orders.ListByContact(ctx, 7)
+	if len(orders) != 1 {
+		t.Errorf("Stored orders is not correct: %d", len(orders))
+	}
+}
+
+func TestPlaceOrderMatchesVariant(t *testing.T) {
+	ctx := context.Background()
+	repos := newMemoryRepositories()
+	repos.Products.Create(ctx, &Products{Product: "pod", Flavor: "uva", Quantity: 1})
+	repos.Products.Create(ctx, &Products{Product: "pod", Flavor: "menta", Quantity: 10})
+	repos.Products.Create(ctx, &Products{Product: "juice", Flavor: "uva", Quantity: 2})
+
+	_, product, placed, err := placeOrder(ctx, repos, 7, "", Arguments{Products: []ExtractedProduct{{Item: "Pod", Flavor: "Menta", Quantity: 2}}})
+	if err != nil || !placed || product.Flavor != "menta" {
+		t.Errorf("The product and flavor were not both matched: %+v, %v", product, err)
+	}
+	_, product, placed, err = placeOrder(ctx, repos, 7, "", Arguments{Products: []ExtractedProduct{{Item: "pod", Flavor: "uva", Quantity: 3}}})
+	if !errors.Is(err, ErrOutOfStock) || placed || product.Flavor != "uva" {
+		t.Errorf("An order above the stock was accepted: %+v, %v", product, err)
+	}
+	if _, _, _, err := placeOrder(ctx, repos, 7, "", Arguments{Products: []ExtractedProduct{{Item: "juice", Flavor: "menta", Quantity: 1}}}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Another variant was matched: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+// Package pii replaces personal data in Portuguese text with placeholders
+// before it leaves our infrastructure (LLM calls, embeddings) and restores
+// it in the replies.
+package pii
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type Kind string
+
+const (
+	CPF      Kind = "cpf"
+	Email    Kind = "email"
+	HealthID Kind = "health_id"
+	Phone    Kind = "phone"
+	Address  Kind = "address"
+)
+
+// Kinds lists every kind in the order they are detected: a CPF is also a
+// valid 11 digit phone number, so it has to be matched first.
+var Kinds = []Kind{Email, CPF, HealthID, Phone, Address}
+
+var labels = map[Kind]string{
+	CPF:      "CPF",
+	Email:    "EMAIL",
+	HealthID: "ID_SAUDE",
+	Phone:    "TELEFONE",
+	Address:  "ENDERECO",
+}
+
+type detector struct {
+	pattern *regexp.Regexp
+	// group is the submatch holding the personal data; 0 is the whole match.
+	group int
+	valid func(string) bool
+}
+
+var detectors = map[Kind][]detector{
+	Email: {{pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)}},
+	CPF: {{
+		pattern: regexp.MustCompile(`\b\d{3}\.?\d{3}\.?\d{3}-?\d{2}\b`),
+		valid:   validCPF,
+	}},
+	HealthID: {
+		// Cartão Nacional de Saúde (CNS): 15 digits starting with 1, 2, 7, 8 or 9.
+		{pattern: regexp.MustCompile(`\b[12789]\d{2}\s?\d{4}\s?\d{4}\s?\d{4}\b`)},
+		// Numbers introduced by a health keyword: "carteirinha 0012345", "prontuário nº 9876".
+		{
+			pattern: regexp.MustCompile(`(?i)(?:cns|sus|carteirinha|conv[eê]nio|prontu[aá]rio|plano de sa[uú]de|crm)[^\d\n]{0,20}(\d[\d./-]{3,}\d)`),
+			group:   1,
+		},
+	},
+	Phone: {{
+		pattern: regexp.MustCompile(`(?:\+?55[\s-]?)?(?:\(\d{2}\)|\b\d{2})[\s-]?9?\d{4}[\s-]?\d{4}\b`),
+		valid:   func(s string) bool { return len(digits(s)) >= 10 },
+	}},
+	Address: {
+		{pattern: regexp.MustCompile(`(?i)\b(?:rua|r\.|avenida|av\.|travessa|tv\.|alameda|al\.|estrada|rodovia|pra[cç]a)\s+[^,\n\d]{2,60},?\s*(?:n[º°o.]?\s*)?\d+`)},
+		// CEP
+		{pattern: regexp.MustCompile(`\b\d{5}-\d{3}\b`)},
+	},
+}
+
+// Policy selects which kinds of personal data are redacted. An empty Kinds
+// list redacts every kind.
+type Policy struct {
+	Enabled bool   `json:"enabled"`
+	Kinds   []Kind `json:"kinds"`
+}
+
+func (p Policy) Validate() error {
+	for _, kind := range p.Kinds {
+		if _, ok := labels[kind]; !ok {
+			return fmt.Errorf("unknown PII kind %q", kind)
+		}
+	}
+	return nil
+}
+
+func (p Policy) redacts(kind Kind) bool {
+	if len(p.Kinds) == 0 {
+		return true
+	}
+	for _, k := range p.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Vault keeps the values behind the placeholders of a conversation turn.
+// The same value always gets the same placeholder.
+type Vault struct {
+	values       map[string]string
+	placeholders map[string]string
+	counts       map[Kind]int
+}
+
+func NewVault() *Vault {
+	return &Vault{values: map[string]string{}, placeholders: map[string]string{}, counts: map[Kind]int{}}
+}
+
+func (v *Vault) placeholder(kind Kind, value string) string {
+	if placeholder, ok := v.placeholders[value]; ok {
+		return placeholder
+	}
+	v.counts[kind]++
+	placeholder := fmt.Sprintf("[%s_%d]", labels[kind], v.counts[kind])
+	v.placeholders[value] = placeholder
+	v.values[placeholder] = value
+	return placeholder
+}
+
+// Len returns how many values were redacted.
+func (v *Vault) Len() int {
+	return len(v.values)
+}
+
+// Redact replaces the personal data the policy covers with placeholders.
+func (v *Vault) Redact(policy Policy, text string) string {
+	if !policy.Enabled {
+		return text
+	}
+
+	for _, kind := range Kinds {
+		if !policy.redacts(kind) {
+			continue
+		}
+		for _, d := range detectors[kind] {
+			text = v.replace(kind, d, text)
+		}
+	}
+
+	return text
+}
+
+func (v *Vault) replace(kind Kind, d detector, text string) string {
+	var b strings.Builder
+	last := 0
+	for _, match := range d.pattern.FindAllStringSubmatchIndex(text, -1) {
+		start, end := match[2*d.group], match[2*d.group+1]
+		if start < 0 || start < last {
+			continue
+		}
+		value := text[start:end]
+		if d.valid != nil && !d.valid(value) {
+			continue
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(v.placeholder(kind, value))
+		last = end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// Restore puts the original values back in place of the placeholders.
+func (v *Vault) Restore(text string) string {
+	if len(v.values) == 0 {
+		return text
+	}
+
+	pairs := make([]string, 0, 2*len(v.values))
+	for placeholder, value := range v.values {
+		pairs = append(pairs, placeholder, value)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+func validCPF(s string) bool {
+	d := digits(s)
+	if len(d) != 11 || strings.Count(d, d[:1]) == 11 {
+		return false
+	}
+
+	for _, n := range []int{9, 10} {
+		sum := 0
+		for i := 0; i < n; i++ {
+			sum += int(d[i]-'0') * (n + 1 - i)
+		}
+		check := sum * 10 % 11 % 10
+		if check != int(d[n]-'0') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,51 @@
+package pii
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	cases := map[string]string{
+		"meu cpf é 529.982.247-25":                       "meu cpf é [CPF_1]",
+		"cpf 52998224725, pode anotar":                   "cpf [CPF_1], pode anotar",
+		"cpf 123.456.789-00":                             "cpf 123.456.789-00",
+		"me liga no (11) 98765-4321":                     "me liga no [TELEFONE_1]",
+		"whats +55 11 987654321":                         "whats [TELEFONE_1]",
+		"manda para ana.souza@gmail.com":                 "manda para [EMAIL_1]",
+		"moro na Rua das Flores, 123 - CEP 01310-100":    "moro na [ENDERECO_1] - CEP [ENDERECO_2]",
+		"Av. Paulista 1578":                              "[ENDERECO_1]",
+		"meu cartão sus é 898 0012 3456 7890":            "meu cartão sus é [ID_SAUDE_1]",
+		"carteirinha do convênio nº 0012345-6":           "carteirinha do convênio nº [ID_SAUDE_1]",
+		"quero 2 pods de menta para amanhã às 15h":       "quero 2 pods de menta para amanhã às 15h",
+		"ligo de 11987654321 ou 11987654321 se precisar": "ligo de [TELEFONE_1] ou [TELEFONE_1] se precisar",
+	}
+
+	for text, expected := range cases {
+		vault := NewVault()
+		redacted := vault.Redact(Policy{Enabled: true}, text)
+		if redacted != expected {
+			t.Errorf("Redaction of %q is not correct: %q", text, redacted)
+		}
+		if restored := vault.Restore(redacted); restored != text {
+			t.Errorf("Restoring %q is not correct: %q", redacted, restored)
+		}
+	}
+}
+
+func TestRedactPolicy(t *testing.T) {
+	text := "cpf 529.982.247-25, email ana@exemplo.com"
+
+	if redacted := NewVault().Redact(Policy{}, text); redacted != text {
+		t.Errorf("Disabled policy should not redact: %q", redacted)
+	}
+
+	redacted := NewVault().Redact(Policy{Enabled: true, Kinds: []Kind{Email}}, text)
+	if !strings.Contains(redacted, "529.982.247-25") || strings.Contains(redacted, "ana@exemplo.com") {
+		t.Errorf("Only emails should be redacted: %q", redacted)
+	}
+
+	if err := (Policy{Kinds: []Kind{"passport"}}).Validate(); err == nil {
+		t.Error("Unknown kinds should not be valid")
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/metrics"
+	"github.com/gofiber/fiber/v2"
+	openai "github.com/sashabaranov/go-openai"
+	"gorm.io/gorm"
+)
+
+// Weights of the signals combined into the score of a recommendation, from
+// 0 to 1: how often the product is bought with the basket, whether it has a
+// flavor the contact likes and how similar its description is.
+const (
+	coPurchaseWeight = 0.5
+	flavorWeight     = 0.2
+	similarityWeight = 0.3
+
+	// minSuggestionScore keeps weak recommendations out of the order replies.
+	minSuggestionScore = 0.25
+	// similarReasonThreshold is the cosine similarity above which a product
+	// is described as similar to the basket.
+	similarReasonThreshold = 0.85
+)
+
+// JobKindEmbedProducts embeds the products whose embedding is missing or
+// outdated, every productEmbeddingInterval, so recommending only embeds the
+// products changed since.
+const JobKindEmbedProducts = "embed_products"
+
+const productEmbeddingInterval = time.Hour
+
+// productEmbeddingBatch is how many texts are sent in one embedding request,
+// well below the 2048 inputs OpenAI accepts.
+const productEmbeddingBatch = 100
+
+// Embedder turns texts into embedding vectors.
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+type openAIEmbedder struct {
+	client *openai.Client
+	usage  *usageLedger
+}
+
+func (e *openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	request := openai.EmbeddingRequest{Input: texts, Model: openai.AdaEmbeddingV2}
+	start := time.Now()
+	resp, err := e.client.CreateEmbeddings(ctx, request)
+	metrics.ObserveLLMCall("embedding", request.Model.String(), start, resp.Usage.PromptTokens, 0, err)
+	if err != nil {
+		return nil, err
+	}
+	e.usage.record(ctx, "product_embedding", request.Model.String(), resp.Usage.PromptTokens, 0)
+	if len(resp.Data) != len(texts) {
+		return nil, fmt.Errorf("embedding returned %d vectors for %d texts", len(resp.Data), len(texts))
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, data := range resp.Data {
+		if data.Index < 0 || data.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding returned index %d out of range", data.Index)
+		}
+		vectors[data.Index] = data.Embedding
+	}
+	return vectors, nil
+}
+
+// ProductEmbedding caches the embedding of a product's description. Digest
+// identifies the text it was computed from.
+type ProductEmbedding struct {
+	gorm.Model
+	ProductID uint      `gorm:"uniqueIndex"`
+	Digest    string    `gorm:"size:64"`
+	Vector    []float32 `gorm:"serializer:json"`
+}
+
+func productText(product *Products) string {
+	return strings.TrimSpace(strings.Join([]string{product.Product, product.Flavor, product.Category, product.Description}, " "))
+}
+
+// productVectors returns the embeddings of the products, computing the ones
+// missing or outdated in batches of productEmbeddingBatch.
+func (s *LLMService) productVectors(ctx context.Context, products []Products) (map[uint][]float32, error) {
+	ids := make([]uint, len(products))
+	for i, product := range products {
+		ids[i] = product.ID
+	}
+	var cached []ProductEmbedding
+	if err := s.db.WithContext(ctx).Where("product_id IN ?", ids).Find(&cached).Error; err != nil {
+		return nil, err
+	}
+	byProduct := map[uint]ProductEmbedding{}
+	for _, embedding := range cached {
+		byProduct[embedding.ProductID] = embedding
+	}
+
+	vectors := map[uint][]float32{}
+	var stale []Products
+	var texts, digests []string
+	for _, product := range products {
+		text := productText(&product)
+		sum := sha256.Sum256([]byte(text))
+		digest := hex.EncodeToString(sum[:])
+		if embedding, ok := byProduct[product.ID]; ok && embedding.Digest == digest {
+			vectors[product.ID] = embedding.Vector
+			continue
+		}
+		stale = append(stale, product)
+		texts = append(texts, text)
+		digests = append(digests, digest)
+	}
+	if len(stale) == 0 {
+		return vectors, nil
+	}
+
+	for start := 0; start < len(stale); start += productEmbeddingBatch {
+		end := min(start+productEmbeddingBatch, len(stale))
+		computed, err := s.embedder.Embed(ctx, texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for i, product := range stale[start:end] {
+			embedding := byProduct[product.ID]
+			embedding.ProductID, embedding.Digest, embedding.Vector = product.ID, digests[start+i], computed[i]
+			if err := s.db.WithContext(ctx).Save(&embedding).Error; err != nil {
+				return nil, err
+			}
+			vectors[product.ID] = computed[i]
+		}
+	}
+	return vectors, nil
+}
+
+// scheduleProductEmbeddings schedules the next embedding run unless one is
+// pending.
+func (s *LLMService) scheduleProductEmbeddings(ctx context.Context, runAt time.Time) error {
+	return s.scheduleUnlessPending(ctx, &Job{Kind: JobKindEmbedProducts, RunAt: runAt})
+}
+
+// runProductEmbeddings is the job handler. It embeds the products that are
+// not archived; the next run is always scheduled and a failed one is retried
+// then.
+func (s *LLMService) runProductEmbeddings(ctx context.Context, job *Job) error {
+	catalog, err := s.repos.Products.List(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "load catalog failed", "error", err)
+	} else if s.embedder != nil {
+		var products []Products
+		for _, product := range catalog {
+			if product.ArchivedAt == nil {
+				products = append(products, product)
+			}
+		}
+		if _, err := s.productVectors(ctx, products); err != nil {
+			slog.ErrorContext(ctx, "product embeddings failed", "error", err)
+		}
+	}
+
+	return s.scheduler.Schedule(ctx, &Job{Kind: JobKindEmbedProducts, RunAt: s.scheduler.now().Add(productEmbeddingInterval)})
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
+
+type Recommendation struct {
+	ProductID uint     `json:"product_id"`
+	Product   string   `json:"product"`
+	Flavor    string   `json:"flavor"`
+	Score     float64  `json:"score"`
+	Reasons   []string `json:"reasons"`
+	// BoughtWith is the basket product it is most often bought with.
+	BoughtWith string `json:"bought_with,omitempty"`
+}
+
+// itemProduct returns the catalog product of an order item: its product ID
+// or, for items placed without one, the product with the same name and
+// flavor.
+func itemProduct(item OrderItem, catalog []Products) (uint, bool) {
+	if item.ProductID != 0 {
+		return item.ProductID, true
+	}
+	for _, product := range catalog {
+		if strings.EqualFold(product.Product, strings.TrimSpace(item.Item)) &&
+			(item.Flavor == "" || strings.EqualFold(product.Flavor, strings.TrimSpace(item.Flavor))) {
+			return product.ID, true
+		}
+	}
+	return 0, false
+}
+
+// coPurchaseTTL is how long the co-purchase counts of a tenant are reused
+// before they are counted again from its orders. Orders placed meanwhile are
+// left out of the recommendations until then.
+const coPurchaseTTL = 10 * time.Minute
+
+// coPurchases counts, over the orders of a tenant that were not cancelled,
+// the orders with each product and the orders with each pair of products.
+type coPurchases struct {
+	orders    map[uint]int
+	together  map[uint]map[uint]int
+	countedAt time.Time
+}
+
+// share returns the share of the orders with product that also have other.
+func (c *coPurchases) share(product, other uint) float64 {
+	if c.orders[product] == 0 {
+		return 0
+	}
+	return float64(c.together[product][other]) / float64(c.orders[product])
+}
+
+// coPurchaseCache keeps the co-purchase counts of each tenant, so placing an
+// order or answering a question does not load the tenant's order history.
+// mu only guards the map; each tenant is counted under its own lock, so
+// recounting one tenant does not hold up the others.
+type coPurchaseCache struct {
+	mu      sync.Mutex
+	tenants map[string]*tenantCoPurchases
+}
+
+type tenantCoPurchases struct {
+	mu     sync.Mutex
+	counts *coPurchases
+}
+
+// tenant returns the cache entry of the tenant, adding it if missing.
+func (c *coPurchaseCache) tenant(tenant string) *tenantCoPurchases {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tenants == nil {
+		c.tenants = map[string]*tenantCoPurchases{}
+	}
+	entry, ok := c.tenants[tenant]
+	if !ok {
+		entry = &tenantCoPurchases{}
+		c.tenants[tenant] = entry
+	}
+	return entry
+}
+
+// coPurchaseCounts returns the co-purchase counts of the tenant, counting
+// them again once they are older than coPurchaseTTL.
+func (s *LLMService) coPurchaseCounts(ctx context.Context, tenant string, catalog []Products) (*coPurchases, error) {
+	now := s.scheduler.now()
+	entry := s.coPurchases.tenant(tenant)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.counts != nil && now.Sub(entry.counts.countedAt) < coPurchaseTTL {
+		return entry.counts, nil
+	}
+
+	orders, err := s.repos.Orders.ListByTenant(ctx, tenant, s.otherTenants())
+	if err != nil {
+		return nil, err
+	}
+	counts := &coPurchases{orders: map[uint]int{}, together: map[uint]map[uint]int{}, countedAt: now}
+	for _, order := range orders {
+		if order.Status == OrderStatusCancelled {
+			continue
+		}
+		basket := orderProducts(order, catalog)
+		for product := range basket {
+			counts.orders[product]++
+			if counts.together[product] == nil {
+				counts.together[product] = map[uint]int{}
+			}
+			for other := range basket {
+				if other != product {
+					counts.together[product][other]++
+				}
+			}
+		}
+	}
+	entry.counts = counts
+	return counts, nil
+}
+
+// orderProducts returns the catalog products of the order's items.
+func orderProducts(order Order, catalog []Products) map[uint]bool {
+	products := map[uint]bool{}
+	for _, item := range order.Items {
+		if id, ok := itemProduct(item, catalog); ok {
+			products[id] = true
+		}
+	}
+	return products
+}
+
+// boughtProducts returns the products of the contact's orders that were not
+// cancelled.
+func (s *LLMService) boughtProducts(ctx context.Context, catalog []Products, contactID uint) (map[uint]bool, error) {
+	orders, err := s.repos.Orders.ListByContact(ctx, contactID)
+	if err != nil {
+		return nil, err
+	}
+	bought := map[uint]bool{}
+	for _, order := range orders {
+		if order.Status == OrderStatusCancelled {
+			continue
+		}
+		for id := range orderProducts(order, catalog) {
+			bought[id] = true
+		}
+	}
+	return bought, nil
+}
+
+// recommendationTenant returns the tenant whose orders the recommendations
+// are drawn from: the contact's or, without a contact, the tenant of the
+// message being answered.
+func recommendationTenant(ctx context.Context, contact *Contact) string {
+	if contact == nil {
+		return usageScopeFrom(ctx).Tenant
+	}
+	if contact.Tenant == "" {
+		return defaultTenant
+	}
+	return contact.Tenant
+}
+
+// recommend ranks the products in stock to suggest along with the basket,
+// from the orders of the tenant. Without a basket, the products the contact
+// bought before are used. The contact may be nil.
+func (s *LLMService) recommend(ctx context.Context, tenant string, contact *Contact, basket []uint, limit int) ([]Recommendation, error) {
+	catalog, err := s.repos.Products.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := s.coPurchaseCounts(ctx, tenant, catalog)
+	if err != nil {
+		return nil, err
+	}
+	if len(basket) == 0 && contact != nil {
+		bought, err := s.boughtProducts(ctx, catalog, contact.ID)
+		if err != nil {
+			return nil, err
+		}
+		for id := range bought {
+			basket = append(basket, id)
+		}
+		sort.Slice(basket, func(i, j int) bool { return basket[i] < basket[j] })
+	}
+
+	names := map[uint]string{}
+	inBasket := map[uint]bool{}
+	for _, product := range catalog {
+		names[product.ID] = productName(product.Product, product.Flavor)
+	}
+	for _, id := range basket {
+		inBasket[id] = true
+	}
+
+	// Only the basket and the candidates are embedded here; the rest of the
+	// catalog is kept up to date by JobKindEmbedProducts.
+	var candidates, embedded []Products
+	for _, product := range catalog {
+		switch {
+		case inBasket[product.ID]:
+			embedded = append(embedded, product)
+		case product.Quantity > 0 && product.ArchivedAt == nil:
+			candidates = append(candidates, product)
+			embedded = append(embedded, product)
+		}
+	}
+
+	var vectors map[uint][]float32
+	if s.embedder != nil && len(basket) > 0 {
+		vectors, err = s.productVectors(ctx, embedded)
+		if err != nil {
+			// Recommendations still work with the other signals.
+			slog.WarnContext(ctx, "product embeddings failed", "error", err)
+		}
+	}
+
+	var recommendations []Recommendation
+	for _, product := range candidates {
+		recommendation := Recommendation{ProductID: product.ID, Product: product.Product, Flavor: product.Flavor}
+
+		// Co-purchases: the share of the orders with a basket product that
+		// also have this one.
+		best := 0.0
+		for _, id := range basket {
+			if share := counts.share(id, product.ID); share > best {
+				best = share
+				recommendation.BoughtWith = names[id]
+			}
+		}
+		if best > 0 {
+			recommendation.Score += coPurchaseWeight * best
+			recommendation.Reasons = append(recommendation.Reasons, fmt.Sprintf("quem comprou %s também leva %s", recommendation.BoughtWith, names[product.ID]))
+		}
+
+		if contact != nil && product.Flavor != "" && containsString(contact.PreferredFlavors, strings.ToLower(product.Flavor)) {
+			recommendation.Score += flavorWeight
+			recommendation.Reasons = append(recommendation.Reasons, "sabor preferido do cliente: "+product.Flavor)
+		}
+
+		if vector, ok := vectors[product.ID]; ok {
+			similarity, similarTo := 0.0, uint(0)
+			for _, id := range basket {
+				if value := cosineSimilarity(vectors[id], vector); value > similarity {
+					similarity, similarTo = value, id
+				}
+			}
+			recommendation.Score += similarityWeight * similarity
+			if similarity >= similarReasonThreshold {
+				recommendation.Reasons = append(recommendation.Reasons, "parecido com "+names[similarTo])
+			}
+		}
+
+		if recommendation.Score > 0 {
+			recommendation.Score = math.Round(recommendation.Score*1000) / 1000
+			recommendations = append(recommendations, recommendation)
+		}
+	}
+
+	sort.SliceStable(recommendations, func(i, j int) bool { return recommendations[i].Score > recommendations[j].Score })
+	if limit > 0 && len(recommendations) > limit {
+		recommendations = recommendations[:limit]
+	}
+	return recommendations, nil
+}
+
+// orderSuggestion suggests a product to add to a newly placed order, or
+// returns an empty string when there is no good one.
+func (s *LLMService) orderSuggestion(ctx context.Context, contact *Contact, order *Order) string {
+	catalog, err := s.repos.Products.List(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "load catalog failed", "error", err)
+		return ""
+	}
+	var basket []uint
+	for _, item := range order.Items {
+		if id, ok := itemProduct(item, catalog); ok {
+			basket = append(basket, id)
+		}
+	}
+	if len(basket) == 0 {
+		return ""
+	}
+
+	recommendations, err := s.recommend(ctx, recommendationTenant(ctx, contact), contact, basket, 1)
+	if err != nil {
+		slog.ErrorContext(ctx, "recommend products failed", "order_id", order.ID, "error", err)
+		return ""
+	}
+	if len(recommendations) == 0 || recommendations[0].Score < minSuggestionScore {
+		return ""
+	}
+	top := recommendations[0]
+	name := productName(top.Product, top.Flavor)
+	if top.BoughtWith != "" {
+		return fmt.Sprintf("Quem comprou %s também leva %s. Quer incluir no pedido?", top.BoughtWith, name)
+	}
+	return fmt.Sprintf("Você também pode gostar de %s. Quer incluir no pedido?", name)
+}
+
+type recommendationArguments struct {
+	Product string `json:"product"`
+	Flavor  string `json:"flavor"`
+}
+
+// callRecommendations runs the getRecommendations function called by the
+// LLM and returns its result as JSON.
+func (s *LLMService) callRecommendations(ctx context.Context, contact *Contact, arguments string) string {
+	var args recommendationArguments
+	if arguments != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			slog.WarnContext(ctx, "invalid recommendation arguments", "error", err)
+		}
+	}
+
+	var basket []uint
+	if args.Product != "" {
+		catalog, err := s.repos.Products.List(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "load catalog failed", "error", err)
+		}
+		if id, ok := itemProduct(OrderItem{Item: args.Product, Flavor: args.Flavor}, catalog); ok {
+			basket = append(basket, id)
+		}
+	}
+
+	recommendations, err := s.recommend(ctx, recommendationTenant(ctx, contact), contact, basket, 3)
+	if err != nil {
+		slog.ErrorContext(ctx, "recommend products failed", "error", err)
+		return `{"error": "recomendações indisponíveis"}`
+	}
+	result, _ := json.Marshal(fiber.Map{"recommendations": recommendations})
+	return string(result)
+}
+
+// getRecommendations handles GET /admin/recommendations?contact_id=&product_id=&limit=.
+func (s *LLMService) getRecommendations(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	var contact *Contact
+	if id := c.QueryInt("contact_id"); id > 0 {
+		var err error
+		contact, err = s.repos.Contacts.Get(ctx, uint(id))
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	var basket []uint
+	if id := c.QueryInt("product_id"); id > 0 {
+		basket = append(basket, uint(id))
+	}
+	tenant := tenantID(c)
+	if contact != nil {
+		tenant = recommendationTenant(ctx, contact)
+	}
+
+	recommendations, err := s.recommend(ctx, tenant, contact, basket, c.QueryInt("limit", 5))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(recommendations)
+}
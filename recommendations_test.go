@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeEmbedder embeds texts by the keywords they contain.
+type fakeEmbedder struct {
+	mu      sync.Mutex
+	texts   []string
+	batches []int
+}
+
+func (f *fakeEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.texts = append(f.texts, texts...)
+	f.batches = append(f.batches, len(texts))
+
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector := make([]float32, 3)
+		for j, keyword := range []string{"pod", "coil", "juice"} {
+			if strings.Contains(text, keyword) {
+				vector[j] = 1
+			}
+		}
+		vectors[i] = vector
+	}
+	return vectors, nil
+}
+
+func newRecommendationFixture(t *testing.T) (*LLMService, *fakeEmbedder, *Contact) {
+	ctx := context.Background()
+	s, _, _, _ := newTestService(t, time.Now())
+	embedder := &fakeEmbedder{}
+	s.embedder = embedder
+
+	for _, product := range []*Products{
+		{Product: "swag kit", Quantity: 5, Description: "pod recarregável"},
+		{Product: "coil x", Quantity: 10, Description: "coil para o pod swag kit"},
+		{Product: "nicsalt", Flavor: "morango", Quantity: 10, Description: "juice para pod"},
+		{Product: "freebase", Flavor: "uva", Quantity: 10, Description: "juice para vape"},
+		{Product: "coil y", Quantity: 0, Description: "coil para o swag kit"},
+	} {
+		if err := s.repos.Products.Create(ctx, product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Most orders of the SWAG Kit come with a coil X.
+	buyer := &Contact{Name: "Bia", Tenant: defaultTenant}
+	if err := s.repos.Contacts.Create(ctx, buyer); err != nil {
+		t.Fatal(err)
+	}
+	for _, items := range [][]OrderItem{
+		{{Item: "swag kit", ProductID: 1}, {Item: "coil x"}},
+		{{Item: "swag kit", ProductID: 1}, {Item: "coil x"}},
+		{{Item: "swag kit", ProductID: 1}, {Item: "freebase", Flavor: "uva"}},
+		{{Item: "coil y", ProductID: 5}, {Item: "swag kit"}},
+	} {
+		if err := s.repos.Orders.Create(ctx, &Order{ContactID: buyer.ID, Status: OrderStatusCompleted, Items: items}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contact := &Contact{Name: "Ana", PreferredFlavors: []string{"morango"}}
+	if err := s.repos.Contacts.Create(ctx, contact); err != nil {
+		t.Fatal(err)
+	}
+	return s, embedder, contact
+}
+
+func TestRecommend(t *testing.T) {
+	ctx := context.Background()
+	s, embedder, contact := newRecommendationFixture(t)
+
+	recommendations, err := s.recommend(ctx, defaultTenant, contact, []uint{1}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recommendations) != 3 || recommendations[0].ProductID != 2 || recommendations[0].BoughtWith != "swag kit" {
+		t.Fatalf("Recommendations are not correct: %+v", recommendations)
+	}
+	if recommendations[1].ProductID != 3 || !strings.Contains(strings.Join(recommendations[1].Reasons, ";"), "sabor preferido") {
+		t.Errorf("Preferred flavor was not recommended: %+v", recommendations[1])
+	}
+	for _, recommendation := range recommendations {
+		if recommendation.ProductID == 1 || recommendation.ProductID == 5 {
+			t.Errorf("Basket or out of stock product was recommended: %+v", recommendation)
+		}
+	}
+
+	// Only the basket and the products in stock are embedded, and the
+	// embeddings are cached until the product changes.
+	s.recommend(ctx, defaultTenant, contact, []uint{1}, 3)
+	if len(embedder.texts) != 4 {
+		t.Errorf("Embeddings were not cached: %d", len(embedder.texts))
+	}
+
+	order := &Order{Items: []OrderItem{{Item: "swag kit", ProductID: 1}}}
+	if suggestion := s.orderSuggestion(ctx, contact, order); suggestion != "Quem comprou swag kit também leva coil x. Quer incluir no pedido?" {
+		t.Errorf("Order suggestion is not correct: %q", suggestion)
+	}
+}
+
+// toolCompleter calls getRecommendations, then answers with what it got.
+type toolCompleter struct {
+	requests []openai.ChatCompletionRequest
+}
+
+func (f *toolCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	f.requests = append(f.requests, request)
+	message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	last := request.Messages[len(request.Messages)-1]
+	if last.Role == openai.ChatMessageRoleFunction {
+		message.Content = "Sugestão: " + last.Content
+	} else {
+		message.FunctionCall = &openai.FunctionCall{Name: "getRecommendations", Arguments: `{"product": "SWAG Kit"}`}
+	}
+	return openai.ChatCompletionResponse{Choices: []openai.ChatCompletionChoice{{Message: message}}}, nil
+}
+
+func TestReplyFAQCallsRecommendations(t *testing.T) {
+	s, _, contact := newRecommendationFixture(t)
+	completer := &toolCompleter{}
+	s.llm = newTestLLM(time.Now, &llmProvider{model: "gpt-4", client: completer})
+
+	reply, err := s.replyFAQ(context.Background(), contact, "o que combina com o swag kit?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completer.requests) != 2 || !strings.Contains(reply, `"product":"coil x"`) {
+		t.Errorf("Recommendations were not used: %d, %q", len(completer.requests), reply)
+	}
+}
+
+func TestRecommendByTenant(t *testing.T) {
+	ctx := context.Background()
+	s, clock, _, _ := newTestService(t, time.Now())
+	s.repos = newGormRepositories(s.db, nil)
+	s.config.Tenants["outra"] = TenantConfig{}
+	s.repos.Products.Create(ctx, &Products{Product: "swag kit", Quantity: 5})
+	s.repos.Products.Create(ctx, &Products{Product: "coil x", Quantity: 10})
+	s.repos.Products.Create(ctx, &Products{Product: "freebase", Quantity: 10})
+	order := func(tenant, with string) {
+		contact := &Contact{Name: "Ana", Tenant: tenant}
+		if err := s.repos.Contacts.Create(ctx, contact); err != nil {
+			t.Fatal(err)
+		}
+		items := []OrderItem{{Item: "swag kit", ProductID: 1}, {Item: with}}
+		if err := s.repos.Orders.Create(ctx, &Order{ContactID: contact.ID, Status: OrderStatusCompleted, Items: items}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	boughtWith := func(tenant string) uint {
+		recommendations, err := s.recommend(ctx, tenant, nil, []uint{1}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recommendations) == 0 {
+			return 0
+		}
+		return recommendations[0].ProductID
+	}
+
+	// Each tenant only sees what its own customers buy together.
+	order(defaultTenant, "coil x")
+	order("outra", "freebase")
+	order("outra", "freebase")
+	if top := boughtWith(defaultTenant); top != 2 {
+		t.Errorf("Default tenant recommendation is not correct: %d", top)
+	}
+	if top := boughtWith("outra"); top != 3 {
+		t.Errorf("Other tenant recommendation is not correct: %d", top)
+	}
+
+	// The counts are reused until they expire.
+	order(defaultTenant, "freebase")
+	order(defaultTenant, "freebase")
+	if top := boughtWith(defaultTenant); top != 2 {
+		t.Errorf("Co-purchase counts were not cached: %d", top)
+	}
+	clock.Advance(coPurchaseTTL)
+	if top := boughtWith(defaultTenant); top != 3 {
+		t.Errorf("Co-purchase counts were not refreshed: %d", top)
+	}
+}
+
+func TestProductEmbeddingsJob(t *testing.T) {
+	ctx := context.Background()
+	s, clock, _, _ := newTestService(t, time.Now())
+	embedder := &fakeEmbedder{}
+	s.embedder = embedder
+	for i := 0; i < 2*productEmbeddingBatch+1; i++ {
+		if err := s.repos.Products.Create(ctx, &Products{Product: fmt.Sprintf("pod %d", i), Quantity: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.scheduleProductEmbeddings(ctx, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if ran, _ := s.scheduler.RunDue(ctx); ran != 1 {
+		t.Fatalf("Embedding job was not run: %d", ran)
+	}
+	if len(embedder.batches) != 3 || embedder.batches[0] != productEmbeddingBatch || embedder.batches[2] != 1 {
+		t.Errorf("Products were not embedded in batches: %v", embedder.batches)
+	}
+
+	// Recommending reuses the embeddings of the job.
+	if _, err := s.recommend(ctx, defaultTenant, nil, []uint{1}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(embedder.batches) != 3 {
+		t.Errorf("Products were embedded again: %v", embedder.batches)
+	}
+
+	// The next run is scheduled.
+	clock.Advance(productEmbeddingInterval)
+	if ran, _ := s.scheduler.RunDue(ctx); ran != 1 {
+		t.Errorf("Next embedding run was not scheduled: %d", ran)
+	}
+}
+
+func TestCoPurchaseCountsLockPerTenant(t *testing.T) {
+	s, _, _, _ := newTestService(t, time.Now())
+
+	// A tenant being counted does not hold up the others.
+	busy := s.coPurchases.tenant("outra")
+	busy.mu.Lock()
+	defer busy.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.coPurchaseCounts(context.Background(), defaultTenant, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Counting the default tenant waited for another tenant")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const JobKindOrderReminder = "order_reminder"
+
+// pickupTime combines the order's pickup date and time in the shop's
+// timezone. Orders without a time use the configured default pickup time.
+func pickupTime(order *Order, defaultTime string, location *time.Location) (time.Time, bool) {
+	if order.PickupDate == "" {
+		return time.Time{}, false
+	}
+
+	clock := order.PickupTime
+	if clock == "" {
+		clock = defaultTime
+	}
+
+	pickup, err := time.ParseInLocation("2006-01-02 15:04", order.PickupDate+" "+clock, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return pickup, true
+}
+
+func orderCalendarEvent(order *Order, contact *Contact, pickup time.Time) CalendarEvent {
+	name := "cliente"
+	if contact != nil && contact.Name != "" {
+		name = contact.Name
+	}
+
+	var items []string
+	for _, item := range order.Items {
+		items = append(items, strings.TrimSpace(fmt.Sprintf("%dx %s %s", item.Quantity, item.Item, item.Flavor)))
+	}
+
+	return CalendarEvent{
+		Summary:     fmt.Sprintf("Retirada do pedido #%d (%s)", order.ID, name),
+		Description: strings.Join(items, "\n"),
+		Start:       pickup,
+		End:         pickup.Add(30 * time.Minute),
+	}
+}
+
+// scheduleOrderFollowUps books the pickup in the calendar and schedules the
+// reminders for a newly placed order.
+func (s *LLMService) scheduleOrderFollowUps(ctx context.Context, order *Order, contact *Contact) error {
+	pickup, ok := pickupTime(order, s.config.Reminders.DefaultPickupTime, s.config.Location())
+	if !ok {
+		return nil
+	}
+
+	if order.CalendarEventID == "" {
+		eventID, err := s.calendar.CreateEvent(ctx, orderCalendarEvent(order, contact, pickup))
+		if err != nil {
+			return fmt.Errorf("creating calendar event: %w", err)
+		}
+		if eventID != "" {
+			order.CalendarEventID = eventID
+			if err := s.repos.Orders.Update(ctx, order); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.scheduleReminders(ctx, order, pickup)
+}
+
+// scheduleReminders replaces the pending reminders of the order with one per
+// configured offset before the pickup. Offsets already in the past are skipped.
+func (s *LLMService) scheduleReminders(ctx context.Context, order *Order, pickup time.Time) error {
+	if order.ContactID == 0 || !s.config.Reminders.Enabled {
+		return nil
+	}
+
+	if err := s.scheduler.CancelOrderJobs(ctx, order.ID, JobKindOrderReminder); err != nil {
+		return err
+	}
+
+	now := s.scheduler.now()
+	for _, offset := range durations(s.config.Reminders.Offsets) {
+		runAt := pickup.Add(-offset)
+		if runAt.Before(now) {
+			continue
+		}
+
+		err := s.scheduler.Schedule(ctx, &Job{
+			Kind:      JobKindOrderReminder,
+			RunAt:     runAt,
+			OrderID:   order.ID,
+			ContactID: order.ContactID,
+			Payload:   offset.String(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *LLMService) sendOrderReminder(ctx context.Context, job *Job) error {
+	order, err := s.repos.Orders.Get(ctx, job.OrderID)
+	if err != nil {
+		return err
+	}
+	if order.Status == OrderStatusCancelled || order.Status == OrderStatusCompleted {
+		return nil
+	}
+
+	contact, err := s.repos.Contacts.Get(ctx, order.ContactID)
+	if err != nil {
+		return err
+	}
+
+	channel, recipient, ok := contactAddress(contact)
+	if !ok {
+		return fmt.Errorf("contact %d has no channel to be reached on", contact.ID)
+	}
+
+	pickup, _ := pickupTime(order, s.config.Reminders.DefaultPickupTime, s.config.Location())
+	text := reminderText(contact, pickup)
+
+	if err := s.sender.Send(ctx, channel, recipient, text); err != nil {
+		return err
+	}
+
+	now := s.scheduler.now()
+	order.ReminderSentAt = &now
+	if err := s.repos.Orders.Update(ctx, order); err != nil {
+		return err
+	}
+
+	return s.repos.Messages.Create(ctx, &Message{Content: text, Role: openai.ChatMessageRoleAssistant, ContactID: contact.ID, Channel: channel, Tenant: contact.Tenant})
+}
+
+func reminderText(contact *Contact, pickup time.Time) string {
+	greeting := "Olá!"
+	if contact.Name != "" {
+		greeting = "Olá, " + contact.Name + "!"
+	}
+
+	return fmt.Sprintf("%s Lembrete: sua retirada está marcada para %s às %s. Responda CONFIRMAR, REMARCAR (com o novo dia e horário) ou CANCELAR.",
+		greeting, pickup.Format("02/01"), pickup.Format("15:04"))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOrderReminders(t *testing.T) {
+	ctx := context.Background()
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	s, clock, sender, calendar := newTestService(t, time.Date(2023, 8, 9, 9, 0, 0, 0, location))
+
+	contact := &Contact{Tenant: defaultTenant, Name: "Ana", Identities: []ContactIdentity{{Tenant: defaultTenant, Channel: "whatsapp", ExternalID: "+5511999999999"}}}
+	if err := s.repos.Contacts.Create(ctx, contact); err != nil {
+		t.Fatal(err)
+	}
+
+	order := &Order{ContactID: contact.ID, Status: OrderStatusPending, PickupDate: "2023-08-10", PickupTime: "14:00"}
+	if err := s.repos.Orders.Create(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.scheduleOrderFollowUps(ctx, order, contact); err != nil {
+		t.Fatalf("Error scheduling follow ups: %v", err)
+	}
+	if len(calendar.events) != 1 || order.CalendarEventID == "" {
+		t.Errorf("Calendar event was not created: %+v", calendar.events)
+	}
+
+	var jobs []Job
+	s.db.Order("run_at").Find(&jobs)
+	if len(jobs) != 2 || !jobs[0].RunAt.Equal(time.Date(2023, 8, 9, 14, 0, 0, 0, location)) {
+		t.Fatalf("Reminder jobs are not correct: %+v", jobs)
+	}
+
+	clock.Advance(5 * time.Hour)
+	s.scheduler.RunDue(ctx)
+
+	sent := sender.Sent()
+	if len(sent) != 1 || sent[0].Recipient != "+5511999999999" {
+		t.Fatalf("Reminder was not sent: %+v", sent)
+	}
+	messages, _ := s.repos.Messages.List(ctx)
+	if len(messages) != 1 || messages[0].Tenant != defaultTenant {
+		t.Errorf("Reminder message was not stored for the tenant: %+v", messages)
+	}
+
+	reply, replied, handled, err := s.handleOrderChange(ctx, contact, "Confirmo, obrigada")
+	if err != nil || !handled || replied.Status != OrderStatusConfirmed || reply == "" {
+		t.Errorf("Confirmation was not handled: %v, %v, %+v", handled, err, replied)
+	}
+}
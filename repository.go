@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrNotFound = errors.New("record not found")
+
+// MessageFilter matches messages of ContactID (when not zero) containing
+// Query. Empty fields match every message.
+type MessageFilter struct {
+	ContactID uint
+	Query     string
+	Limit     int
+}
+
+type MessageRepository interface {
+	Create(ctx context.Context, message *Message) error
+	List(ctx context.Context) ([]Message, error)
+	ListByContact(ctx context.Context, contactID uint) ([]Message, error)
+	// ListByContactAfter returns the contact's messages with an ID greater
+	// than afterID, oldest first.
+	ListByContactAfter(ctx context.Context, contactID, afterID uint) ([]Message, error)
+	// Search returns the newest messages first.
+	Search(ctx context.Context, filter MessageFilter) ([]Message, error)
+	// DeleteByContact permanently deletes the contact's messages.
+	DeleteByContact(ctx context.Context, contactID uint) (int64, error)
+	// LastInteractions returns when each of the contacts last sent us a
+	// message. Contacts that never did are left out.
+	LastInteractions(ctx context.Context, contactIDs []uint) (map[uint]time.Time, error)
+}
+
+type ProductRepository interface {
+	Create(ctx context.Context, product *Products) error
+	Get(ctx context.Context, id uint) (*Products, error)
+	List(ctx context.Context) ([]Products, error)
+	// GetForUpdate is Get that, in a transaction, locks the product until
+	// the transaction ends.
+	GetForUpdate(ctx context.Context, id uint) (*Products, error)
+	// Update stores every field of the product but the quantity, which only
+	// changes with the stock ledger through UpdateQuantity.
+	Update(ctx context.Context, product *Products) error
+	UpdateQuantity(ctx context.Context, id uint, quantity int) error
+	// Delete soft deletes the product; its stock movements are kept.
+	Delete(ctx context.Context, id uint) (bool, error)
+	// FindMatch returns the first product not archived with the item and
+	// flavor, ignoring case. An empty flavor matches any flavor.
+	FindMatch(ctx context.Context, item, flavor string) (*Products, error)
+}
+
+type OrderRepository interface {
+	Create(ctx context.Context, order *Order) error
+	Get(ctx context.Context, id uint) (*Order, error)
+	List(ctx context.Context) ([]Order, error)
+	ListByContact(ctx context.Context, contactID uint) ([]Order, error)
+	// ListByTenant returns the orders of the tenant's contacts. others are
+	// the tenants with their own settings; contacts of any other tenant, or
+	// without one, belong to the default tenant.
+	ListByTenant(ctx context.Context, tenant string, others []string) ([]Order, error)
+	// ContactsOrdering returns the contacts with an order, not cancelled,
+	// with an item of the category. Items are matched by their product's
+	// category or by name.
+	ContactsOrdering(ctx context.Context, category string) (map[uint]bool, error)
+	Update(ctx context.Context, order *Order) error
+	// FindByIdempotencyKey returns the order placed for an inbound request.
+	FindByIdempotencyKey(ctx context.Context, key string) (*Order, error)
+	// Delete permanently deletes the order and its items.
+	Delete(ctx context.Context, id uint) error
+}
+
+// ContactFilter matches contacts of Tenant whose name, phone or notes
+// contain Query and that are tagged with Tag. Empty fields match every
+// contact. OtherTenants are the tenants with their own settings; contacts
+// of any other tenant, or without one, belong to the default tenant.
+type ContactFilter struct {
+	Tenant       string
+	OtherTenants []string
+	Query        string
+	Tag          string
+}
+
+type ContactRepository interface {
+	// Create stores the contact along with its channel identities.
+	Create(ctx context.Context, contact *Contact) error
+	Get(ctx context.Context, id uint) (*Contact, error)
+	FindByPhone(ctx context.Context, phone string) (*Contact, error)
+	FindByIdentity(ctx context.Context, tenant, channel, externalID string) (*Contact, error)
+	Search(ctx context.Context, filter ContactFilter) ([]Contact, error)
+	Update(ctx context.Context, contact *Contact) error
+	// Delete permanently deletes the contact and its channel identities.
+	Delete(ctx context.Context, id uint) error
+}
+
+type Repositories struct {
+	Messages MessageRepository
+	Products ProductRepository
+	Orders   OrderRepository
+	Contacts ContactRepository
+
+	// bind returns the repositories running in the SQL transaction tx. It
+	// is nil when the repositories are not SQL backed.
+	bind func(tx *gorm.DB) Repositories
+}
+
+// transaction runs fn in a single SQL transaction, with the repositories
+// bound to it when they are SQL backed.
+func (s *LLMService) transaction(ctx context.Context, fn func(tx *gorm.DB, repos Repositories) error) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		repos := s.repos
+		if repos.bind != nil {
+			repos = repos.bind(tx)
+		}
+		return fn(tx, repos)
+	})
+}
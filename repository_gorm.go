@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// newGormRepositories builds the SQL repositories. When crypter is not nil,
+// message content and the contacts' name, phone and notes are encrypted
+// before they are written and decrypted when they are read.
+func newGormRepositories(db *gorm.DB, crypter *FieldCrypter) Repositories {
+	return Repositories{
+		Messages: &gormMessageRepository{db: db, crypter: crypter},
+		Products: &gormProductRepository{db: db},
+		Orders:   &gormOrderRepository{db: db},
+		Contacts: &gormContactRepository{db: db, crypter: crypter},
+		bind: func(tx *gorm.DB) Repositories {
+			return newGormRepositories(tx, crypter)
+		},
+	}
+}
+
+// escapeLike escapes the LIKE wildcards in s, for patterns matched with
+// ESCAPE '!'.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+type gormMessageRepository struct {
+	db      *gorm.DB
+	crypter *FieldCrypter
+}
+
+func (r *gormMessageRepository) seal(ctx context.Context, message Message) (Message, error) {
+	message.ContentIndex = r.crypter.WordIndex(message.Content)
+
+	var err error
+	message.Content, err = r.crypter.Encrypt(ctx, message.Content)
+	return message, err
+}
+
+func (r *gormMessageRepository) open(ctx context.Context, message *Message) error {
+	var err error
+	message.Content, err = r.crypter.Decrypt(ctx, message.Content)
+	return err
+}
+
+func (r *gormMessageRepository) openAll(ctx context.Context, messages []Message, err error) ([]Message, error) {
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		if err := r.open(ctx, &messages[i]); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+func (r *gormMessageRepository) Create(ctx context.Context, message *Message) error {
+	sealed, err := r.seal(ctx, *message)
+	if err != nil {
+		return err
+	}
+	if err := r.db.WithContext(ctx).Create(&sealed).Error; err != nil {
+		return err
+	}
+	message.Model = sealed.Model
+	message.ContentIndex = sealed.ContentIndex
+	return nil
+}
+
+func (r *gormMessageRepository) List(ctx context.Context) ([]Message, error) {
+	var messages []Message
+	err := r.db.WithContext(ctx).Find(&messages).Error
+	return r.openAll(ctx, messages, err)
+}
+
+func (r *gormMessageRepository) ListByContact(ctx context.Context, contactID uint) ([]Message, error) {
+	var messages []Message
+	err := r.db.WithContext(ctx).Where("contact_id = ?", contactID).Order("id").Find(&messages).Error
+	return r.openAll(ctx, messages, err)
+}
+
+func (r *gormMessageRepository) ListByContactAfter(ctx context.Context, contactID, afterID uint) ([]Message, error) {
+	var messages []Message
+	err := r.db.WithContext(ctx).Where("contact_id = ? AND id > ?", contactID, afterID).Order("id").Find(&messages).Error
+	return r.openAll(ctx, messages, err)
+}
+
+func (r *gormMessageRepository) Search(ctx context.Context, filter MessageFilter) ([]Message, error) {
+	query := r.db.WithContext(ctx).Order("id desc")
+	if filter.ContactID != 0 {
+		query = query.Where("contact_id = ?", filter.ContactID)
+	}
+	if filter.Query != "" {
+		if r.crypter != nil {
+			for _, pattern := range r.crypter.WordTokens(filter.Query) {
+				query = query.Where("content_index LIKE ?", pattern)
+			}
+		} else {
+			query = query.Where("content LIKE ? ESCAPE '!'", "%"+escapeLike(filter.Query)+"%")
+		}
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var messages []Message
+	err := query.Find(&messages).Error
+	return r.openAll(ctx, messages, err)
+}
+
+// lastInteractionsBatch bounds the contact IDs of one query below the
+// placeholder limits of the databases.
+const lastInteractionsBatch = 500
+
+func (r *gormMessageRepository) LastInteractions(ctx context.Context, contactIDs []uint) (map[uint]time.Time, error) {
+	last := map[uint]time.Time{}
+	for start := 0; start < len(contactIDs); start += lastInteractionsBatch {
+		batch := contactIDs[start:min(start+lastInteractionsBatch, len(contactIDs))]
+		newest := r.db.Model(&Message{}).Select("MAX(id)").
+			Where("role = ? AND contact_id IN ?", openai.ChatMessageRoleUser, batch).Group("contact_id")
+
+		var rows []Message
+		if err := r.db.WithContext(ctx).Select("contact_id", "created_at").Where("id IN (?)", newest).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			last[row.ContactID] = row.CreatedAt
+		}
+	}
+	return last, nil
+}
+
+func (r *gormMessageRepository) DeleteByContact(ctx context.Context, contactID uint) (int64, error) {
+	result := r.db.WithContext(ctx).Unscoped().Where("contact_id = ?", contactID).Delete(&Message{})
+	return result.RowsAffected, result.Error
+}
+
+type gormProductRepository struct {
+	db *gorm.DB
+}
+
+func (r *gormProductRepository) Create(ctx context.Context, product *Products) error {
+	return r.db.WithContext(ctx).Create(product).Error
+}
+
+func (r *gormProductRepository) Get(ctx context.Context, id uint) (*Products, error) {
+	var product Products
+	if err := r.db.WithContext(ctx).First(&product, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &product, nil
+}
+
+func (r *gormProductRepository) List(ctx context.Context) ([]Products, error) {
+	var products []Products
+	err := r.db.WithContext(ctx).Find(&products).Error
+	return products, err
+}
+
+func (r *gormProductRepository) GetForUpdate(ctx context.Context, id uint) (*Products, error) {
+	var product Products
+	if err := r.db.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&product, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &product, nil
+}
+
+func (r *gormProductRepository) Update(ctx context.Context, product *Products) error {
+	return r.db.WithContext(ctx).Omit("quantity").Save(product).Error
+}
+
+func (r *gormProductRepository) UpdateQuantity(ctx context.Context, id uint, quantity int) error {
+	return r.db.WithContext(ctx).Model(&Products{}).Where("id = ?", id).Update("quantity", quantity).Error
+}
+
+func (r *gormProductRepository) Delete(ctx context.Context, id uint) (bool, error) {
+	result := r.db.WithContext(ctx).Delete(&Products{}, id)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r *gormProductRepository) FindMatch(ctx context.Context, item, flavor string) (*Products, error) {
+	query := r.db.WithContext(ctx).Where("archived_at IS NULL AND LOWER(product) = ?", strings.ToLower(item))
+	if flavor != "" {
+		query = query.Where("LOWER(flavor) = ?", strings.ToLower(flavor))
+	}
+
+	var product Products
+	err := query.Order("id").First(&product).Error
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &product, nil
+}
+
+type gormOrderRepository struct {
+	db *gorm.DB
+}
+
+func (r *gormOrderRepository) Create(ctx context.Context, order *Order) error {
+	return r.db.WithContext(ctx).Create(order).Error
+}
+
+func (r *gormOrderRepository) Get(ctx context.Context, id uint) (*Order, error) {
+	var order Order
+	err := r.db.WithContext(ctx).Preload("Items").First(&order, id).Error
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &order, nil
+}
+
+func (r *gormOrderRepository) List(ctx context.Context) ([]Order, error) {
+	var orders []Order
+	err := r.db.WithContext(ctx).Preload("Items").Find(&orders).Error
+	return orders, err
+}
+
+func (r *gormOrderRepository) ListByContact(ctx context.Context, contactID uint) ([]Order, error) {
+	var orders []Order
+	err := r.db.WithContext(ctx).Preload("Items").Where("contact_id = ?", contactID).Find(&orders).Error
+	return orders, err
+}
+
+func (r *gormOrderRepository) ListByTenant(ctx context.Context, tenant string, others []string) ([]Order, error) {
+	var orders []Order
+	scope, args := tenantScope("tenant", tenant, others)
+	contacts := r.db.Model(&Contact{}).Select("id").Where(scope, args...)
+	err := r.db.WithContext(ctx).Preload("Items").Where("contact_id IN (?)", contacts).Find(&orders).Error
+	return orders, err
+}
+
+func (r *gormOrderRepository) ContactsOrdering(ctx context.Context, category string) (map[uint]bool, error) {
+	var ids []uint
+	err := r.db.WithContext(ctx).Model(&Order{}).
+		Joins("JOIN order_items ON order_items.order_id = orders.id AND order_items.deleted_at IS NULL").
+		Joins("LEFT JOIN products ON products.id = order_items.product_id AND products.deleted_at IS NULL").
+		Where("orders.status <> ?", OrderStatusCancelled).
+		Where("LOWER(products.category) = LOWER(?) OR LOWER(order_items.item) = LOWER(?)", category, category).
+		Distinct().Pluck("orders.contact_id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	contacts := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		contacts[id] = true
+	}
+	return contacts, nil
+}
+
+func (r *gormOrderRepository) Update(ctx context.Context, order *Order) error {
+	return r.db.WithContext(ctx).Session(&gorm.Session{FullSaveAssociations: true}).Save(order).Error
+}
+
+func (r *gormOrderRepository) FindByIdempotencyKey(ctx context.Context, key string) (*Order, error) {
+	var order Order
+	err := r.db.WithContext(ctx).Preload("Items").Where("idempotency_key = ?", key).First(&order).Error
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &order, nil
+}
+
+func (r *gormOrderRepository) Delete(ctx context.Context, id uint) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("order_id = ?", id).Delete(&OrderItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&Order{}, id).Error
+	})
+}
+
+type gormContactRepository struct {
+	db      *gorm.DB
+	crypter *FieldCrypter
+}
+
+func (r *gormContactRepository) seal(ctx context.Context, contact Contact) (Contact, error) {
+	contact.PhoneIndex = r.crypter.BlindIndex(contact.Phone)
+	contact.SearchIndex = r.crypter.WordIndex(contact.Name, contact.Phone, contact.Notes)
+
+	for _, field := range []*string{&contact.Name, &contact.Phone, &contact.Notes} {
+		var err error
+		if *field, err = r.crypter.Encrypt(ctx, *field); err != nil {
+			return contact, err
+		}
+	}
+	return contact, nil
+}
+
+func (r *gormContactRepository) open(ctx context.Context, contact *Contact) error {
+	for _, field := range []*string{&contact.Name, &contact.Phone, &contact.Notes} {
+		var err error
+		if *field, err = r.crypter.Decrypt(ctx, *field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *gormContactRepository) first(ctx context.Context, query *gorm.DB) (*Contact, error) {
+	var contact Contact
+	if err := query.Preload("Identities").First(&contact).Error; err != nil {
+		return nil, notFound(err)
+	}
+	if err := r.open(ctx, &contact); err != nil {
+		return nil, err
+	}
+	return &contact, nil
+}
+
+func (r *gormContactRepository) Create(ctx context.Context, contact *Contact) error {
+	sealed, err := r.seal(ctx, *contact)
+	if err != nil {
+		return err
+	}
+	if err := r.db.WithContext(ctx).Create(&sealed).Error; err != nil {
+		return err
+	}
+	contact.Model = sealed.Model
+	contact.Identities = sealed.Identities
+	contact.PhoneIndex, contact.SearchIndex = sealed.PhoneIndex, sealed.SearchIndex
+	return nil
+}
+
+func (r *gormContactRepository) Get(ctx context.Context, id uint) (*Contact, error) {
+	return r.first(ctx, r.db.WithContext(ctx).Where("id = ?", id))
+}
+
+func (r *gormContactRepository) FindByPhone(ctx context.Context, phone string) (*Contact, error) {
+	if r.crypter != nil {
+		return r.first(ctx, r.db.WithContext(ctx).Where("phone_index = ?", r.crypter.BlindIndex(phone)))
+	}
+	return r.first(ctx, r.db.WithContext(ctx).Where("phone = ?", phone))
+}
+
+func (r *gormContactRepository) FindByIdentity(ctx context.Context, tenant, channel, externalID string) (*Contact, error) {
+	var identity ContactIdentity
+	err := r.db.WithContext(ctx).Where("tenant = ? AND channel = ? AND external_id = ?", tenant, channel, externalID).First(&identity).Error
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return r.Get(ctx, identity.ContactID)
+}
+
+// Search matches Query as a substring, or by whole words when the contacts
+// are encrypted.
+func (r *gormContactRepository) Search(ctx context.Context, filter ContactFilter) ([]Contact, error) {
+	query := r.db.WithContext(ctx).Preload("Identities").Order("id")
+	if filter.Tenant != "" {
+		scope, args := tenantScope("tenant", filter.Tenant, filter.OtherTenants)
+		query = query.Where(scope, args...)
+	}
+	if filter.Query != "" {
+		if r.crypter != nil {
+			for _, pattern := range r.crypter.WordTokens(filter.Query) {
+				query = query.Where("search_index LIKE ?", pattern)
+			}
+		} else {
+			like := "%" + escapeLike(filter.Query) + "%"
+			query = query.Where("name LIKE ? ESCAPE '!' OR phone LIKE ? ESCAPE '!' OR notes LIKE ? ESCAPE '!'", like, like, like)
+		}
+	}
+	if filter.Tag != "" {
+		// Tags are stored as a JSON array, so match the quoted tag.
+		query = query.Where("tags LIKE ? ESCAPE '!'", `%"`+escapeLike(filter.Tag)+`"%`)
+	}
+
+	var contacts []Contact
+	if err := query.Find(&contacts).Error; err != nil {
+		return nil, err
+	}
+	for i := range contacts {
+		if err := r.open(ctx, &contacts[i]); err != nil {
+			return nil, err
+		}
+	}
+	return contacts, nil
+}
+
+func (r *gormContactRepository) Update(ctx context.Context, contact *Contact) error {
+	sealed, err := r.seal(ctx, *contact)
+	if err != nil {
+		return err
+	}
+	if err := r.db.WithContext(ctx).Session(&gorm.Session{FullSaveAssociations: true}).Save(&sealed).Error; err != nil {
+		return err
+	}
+	contact.Model = sealed.Model
+	contact.Identities = sealed.Identities
+	contact.PhoneIndex, contact.SearchIndex = sealed.PhoneIndex, sealed.SearchIndex
+	return nil
+}
+
+func (r *gormContactRepository) Delete(ctx context.Context, id uint) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("contact_id = ?", id).Delete(&ContactIdentity{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&Contact{}, id).Error
+	})
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// In-memory repositories are used by unit tests to exercise handlers and
+// business logic without a SQL database.
+func newMemoryRepositories() Repositories {
+	contacts := &memoryContactRepository{contacts: map[uint]Contact{}}
+	products := &memoryProductRepository{products: map[uint]Products{}}
+	return Repositories{
+		Messages: &memoryMessageRepository{},
+		Products: products,
+		Orders:   &memoryOrderRepository{orders: map[uint]Order{}, contacts: contacts, products: products},
+		Contacts: contacts,
+	}
+}
+
+type memoryMessageRepository struct {
+	mu       sync.Mutex
+	nextID   uint
+	messages []Message
+}
+
+func (r *memoryMessageRepository) Create(ctx context.Context, message *Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	message.ID = r.nextID
+	message.CreatedAt = time.Now()
+	message.UpdatedAt = message.CreatedAt
+	r.messages = append(r.messages, *message)
+	return nil
+}
+
+func (r *memoryMessageRepository) List(ctx context.Context) ([]Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Message(nil), r.messages...), nil
+}
+
+func (r *memoryMessageRepository) ListByContact(ctx context.Context, contactID uint) ([]Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	messages := []Message{}
+	for _, message := range r.messages {
+		if message.ContactID == contactID {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func (r *memoryMessageRepository) ListByContactAfter(ctx context.Context, contactID, afterID uint) ([]Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	messages := []Message{}
+	for _, message := range r.messages {
+		if message.ContactID == contactID && message.ID > afterID {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func (r *memoryMessageRepository) Search(ctx context.Context, filter MessageFilter) ([]Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	messages := []Message{}
+	for i := len(r.messages) - 1; i >= 0; i-- {
+		message := r.messages[i]
+		if filter.ContactID != 0 && message.ContactID != filter.ContactID {
+			continue
+		}
+		if filter.Query != "" && !strings.Contains(strings.ToLower(message.Content), strings.ToLower(filter.Query)) {
+			continue
+		}
+		messages = append(messages, message)
+		if filter.Limit > 0 && len(messages) == filter.Limit {
+			break
+		}
+	}
+	return messages, nil
+}
+
+func (r *memoryMessageRepository) LastInteractions(ctx context.Context, contactIDs []uint) (map[uint]time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wanted := map[uint]bool{}
+	for _, id := range contactIDs {
+		wanted[id] = true
+	}
+	last := map[uint]time.Time{}
+	for _, message := range r.messages {
+		if wanted[message.ContactID] && message.Role == openai.ChatMessageRoleUser {
+			last[message.ContactID] = message.CreatedAt
+		}
+	}
+	return last, nil
+}
+
+func (r *memoryMessageRepository) DeleteByContact(ctx context.Context, contactID uint) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := r.messages[:0]
+	for _, message := range r.messages {
+		if message.ContactID != contactID {
+			kept = append(kept, message)
+		}
+	}
+	deleted := int64(len(r.messages) - len(kept))
+	r.messages = kept
+	return deleted, nil
+}
+
+type memoryProductRepository struct {
+	mu       sync.Mutex
+	nextID   uint
+	products map[uint]Products
+}
+
+func (r *memoryProductRepository) Create(ctx context.Context, product *Products) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	product.ID = r.nextID
+	product.CreatedAt = time.Now()
+	product.UpdatedAt = product.CreatedAt
+	r.products[product.ID] = *product
+	return nil
+}
+
+func (r *memoryProductRepository) sorted() []Products {
+	products := make([]Products, 0, len(r.products))
+	for _, product := range r.products {
+		products = append(products, product)
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+	return products
+}
+
+func (r *memoryProductRepository) Get(ctx context.Context, id uint) (*Products, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	product, ok := r.products[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &product, nil
+}
+
+func (r *memoryProductRepository) List(ctx context.Context) ([]Products, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.sorted(), nil
+}
+
+// GetForUpdate is Get: the memory repositories have no transactions.
+func (r *memoryProductRepository) GetForUpdate(ctx context.Context, id uint) (*Products, error) {
+	return r.Get(ctx, id)
+}
+
+func (r *memoryProductRepository) Update(ctx context.Context, product *Products) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.products[product.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	product.UpdatedAt = time.Now()
+	quantity := stored.Quantity
+	stored = *product
+	stored.Quantity = quantity
+	r.products[product.ID] = stored
+	return nil
+}
+
+func (r *memoryProductRepository) UpdateQuantity(ctx context.Context, id uint, quantity int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.products[id]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.Quantity = quantity
+	stored.UpdatedAt = time.Now()
+	r.products[id] = stored
+	return nil
+}
+
+func (r *memoryProductRepository) Delete(ctx context.Context, id uint) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.products[id]
+	delete(r.products, id)
+	return ok, nil
+}
+
+func (r *memoryProductRepository) FindMatch(ctx context.Context, item, flavor string) (*Products, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, product := range r.sorted() {
+		if product.ArchivedAt == nil && strings.EqualFold(product.Product, item) && (flavor == "" || strings.EqualFold(product.Flavor, flavor)) {
+			return &product, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+type memoryOrderRepository struct {
+	mu     sync.Mutex
+	nextID uint
+	orders map[uint]Order
+	// contacts resolves the tenant of the orders and products the category
+	// of their items.
+	contacts *memoryContactRepository
+	products *memoryProductRepository
+}
+
+func (r *memoryOrderRepository) Create(ctx context.Context, order *Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	order.ID = r.nextID
+	order.CreatedAt = time.Now()
+	order.UpdatedAt = order.CreatedAt
+	for i := range order.Items {
+		order.Items[i].ID = uint(i + 1)
+		order.Items[i].OrderID = order.ID
+	}
+	r.orders[order.ID] = copyOrder(*order)
+	return nil
+}
+
+func copyOrder(order Order) Order {
+	order.Items = append([]OrderItem(nil), order.Items...)
+	return order
+}
+
+func (r *memoryOrderRepository) Get(ctx context.Context, id uint) (*Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	order, ok := r.orders[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	order = copyOrder(order)
+	return &order, nil
+}
+
+func (r *memoryOrderRepository) list(match func(Order) bool) []Order {
+	orders := []Order{}
+	for _, order := range r.orders {
+		if match(order) {
+			orders = append(orders, copyOrder(order))
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders
+}
+
+func (r *memoryOrderRepository) List(ctx context.Context) ([]Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.list(func(Order) bool { return true }), nil
+}
+
+func (r *memoryOrderRepository) ListByContact(ctx context.Context, contactID uint) ([]Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.list(func(order Order) bool { return order.ContactID == contactID }), nil
+}
+
+func (r *memoryOrderRepository) ListByTenant(ctx context.Context, tenant string, others []string) ([]Order, error) {
+	r.contacts.mu.Lock()
+	ids := map[uint]bool{}
+	for id, contact := range r.contacts.contacts {
+		if inTenant(contact.Tenant, tenant, others) {
+			ids[id] = true
+		}
+	}
+	r.contacts.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.list(func(order Order) bool { return ids[order.ContactID] }), nil
+}
+
+func (r *memoryOrderRepository) ContactsOrdering(ctx context.Context, category string) (map[uint]bool, error) {
+	r.products.mu.Lock()
+	categories := map[uint]string{}
+	for id, product := range r.products.products {
+		categories[id] = product.Category
+	}
+	r.products.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	contacts := map[uint]bool{}
+	for _, order := range r.orders {
+		if order.Status == OrderStatusCancelled {
+			continue
+		}
+		for _, item := range order.Items {
+			if strings.EqualFold(categories[item.ProductID], category) || strings.EqualFold(item.Item, category) {
+				contacts[order.ContactID] = true
+			}
+		}
+	}
+	return contacts, nil
+}
+
+func (r *memoryOrderRepository) Update(ctx context.Context, order *Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.orders[order.ID]; !ok {
+		return ErrNotFound
+	}
+	order.UpdatedAt = time.Now()
+	r.orders[order.ID] = copyOrder(*order)
+	return nil
+}
+
+func (r *memoryOrderRepository) FindByIdempotencyKey(ctx context.Context, key string) (*Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if orders := r.list(func(order Order) bool { return order.IdempotencyKey == key }); len(orders) > 0 {
+		return &orders[0], nil
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryOrderRepository) Delete(ctx context.Context, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.orders, id)
+	return nil
+}
+
+type memoryContactRepository struct {
+	mu       sync.Mutex
+	nextID   uint
+	contacts map[uint]Contact
+}
+
+func (r *memoryContactRepository) Create(ctx context.Context, contact *Contact) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	contact.ID = r.nextID
+	contact.CreatedAt = time.Now()
+	contact.UpdatedAt = contact.CreatedAt
+	for i := range contact.Identities {
+		contact.Identities[i].ContactID = contact.ID
+	}
+	r.contacts[contact.ID] = copyContact(*contact)
+	return nil
+}
+
+func copyContact(contact Contact) Contact {
+	contact.Identities = append([]ContactIdentity(nil), contact.Identities...)
+	contact.PreferredFlavors = append([]string(nil), contact.PreferredFlavors...)
+	contact.PreferredProducts = append([]string(nil), contact.PreferredProducts...)
+	contact.Tags = append([]string(nil), contact.Tags...)
+	return contact
+}
+
+func (r *memoryContactRepository) Get(ctx context.Context, id uint) (*Contact, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	contact, ok := r.contacts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	contact = copyContact(contact)
+	return &contact, nil
+}
+
+func (r *memoryContactRepository) find(match func(Contact) bool) []Contact {
+	contacts := []Contact{}
+	for _, contact := range r.contacts {
+		if match(contact) {
+			contacts = append(contacts, copyContact(contact))
+		}
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].ID < contacts[j].ID })
+	return contacts
+}
+
+func (r *memoryContactRepository) FindByPhone(ctx context.Context, phone string) (*Contact, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	contacts := r.find(func(contact Contact) bool { return contact.Phone == phone })
+	if len(contacts) == 0 {
+		return nil, ErrNotFound
+	}
+	return &contacts[0], nil
+}
+
+func (r *memoryContactRepository) FindByIdentity(ctx context.Context, tenant, channel, externalID string) (*Contact, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	contacts := r.find(func(contact Contact) bool {
+		for _, identity := range contact.Identities {
+			if identity.Tenant == tenant && identity.Channel == channel && identity.ExternalID == externalID {
+				return true
+			}
+		}
+		return false
+	})
+	if len(contacts) == 0 {
+		return nil, ErrNotFound
+	}
+	return &contacts[0], nil
+}
+
+func (r *memoryContactRepository) Search(ctx context.Context, filter ContactFilter) ([]Contact, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.find(func(contact Contact) bool {
+		if filter.Tenant != "" && !inTenant(contact.Tenant, filter.Tenant, filter.OtherTenants) {
+			return false
+		}
+		if filter.Query != "" && !strings.Contains(contact.Name, filter.Query) &&
+			!strings.Contains(contact.Phone, filter.Query) && !strings.Contains(contact.Notes, filter.Query) {
+			return false
+		}
+		if filter.Tag != "" && !containsString(contact.Tags, filter.Tag) {
+			return false
+		}
+		return true
+	}), nil
+}
+
+func (r *memoryContactRepository) Update(ctx context.Context, contact *Contact) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.contacts[contact.ID]; !ok {
+		return ErrNotFound
+	}
+	contact.UpdatedAt = time.Now()
+	r.contacts[contact.ID] = copyContact(*contact)
+	return nil
+}
+
+func (r *memoryContactRepository) Delete(ctx context.Context, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.contacts, id)
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// errLLMUnavailable is returned when every model of the fallback chain
+// failed with transient errors or has its circuit open. Errors that retrying
+// would not fix, like bad requests, are returned as they are.
+var errLLMUnavailable = errors.New("llm unavailable")
+
+var errNoChoices = errors.New("completion returned no choices")
+
+// llmApology is sent to the customer when the LLM is down. The message is
+// queued and answered once it is back.
+const llmApology = "Desculpe, estou com uma instabilidade no momento. Já anotei sua mensagem e te respondo em instantes."
+
+// chatCompleter is the part of the OpenAI client used for chat completions.
+type chatCompleter interface {
+	CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+}
+
+// llmProvider is one model of the fallback chain, with its own client (a
+// fallback may live on another OpenAI compatible provider) and breaker.
+type llmProvider struct {
+	model   string
+	client  chatCompleter
+	breaker *circuitBreaker
+}
+
+// resilientLLM makes chat completions with a deadline per attempt, retries
+// rate limits and server errors with exponential backoff, and falls back to
+// the next model of the chain when one keeps failing or its circuit is open.
+type resilientLLM struct {
+	providers  []*llmProvider
+	timeout    time.Duration
+	maxRetries int
+	backoff    time.Duration
+	sleep      func(ctx context.Context, d time.Duration) error
+	usage      *usageLedger
+}
+
+func newResilientLLM(config OpenAIConfig, client chatCompleter, usage *usageLedger) *resilientLLM {
+	timeout, _ := time.ParseDuration(config.Timeout)
+	cooldown, _ := time.ParseDuration(config.Breaker.Cooldown)
+	breaker := func() *circuitBreaker {
+		return &circuitBreaker{threshold: config.Breaker.Failures, cooldown: cooldown, now: time.Now}
+	}
+
+	r := &resilientLLM{
+		providers:  []*llmProvider{{model: config.Model, client: client, breaker: breaker()}},
+		timeout:    timeout,
+		maxRetries: config.MaxRetries,
+		backoff:    500 * time.Millisecond,
+		sleep:      sleepContext,
+		usage:      usage,
+	}
+	for _, fallback := range config.Fallbacks {
+		fallbackClient := client
+		if fallback.BaseURL != "" || fallback.AuthToken != "" {
+			token := config.AuthToken
+			if fallback.AuthToken != "" {
+				token = fallback.AuthToken
+			}
+			clientConfig := openai.DefaultConfig(token)
+			if fallback.BaseURL != "" {
+				clientConfig.BaseURL = fallback.BaseURL
+			}
+			fallbackClient = openai.NewClientWithConfig(clientConfig)
+		}
+		r.providers = append(r.providers, &llmProvider{model: fallback.Model, client: fallbackClient, breaker: breaker()})
+	}
+
+	return r
+}
+
+// complete sends the request to the first available model of the chain. The
+// request model is set per provider: the primary model can be replaced by the
+// usage scope (see chatModel), fallbacks always use their own.
+func (r *resilientLLM) complete(ctx context.Context, operation string, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	var lastErr error
+	for i, provider := range r.providers {
+		model := provider.model
+		if i == 0 {
+			model = chatModel(ctx, model)
+		}
+		if !provider.breaker.Allow() {
+			slog.WarnContext(ctx, "llm circuit open, skipping model", "operation", operation, "model", model)
+			lastErr = fmt.Errorf("%s: circuit open", model)
+			continue
+		}
+
+		request.Model = model
+		resp, err := r.attempt(ctx, operation, provider, request)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return openai.ChatCompletionResponse{}, ctx.Err()
+		}
+		if !retryable(err) {
+			// The request itself is wrong: another model will not answer it
+			// and queueing it for later would only fail again.
+			return openai.ChatCompletionResponse{}, err
+		}
+		lastErr = err
+		if i < len(r.providers)-1 {
+			slog.WarnContext(ctx, "llm model failed, falling back", "operation", operation, "model", model, "error", err)
+		}
+	}
+
+	return openai.ChatCompletionResponse{}, fmt.Errorf("%w: %v", errLLMUnavailable, lastErr)
+}
+
+// attempt calls one provider, retrying transient errors.
+func (r *resilientLLM) attempt(ctx context.Context, operation string, provider *llmProvider, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	var err error
+	for try := 0; try <= r.maxRetries; try++ {
+		if try > 0 {
+			delay := r.backoff<<(try-1) + time.Duration(rand.Int63n(int64(r.backoff)))
+			slog.InfoContext(ctx, "retrying llm call", "operation", operation, "model", request.Model, "attempt", try+1, "delay", delay, "error", err)
+			if err := r.sleep(ctx, delay); err != nil {
+				provider.breaker.Cancel()
+				return openai.ChatCompletionResponse{}, err
+			}
+		}
+
+		callCtx, cancel := ctx, context.CancelFunc(func() {})
+		if r.timeout > 0 {
+			callCtx, cancel = context.WithTimeout(ctx, r.timeout)
+		}
+		start := time.Now()
+		var resp openai.ChatCompletionResponse
+		resp, err = provider.client.CreateChatCompletion(callCtx, request)
+		cancel()
+		if err == nil && len(resp.Choices) == 0 {
+			err = errNoChoices
+		}
+		r.usage.observeChatCompletion(ctx, operation, request.Model, start, resp, err)
+		if err == nil {
+			provider.breaker.Success()
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			// The caller gave up, which says nothing about the provider:
+			// release the probe without counting a failure.
+			provider.breaker.Cancel()
+			return resp, err
+		}
+
+		if !retryable(err) {
+			// Bad requests are our fault, not the provider's: the provider
+			// is up, so they close the breaker and are not retried.
+			provider.breaker.Success()
+			return resp, err
+		}
+		provider.breaker.Failure()
+		if !provider.breaker.Allow() {
+			return resp, err
+		}
+	}
+
+	return openai.ChatCompletionResponse{}, err
+}
+
+// retryable reports whether the error is worth retrying: rate limits, server
+// errors, timeouts and network errors.
+func retryable(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == 429 || apiErr.HTTPStatusCode >= 500
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.HTTPStatusCode == 429 || requestErr.HTTPStatusCode >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errNoChoices)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// circuitBreaker opens after threshold consecutive failures and lets a
+// single probe call through once cooldown has passed. A successful probe
+// closes it again, a failed one keeps it open for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+// Cancel releases a probe whose call was abandoned by the caller, so the next
+// call after the cooldown can probe again.
+func (b *circuitBreaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.probing = false
+	}
+}
+
+// JobKindQueuedMessage answers an inbound message that could not be answered
+// while the LLM was down.
+const JobKindQueuedMessage = "queued_message"
+
+// queuedMessageDelay is how long a queued message waits before its first
+// attempt; the scheduler backs off further attempts.
+const queuedMessageDelay = time.Minute
+
+// queueMessage schedules a job answering the message. The payload is
+// encrypted like the inbound queue's, and the job belongs to the contact so
+// it is erased with it.
+func (s *LLMService) queueMessage(ctx context.Context, message *Message) error {
+	contact, err := resolveContact(ctx, s.repos, message)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.crypter.Encrypt(ctx, string(payload))
+	if err != nil {
+		return err
+	}
+
+	job := &Job{
+		Kind:    JobKindQueuedMessage,
+		RunAt:   s.scheduler.now().Add(queuedMessageDelay),
+		Payload: sealed,
+	}
+	if contact != nil {
+		job.ContactID = contact.ID
+	}
+	return s.scheduler.Schedule(ctx, job)
+}
+
+// answerQueuedMessage processes a queued message and sends the reply to the
+// customer through the channel it came from. When the last attempt fails
+// the message is moved to the inbound dead letters instead of being lost.
+func (s *LLMService) answerQueuedMessage(ctx context.Context, job *Job) error {
+	payload, err := s.crypter.Decrypt(ctx, job.Payload)
+	if err != nil {
+		return err
+	}
+	var message Message
+	if err := json.Unmarshal([]byte(payload), &message); err != nil {
+		return err
+	}
+
+	err = s.replyQueuedMessage(ctx, &message)
+	if err != nil && job.Attempts >= s.scheduler.maxAttempts && s.inbound != nil {
+		if err := s.inbound.BuryMessage(ctx, &message, job.Attempts, job.CreatedAt, err); err != nil {
+			slog.ErrorContext(ctx, "dead-letter queued message failed", "job_id", job.ID, "error", err)
+		} else {
+			slog.ErrorContext(ctx, "queued message dead-lettered", "job_id", job.ID, "contact_id", job.ContactID)
+		}
+	}
+	return err
+}
+
+func (s *LLMService) replyQueuedMessage(ctx context.Context, message *Message) error {
+	response, err := s.processMessage(ctx, message)
+	if err != nil {
+		return err
+	}
+	if response.reply == "" {
+		return nil
+	}
+
+	return s.sender.Send(ctx, message.Channel, message.Sender, response.reply)
+}
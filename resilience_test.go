@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeCompleter returns errs in order, then reply.
+type fakeCompleter struct {
+	mu     sync.Mutex
+	errs   []error
+	reply  string
+	models []string
+	block  bool
+}
+
+func (f *fakeCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	f.mu.Lock()
+	f.models = append(f.models, request.Model)
+	var err error
+	if len(f.errs) > 0 {
+		err, f.errs = f.errs[0], f.errs[1:]
+	}
+	block := f.block
+	f.mu.Unlock()
+
+	if block {
+		<-ctx.Done()
+		return openai.ChatCompletionResponse{}, ctx.Err()
+	}
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	return openai.ChatCompletionResponse{Choices: []openai.ChatCompletionChoice{
+		{Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: f.reply}},
+	}}, nil
+}
+
+func (f *fakeCompleter) calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.models...)
+}
+
+func apiError(status int) error {
+	return &openai.APIError{HTTPStatusCode: status, Message: "fake"}
+}
+
+func newTestLLM(now func() time.Time, providers ...*llmProvider) *resilientLLM {
+	for _, provider := range providers {
+		provider.breaker = &circuitBreaker{threshold: 3, cooldown: 30 * time.Second, now: now}
+	}
+	return &resilientLLM{
+		providers:  providers,
+		timeout:    time.Second,
+		maxRetries: 2,
+		backoff:    time.Millisecond,
+		sleep:      func(ctx context.Context, d time.Duration) error { return nil },
+	}
+}
+
+func TestResilientLLMRetries(t *testing.T) {
+	primary := &fakeCompleter{errs: []error{apiError(429), apiError(503)}, reply: "ok"}
+	llm := newTestLLM(time.Now, &llmProvider{model: "gpt-4", client: primary})
+
+	resp, err := llm.complete(context.Background(), "test", openai.ChatCompletionRequest{})
+	if err != nil || resp.Choices[0].Message.Content != "ok" {
+		t.Fatalf("Transient errors should be retried: %v", err)
+	}
+	if calls := primary.calls(); len(calls) != 3 {
+		t.Errorf("Expected 3 attempts, got %v", calls)
+	}
+
+	primary.errs = []error{apiError(400)}
+	if _, err := llm.complete(context.Background(), "test", openai.ChatCompletionRequest{}); err == nil || errors.Is(err, errLLMUnavailable) {
+		t.Errorf("Bad requests should fail without making the LLM unavailable: %v", err)
+	}
+	if calls := primary.calls(); len(calls) != 4 {
+		t.Errorf("Bad requests should not be retried: %v", calls)
+	}
+}
+
+func TestResilientLLMFallback(t *testing.T) {
+	primary := &fakeCompleter{errs: []error{apiError(500), apiError(500), apiError(500)}}
+	fallback := &fakeCompleter{reply: "from fallback"}
+	llm := newTestLLM(time.Now, &llmProvider{model: "gpt-4", client: primary}, &llmProvider{model: "gpt-3.5-turbo", client: fallback})
+
+	ctx := withUsageScope(context.Background(), usageScope{Model: "gpt-4-cheap"})
+	resp, err := llm.complete(ctx, "test", openai.ChatCompletionRequest{})
+	if err != nil || resp.Choices[0].Message.Content != "from fallback" {
+		t.Fatalf("The fallback model should answer: %v", err)
+	}
+	if calls := primary.calls(); len(calls) != 3 || calls[0] != "gpt-4-cheap" {
+		t.Errorf("The primary should use the scope model: %v", calls)
+	}
+	if calls := fallback.calls(); len(calls) != 1 || calls[0] != "gpt-3.5-turbo" {
+		t.Errorf("The fallback should use its own model: %v", calls)
+	}
+
+	fallback.errs = []error{apiError(502), apiError(502), apiError(502)}
+	primary.errs = []error{apiError(500), apiError(500), apiError(500)}
+	if _, err := llm.complete(ctx, "test", openai.ChatCompletionRequest{}); !errors.Is(err, errLLMUnavailable) {
+		t.Errorf("Every model failing should make the LLM unavailable: %v", err)
+	}
+}
+
+func TestResilientLLMTimeout(t *testing.T) {
+	primary := &fakeCompleter{block: true}
+	llm := newTestLLM(time.Now, &llmProvider{model: "gpt-4", client: primary})
+	llm.timeout = 10 * time.Millisecond
+	llm.maxRetries = 1
+
+	if _, err := llm.complete(context.Background(), "test", openai.ChatCompletionRequest{}); !errors.Is(err, errLLMUnavailable) {
+		t.Errorf("Timeouts should make the LLM unavailable: %v", err)
+	}
+	if calls := primary.calls(); len(calls) != 2 {
+		t.Errorf("Timeouts should be retried: %v", calls)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	primary := &fakeCompleter{errs: []error{apiError(500), apiError(500), apiError(500)}, reply: "ok"}
+	fallback := &fakeCompleter{reply: "from fallback"}
+	llm := newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: primary}, &llmProvider{model: "gpt-3.5-turbo", client: fallback})
+
+	llm.complete(context.Background(), "test", openai.ChatCompletionRequest{})
+	llm.complete(context.Background(), "test", openai.ChatCompletionRequest{})
+	if calls := primary.calls(); len(calls) != 3 {
+		t.Errorf("An open circuit should skip the model: %v", calls)
+	}
+
+	clock.Advance(31 * time.Second)
+	resp, err := llm.complete(context.Background(), "test", openai.ChatCompletionRequest{})
+	if err != nil || resp.Choices[0].Message.Content != "ok" {
+		t.Errorf("The circuit should let a probe through after the cooldown: %v", err)
+	}
+	if !llm.providers[0].breaker.Allow() {
+		t.Error("A successful probe should close the circuit")
+	}
+}
+
+func TestCircuitBreakerCancelledProbe(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	primary := &fakeCompleter{errs: []error{apiError(500), apiError(500), apiError(500)}, reply: "ok"}
+	llm := newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: primary})
+	llm.complete(context.Background(), "test", openai.ChatCompletionRequest{})
+
+	clock.Advance(31 * time.Second)
+	primary.block = true
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := llm.complete(ctx, "test", openai.ChatCompletionRequest{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("A cancelled probe should return the context error: %v", err)
+	}
+
+	primary.block = false
+	resp, err := llm.complete(context.Background(), "test", openai.ChatCompletionRequest{})
+	if err != nil || resp.Choices[0].Message.Content != "ok" {
+		t.Errorf("The circuit should let a new probe through after a cancelled one: %v", err)
+	}
+	if !llm.providers[0].breaker.Allow() {
+		t.Error("A successful probe should close the circuit")
+	}
+}
+
+func TestChatQueuesMessageWhenLLMIsDown(t *testing.T) {
+	now := time.Date(2023, 8, 15, 12, 0, 0, 0, time.UTC)
+	s, clock, sender, _ := newTestService(t, now)
+	s.crypter = writeKeyFile(t, filepath.Join(t.TempDir(), "keys.json"), "k1", map[string]string{"k1": randomKey()}, randomKey())
+	completer := &fakeCompleter{errs: []error{apiError(503), apiError(503), apiError(503)}, reply: "Abrimos às 9h."}
+	s.llm = newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: completer})
+
+	app := fiber.New()
+	s.RegisterRoutes(app)
+	body := `{"content": "Qual o horário de funcionamento?", "channel": "whatsapp", "sender": "+5511988887777"}`
+	req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusOK || !strings.Contains(string(data), llmApology) || !strings.Contains(string(data), `"queued":true`) {
+		t.Fatalf("The customer should get an apology: %d %s", resp.StatusCode, data)
+	}
+
+	messages, _ := s.repos.Messages.List(context.Background())
+	if len(messages) != 0 {
+		t.Errorf("Nothing should be stored until the message is answered: %+v", messages)
+	}
+	contact, _ := s.repos.Contacts.FindByIdentity(context.Background(), defaultTenant, "whatsapp", "+5511988887777")
+	var job Job
+	s.db.Where("kind = ?", JobKindQueuedMessage).First(&job)
+	if contact == nil || job.ContactID != contact.ID || strings.Contains(job.Payload, "horário") {
+		t.Errorf("The queued message should be encrypted and belong to the contact: %+v", job)
+	}
+
+	clock.Advance(queuedMessageDelay)
+	if ran, err := s.scheduler.RunDue(context.Background()); err != nil || ran != 1 {
+		t.Fatalf("The queued message should run: %d, %v", ran, err)
+	}
+
+	sent := sender.Sent()
+	if len(sent) != 1 || sent[0].Text != "Abrimos às 9h." || sent[0].Recipient != "+5511988887777" || sent[0].Channel != "whatsapp" {
+		t.Errorf("The reply should be sent to the customer: %+v", sent)
+	}
+	messages, _ = s.repos.Messages.List(context.Background())
+	if len(messages) != 2 {
+		t.Errorf("The conversation should be stored once: %+v", messages)
+	}
+}
+
+func TestChatDoesNotQueueRejectedRequests(t *testing.T) {
+	s, clock, _, _ := newTestService(t, time.Now())
+	completer := &fakeCompleter{errs: []error{apiError(401)}}
+	fallback := &fakeCompleter{reply: "from fallback"}
+	s.llm = newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: completer}, &llmProvider{model: "gpt-3.5-turbo", client: fallback})
+
+	app := fiber.New()
+	s.RegisterRoutes(app)
+	body := `{"content": "Qual o horário de funcionamento?", "channel": "whatsapp", "sender": "+5511988887777"}`
+	req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusInternalServerError || strings.Contains(string(data), llmApology) {
+		t.Errorf("A rejected request should fail without an apology: %d %s", resp.StatusCode, data)
+	}
+	if calls := fallback.calls(); len(calls) != 0 {
+		t.Errorf("A rejected request should not fall back: %v", calls)
+	}
+	var jobs int64
+	s.db.Model(&Job{}).Where("kind = ?", JobKindQueuedMessage).Count(&jobs)
+	if jobs != 0 {
+		t.Errorf("A rejected request should not be queued: %d", jobs)
+	}
+}
+
+func TestQueuedMessageIsDeadLettered(t *testing.T) {
+	ctx := context.Background()
+	s, clock, sender, _ := newTestService(t, time.Date(2023, 8, 15, 12, 0, 0, 0, time.UTC))
+	s.inbound = newGormInboundQueue(s.db, nil)
+	s.llm = newTestLLM(clock.Now, &llmProvider{model: "gpt-4", client: &fakeCompleter{block: true}})
+	s.llm.timeout = time.Millisecond
+	s.llm.maxRetries = 0
+
+	if err := s.queueMessage(ctx, &Message{Content: "Tem pod de uva?", Channel: "whatsapp", Sender: "+5511988887777"}); err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= s.scheduler.maxAttempts; attempt++ {
+		clock.Advance(time.Hour)
+		if ran, err := s.scheduler.RunDue(ctx); err != nil || ran != 1 {
+			t.Fatalf("Attempt %d should run: %d, %v", attempt, ran, err)
+		}
+	}
+
+	letters, _ := s.inbound.DeadLetters(ctx)
+	if len(letters) != 1 || letters[0].Attempts != s.scheduler.maxAttempts || letters[0].LastError == "" {
+		t.Fatalf("The message should be dead-lettered: %+v", letters)
+	}
+	var failed int64
+	s.db.Model(&Job{}).Where("status = ?", JobStatusFailed).Count(&failed)
+	if failed != 1 || len(sender.Sent()) != 0 {
+		t.Errorf("The job should fail without a reply: %d, %+v", failed, sender.Sent())
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/vectordb"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const JobKindRetentionPurge = "retention_purge"
+
+// parseRetention parses a retention period: a Go duration or a number of
+// days ("90d") or years ("5y"). Empty means forever and returns 0.
+func parseRetention(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	var unit time.Duration
+	switch {
+	case strings.HasSuffix(value, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(value, "y"):
+		unit = 365 * 24 * time.Hour
+	default:
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("%q must be a positive duration like 720h, 90d or 5y", value)
+		}
+		return d, nil
+	}
+
+	n, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q must be a positive duration like 720h, 90d or 5y", value)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// PurgeReport records what one purge deleted for a tenant.
+type PurgeReport struct {
+	gorm.Model
+	Tenant   string    `json:"tenant" gorm:"index"`
+	RanAt    time.Time `json:"ran_at"`
+	Messages int64     `json:"messages"`
+	Orders   int64     `json:"orders"`
+	Vectors  int       `json:"vectors"`
+	Errors   string    `json:"errors"`
+}
+
+// tenantScope returns the condition matching the rows of the tenant. Rows of
+// tenants without their own settings and rows without a tenant (written
+// before tenants were recorded) belong to the default tenant.
+func tenantScope(column, tenant string, others []string) (string, []interface{}) {
+	if tenant != defaultTenant {
+		return column + " = ?", []interface{}{tenant}
+	}
+	if len(others) == 0 {
+		return "1 = 1", nil
+	}
+	return "(" + column + " NOT IN ? OR " + column + " IS NULL)", []interface{}{others}
+}
+
+// inTenant reports whether a row with the value in its tenant column
+// belongs to the tenant, by the same rule as tenantScope.
+func inTenant(value, tenant string, others []string) bool {
+	if tenant != defaultTenant {
+		return value == tenant
+	}
+	return !containsString(others, value)
+}
+
+// otherTenants returns, sorted, the tenants other than the default one that
+// have their own settings.
+func (s *LLMService) otherTenants() []string {
+	var others []string
+	for tenant := range s.config.Tenants {
+		if tenant != defaultTenant {
+			others = append(others, tenant)
+		}
+	}
+	sort.Strings(others)
+	return others
+}
+
+func (s *LLMService) purgeTenant(ctx context.Context, tenant string, others []string, now time.Time) PurgeReport {
+	policy := s.config.Tenant(tenant).Retention
+	report := PurgeReport{Tenant: tenant, RanAt: now}
+	var errs []error
+
+	if period, _ := parseRetention(policy.Messages); period > 0 {
+		scope, args := tenantScope("tenant", tenant, others)
+		result := s.db.WithContext(ctx).Unscoped().Where(scope, args...).Where("created_at < ?", now.Add(-period)).Delete(&Message{})
+		if result.Error != nil {
+			errs = append(errs, fmt.Errorf("messages: %w", result.Error))
+		}
+		report.Messages = result.RowsAffected
+
+		// Dead letters hold message content too.
+		result = s.db.WithContext(ctx).Unscoped().Where(scope, args...).Where("created_at < ?", now.Add(-period)).Delete(&DeadLetter{})
+		if result.Error != nil {
+			errs = append(errs, fmt.Errorf("dead letters: %w", result.Error))
+		}
+		report.Messages += result.RowsAffected
+
+		// Summaries are made of messages: one not updated within the
+		// period only holds expired messages.
+		result = s.db.WithContext(ctx).Unscoped().Where(scope, args...).Where("updated_at < ?", now.Add(-period)).Delete(&ConversationSummary{})
+		if result.Error != nil {
+			errs = append(errs, fmt.Errorf("summaries: %w", result.Error))
+		}
+		report.Messages += result.RowsAffected
+	}
+
+	// Responses kept for replay hold replies too: they expire on their own
+	// (see runIdempotencyCleanup), or go with the messages if those go
+	// sooner.
+	if period, _ := parseRetention(policy.Messages); period > 0 && period < idempotencyTTL {
+		scope, args := tenantScope("tenant", tenant, others)
+		if err := s.db.WithContext(ctx).Unscoped().Where(scope, args...).Where("created_at < ?", now.Add(-period)).Delete(&IdempotencyRecord{}).Error; err != nil {
+			errs = append(errs, fmt.Errorf("idempotency records: %w", err))
+		}
+	}
+
+	if period, _ := parseRetention(policy.Orders); period > 0 {
+		deleted, err := s.purgeOrders(ctx, tenant, others, now.Add(-period))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("orders: %w", err))
+		}
+		report.Orders = deleted
+	}
+
+	if period, _ := parseRetention(policy.Embeddings); period > 0 && s.vectors != nil {
+		filter := vectordb.PurgeFilter{Tenants: []string{tenant}, Before: now.Add(-period)}
+		if tenant == defaultTenant {
+			filter = vectordb.PurgeFilter{Tenants: others, Exclude: true, Before: now.Add(-period)}
+		}
+		deleted, err := s.vectors.PurgeVectors(ctx, filter)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("vectors: %w", err))
+		}
+		report.Vectors = deleted
+	}
+
+	if len(errs) > 0 {
+		report.Errors = errors.Join(errs...).Error()
+	}
+	return report
+}
+
+// purgeOrders deletes the orders of the tenant's contacts created before the
+// cutoff, with their items and jobs. Orders belong to their contact's tenant.
+func (s *LLMService) purgeOrders(ctx context.Context, tenant string, others []string, cutoff time.Time) (int64, error) {
+	scope, args := tenantScope("tenant", tenant, others)
+	contacts := s.db.Unscoped().Model(&Contact{}).Select("id").Where(scope, args...)
+
+	query := s.db.WithContext(ctx).Unscoped().Model(&Order{}).Where("created_at < ?", cutoff)
+	if tenant == defaultTenant {
+		if len(others) > 0 {
+			query = query.Where("contact_id NOT IN (?)", s.db.Unscoped().Model(&Contact{}).Select("id").Where("tenant IN ?", others))
+		}
+	} else {
+		query = query.Where("contact_id IN (?)", contacts)
+	}
+
+	var orders []*Order
+	if err := query.Select("id", "status").Find(&orders).Error; err != nil || len(orders) == 0 {
+		return 0, err
+	}
+	ids := make([]uint, 0, len(orders))
+	for _, order := range orders {
+		ids = append(ids, order.ID)
+	}
+
+	// Orders still open give their reserved units back before they go.
+	var restocks []restock
+	err := s.transaction(ctx, func(tx *gorm.DB, repos Repositories) error {
+		for _, order := range orders {
+			if order.Status != OrderStatusPending && order.Status != OrderStatusConfirmed {
+				continue
+			}
+			released, err := s.releaseOrderStock(ctx, tx, repos, order, "order purged")
+			if err != nil {
+				return err
+			}
+			restocks = append(restocks, released...)
+		}
+		if err := tx.Unscoped().Where("order_id IN ?", ids).Delete(&OrderItem{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("order_id IN ?", ids).Delete(&Job{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("id IN ?", ids).Delete(&Order{}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.alertRestocks(ctx, restocks)
+	return int64(len(ids)), nil
+}
+
+// purgeExpiredData enforces the retention policy of every tenant and stores
+// a report per tenant.
+func (s *LLMService) purgeExpiredData(ctx context.Context) ([]PurgeReport, error) {
+	now := s.scheduler.now()
+	others := s.otherTenants()
+
+	var reports []PurgeReport
+	for _, tenant := range append([]string{defaultTenant}, others...) {
+		report := s.purgeTenant(ctx, tenant, others, now)
+		if err := s.db.WithContext(ctx).Create(&report).Error; err != nil {
+			return reports, err
+		}
+		slog.InfoContext(ctx, "retention purge", "tenant", tenant, "messages", report.Messages, "orders", report.Orders, "vectors", report.Vectors)
+		if report.Errors != "" {
+			slog.ErrorContext(ctx, "retention purge failed", "tenant", tenant, "error", report.Errors)
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// scheduleRetentionPurge schedules the next purge unless one is pending.
+func (s *LLMService) scheduleRetentionPurge(ctx context.Context, runAt time.Time) error {
+	return s.scheduleUnlessPending(ctx, &Job{Kind: JobKindRetentionPurge, RunAt: runAt})
+}
+
+// scheduleUnlessPending schedules a recurring job unless a job of its kind
+// is pending or running, so restarts do not pile up copies of it.
+func (s *LLMService) scheduleUnlessPending(ctx context.Context, job *Job) error {
+	var pending int64
+	err := s.db.WithContext(ctx).Model(&Job{}).Where("kind = ? AND status IN ?", job.Kind, []string{JobStatusPending, JobStatusRunning}).Count(&pending).Error
+	if err != nil || pending > 0 {
+		return err
+	}
+	return s.scheduler.Schedule(ctx, job)
+}
+
+// runRetentionPurge is the job handler. Failures are kept in the reports
+// rather than retried, and the next purge is always scheduled.
+func (s *LLMService) runRetentionPurge(ctx context.Context, job *Job) error {
+	if _, err := s.purgeExpiredData(ctx); err != nil {
+		slog.ErrorContext(ctx, "retention purge failed", "error", err)
+	}
+
+	interval, _ := time.ParseDuration(s.config.Retention.Interval)
+	return s.scheduler.Schedule(ctx, &Job{Kind: JobKindRetentionPurge, RunAt: s.scheduler.now().Add(interval)})
+}
+
+func (s *LLMService) getPurgeReports(c *fiber.Ctx) error {
+	query := s.db.Order("id desc").Limit(c.QueryInt("limit", 100))
+	if tenant := c.Query("tenant"); tenant != "" {
+		query = query.Where("tenant = ?", tenant)
+	}
+
+	var reports []PurgeReport
+	if err := query.Find(&reports).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(reports)
+}
+
+func (s *LLMService) runPurge(c *fiber.Ctx) error {
+	reports, err := s.purgeExpiredData(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(reports)
+}
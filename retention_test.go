@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/vectordb"
+	"gorm.io/gorm"
+)
+
+func TestParseRetention(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":     0,
+		"90d":  90 * 24 * time.Hour,
+		"5y":   5 * 365 * 24 * time.Hour,
+		"720h": 720 * time.Hour,
+	}
+	for value, expected := range cases {
+		if d, err := parseRetention(value); err != nil || d != expected {
+			t.Errorf("Retention %q is not correct: %v, %v", value, d, err)
+		}
+	}
+
+	for _, value := range []string{"0d", "-1y", "ninety days", "2w"} {
+		if _, err := parseRetention(value); err == nil {
+			t.Errorf("Retention %q should not be valid", value)
+		}
+	}
+}
+
+type purgeRecorder struct {
+	fakeVectorStore
+	filters []vectordb.PurgeFilter
+}
+
+func (p *purgeRecorder) PurgeVectors(ctx context.Context, filter vectordb.PurgeFilter) (int, error) {
+	p.filters = append(p.filters, filter)
+	return 1, nil
+}
+
+func TestPurgeExpiredData(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 8, 9, 9, 0, 0, 0, time.UTC)
+	s, clock, _, _ := newTestService(t, now)
+	if err := s.db.AutoMigrate(&Message{}, &Contact{}, &ContactIdentity{}, &Order{}, &OrderItem{}, &PurgeReport{}); err != nil {
+		t.Fatal(err)
+	}
+	vectors := &purgeRecorder{}
+	s.vectors = vectors
+	s.config.Tenants["clinic"] = TenantConfig{Retention: RetentionPolicy{Messages: "30d"}}
+
+	old := now.AddDate(0, 0, -60)
+	ancient := now.AddDate(-6, 0, 0)
+
+	shopContact := &Contact{Name: "Ana"}
+	clinicContact := &Contact{Name: "Bia", Tenant: "clinic"}
+	s.db.Create(shopContact)
+	s.db.Create(clinicContact)
+
+	s.db.Create(&Message{Content: "recent", Tenant: "default", Model: gorm.Model{CreatedAt: now}})
+	s.db.Create(&Message{Content: "60 days, default tenant", Tenant: "default", Model: gorm.Model{CreatedAt: old}})
+	s.db.Create(&Message{Content: "before tenants were recorded", Model: gorm.Model{CreatedAt: ancient}})
+	s.db.Exec("UPDATE messages SET tenant = NULL WHERE content = ?", "before tenants were recorded")
+	s.db.Create(&Message{Content: "60 days, clinic", Tenant: "clinic", Model: gorm.Model{CreatedAt: old}})
+	s.db.Create(&Order{ContactID: shopContact.ID, Status: OrderStatusPending, Model: gorm.Model{CreatedAt: ancient}, Items: []OrderItem{{Item: "pod", ProductID: 1, Quantity: 2}}})
+	s.db.Create(&Order{ContactID: clinicContact.ID, Model: gorm.Model{CreatedAt: ancient}})
+	s.db.Create(&Order{ContactID: shopContact.ID, Model: gorm.Model{CreatedAt: old}})
+
+	s.repos.Products.Create(ctx, &Products{Product: "pod", Quantity: 10})
+	err := s.transaction(ctx, func(tx *gorm.DB, repos Repositories) error {
+		return s.takeOrderStock(ctx, tx, repos, &Order{Model: gorm.Model{ID: 1}, Items: []OrderItem{{ProductID: 1, Quantity: 2}}}, StockReservation, "order placed")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := s.purgeExpiredData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 || reports[0].Tenant != "default" || reports[1].Tenant != "clinic" {
+		t.Fatalf("There should be a report per tenant: %+v", reports)
+	}
+	// 90 days for the default tenant: only the 6 years old message goes.
+	if reports[0].Messages != 1 || reports[0].Orders != 1 || reports[0].Vectors != 1 {
+		t.Errorf("Default tenant report is not correct: %+v", reports[0])
+	}
+	// The clinic keeps orders and embeddings forever.
+	if reports[1].Messages != 1 || reports[1].Orders != 0 || reports[1].Vectors != 0 {
+		t.Errorf("Clinic tenant report is not correct: %+v", reports[1])
+	}
+
+	var remaining []Message
+	s.db.Order("id").Find(&remaining)
+	if len(remaining) != 2 || remaining[0].Content != "recent" || remaining[1].Content != "60 days, default tenant" {
+		t.Errorf("Remaining messages are not correct: %+v", remaining)
+	}
+	var items int64
+	s.db.Model(&OrderItem{}).Count(&items)
+	if items != 0 {
+		t.Errorf("Items of purged orders should be deleted, %d left", items)
+	}
+	if product, _ := s.repos.Products.Get(ctx, 1); product.Quantity != 10 {
+		t.Errorf("Purged open order did not give its stock back: %d", product.Quantity)
+	}
+
+	if len(vectors.filters) != 1 || !vectors.filters[0].Exclude || vectors.filters[0].Tenants[0] != "clinic" ||
+		!vectors.filters[0].Before.Equal(now.AddDate(-1, 0, 0)) {
+		t.Errorf("Vector purge filter is not correct: %+v", vectors.filters)
+	}
+
+	// The job keeps itself scheduled.
+	if err := s.scheduleRetentionPurge(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	s.scheduleRetentionPurge(ctx, now)
+	if ran, _ := s.scheduler.RunDue(ctx); ran != 1 {
+		t.Errorf("One purge job should run, ran %d", ran)
+	}
+	clock.Advance(24 * time.Hour)
+	if ran, _ := s.scheduler.RunDue(ctx); ran != 1 {
+		t.Errorf("The next purge should run a day later, ran %d", ran)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/telemetry"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusDone      = "done"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+// Job is a unit of background work persisted in the database so it
+// survives restarts.
+type Job struct {
+	gorm.Model
+	Kind      string    `json:"kind" gorm:"index"`
+	RunAt     time.Time `json:"run_at" gorm:"index"`
+	OrderID   uint      `json:"order_id" gorm:"index"`
+	ContactID uint      `json:"contact_id"`
+	Payload   string    `json:"payload"`
+	Status    string    `json:"status" gorm:"index"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	// LockedUntil is the lease of a running job. A job still running after
+	// it, e.g. because the process crashed, is run again.
+	LockedUntil *time.Time `json:"locked_until"`
+}
+
+type JobHandler func(ctx context.Context, job *Job) error
+
+// Scheduler runs the due jobs on up to workers goroutines, so a slow job
+// (an LLM summary, a campaign batch) does not hold back the others. A
+// running job renews its lease every lease/3, so it is not run again by
+// another instance while it is still making progress.
+type Scheduler struct {
+	db          *gorm.DB
+	handlers    map[string]JobHandler
+	interval    time.Duration
+	workers     int
+	maxAttempts int
+	lease       time.Duration
+	now         func() time.Time
+	wg          sync.WaitGroup
+}
+
+func newScheduler(db *gorm.DB, interval time.Duration, workers int) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Scheduler{
+		db:          db,
+		handlers:    map[string]JobHandler{},
+		interval:    interval,
+		workers:     workers,
+		maxAttempts: 5,
+		lease:       10 * time.Minute,
+		now:         time.Now,
+	}
+}
+
+func (s *Scheduler) Register(kind string, handler JobHandler) {
+	s.handlers[kind] = handler
+}
+
+func (s *Scheduler) Schedule(ctx context.Context, job *Job) error {
+	job.Status = JobStatusPending
+	return s.db.WithContext(ctx).Create(job).Error
+}
+
+// CancelOrderJobs cancels the pending jobs of an order, optionally only of one kind.
+func (s *Scheduler) CancelOrderJobs(ctx context.Context, orderID uint, kind string) error {
+	query := s.db.WithContext(ctx).Model(&Job{}).Where("order_id = ? AND status = ?", orderID, JobStatusPending)
+	if kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	return query.Update("status", JobStatusCancelled).Error
+}
+
+// RunDue runs every job due by now, and the running jobs whose lease
+// expired, waits for them and returns how many were run.
+func (s *Scheduler) RunDue(ctx context.Context) (int, error) {
+	slots := make(chan struct{}, s.workers)
+	ran, err := s.dispatchDue(ctx, slots)
+	s.wg.Wait()
+	return ran, err
+}
+
+// dispatchDue starts the due jobs as worker slots free up and returns how
+// many it started. A job is claimed only once it has a slot, so its lease
+// does not run out while it waits for one.
+func (s *Scheduler) dispatchDue(ctx context.Context, slots chan struct{}) (int, error) {
+	now := s.now()
+	var jobs []Job
+	err := s.db.WithContext(ctx).
+		Where("(status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?)", JobStatusPending, now, JobStatusRunning, now).
+		Order("run_at").Find(&jobs).Error
+	if err != nil {
+		return 0, err
+	}
+
+	ran := 0
+	for i := range jobs {
+		job := &jobs[i]
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ran, ctx.Err()
+		}
+
+		claimed, err := s.claim(ctx, job)
+		if err != nil || !claimed {
+			<-slots
+			if err != nil {
+				return ran, err
+			}
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				s.wg.Done()
+			}()
+			s.run(ctx, job)
+		}()
+		ran++
+	}
+
+	return ran, nil
+}
+
+// claim takes the job so another instance polling the same database skips
+// it. The attempts counted at the claim make a job that keeps crashing the
+// process fail eventually. It reports false when the job was taken by
+// another instance or has been reclaimed too many times.
+func (s *Scheduler) claim(ctx context.Context, job *Job) (bool, error) {
+	lockedUntil := s.now().Add(s.lease)
+	claim := s.db.WithContext(ctx).Model(&Job{}).Where("id = ? AND status = ? AND attempts = ?", job.ID, job.Status, job.Attempts).
+		Updates(map[string]interface{}{"status": JobStatusRunning, "locked_until": lockedUntil, "attempts": job.Attempts + 1})
+	if claim.Error != nil {
+		return false, claim.Error
+	}
+	if claim.RowsAffected == 0 {
+		return false, nil
+	}
+	job.Attempts++
+	if job.Status == JobStatusRunning {
+		slog.WarnContext(ctx, "reclaimed job with an expired lease", "job_id", job.ID, "kind", job.Kind, "attempts", job.Attempts)
+		if job.Attempts > s.maxAttempts {
+			err := s.db.WithContext(ctx).Model(&Job{}).Where("id = ?", job.ID).
+				Updates(map[string]interface{}{"status": JobStatusFailed, "last_error": "lease expired", "locked_until": nil}).Error
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// renewLease extends the lease of the running job every lease/3 until done
+// is closed. When the job was reclaimed by another instance meanwhile, the
+// handler's context is cancelled so it stops instead of running twice.
+func (s *Scheduler) renewLease(ctx context.Context, job *Job, done <-chan struct{}, cancel context.CancelFunc) {
+	ticker := time.NewTicker(s.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		renew := s.db.WithContext(ctx).Model(&Job{}).Where("id = ? AND status = ? AND attempts = ?", job.ID, JobStatusRunning, job.Attempts).
+			Update("locked_until", s.now().Add(s.lease))
+		if renew.Error != nil {
+			slog.ErrorContext(ctx, "renew job lease failed", "job_id", job.ID, "error", renew.Error)
+			continue
+		}
+		if renew.RowsAffected == 0 {
+			slog.WarnContext(ctx, "job lease lost, stopping it", "job_id", job.ID, "kind", job.Kind)
+			cancel()
+			return
+		}
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, job *Job) {
+	// Jobs run outside of a request, each one gets its own correlation ID.
+	ctx, span := telemetry.Start(telemetry.WithCorrelationID(ctx, fmt.Sprintf("job-%d", job.ID)), "job "+job.Kind, telemetry.KindInternal,
+		attribute.Int("job.id", int(job.ID)),
+		attribute.Int("job.attempts", job.Attempts),
+	)
+
+	handler, ok := s.handlers[job.Kind]
+	var err error
+	if !ok {
+		err = fmt.Errorf("no handler registered for job kind %q", job.Kind)
+	} else {
+		handlerCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go s.renewLease(ctx, job, done, cancel)
+		err = handler(handlerCtx, job)
+		close(done)
+		cancel()
+	}
+
+	updates := map[string]interface{}{"status": JobStatusDone, "last_error": "", "locked_until": nil}
+	if err != nil {
+		slog.ErrorContext(ctx, "job failed", "job_id", job.ID, "kind", job.Kind, "attempts", job.Attempts, "error", err)
+		updates["last_error"] = err.Error()
+		if job.Attempts >= s.maxAttempts || !ok {
+			updates["status"] = JobStatusFailed
+		} else {
+			updates["status"] = JobStatusPending
+			updates["run_at"] = s.now().Add(time.Duration(job.Attempts*job.Attempts) * time.Minute)
+		}
+	}
+
+	// Only the owner of the job records its outcome: a job whose lease was
+	// lost belongs to the instance that reclaimed it.
+	result := s.db.WithContext(ctx).Model(&Job{}).Where("id = ? AND status = ? AND attempts = ?", job.ID, JobStatusRunning, job.Attempts).Updates(updates)
+	if result.Error != nil {
+		slog.ErrorContext(ctx, "job update failed", "job_id", job.ID, "error", result.Error)
+	}
+	telemetry.End(span, err)
+}
+
+// Start polls for due jobs until the context is cancelled, then waits for
+// the jobs still running. A poll only waits for a free worker, not for the
+// jobs of the previous poll to finish.
+func (s *Scheduler) Start(ctx context.Context) {
+	slots := make(chan struct{}, s.workers)
+	defer s.wg.Wait()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.dispatchDue(ctx, slots); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "scheduler failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *LLMService) getJobs(c *fiber.Ctx) error {
+	query := s.db.Order("run_at desc").Limit(c.QueryInt("limit", 100))
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var jobs []Job
+	if err := query.Find(&jobs).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(jobs)
+}
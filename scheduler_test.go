@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSchedulerRunsDueJobs(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2023, 8, 10, 9, 0, 0, 0, time.UTC)}
+	scheduler := newScheduler(newTestDB(t, &Job{}), time.Second, 4)
+	scheduler.now = clock.Now
+
+	var ran []uint
+	scheduler.Register("test", func(ctx context.Context, job *Job) error {
+		ran = append(ran, job.OrderID)
+		return nil
+	})
+
+	scheduler.Schedule(ctx, &Job{Kind: "test", OrderID: 1, RunAt: clock.Now().Add(time.Hour)})
+	scheduler.Schedule(ctx, &Job{Kind: "test", OrderID: 2, RunAt: clock.Now().Add(2 * time.Hour)})
+
+	if count, _ := scheduler.RunDue(ctx); count != 0 {
+		t.Errorf("Jobs ran before they were due: %d", count)
+	}
+
+	clock.Advance(90 * time.Minute)
+	if count, _ := scheduler.RunDue(ctx); count != 1 || len(ran) != 1 || ran[0] != 1 {
+		t.Errorf("Due jobs are not correct: %d, %v", count, ran)
+	}
+
+	scheduler.CancelOrderJobs(ctx, 2, "")
+	clock.Advance(time.Hour)
+	if count, _ := scheduler.RunDue(ctx); count != 0 {
+		t.Errorf("Cancelled job ran: %d", count)
+	}
+}
+
+func TestSchedulerRetriesFailedJobs(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2023, 8, 10, 9, 0, 0, 0, time.UTC)}
+	db := newTestDB(t, &Job{})
+	scheduler := newScheduler(db, time.Second, 4)
+	scheduler.now = clock.Now
+	scheduler.maxAttempts = 2
+
+	scheduler.Register("flaky", func(ctx context.Context, job *Job) error {
+		return errors.New("channel is down")
+	})
+	scheduler.Schedule(ctx, &Job{Kind: "flaky", RunAt: clock.Now()})
+
+	scheduler.RunDue(ctx)
+
+	var job Job
+	db.First(&job)
+	if job.Status != JobStatusPending || job.Attempts != 1 || !job.RunAt.After(clock.Now()) {
+		t.Errorf("Job was not rescheduled: %+v", job)
+	}
+
+	clock.Advance(time.Hour)
+	scheduler.RunDue(ctx)
+
+	db.First(&job)
+	if job.Status != JobStatusFailed || job.LastError != "channel is down" {
+		t.Errorf("Job did not fail after max attempts: %+v", job)
+	}
+}
+
+func TestSchedulerReclaimsOrphanedJobs(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2023, 8, 10, 9, 0, 0, 0, time.UTC)}
+	db := newTestDB(t, &Job{})
+	scheduler := newScheduler(db, time.Second, 4)
+	scheduler.now = clock.Now
+
+	var ran int
+	scheduler.Register("test", func(ctx context.Context, job *Job) error {
+		ran++
+		return nil
+	})
+
+	// The process crashed while the job was running.
+	lockedUntil := clock.Now().Add(scheduler.lease)
+	db.Create(&Job{Kind: "test", RunAt: clock.Now(), Status: JobStatusRunning, Attempts: 1, LockedUntil: &lockedUntil})
+
+	if count, _ := scheduler.RunDue(ctx); count != 0 || ran != 0 {
+		t.Errorf("Job ran while its lease was valid: %d", count)
+	}
+
+	clock.Advance(scheduler.lease + time.Minute)
+	if count, _ := scheduler.RunDue(ctx); count != 1 || ran != 1 {
+		t.Fatalf("Orphaned job was not reclaimed: %d", count)
+	}
+
+	var job Job
+	db.First(&job)
+	if job.Status != JobStatusDone || job.Attempts != 2 || job.LockedUntil != nil {
+		t.Errorf("Reclaimed job is not correct: %+v", job)
+	}
+}
+
+func TestSchedulerRunsJobsInParallel(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2023, 8, 10, 9, 0, 0, 0, time.UTC)}
+	scheduler := newScheduler(newTestDB(t, &Job{}), time.Second, 2)
+	scheduler.now = clock.Now
+
+	// The slow job only finishes once the reminder due after it has run.
+	reminded := make(chan struct{})
+	scheduler.Register("slow", func(ctx context.Context, job *Job) error {
+		select {
+		case <-reminded:
+			return nil
+		case <-time.After(5 * time.Second):
+			return errors.New("the reminder waited for the slow job")
+		}
+	})
+	scheduler.Register("reminder", func(ctx context.Context, job *Job) error {
+		close(reminded)
+		return nil
+	})
+	scheduler.Schedule(ctx, &Job{Kind: "slow", RunAt: clock.Now()})
+	scheduler.Schedule(ctx, &Job{Kind: "reminder", RunAt: clock.Now().Add(time.Second)})
+
+	clock.Advance(time.Minute)
+	if count, err := scheduler.RunDue(ctx); count != 2 || err != nil {
+		t.Fatalf("Due jobs are not correct: %d, %v", count, err)
+	}
+	var failed int64
+	scheduler.db.Model(&Job{}).Where("status <> ?", JobStatusDone).Count(&failed)
+	if failed != 0 {
+		t.Errorf("Jobs did not run in parallel: %d not done", failed)
+	}
+}
+
+func TestSchedulerRenewsLeaseOfRunningJobs(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2023, 8, 10, 9, 0, 0, 0, time.UTC)}
+	db := newTestDB(t, &Job{})
+	scheduler := newScheduler(db, time.Second, 1)
+	scheduler.now = clock.Now
+	scheduler.lease = 30 * time.Millisecond
+
+	// Another instance polls the same database while the job runs past the
+	// lease it was claimed with.
+	other := newScheduler(db, time.Second, 1)
+	other.now = clock.Now
+	other.Register("summary", func(ctx context.Context, job *Job) error {
+		return nil
+	})
+	scheduler.Register("summary", func(ctx context.Context, job *Job) error {
+		clock.Advance(time.Hour)
+		time.Sleep(100 * time.Millisecond)
+		if count, _ := other.RunDue(ctx); count != 0 {
+			t.Errorf("Running job was picked up by another instance: %d", count)
+		}
+		return nil
+	})
+	scheduler.Schedule(ctx, &Job{Kind: "summary", RunAt: clock.Now()})
+
+	scheduler.RunDue(ctx)
+	var job Job
+	db.First(&job)
+	if job.Status != JobStatusDone || job.Attempts != 1 {
+		t.Errorf("Job is not correct: %+v", job)
+	}
+}
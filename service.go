@@ -1,24 +1,66 @@
 package main
 
 import (
-	"log"
-	"os"
+	"context"
+	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/sashabaranov/go-openai"
 	"gorm.io/gorm"
 )
 
-func New(db *gorm.DB) (*LLMService, error) {
-	err := godotenv.Load()
+func New(db *gorm.DB, config *Config) (*LLMService, error) {
+	llmClient := openai.NewClient(config.OpenAI.AuthToken)
+
+	calendar, err := newCalendar(context.Background(), config.Google)
+	if err != nil {
+		return nil, err
+	}
+
+	crypter, err := newFieldCrypter(config.Encryption)
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		return nil, err
 	}
 
-	llmClient := openai.NewClient(os.Getenv("OPENAI_AUTH_TOKEN"))
+	pollInterval, _ := time.ParseDuration(config.Reminders.PollInterval)
 
-	return &LLMService{
+	s := &LLMService{
 		db:        db,
 		llmClient: llmClient,
-	}, nil
+		repos:     newGormRepositories(db, crypter),
+		config:    config,
+		calendar:  calendar,
+		sender:    newWebhookSender(config.Channels),
+		scheduler: newScheduler(db, pollInterval, config.Reminders.Workers),
+		usage:     &usageLedger{db: db, prices: config.OpenAI.Prices},
+		crypter:   crypter,
+	}
+	s.embedder = &openAIEmbedder{client: llmClient, usage: s.usage}
+	s.llm = newResilientLLM(config.OpenAI, llmClient, s.usage)
+	s.inbound = newGormInboundQueue(db, crypter)
+	s.workers = newInboundWorkers(s.inbound, s.handleInbound, config.Inbound)
+	if config.Debounce.Window != "" {
+		s.debouncer = newDebouncer(config.Debounce, s.answerTurn)
+	}
+
+	router := &intentRouter{rules: ruleClassifier{}, threshold: config.Intents.ConfidenceThreshold}
+	if config.Intents.LLMFallback {
+		router.fallback = &llmClassifier{llm: s.llm}
+	}
+	s.intents = router
+
+	s.registerJobs()
+
+	return s, nil
+}
+
+// registerJobs registers the handler of every job kind the service schedules.
+func (s *LLMService) registerJobs() {
+	s.scheduler.Register(JobKindOrderReminder, s.sendOrderReminder)
+	s.scheduler.Register(JobKindRetentionPurge, s.runRetentionPurge)
+	s.scheduler.Register(JobKindQueuedMessage, s.answerQueuedMessage)
+	s.scheduler.Register(JobKindSummarizeConversation, s.runSummaryJob)
+	s.scheduler.Register(JobKindCampaignBatch, s.sendCampaignBatch)
+	s.scheduler.Register(JobKindRestockAlert, s.sendRestockAlerts)
+	s.scheduler.Register(JobKindIdempotencyCleanup, s.runIdempotencyCleanup)
+	s.scheduler.Register(JobKindEmbedProducts, s.runProductEmbeddings)
 }
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	StockPurchase    = "purchase"
+	StockSale        = "sale"
+	StockAdjustment  = "adjustment"
+	StockReservation = "reservation"
+	StockReturn      = "return"
+)
+
+// ErrInsufficientStock is returned for a movement that would leave a
+// negative stock.
+var ErrInsufficientStock = errors.New("not enough stock")
+
+// StockMovement is an entry of the append-only stock ledger. The stock of a
+// product is the sum of the quantities of its movements: purchases and
+// returns add units, sales take them, reservations hold them for an order
+// (and give them back with a positive quantity) and adjustments correct
+// counts. Products.Quantity caches the sum.
+type StockMovement struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+	ProductID uint      `json:"product_id" gorm:"index"`
+	Kind      string    `json:"kind" gorm:"index"`
+	Quantity  int       `json:"quantity"`
+	// Balance is the stock of the product after the movement.
+	Balance int    `json:"balance"`
+	OrderID uint   `json:"order_id,omitempty" gorm:"index"`
+	Actor   string `json:"actor,omitempty"`
+	Note    string `json:"note,omitempty"`
+}
+
+func validateMovement(kind string, quantity int) error {
+	switch kind {
+	case StockPurchase, StockReturn:
+		if quantity <= 0 {
+			return fmt.Errorf("%s quantity must be positive", kind)
+		}
+	case StockSale:
+		if quantity >= 0 {
+			return fmt.Errorf("%s quantity must be negative", kind)
+		}
+	case StockAdjustment, StockReservation:
+		if quantity == 0 {
+			return fmt.Errorf("%s quantity must not be zero", kind)
+		}
+	default:
+		return fmt.Errorf("unknown stock movement kind %q", kind)
+	}
+	return nil
+}
+
+// moveStock appends the movement to the ledger of the product and caches the
+// stock it leaves in product.Quantity. Only the sales of orders, whose units
+// were already handed over, may leave a negative stock. Raising the stock of
+// a product notifies its waitlist.
+func (s *LLMService) moveStock(ctx context.Context, product *Products, movement *StockMovement) error {
+	var previous int
+	err := s.transaction(ctx, func(tx *gorm.DB, repos Repositories) error {
+		var err error
+		previous, err = s.recordStock(ctx, tx, repos, product, movement)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.alertRestock(ctx, product, previous)
+	return nil
+}
+
+// recordStock is moveStock within the transaction tx, without the waitlist
+// notification, which must wait for the commit. It returns the stock before
+// the movement.
+func (s *LLMService) recordStock(ctx context.Context, tx *gorm.DB, repos Repositories, product *Products, movement *StockMovement) (int, error) {
+	if err := validateMovement(movement.Kind, movement.Quantity); err != nil {
+		return 0, err
+	}
+
+	// Locking the product serialises its movements: the ledger is read and
+	// appended to by one transaction at a time.
+	locked, err := repos.Products.GetForUpdate(ctx, product.ID)
+	if err != nil {
+		return 0, err
+	}
+	previous := locked.Quantity
+
+	var stock struct {
+		Count int64
+		Total int
+	}
+	err = tx.Model(&StockMovement{}).Select("COUNT(*) AS count, COALESCE(SUM(quantity), 0) AS total").
+		Where("product_id = ?", product.ID).Scan(&stock).Error
+	if err != nil {
+		return 0, err
+	}
+
+	now := s.scheduler.now()
+	// Products stored without the ledger start from the quantity they have.
+	if stock.Count == 0 && previous != 0 {
+		opening := &StockMovement{CreatedAt: now, ProductID: product.ID, Kind: StockAdjustment, Quantity: previous, Balance: previous, Note: "opening balance"}
+		if err := tx.Create(opening).Error; err != nil {
+			return 0, err
+		}
+		stock.Total = previous
+	}
+
+	movement.ProductID, movement.CreatedAt = product.ID, now
+	movement.Balance = stock.Total + movement.Quantity
+	if movement.Balance < 0 && (movement.OrderID == 0 || movement.Kind != StockSale) {
+		return 0, ErrInsufficientStock
+	}
+	if err := tx.Create(movement).Error; err != nil {
+		return 0, err
+	}
+	if err := repos.Products.UpdateQuantity(ctx, product.ID, movement.Balance); err != nil {
+		return 0, err
+	}
+
+	product.Quantity = movement.Balance
+	return previous, nil
+}
+
+// alertRestock notifies the waitlist of the product when a committed
+// movement raised its stock from previous.
+func (s *LLMService) alertRestock(ctx context.Context, product *Products, previous int) {
+	if err := s.scheduleRestockAlert(ctx, product, previous); err != nil {
+		slog.ErrorContext(ctx, "schedule restock alert failed", "product_id", product.ID, "error", err)
+	}
+}
+
+// setStock saves the product and records the adjustment that takes its stock
+// to quantity, if it changes.
+func (s *LLMService) setStock(ctx context.Context, product *Products, quantity int, actor, note string) error {
+	var previous int
+	err := s.transaction(ctx, func(tx *gorm.DB, repos Repositories) error {
+		var err error
+		previous, err = s.adjustStock(ctx, tx, repos, product, quantity, actor, note)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.alertRestock(ctx, product, previous)
+	return nil
+}
+
+// adjustStock is setStock within the transaction tx. It returns the stock
+// before the adjustment.
+func (s *LLMService) adjustStock(ctx context.Context, tx *gorm.DB, repos Repositories, product *Products, quantity int, actor, note string) (int, error) {
+	if quantity < 0 {
+		return 0, ErrInsufficientStock
+	}
+	if err := repos.Products.Update(ctx, product); err != nil {
+		return 0, err
+	}
+
+	locked, err := repos.Products.GetForUpdate(ctx, product.ID)
+	if err != nil {
+		return 0, err
+	}
+	product.Quantity = locked.Quantity
+	if quantity == product.Quantity {
+		return product.Quantity, nil
+	}
+	return s.recordStock(ctx, tx, repos, product, &StockMovement{Kind: StockAdjustment, Quantity: quantity - product.Quantity, Actor: actor, Note: note})
+}
+
+// takeOrderStock applies, within the transaction tx, a movement of kind, a
+// reservation or a sale, that takes the units of every catalog item of the
+// order.
+func (s *LLMService) takeOrderStock(ctx context.Context, tx *gorm.DB, repos Repositories, order *Order, kind, note string) error {
+	for _, item := range order.Items {
+		if item.ProductID == 0 {
+			continue
+		}
+		product, err := repos.Products.Get(ctx, item.ProductID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		quantity := item.Quantity
+		if quantity <= 0 {
+			quantity = 1
+		}
+		if _, err := s.recordStock(ctx, tx, repos, product, &StockMovement{Kind: kind, Quantity: -quantity, OrderID: order.ID, Note: note}); err != nil {
+			return err
+		}
+		if product.Quantity < 0 {
+			slog.WarnContext(ctx, "order took more than the stock", "order_id", order.ID, "product_id", product.ID, "stock", product.Quantity)
+		}
+	}
+	return nil
+}
+
+// placeReservedOrder places the order with placeOrder and holds the units of
+// its items until it is completed or cancelled, in one transaction. The
+// reservation checks the locked stock, so of two orders racing for the last
+// units one gets ErrOutOfStock, with the matched product, and is not placed.
+func (s *LLMService) placeReservedOrder(ctx context.Context, contactID uint, key string, arguments Arguments) (order *Order, product *Products, placed bool, err error) {
+	err = s.transaction(ctx, func(tx *gorm.DB, repos Repositories) error {
+		var err error
+		order, product, placed, err = placeOrder(ctx, repos, contactID, key, arguments)
+		if err != nil || !placed {
+			return err
+		}
+		err = s.takeOrderStock(ctx, tx, repos, order, StockReservation, "order placed")
+		if errors.Is(err, ErrInsufficientStock) {
+			return ErrOutOfStock
+		}
+		return err
+	})
+	if err != nil {
+		return nil, product, false, err
+	}
+	return order, product, placed, nil
+}
+
+// restock is a product whose stock a movement raised from previous. Its
+// waitlist is notified with alertRestocks once the transaction commits.
+type restock struct {
+	product  *Products
+	previous int
+}
+
+func (s *LLMService) alertRestocks(ctx context.Context, restocks []restock) {
+	for _, r := range restocks {
+		s.alertRestock(ctx, r.product, r.previous)
+	}
+}
+
+// releaseOrderStock gives back, within the transaction tx, the units still
+// reserved for the order. Orders placed before the ledger have nothing to
+// give back.
+func (s *LLMService) releaseOrderStock(ctx context.Context, tx *gorm.DB, repos Repositories, order *Order, note string) ([]restock, error) {
+	var rows []struct {
+		ProductID uint
+		Reserved  int
+	}
+	err := tx.Model(&StockMovement{}).Select("product_id, -SUM(quantity) AS reserved").
+		Where("order_id = ? AND kind = ?", order.ID, StockReservation).Group("product_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var restocks []restock
+	for _, row := range rows {
+		if row.Reserved <= 0 {
+			continue
+		}
+		product, err := repos.Products.Get(ctx, row.ProductID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		previous, err := s.recordStock(ctx, tx, repos, product, &StockMovement{Kind: StockReservation, Quantity: row.Reserved, OrderID: order.ID, Note: note})
+		if err != nil {
+			return nil, err
+		}
+		restocks = append(restocks, restock{product: product, previous: previous})
+	}
+	return restocks, nil
+}
+
+// completeOrder marks the order completed and turns its reservation into a
+// sale in one transaction, so a failure leaves the order open to be
+// completed again.
+func (s *LLMService) completeOrder(ctx context.Context, order *Order) error {
+	status := order.Status
+	err := s.transaction(ctx, func(tx *gorm.DB, repos Repositories) error {
+		order.Status = OrderStatusCompleted
+		if err := repos.Orders.Update(ctx, order); err != nil {
+			return err
+		}
+		if _, err := s.releaseOrderStock(ctx, tx, repos, order, "order completed"); err != nil {
+			return err
+		}
+		return s.takeOrderStock(ctx, tx, repos, order, StockSale, "order completed")
+	})
+	if err != nil {
+		order.Status = status
+		return err
+	}
+
+	return s.scheduler.CancelOrderJobs(ctx, order.ID, "")
+}
+
+// completeOrderHandler handles POST /admin/ordersdb/:id/complete, when the
+// customer picks the order up.
+func (s *LLMService) completeOrderHandler(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid order ID.")
+	}
+
+	order, err := s.repos.Orders.Get(ctx, uint(id))
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if order.Status == OrderStatusCompleted || order.Status == OrderStatusCancelled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "order is already " + order.Status,
+		})
+	}
+
+	if err := s.completeOrder(ctx, order); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(order)
+}
+
+// createStockMovement handles POST /admin/stock/movements.
+func (s *LLMService) createStockMovement(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	var request struct {
+		ProductID uint   `json:"product_id"`
+		Kind      string `json:"kind"`
+		Quantity  int    `json:"quantity"`
+		Note      string `json:"note"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := validateMovement(request.Kind, request.Quantity); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	product, err := s.repos.Products.Get(ctx, request.ProductID)
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	principal, _ := currentPrincipal(c)
+	movement := &StockMovement{Kind: request.Kind, Quantity: request.Quantity, Actor: principal.Subject, Note: request.Note}
+	err = s.moveStock(ctx, product, movement)
+	if errors.Is(err, ErrInsufficientStock) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": fmt.Sprintf("%s: %d in stock", err, product.Quantity),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(movement)
+}
+
+// queryPeriod reads the ?from= and ?to= dates of a report; to is exclusive.
+// The period defaults to the current month up to today.
+func queryPeriod(c *fiber.Ctx, location *time.Location) (time.Time, time.Time, error) {
+	now := time.Now().In(location)
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, location)
+	to := now.AddDate(0, 0, 1)
+	for param, value := range map[string]*time.Time{"from": &from, "to": &to} {
+		if raw := c.Query(param); raw != "" {
+			parsed, err := time.ParseInLocation("2006-01-02", raw, location)
+			if err != nil {
+				return from, to, errors.New(param + " must be a date like 2023-08-01")
+			}
+			*value = parsed
+		}
+	}
+	return from, to, nil
+}
+
+// getStockMovements handles GET /admin/stock/movements?product_id=&kind=&from=&to=,
+// newest first.
+func (s *LLMService) getStockMovements(c *fiber.Ctx) error {
+	from, to, err := queryPeriod(c, s.config.Location())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	query := s.db.WithContext(c.UserContext()).Where("created_at >= ? AND created_at < ?", from, to).Order("id desc")
+	if productID := c.QueryInt("product_id"); productID > 0 {
+		query = query.Where("product_id = ?", productID)
+	}
+	if kind := c.Query("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+
+	var movements []StockMovement
+	if err := query.Find(&movements).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(movements)
+}
+
+// StockReport sums the movements of a product in a period.
+type StockReport struct {
+	ProductID    uint   `json:"product_id"`
+	SKU          string `json:"sku"`
+	Product      string `json:"product"`
+	Flavor       string `json:"flavor"`
+	Opening      int    `json:"opening"`
+	Purchases    int    `json:"purchases"`
+	Sales        int    `json:"sales"`
+	Adjustments  int    `json:"adjustments"`
+	Reservations int    `json:"reservations"`
+	Returns      int    `json:"returns"`
+	Closing      int    `json:"closing"`
+}
+
+func (s *LLMService) stockReport(ctx context.Context, productID uint, from, to time.Time) ([]StockReport, error) {
+	var rows []struct {
+		ProductID uint
+		Kind      string
+		Opening   int
+		Period    int
+	}
+	query := s.db.WithContext(ctx).Model(&StockMovement{}).
+		Select("product_id, kind, SUM(CASE WHEN created_at < ? THEN quantity ELSE 0 END) AS opening, "+
+			"SUM(CASE WHEN created_at >= ? THEN quantity ELSE 0 END) AS period", from, from).
+		Where("created_at < ?", to).
+		Group("product_id, kind").
+		Order("product_id")
+	if productID > 0 {
+		query = query.Where("product_id = ?", productID)
+	}
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	products, err := s.repos.Products.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[uint]Products{}
+	for _, product := range products {
+		byID[product.ID] = product
+	}
+
+	reports := []StockReport{}
+	for _, row := range rows {
+		if len(reports) == 0 || reports[len(reports)-1].ProductID != row.ProductID {
+			// Deleted products are reported by their ID only.
+			product := byID[row.ProductID]
+			reports = append(reports, StockReport{ProductID: row.ProductID, SKU: product.SKU, Product: product.Product, Flavor: product.Flavor})
+		}
+		report := &reports[len(reports)-1]
+
+		report.Opening += row.Opening
+		report.Closing += row.Opening + row.Period
+		switch row.Kind {
+		case StockPurchase:
+			report.Purchases += row.Period
+		case StockSale:
+			report.Sales += row.Period
+		case StockAdjustment:
+			report.Adjustments += row.Period
+		case StockReservation:
+			report.Reservations += row.Period
+		case StockReturn:
+			report.Returns += row.Period
+		}
+	}
+	return reports, nil
+}
+
+// getStockReport handles GET /admin/stock/report?product_id=&from=&to=, the
+// stock of each product at the start and end of the period and its movements
+// in between.
+func (s *LLMService) getStockReport(c *fiber.Ctx) error {
+	from, to, err := queryPeriod(c, s.config.Location())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	reports, err := s.stockReport(c.UserContext(), uint(c.QueryInt("product_id")), from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(reports)
+}
+
+// archiveProduct handles POST /admin/productsdb/:id/archive and
+// /unarchive. Archived products are kept with their stock history but are
+// no longer matched to orders or recommended.
+func (s *LLMService) archiveProduct(archive bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		id, err := c.ParamsInt("id")
+		if err != nil || id <= 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid product ID.")
+		}
+
+		product, err := s.repos.Products.Get(ctx, uint(id))
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		product.ArchivedAt = nil
+		if archive {
+			now := s.scheduler.now()
+			product.ArchivedAt = &now
+		}
+		if err := s.repos.Products.Update(ctx, product); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(product)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func TestStockLedger(t *testing.T) {
+	ctx := context.Background()
+	s, clock, _, _ := newTestService(t, time.Now())
+	clock.now = clock.now.In(s.config.Location())
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("principal", Principal{Subject: "owner", Role: RoleOwner})
+		return c.Next()
+	})
+	s.RegisterAdminRoutes(app)
+	request := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	request("POST", "/productsdb", `{"product": "Pod", "flavor": "Uva", "quantity": 10}`)
+	for _, movement := range []struct {
+		body   string
+		status int
+	}{
+		{`{"product_id": 1, "kind": "purchase", "quantity": 5}`, fiber.StatusCreated},
+		{`{"product_id": 1, "kind": "sale", "quantity": -20}`, fiber.StatusConflict},
+		{`{"product_id": 1, "kind": "sale", "quantity": 3}`, fiber.StatusBadRequest},
+		{`{"product_id": 1, "kind": "return", "quantity": 1, "note": "troca"}`, fiber.StatusCreated},
+	} {
+		if status := request("POST", "/stock/movements", movement.body); status != movement.status {
+			t.Errorf("Movement %s status is not correct: %d", movement.body, status)
+		}
+	}
+
+	// Orders hold their units until they are cancelled or completed.
+	contact := &Contact{Name: "Ana"}
+	s.repos.Contacts.Create(ctx, contact)
+	arguments := Arguments{Products: []ExtractedProduct{{Item: "pod", Flavor: "uva", Quantity: 3}}}
+	cancelled, _, _, err := s.placeReservedOrder(ctx, contact.ID, "", arguments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product, _ := s.repos.Products.Get(ctx, 1); product.Quantity != 13 {
+		t.Errorf("Order stock was not reserved: %d", product.Quantity)
+	}
+	if err := s.cancelOrder(ctx, cancelled); err != nil {
+		t.Fatal(err)
+	}
+	arguments.Products[0].Quantity = 2
+	s.placeReservedOrder(ctx, contact.ID, "", arguments)
+	if status := request("POST", "/ordersdb/2/complete", ""); status != fiber.StatusOK {
+		t.Fatalf("Order was not completed: %d", status)
+	}
+	if status := request("POST", "/ordersdb/2/complete", ""); status != fiber.StatusConflict {
+		t.Errorf("Order was completed twice: %d", status)
+	}
+
+	product, _ := s.repos.Products.Get(ctx, 1)
+	var total int
+	s.db.Model(&StockMovement{}).Select("SUM(quantity)").Where("product_id = ?", 1).Scan(&total)
+	if product.Quantity != 14 || total != 14 {
+		t.Errorf("Stock is not derived from the ledger: %d, %d", product.Quantity, total)
+	}
+
+	today := clock.now.Format("2006-01-02")
+	tomorrow := clock.now.AddDate(0, 0, 1).Format("2006-01-02")
+	reports, err := s.stockReport(ctx, 0, mustParseDate(t, s, today), mustParseDate(t, s, tomorrow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StockReport{ProductID: 1, Product: "pod", Flavor: "uva", Opening: 0, Purchases: 5, Sales: -2, Adjustments: 10, Reservations: 0, Returns: 1, Closing: 14}
+	if len(reports) != 1 || reports[0] != want {
+		t.Errorf("Stock report is not correct: %+v", reports)
+	}
+	reports, _ = s.stockReport(ctx, 1, mustParseDate(t, s, tomorrow), mustParseDate(t, s, clock.now.AddDate(0, 0, 2).Format("2006-01-02")))
+	if len(reports) != 1 || reports[0].Opening != 14 || reports[0].Closing != 14 || reports[0].Purchases != 0 {
+		t.Errorf("Stock report of a later period is not correct: %+v", reports)
+	}
+
+	// Archived products are kept but not sold; deleted ones keep their history.
+	if status := request("POST", "/productsdb/1/archive", ""); status != fiber.StatusOK {
+		t.Fatalf("Product was not archived: %d", status)
+	}
+	if _, _, _, err := placeOrder(ctx, s.repos, contact.ID, "", arguments); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Archived product was matched: %v", err)
+	}
+	request("DELETE", "/productsdb/1", "")
+	req := httptest.NewRequest("GET", "/stock/movements?product_id=1&from="+today+"&to="+tomorrow, nil)
+	resp, _ := app.Test(req)
+	var movements []StockMovement
+	json.NewDecoder(resp.Body).Decode(&movements)
+	if len(movements) != 8 || movements[len(movements)-1].Note != "initial stock" || movements[0].Kind != StockSale || movements[0].Balance != 14 {
+		t.Errorf("Movements are not correct: %+v", movements)
+	}
+}
+
+func mustParseDate(t *testing.T, s *LLMService, date string) time.Time {
+	parsed, err := time.ParseInLocation("2006-01-02", date, s.config.Location())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestMoveStockWithStaleProducts(t *testing.T) {
+	ctx := context.Background()
+	s, _, _, _ := newTestService(t, time.Now())
+	if err := s.db.AutoMigrate(&Products{}); err != nil {
+		t.Fatal(err)
+	}
+	s.repos = newGormRepositories(s.db, nil)
+	s.repos.Products.Create(ctx, &Products{Product: "pod", Flavor: "uva", Quantity: 10})
+
+	// Two requests loaded the product before either moved its stock.
+	first, _ := s.repos.Products.Get(ctx, 1)
+	second, _ := s.repos.Products.Get(ctx, 1)
+	first.Product = "renamed meanwhile"
+	if err := s.moveStock(ctx, first, &StockMovement{Kind: StockSale, Quantity: -3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.moveStock(ctx, second, &StockMovement{Kind: StockSale, Quantity: -3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.moveStock(ctx, second, &StockMovement{Kind: StockSale, Quantity: -5}); !errors.Is(err, ErrInsufficientStock) {
+		t.Errorf("Movement past the stock was accepted: %v", err)
+	}
+
+	product, _ := s.repos.Products.Get(ctx, 1)
+	if product.Quantity != 4 || second.Quantity != 4 || product.Product != "pod" {
+		t.Errorf("Product is not correct: %+v", product)
+	}
+	var balances []int
+	s.db.Model(&StockMovement{}).Order("id").Pluck("balance", &balances)
+	if len(balances) != 3 || balances[0] != 10 || balances[1] != 7 || balances[2] != 4 {
+		t.Errorf("Ledger balances are not correct: %v", balances)
+	}
+}
+
+func TestCompleteOrderIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	s, _, _, _ := newTestService(t, time.Now())
+	s.repos = newGormRepositories(s.db, nil)
+	s.repos.Products.Create(ctx, &Products{Product: "pod", Flavor: "uva", Quantity: 10})
+	contact := &Contact{Name: "Ana"}
+	s.repos.Contacts.Create(ctx, contact)
+	order, _, _, err := s.placeReservedOrder(ctx, contact.ID, "", Arguments{Products: []ExtractedProduct{{Item: "pod", Flavor: "uva", Quantity: 3}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sale fails after the reservation was given back.
+	failSale := func(db *gorm.DB) {
+		if movement, ok := db.Statement.Dest.(*StockMovement); ok && movement.Kind == StockSale {
+			db.AddError(errors.New("disk full"))
+		}
+	}
+	if err := s.db.Callback().Create().Before("gorm:create").Register("test:fail_sale", failSale); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.completeOrder(ctx, order); err == nil {
+		t.Fatal("The failed sale was not reported")
+	}
+	stored, _ := s.repos.Orders.Get(ctx, order.ID)
+	product, _ := s.repos.Products.Get(ctx, 1)
+	if stored.Status != OrderStatusPending || order.Status != OrderStatusPending || product.Quantity != 7 {
+		t.Errorf("A failed completion changed the order or the stock: %s, %d", stored.Status, product.Quantity)
+	}
+
+	s.db.Callback().Create().Remove("test:fail_sale")
+	if err := s.completeOrder(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ = s.repos.Orders.Get(ctx, order.ID)
+	product, _ = s.repos.Products.Get(ctx, 1)
+	var total int
+	s.db.Model(&StockMovement{}).Select("SUM(quantity)").Where("product_id = ?", 1).Scan(&total)
+	if stored.Status != OrderStatusCompleted || product.Quantity != 7 || total != 7 {
+		t.Errorf("The retried completion is not correct: %s, %d, %d", stored.Status, product.Quantity, total)
+	}
+}
+
+func TestPlaceReservedOrderChecksLockedStock(t *testing.T) {
+	ctx := context.Background()
+	s, _, _, _ := newTestService(t, time.Now())
+	s.repos = newGormRepositories(s.db, nil)
+	s.repos.Products.Create(ctx, &Products{Product: "pod", Flavor: "uva", Quantity: 5})
+	contact := &Contact{Name: "Ana"}
+	s.repos.Contacts.Create(ctx, contact)
+
+	// Another order reserved units after this one read the product.
+	s.db.Create(&StockMovement{ProductID: 1, Kind: StockAdjustment, Quantity: 5, Balance: 5})
+	s.db.Create(&StockMovement{ProductID: 1, Kind: StockReservation, Quantity: -4, Balance: 1, OrderID: 99})
+
+	order, product, placed, err := s.placeReservedOrder(ctx, contact.ID, "", Arguments{Products: []ExtractedProduct{{Item: "pod", Flavor: "uva", Quantity: 2}}})
+	if !errors.Is(err, ErrOutOfStock) || placed || order != nil || product == nil || product.ID != 1 {
+		t.Fatalf("An order above the locked stock was accepted: %+v, %v", order, err)
+	}
+	if orders, _ := s.repos.Orders.List(ctx); len(orders) != 0 {
+		t.Errorf("The refused order was stored: %+v", orders)
+	}
+	var total int
+	s.db.Model(&StockMovement{}).Select("SUM(quantity)").Where("product_id = ?", 1).Scan(&total)
+	if total != 1 {
+		t.Errorf("The refused order reserved stock: %d", total)
+	}
+
+	if _, _, placed, err := s.placeReservedOrder(ctx, contact.ID, "", Arguments{Products: []ExtractedProduct{{Item: "pod", Flavor: "uva", Quantity: 1}}}); err != nil || !placed {
+		t.Errorf("An order within the stock was refused: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Package telemetry carries correlation IDs through a request and provides
+// structured logging and tracing that include them.
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey int
+
+const correlationKey contextKey = iota
+
+// WithCorrelationID returns a context carrying the correlation ID. Every log
+// record and span created from it is tagged with the ID.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey, id)
+}
+
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey).(string)
+	return id
+}
+
+// NewID returns a random hex ID of n bytes.
+func NewID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// ContentKeys are the log attributes holding message content. They are
+// omitted unless LogOptions.Content is set.
+var ContentKeys = map[string]bool{
+	"content":   true,
+	"reply":     true,
+	"arguments": true,
+}
+
+type LogOptions struct {
+	Level slog.Level
+	// JSON selects the JSON handler; the text handler is used otherwise.
+	JSON bool
+	// Content keeps message content in the logs.
+	Content bool
+}
+
+func NewLogger(w io.Writer, options LogOptions) *slog.Logger {
+	handlerOptions := &slog.HandlerOptions{
+		Level: options.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if !options.Content && ContentKeys[a.Key] {
+				return slog.String(a.Key, fmt.Sprintf("[omitted, %d chars]", len(a.Value.String())))
+			}
+			return a
+		},
+	}
+
+	var handler slog.Handler
+	if options.JSON {
+		handler = slog.NewJSONHandler(w, handlerOptions)
+	} else {
+		handler = slog.NewTextHandler(w, handlerOptions)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// contextHandler adds the correlation ID and the current span to records
+// logged with a context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := CorrelationID(ctx); id != "" {
+		record.AddAttrs(slog.String("correlation_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
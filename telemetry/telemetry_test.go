@@ -0,0 +1,126 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLoggerCorrelationAndContent(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LogOptions{Level: slog.LevelInfo, JSON: true})
+	ctx := WithCorrelationID(context.Background(), "req-1")
+
+	logger.InfoContext(ctx, "message classified", "content", "Quero 2 pods de menta", "intent", "order")
+	logger.DebugContext(ctx, "hidden")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Log is not a single JSON record: %s", buf.String())
+	}
+	if record["correlation_id"] != "req-1" || record["intent"] != "order" {
+		t.Errorf("Record is not correct: %v", record)
+	}
+	if record["content"] != "[omitted, 21 chars]" {
+		t.Errorf("Content should be omitted: %v", record["content"])
+	}
+
+	buf.Reset()
+	NewLogger(&buf, LogOptions{Level: slog.LevelInfo, Content: true}).InfoContext(ctx, "reply", "reply", "Olá!")
+	if !strings.Contains(buf.String(), "reply=Olá!") || !strings.Contains(buf.String(), "correlation_id=req-1") {
+		t.Errorf("Content should be logged when enabled: %s", buf.String())
+	}
+}
+
+func TestSetupTracingExportsOTLP(t *testing.T) {
+	requests := make(chan *coltracepb.ExportTraceServiceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("Unexpected export request: %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		request := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			t.Errorf("Export request is not OTLP: %v", err)
+		}
+		requests <- request
+	}))
+	defer collector.Close()
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	shutdown, err := SetupTracing(context.Background(), collector.URL+"/", "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Start(context.Background(), "POST /messages", KindServer)
+	End(span, nil)
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	request := <-requests
+	resource := request.ResourceSpans[0]
+	if service := resource.Resource.Attributes[0]; service.Key != "service.name" || service.Value.GetStringValue() != "bot" {
+		t.Errorf("Resource is not correct: %v", resource.Resource)
+	}
+	if spans := resource.ScopeSpans[0].Spans; len(spans) != 1 || spans[0].Name != "POST /messages" {
+		t.Errorf("The span was not exported: %v", spans)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	ctx, root := Start(WithCorrelationID(context.Background(), "req-2"), "POST /messages", KindServer)
+	started := time.Now().Add(-time.Second)
+	Record(ctx, "llm.extract", KindClient, started, errors.New("timeout"), attribute.Int("llm.prompt_tokens", 12))
+	End(root, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Both spans should be recorded: %v", spans)
+	}
+	child, parent := spans[0], spans[1]
+	if child.Parent().SpanID() != parent.SpanContext().SpanID() || child.SpanContext().TraceID() != parent.SpanContext().TraceID() {
+		t.Errorf("Child span is not linked to its parent: %v %v", child.Parent(), parent.SpanContext())
+	}
+	if child.Status().Code != codes.Error || child.SpanKind() != KindClient || !child.StartTime().Equal(started) {
+		t.Errorf("Failed span is not correct: %v %v %v", child.Status(), child.SpanKind(), child.StartTime())
+	}
+	attributes := attribute.NewSet(child.Attributes()...)
+	if tokens, _ := attributes.Value("llm.prompt_tokens"); tokens.AsInt64() != 12 {
+		t.Errorf("Attributes are not correct: %v", child.Attributes())
+	}
+	if id, _ := attributes.Value("correlation_id"); id.AsString() != "req-2" {
+		t.Errorf("Span should carry the correlation ID: %v", child.Attributes())
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	ctx, span := Start(context.Background(), "noop", KindInternal)
+	if span.IsRecording() || trace.SpanContextFromContext(ctx).IsValid() {
+		t.Errorf("No span should be recorded without a tracer provider")
+	}
+	span.SetAttributes(attribute.String("key", "value"))
+	End(span, nil)
+}
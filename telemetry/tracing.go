@@ -0,0 +1,78 @@
+package telemetry
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span kinds of the spans recorded by the service.
+const (
+	KindInternal = trace.SpanKindInternal
+	KindServer   = trace.SpanKindServer
+	KindClient   = trace.SpanKindClient
+)
+
+const instrumentationName = "github.com/arthurborgesdev/relationship-bot"
+
+// SetupTracing installs the W3C trace context propagator and, when an
+// endpoint is set, a tracer provider batching spans to that OpenTelemetry
+// collector over OTLP/HTTP. Without an endpoint spans are not recorded. The
+// returned function flushes the pending spans.
+func SetupTracing(ctx context.Context, endpoint, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span, child of the span in ctx if any, tagged with the
+// correlation ID of ctx.
+func Start(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return startSpan(ctx, name, kind, attrs)
+}
+
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, attrs []attribute.KeyValue, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if id := CorrelationID(ctx); id != "" {
+		attrs = append(attrs, attribute.String("correlation_id", id))
+	}
+	options = append(options, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+	return otel.Tracer(instrumentationName).Start(ctx, name, options...)
+}
+
+// End ends the span, marking it failed when err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Record adds a finished span for an operation that started at start.
+func Record(ctx context.Context, name string, kind trace.SpanKind, start time.Time, err error, attrs ...attribute.KeyValue) {
+	_, span := startSpan(ctx, name, kind, attrs, trace.WithTimestamp(start))
+	End(span, err)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// cl100k returns the BPE tokenizer of the chat models (gpt-3.5-turbo,
+// gpt-4). Its ranks are embedded in the binary, so nothing is downloaded; they
+// are loaded on first use.
+var cl100k = sync.OnceValue(func() *tiktoken.Tiktoken {
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+	encoding, err := tiktoken.GetEncoding(tiktoken.MODEL_CL100K_BASE)
+	if err != nil {
+		panic("loading the cl100k_base tokenizer: " + err.Error())
+	}
+	return encoding
+})
+
+// countTokens returns the number of cl100k_base tokens of the text. Special
+// tokens like <|endoftext|> in the text are counted as plain text, as the API
+// does for message content.
+func countTokens(text string) int {
+	return len(cl100k().EncodeOrdinary(text))
+}
+
+// Every chat message is wrapped in a few tokens (role and separators) and
+// the reply is primed with a few more.
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+// countMessageTokens returns the prompt tokens of the messages, counting the
+// wrapping tokens the way OpenAI documents for the chat models.
+func countMessageTokens(messages []openai.ChatCompletionMessage) int {
+	tokens := tokensPerReply
+	for _, message := range messages {
+		tokens += tokensPerMessage + countTokens(message.Role) + countTokens(message.Content)
+	}
+	return tokens
+}
+
+// tokenBudget hands out a fixed number of tokens to the parts of a prompt.
+type tokenBudget struct {
+	remaining int
+}
+
+// take reserves the tokens of the message and reports whether they fit.
+func (b *tokenBudget) take(message openai.ChatCompletionMessage) bool {
+	tokens := tokensPerMessage + countTokens(message.Role) + countTokens(message.Content)
+	if tokens > b.remaining {
+		return false
+	}
+	b.remaining -= tokens
+	return true
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/metrics"
+	"github.com/arthurborgesdev/relationship-bot/telemetry"
+	"github.com/gofiber/fiber/v2"
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+// LLMUsage records the tokens and cost of one LLM or embedding call.
+type LLMUsage struct {
+	gorm.Model
+	Tenant           string  `json:"tenant" gorm:"index"`
+	ContactID        uint    `json:"contact_id" gorm:"index"`
+	Operation        string  `json:"operation"`
+	LLMModel         string  `json:"model" gorm:"column:model"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+	CorrelationID    string  `json:"correlation_id"`
+}
+
+// usageScope is who LLM calls made with the context are billed to, and the
+// model to use instead of the configured one (when the budget is exhausted).
+type usageScope struct {
+	Tenant    string
+	ContactID uint
+	Model     string
+}
+
+type usageScopeKey struct{}
+
+func withUsageScope(ctx context.Context, scope usageScope) context.Context {
+	return context.WithValue(ctx, usageScopeKey{}, scope)
+}
+
+func usageScopeFrom(ctx context.Context) usageScope {
+	scope, _ := ctx.Value(usageScopeKey{}).(usageScope)
+	if scope.Tenant == "" {
+		scope.Tenant = defaultTenant
+	}
+	return scope
+}
+
+// chatModel returns the model for chat completions made with the context.
+func chatModel(ctx context.Context, configured string) string {
+	if model := usageScopeFrom(ctx).Model; model != "" {
+		return model
+	}
+	return configured
+}
+
+// usageLedger stores the usage of every LLM call. A nil ledger records
+// nothing.
+type usageLedger struct {
+	db     *gorm.DB
+	prices map[string]ModelPrice
+}
+
+// price returns the price of the model, matching the longest configured
+// model name it starts with.
+func (l *usageLedger) price(model string) (ModelPrice, bool) {
+	if price, ok := l.prices[model]; ok {
+		return price, true
+	}
+
+	var names []string
+	for name := range l.prices {
+		if strings.HasPrefix(model, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ModelPrice{}, false
+	}
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	return l.prices[names[0]], true
+}
+
+func (l *usageLedger) record(ctx context.Context, operation, model string, promptTokens, completionTokens int) {
+	if l == nil || promptTokens+completionTokens == 0 {
+		return
+	}
+
+	price, ok := l.price(model)
+	if !ok {
+		slog.WarnContext(ctx, "no price for model, usage recorded without cost", "model", model)
+	}
+
+	scope := usageScopeFrom(ctx)
+	usage := LLMUsage{
+		Tenant:           scope.Tenant,
+		ContactID:        scope.ContactID,
+		Operation:        operation,
+		LLMModel:         model,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		Cost:             float64(promptTokens)/1000*price.Prompt + float64(completionTokens)/1000*price.Completion,
+		CorrelationID:    telemetry.CorrelationID(ctx),
+	}
+	if err := l.db.WithContext(ctx).Create(&usage).Error; err != nil {
+		slog.ErrorContext(ctx, "record llm usage failed", "operation", operation, "error", err)
+	}
+}
+
+// observeChatCompletion records the latency and tokens of a chat completion
+// in the metrics, as a span, in the debug log and in the usage ledger.
+func (l *usageLedger) observeChatCompletion(ctx context.Context, operation, model string, start time.Time, resp openai.ChatCompletionResponse, err error) {
+	metrics.ObserveLLMCall(operation, model, start, resp.Usage.PromptTokens, resp.Usage.CompletionTokens, err)
+	telemetry.Record(ctx, "llm."+operation, telemetry.KindClient, start, err,
+		attribute.String("llm.model", model),
+		attribute.Int("llm.prompt_tokens", resp.Usage.PromptTokens),
+		attribute.Int("llm.completion_tokens", resp.Usage.CompletionTokens),
+	)
+	slog.DebugContext(ctx, "llm call", "operation", operation, "model", model, "duration", time.Since(start),
+		"prompt_tokens", resp.Usage.PromptTokens, "completion_tokens", resp.Usage.CompletionTokens)
+	l.record(ctx, operation, model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+}
+
+// BudgetStatus is the spend of a tenant in the current month.
+type BudgetStatus struct {
+	Tenant    string  `json:"tenant"`
+	Month     string  `json:"month"`
+	Budget    float64 `json:"budget"`
+	Spent     float64 `json:"spent"`
+	Remaining float64 `json:"remaining"`
+	Exhausted bool    `json:"exhausted"`
+	Mode      string  `json:"mode,omitempty"`
+}
+
+// budgetTenant returns the tenant whose budget applies: tenants without
+// their own settings share the default tenant's budget.
+func (s *LLMService) budgetTenant(tenant string) (string, []string) {
+	var others []string
+	for id := range s.config.Tenants {
+		if id != defaultTenant {
+			others = append(others, id)
+		}
+	}
+	if _, ok := s.config.Tenants[tenant]; !ok {
+		tenant = defaultTenant
+	}
+	return tenant, others
+}
+
+func (s *LLMService) budgetStatus(ctx context.Context, tenant string) (BudgetStatus, error) {
+	tenant, others := s.budgetTenant(tenant)
+	budget := s.config.Tenant(tenant).Budget
+
+	now := s.scheduler.now().In(s.config.Location())
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	status := BudgetStatus{Tenant: tenant, Month: monthStart.Format("2006-01"), Budget: budget.Monthly}
+
+	scope, args := tenantScope("tenant", tenant, others)
+	err := s.db.WithContext(ctx).Model(&LLMUsage{}).
+		Where(scope, args...).
+		Where("created_at >= ?", monthStart).
+		Select("COALESCE(SUM(cost), 0)").
+		Scan(&status.Spent).Error
+	if err != nil {
+		return status, err
+	}
+
+	if budget.Monthly > 0 {
+		status.Remaining = budget.Monthly - status.Spent
+		if status.Remaining <= 0 {
+			status.Remaining = 0
+			status.Exhausted = true
+			status.Mode = budget.Mode
+		}
+	}
+	return status, nil
+}
+
+// UsageSummary aggregates the usage of one group (tenant, contact, model,
+// operation or day).
+type UsageSummary struct {
+	Key              string  `json:"key" gorm:"column:group_key"`
+	Calls            int64   `json:"calls"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+var usageGroups = map[string]string{
+	"tenant":    "tenant",
+	"contact":   "contact_id",
+	"model":     "model",
+	"operation": "operation",
+	"day":       "DATE(created_at)",
+}
+
+// getUsage aggregates the usage between from and to (YYYY-MM-DD, to is
+// exclusive), by default for the current month, grouped by ?group_by=.
+func (s *LLMService) getUsage(c *fiber.Ctx) error {
+	group, ok := usageGroups[c.Query("group_by", "tenant")]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "group_by must be tenant, contact, model, operation or day",
+		})
+	}
+
+	from, to, err := queryPeriod(c, s.config.Location())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	query := s.db.WithContext(c.UserContext()).Model(&LLMUsage{}).
+		Select(group+" AS group_key, COUNT(*) AS calls, SUM(prompt_tokens) AS prompt_tokens, SUM(completion_tokens) AS completion_tokens, SUM(cost) AS cost").
+		Where("created_at >= ? AND created_at < ?", from, to).
+		Group(group).
+		Order("cost desc")
+	if tenant := c.Query("tenant"); tenant != "" {
+		query = query.Where("tenant = ?", tenant)
+	}
+	if contactID := c.QueryInt("contact_id"); contactID > 0 {
+		query = query.Where("contact_id = ?", contactID)
+	}
+
+	var summaries []UsageSummary
+	if err := query.Scan(&summaries).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(summaries)
+}
+
+// getBudgets returns the budget status of every configured tenant.
+func (s *LLMService) getBudgets(c *fiber.Ctx) error {
+	var tenants []string
+	for id := range s.config.Tenants {
+		tenants = append(tenants, id)
+	}
+	sort.Strings(tenants)
+
+	statuses := make([]BudgetStatus, 0, len(tenants))
+	for _, tenant := range tenants {
+		status, err := s.budgetStatus(c.UserContext(), tenant)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		statuses = append(statuses, status)
+	}
+
+	return c.JSON(statuses)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestUsageLedger(t *testing.T) {
+	s, _, _, _ := newTestService(t, time.Now())
+	ctx := withUsageScope(context.Background(), usageScope{Tenant: "acme", ContactID: 7})
+
+	s.usage.record(ctx, "chat", "gpt-4-0613", 1000, 500)
+	s.usage.record(ctx, "embedding", "text-embedding-ada-002", 2000, 0)
+	s.usage.record(ctx, "chat", "unknown-model", 10, 10)
+	s.usage.record(ctx, "chat", "gpt-4", 0, 0)
+
+	var usages []LLMUsage
+	if err := s.db.Order("id").Find(&usages).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 3 {
+		t.Fatalf("Calls without tokens should not be recorded: %+v", usages)
+	}
+
+	gpt4 := s.usage.prices["gpt-4"]
+	if expected := gpt4.Prompt + gpt4.Completion/2; math.Abs(usages[0].Cost-expected) > 1e-9 {
+		t.Errorf("Cost should use the longest matching price: %v, expected %v", usages[0].Cost, expected)
+	}
+	if usages[0].Tenant != "acme" || usages[0].ContactID != 7 {
+		t.Errorf("Usage is not billed to the scope: %+v", usages[0])
+	}
+	if usages[1].Cost <= 0 || usages[2].Cost != 0 {
+		t.Errorf("Costs are not correct: %v, %v", usages[1].Cost, usages[2].Cost)
+	}
+}
+
+func TestBudgetModes(t *testing.T) {
+	now := time.Date(2023, 8, 15, 12, 0, 0, 0, time.UTC)
+	s, _, _, _ := newTestService(t, now)
+	s.config.Shop.FAQ = "Abrimos de segunda a sexta, das 9h às 18h."
+	tenant := s.config.Tenants[defaultTenant]
+	tenant.Budget = BudgetConfig{Monthly: 1, Mode: BudgetModeFAQOnly}
+	s.config.Tenants[defaultTenant] = tenant
+
+	ctx := context.Background()
+	last := LLMUsage{Tenant: defaultTenant, Operation: "chat", LLMModel: "gpt-4", Cost: 5}
+	last.CreatedAt = now.AddDate(0, -1, 0)
+	s.db.Create(&last)
+
+	status, err := s.budgetStatus(ctx, "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Tenant != defaultTenant || status.Spent != 0 || status.Exhausted {
+		t.Errorf("Last month's spend should not count: %+v", status)
+	}
+
+	s.usage.record(withUsageScope(ctx, usageScope{Tenant: "unknown"}), "chat", "gpt-4", 20000, 10000)
+	status, _ = s.budgetStatus(ctx, defaultTenant)
+	if !status.Exhausted || status.Remaining != 0 || status.Mode != BudgetModeFAQOnly {
+		t.Errorf("Budget should be exhausted: %+v", status)
+	}
+
+	// In FAQ only mode the LLM (nil in tests) is never called.
+	app := fiber.New()
+	s.RegisterRoutes(app)
+	post := func(content string) string {
+		body := `{"content": "` + content + `", "channel": "whatsapp", "sender": "+5511988887777"}`
+		req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return string(data)
+	}
+
+	if reply := post("Qual o horário de funcionamento?"); !strings.Contains(reply, "segunda a sexta") {
+		t.Errorf("FAQ should be answered with the static FAQ: %s", reply)
+	}
+	if reply := post("Quero 2 pods de menta para amanhã"); !strings.Contains(reply, "atendente") {
+		t.Errorf("Orders should be handed over: %s", reply)
+	}
+
+	tenant.Budget = BudgetConfig{Monthly: 1, Mode: BudgetModeCheaperModel, CheaperModel: "gpt-3.5-turbo"}
+	s.config.Tenants[defaultTenant] = tenant
+	status, _ = s.budgetStatus(ctx, defaultTenant)
+	scope := usageScope{Model: s.config.Tenant(status.Tenant).Budget.CheaperModel}
+	if model := chatModel(withUsageScope(ctx, scope), "gpt-4"); model != "gpt-3.5-turbo" {
+		t.Errorf("Cheaper model is not used: %s", model)
+	}
+	if model := chatModel(ctx, "gpt-4"); model != "gpt-4" {
+		t.Errorf("Configured model is not used: %s", model)
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	s, _, _, _ := newTestService(t, time.Now())
+	for _, scope := range []usageScope{{Tenant: "acme", ContactID: 1}, {Tenant: "acme", ContactID: 2}, {Tenant: "other", ContactID: 3}} {
+		s.usage.record(withUsageScope(context.Background(), scope), "chat", "gpt-4", 1000, 0)
+	}
+
+	app := fiber.New()
+	app.Get("/usage", s.getUsage)
+
+	get := func(query string) (int, []UsageSummary) {
+		resp, err := app.Test(httptest.NewRequest("GET", "/usage"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var summaries []UsageSummary
+		json.NewDecoder(resp.Body).Decode(&summaries)
+		return resp.StatusCode, summaries
+	}
+
+	_, summaries := get("?group_by=tenant")
+	if len(summaries) != 2 || summaries[0].Key != "acme" || summaries[0].Calls != 2 || summaries[0].PromptTokens != 2000 {
+		t.Errorf("Usage by tenant is not correct: %+v", summaries)
+	}
+
+	_, summaries = get("?group_by=contact&tenant=acme")
+	if len(summaries) != 2 {
+		t.Errorf("Usage by contact is not correct: %+v", summaries)
+	}
+
+	if status, _ := get("?group_by=user"); status != fiber.StatusBadRequest {
+		t.Errorf("Unknown groups should be rejected: %d", status)
+	}
+}
+
+func TestWebhookTenant(t *testing.T) {
+	s, _, _, _ := newTestService(t, time.Now())
+	clinic := s.config.Tenant(defaultTenant)
+	clinic.WebhookToken = "clinic-token"
+	s.config.Tenants["clinic"] = clinic
+
+	app := fiber.New()
+	s.RegisterRoutes(app)
+	app.Post("/tenant", func(c *fiber.Ctx) error {
+		tenant, ok := s.webhookTenant(c)
+		if !ok {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		return c.SendString(tenant)
+	})
+	post := func(path string, header map[string]string) (int, string) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"content": "oi", "sender": "+5511988887777"}`))
+		req.Header.Set("Content-Type", "application/json")
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	// The tenant header of an unauthenticated webhook is ignored.
+	if status, tenant := post("/tenant", map[string]string{"X-Tenant-ID": "clinic"}); status != fiber.StatusOK || tenant != defaultTenant {
+		t.Errorf("The tenant was taken from the header: %d %s", status, tenant)
+	}
+	if status, tenant := post("/tenant", map[string]string{"X-Webhook-Token": "clinic-token"}); status != fiber.StatusOK || tenant != "clinic" {
+		t.Errorf("The tenant was not taken from the token: %d %s", status, tenant)
+	}
+	if status, _ := post("/messages", map[string]string{"X-Webhook-Token": "guessed"}); status != fiber.StatusUnauthorized {
+		t.Errorf("An unknown token was accepted: %d", status)
+	}
+
+	// Once the default tenant has a token, webhooks must carry one.
+	defaults := s.config.Tenants[defaultTenant]
+	defaults.WebhookToken = "shop-token"
+	s.config.Tenants[defaultTenant] = defaults
+	if status, _ := post("/messages", nil); status != fiber.StatusUnauthorized {
+		t.Errorf("A webhook without a token was accepted: %d", status)
+	}
+}
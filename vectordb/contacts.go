@@ -0,0 +1,112 @@
+package vectordb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/telemetry"
+	"github.com/gofiber/fiber/v2"
+	"github.com/milvus-io/milvus-sdk-go/v2/entity"
+)
+
+// Dynamic fields holding the contact and the tenant a vector belongs to and
+// when it was inserted (unix seconds).
+const (
+	contactField   = "contact_id"
+	tenantField    = "tenant"
+	createdAtField = "created_at"
+)
+
+const DefaultTenant = "default"
+
+type Record struct {
+	ID      int64  `json:"id"`
+	Message string `json:"message"`
+	Sender  string `json:"sender"`
+}
+
+// ContactVectors returns every vector stored for the contact, without the
+// embedding itself (it is derived from the message).
+func (s *MilvusService) ContactVectors(ctx context.Context, contactID uint) (records []Record, err error) {
+	ctx, span := telemetry.Start(ctx, "milvus.contact_vectors", telemetry.KindClient)
+	defer func() { telemetry.End(span, err) }()
+
+	if err := s.milvusClient.LoadCollection(ctx, "messages", false); err != nil {
+		return nil, err
+	}
+
+	result, err := s.milvusClient.Query(
+		ctx,
+		"messages",
+		[]string{},
+		fmt.Sprintf("%s == %d", contactField, contactID),
+		[]string{"message_id", "message", "sender"},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, ok := result.GetColumn("message_id").(*entity.ColumnInt64)
+	if !ok {
+		return nil, nil
+	}
+	messages, _ := result.GetColumn("message").(*entity.ColumnVarChar)
+	senders, _ := result.GetColumn("sender").(*entity.ColumnVarChar)
+
+	records = make([]Record, 0, ids.Len())
+	for i, id := range ids.Data() {
+		record := Record{ID: id}
+		if messages != nil {
+			record.Message = messages.Data()[i]
+		}
+		if senders != nil {
+			record.Sender = senders.Data()[i]
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// DeleteContactVectors deletes every vector stored for the contact and
+// returns how many were deleted.
+func (s *MilvusService) DeleteContactVectors(ctx context.Context, contactID uint) (deleted int, err error) {
+	ctx, span := telemetry.Start(ctx, "milvus.delete_contact_vectors", telemetry.KindClient)
+	defer func() { telemetry.End(span, err) }()
+
+	records, err := s.ContactVectors(ctx, contactID)
+	if err != nil || len(records) == 0 {
+		return 0, err
+	}
+
+	ids := make([]int64, len(records))
+	for i, record := range records {
+		ids[i] = record.ID
+	}
+
+	if err := s.milvusClient.DeleteByPks(ctx, "messages", "", entity.NewColumnInt64("message_id", ids)); err != nil {
+		return 0, err
+	}
+
+	return len(ids), nil
+}
+
+// tenantOf returns the tenant of the request (X-Tenant-ID header).
+func tenantOf(c *fiber.Ctx) string {
+	if tenant := c.Get("X-Tenant-ID"); tenant != "" {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// metadataColumns are the dynamic fields stored with every vector: the
+// contact, the tenant (X-Tenant-ID header) and the insertion time, used for
+// data subject requests and retention.
+func metadataColumns(c *fiber.Ctx, contactID int64) []entity.Column {
+	return []entity.Column{
+		entity.NewColumnInt64(contactField, []int64{contactID}),
+		entity.NewColumnVarChar(tenantField, []string{tenantOf(c)}),
+		entity.NewColumnInt64(createdAtField, []int64{time.Now().Unix()}),
+	}
+}
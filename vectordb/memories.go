@@ -0,0 +1,77 @@
+package vectordb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/telemetry"
+	"github.com/milvus-io/milvus-sdk-go/v2/client"
+	"github.com/milvus-io/milvus-sdk-go/v2/entity"
+)
+
+// Memories returns up to limit messages of the contact most similar to the
+// text, the closest first. The text is embedded as is: redact it first.
+func (s *MilvusService) Memories(ctx context.Context, tenant string, contactID uint, text string, limit int) (records []Record, err error) {
+	ctx, span := telemetry.Start(ctx, "milvus.memories", telemetry.KindClient)
+	defer func() { telemetry.End(span, err) }()
+
+	vector, err := s.embedText(ctx, tenant, text, int64(contactID))
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	err = s.milvusClient.LoadCollection(ctx, "messages", false)
+	observe(ctx, "load_collection", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	sp, _ := entity.NewIndexIvfFlatSearchParam(10)
+	opt := client.SearchQueryOptionFunc(func(option *client.SearchQueryOption) {
+		option.ConsistencyLevel = entity.ClBounded
+	})
+
+	start = time.Now()
+	results, err := s.milvusClient.Search(
+		ctx,
+		"messages",
+		[]string{},
+		fmt.Sprintf("%s == %d && %s == %s", contactField, contactID, tenantField, strconv.Quote(tenant)),
+		[]string{"message", "sender"},
+		[]entity.Vector{entity.FloatVector(vector)},
+		"message_vector",
+		entity.L2,
+		limit,
+		sp,
+		opt,
+	)
+	observeSearch(start, err)
+	observe(ctx, "search", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		ids, _ := result.IDs.(*entity.ColumnInt64)
+		messages, _ := result.Fields.GetColumn("message").(*entity.ColumnVarChar)
+		senders, _ := result.Fields.GetColumn("sender").(*entity.ColumnVarChar)
+		if messages == nil {
+			continue
+		}
+		for i, message := range messages.Data() {
+			record := Record{Message: message}
+			if ids != nil && i < ids.Len() {
+				record.ID = ids.Data()[i]
+			}
+			if senders != nil && i < senders.Len() {
+				record.Sender = senders.Data()[i]
+			}
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
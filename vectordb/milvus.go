@@ -2,26 +2,62 @@ package vectordb
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/arthurborgesdev/relationship-bot/metrics"
+	"github.com/arthurborgesdev/relationship-bot/pii"
+	"github.com/arthurborgesdev/relationship-bot/telemetry"
 	"github.com/gofiber/fiber/v2"
-	"github.com/joho/godotenv"
 	"github.com/milvus-io/milvus-sdk-go/v2/client"
 	"github.com/milvus-io/milvus-sdk-go/v2/entity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Message struct {
 	MessageText string `json:"message"`
+	// ContactID links the vectors to a contact so they can be exported and
+	// erased on request (LGPD). Zero for anonymous messages.
+	ContactID int64 `json:"contact_id"`
+}
+
+type Config struct {
+	Address string
+	Model   string
+	// Timeout is the deadline of each LLM and embedding call.
+	Timeout time.Duration
+	// Redaction returns the policy of a tenant, applied to its messages
+	// before they are embedded, stored or sent to the LLM.
+	Redaction func(tenant string) pii.Policy
+	// OnUsage, when set, is called with the tokens used by every LLM and
+	// embedding call, for cost accounting.
+	OnUsage func(ctx context.Context, usage Usage)
+}
+
+// Usage is the tokens used by one LLM or embedding call.
+type Usage struct {
+	Tenant           string
+	ContactID        int64
+	Operation        string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
 }
 
 type MilvusService struct {
 	llmClient    *openai.Client
 	milvusClient client.Client
+	model        string
+	redaction    func(tenant string) pii.Policy
+	onUsage      func(ctx context.Context, usage Usage)
+	timeout      time.Duration
 }
 
 var schema = &entity.Schema{
@@ -63,23 +99,90 @@ var schema = &entity.Schema{
 	EnableDynamicField: true,
 }
 
-func embed(message string, llmClient *openai.Client) ([]float32, error) {
+var searchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "vector_search_duration_seconds",
+	Help:    "Latency of Milvus vector searches.",
+	Buckets: metrics.DefaultBuckets,
+}, []string{"status"})
+
+func observeSearch(start time.Time, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	searchDuration.WithLabelValues(status).Observe(time.Since(start).Seconds())
+}
+
+// observe records a Milvus operation as a span and logs it when it fails.
+func observe(ctx context.Context, operation string, start time.Time, err error) {
+	telemetry.Record(ctx, "milvus."+operation, telemetry.KindClient, start, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "milvus operation failed", "operation", operation, "error", err)
+	}
+}
+
+// redact applies the redaction policy of the tenant of the request.
+func (s *MilvusService) redact(c *fiber.Ctx, vault *pii.Vault, text string) string {
+	return vault.Redact(s.redaction(tenantOf(c)), text)
+}
+
+func (s *MilvusService) embed(c *fiber.Ctx, message string, contactID int64) ([]float32, error) {
+	return s.embedText(c.UserContext(), tenantOf(c), message, contactID)
+}
+
+func (s *MilvusService) embedText(ctx context.Context, tenant, message string, contactID int64) ([]float32, error) {
 	embeddingReq := openai.EmbeddingRequest{
 		Input: message,
 		Model: openai.AdaEmbeddingV2,
 	}
 
-	resp, err := llmClient.CreateEmbeddings(context.Background(), embeddingReq)
+	callCtx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	resp, err := s.llmClient.CreateEmbeddings(callCtx, embeddingReq)
+	observeEmbedding(ctx, embeddingReq, start, resp, err)
+	s.recordUsage(ctx, Usage{
+		Tenant:       tenant,
+		ContactID:    contactID,
+		Operation:    "embedding",
+		Model:        embeddingReq.Model.String(),
+		PromptTokens: resp.Usage.PromptTokens,
+	})
 	if err != nil {
-		fmt.Printf("Embedding error: %v\n", err)
 		return nil, err
 	}
-
-	fmt.Println(resp.Data[0].Embedding)
+	if len(resp.Data) == 0 {
+		return nil, errors.New("embedding returned no data")
+	}
 
 	return resp.Data[0].Embedding, nil
 }
 
+func observeEmbedding(ctx context.Context, req openai.EmbeddingRequest, start time.Time, resp openai.EmbeddingResponse, err error) {
+	metrics.ObserveLLMCall("embedding", req.Model.String(), start, resp.Usage.PromptTokens, 0, err)
+	telemetry.Record(ctx, "llm.embedding", telemetry.KindClient, start, err,
+		attribute.String("llm.model", req.Model.String()),
+		attribute.Int("llm.prompt_tokens", resp.Usage.PromptTokens),
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "embedding failed", "error", err)
+	}
+}
+
+func (s *MilvusService) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+func (s *MilvusService) recordUsage(ctx context.Context, usage Usage) {
+	if s.onUsage == nil || usage.PromptTokens+usage.CompletionTokens == 0 {
+		return
+	}
+	s.onUsage(ctx, usage)
+}
+
 func (s *MilvusService) RegisterRoutes(router fiber.Router) {
 	router.Post("/messages", s.insertMessage)
 	router.Get("/messages", s.vectorSearch)
@@ -91,47 +194,43 @@ func (s *MilvusService) RegisterRoutes(router fiber.Router) {
 	router.Post("/collections", s.createCollection)
 }
 
-func New(llmClient *openai.Client) (*MilvusService, error) {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
+func New(llmClient *openai.Client, config Config) (*MilvusService, error) {
 	milvusClient, err := client.NewClient(context.Background(), client.Config{
-		Address: "localhost:19530",
+		Address: config.Address,
 	})
 	if err != nil {
-		fmt.Printf("Can't connect to Milvus: %v\n", err)
-		return nil, err
+		return nil, fmt.Errorf("can't connect to Milvus: %w", err)
 	}
 
 	return &MilvusService{
 		llmClient:    llmClient,
 		milvusClient: milvusClient,
+		model:        config.Model,
+		redaction:    config.Redaction,
+		onUsage:      config.OnUsage,
+		timeout:      config.Timeout,
 	}, nil
 }
 
-func insertVector(llmClient *openai.Client, milvusClient client.Client, c *fiber.Ctx, message, user string) error {
-	vector, err := embed(message, llmClient)
-	if err != nil {
-		fmt.Printf("Embedding error: %v\n", err)
-		return err
-	}
-
+// storeVector inserts the message with its vector and metadata, then indexes
+// and loads the collection.
+func storeVector(ctx context.Context, milvusClient client.Client, c *fiber.Ctx, message, user string, vector []float32, contactID int64) error {
 	messageColumn := entity.NewColumnVarChar("message", []string{message})
 	senderColumn := entity.NewColumnVarChar("sender", []string{user})
 	messageVectorColumn := entity.NewColumnFloatVector("message_vector", 1536, [][]float32{vector})
 
-	_, err = milvusClient.Insert(
-		context.Background(), // ctx
-		"messages",           // CollectionName
-		"",                   // partitionName
-		messageColumn,        // columnarData
-		senderColumn,         // columnarData
-		messageVectorColumn,  // columnarData
+	columns := append([]entity.Column{messageColumn, senderColumn, messageVectorColumn}, metadataColumns(c, contactID)...)
+
+	start := time.Now()
+	_, err := milvusClient.Insert(
+		ctx,        // ctx
+		"messages", // CollectionName
+		"",         // partitionName
+		columns..., // columnarData
 	)
+	observe(ctx, "insert", start, err)
 	if err != nil {
-		log.Println("failed to insert data:", err.Error())
-		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		return err
 	}
 
 	idx, err := entity.NewIndexIvfFlat(
@@ -139,43 +238,51 @@ func insertVector(llmClient *openai.Client, milvusClient client.Client, c *fiber
 		1024,
 	)
 	if err != nil {
-		log.Fatal("fail to create ivf flat index parameter:", err.Error())
 		return err
 	}
 
+	start = time.Now()
 	err = milvusClient.CreateIndex(
-		context.Background(),
+		ctx,
 		"messages",
 		"message_vector",
 		idx,
 		false,
 	)
+	observe(ctx, "create_index", start, err)
 	if err != nil {
-		log.Fatal("fail to create index:", err.Error())
 		return err
 	}
 
+	start = time.Now()
 	err = milvusClient.LoadCollection(
-		context.Background(),
+		ctx,
 		"messages",
 		false,
 	)
+	observe(ctx, "load_collection", start, err)
+	return err
+}
+
+func (s *MilvusService) embedAndStore(c *fiber.Ctx, message, user string, contactID int64) error {
+	vector, err := s.embed(c, message, contactID)
 	if err != nil {
-		log.Println("Failed to load collection:", err.Error())
 		return err
 	}
 
-	return nil
+	return storeVector(c.UserContext(), s.milvusClient, c, message, user, vector, contactID)
 }
 
 func (s *MilvusService) createCollection(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	start := time.Now()
 	err := s.milvusClient.CreateCollection(
-		context.Background(), // ctx
+		ctx, // ctx
 		schema,
 		2, // shardNum
 	)
+	observe(ctx, "create_collection", start, err)
 	if err != nil {
-		log.Println("failed to create collection:", err.Error())
 		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 	}
 
@@ -183,39 +290,43 @@ func (s *MilvusService) createCollection(c *fiber.Ctx) error {
 }
 
 func (s *MilvusService) showCollection(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	start := time.Now()
 	collDesc, err := s.milvusClient.DescribeCollection( // Return the name and schema of the collection.
-		context.Background(),
+		ctx,
 		c.Params("name"),
 	)
+	observe(ctx, "describe_collection", start, err)
 	if err != nil {
-		log.Println("failed to check collection schema:", err.Error())
 		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 	}
-	log.Printf("%v\n", collDesc)
 
 	return c.JSON(collDesc)
 }
 
 func (s *MilvusService) listCollections(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	start := time.Now()
 	listColl, err := s.milvusClient.ListCollections(
-		context.Background(), // ctx
+		ctx, // ctx
 	)
+	observe(ctx, "list_collections", start, err)
 	if err != nil {
-		log.Println("failed to list all collections", err.Error())
 		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 	}
-	log.Println(listColl)
 
 	return c.JSON(listColl)
 }
 
 func (s *MilvusService) deleteCollection(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	start := time.Now()
 	err := s.milvusClient.DropCollection(
-		context.Background(), // ctx
+		ctx, // ctx
 		c.Params("name"),
 	)
+	observe(ctx, "drop_collection", start, err)
 	if err != nil {
-		log.Println("failed to delete collection", err.Error())
 		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 	}
 
@@ -229,22 +340,14 @@ func (s *MilvusService) createEmbeddings(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 	}
 
-	embeddingReq := openai.EmbeddingRequest{
-		Input: message.MessageText,
-		Model: openai.AdaEmbeddingV2,
-	}
-
-	resp, err := s.llmClient.CreateEmbeddings(context.Background(), embeddingReq)
+	vector, err := s.embed(c, s.redact(c, pii.NewVault(), message.MessageText), message.ContactID)
 	if err != nil {
-		fmt.Printf("Embedding error: %v\n", err)
 		return c.SendString(err.Error())
 	}
 
-	fmt.Println(resp.Data[0].Embedding)
+	strData := make([]string, len(vector))
 
-	strData := make([]string, len(resp.Data[0].Embedding))
-
-	for i, v := range resp.Data[0].Embedding {
+	for i, v := range vector {
 		strData[i] = strconv.FormatFloat(float64(v), 'f', 6, 64)
 	}
 
@@ -259,56 +362,11 @@ func (s *MilvusService) insertVector(c *fiber.Ctx) error {
 	if err := c.BodyParser(message); err != nil {
 		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 	}
-	vector, err := embed(message.MessageText, s.llmClient)
-	if err != nil {
-		fmt.Printf("Embedding error: %v\n", err)
-	}
-
-	messageColumn := entity.NewColumnVarChar("message", []string{message.MessageText})
-	senderColumn := entity.NewColumnVarChar("sender", []string{"user"})
-	messageVectorColumn := entity.NewColumnFloatVector("message_vector", 1536, [][]float32{vector})
-
-	_, err = s.milvusClient.Insert(
-		context.Background(), // ctx
-		"messages",           // CollectionName
-		"",                   // partitionName
-		messageColumn,        // columnarData
-		senderColumn,         // columnarData
-		messageVectorColumn,  // columnarData
-	)
-	if err != nil {
-		log.Println("failed to insert data:", err.Error())
+	text := s.redact(c, pii.NewVault(), message.MessageText)
+	if err := s.embedAndStore(c, text, "user", message.ContactID); err != nil {
 		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 	}
 
-	idx, err := entity.NewIndexIvfFlat(
-		entity.L2,
-		1024,
-	)
-	if err != nil {
-		log.Fatal("fail to create ivf flat index parameter:", err.Error())
-	}
-	err = s.milvusClient.CreateIndex(
-		context.Background(),
-		"messages",
-		"message_vector",
-		idx,
-		false,
-	)
-	if err != nil {
-		log.Fatal("fail to create index:", err.Error())
-	}
-
-	err = s.milvusClient.LoadCollection(
-		context.Background(),
-		"messages",
-		false,
-	)
-	if err != nil {
-		log.Println("Failed to load collection:", err.Error())
-		return c.SendString(err.Error())
-	}
-
 	return c.SendString("Data inserted and collection loaded in memory!")
 }
 
@@ -319,38 +377,61 @@ func (s *MilvusService) insertMessage(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 	}
 
+	ctx := c.UserContext()
+	vault := pii.NewVault()
+	text := s.redact(c, vault, message.MessageText)
+
+	callCtx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
 	resp, err := s.llmClient.CreateChatCompletion(
-		context.Background(),
+		callCtx,
 		openai.ChatCompletionRequest{
-			Model: os.Getenv("OPENAI_MODEL_ID"),
+			Model: s.model,
 			Messages: []openai.ChatCompletionMessage{
 				{
 					Role:    openai.ChatMessageRoleUser,
-					Content: message.MessageText,
+					Content: text,
 				},
 			},
 		},
 	)
+	metrics.ObserveLLMCall("vector_chat", s.model, start, resp.Usage.PromptTokens, resp.Usage.CompletionTokens, err)
+	telemetry.Record(ctx, "llm.vector_chat", telemetry.KindClient, start, err, attribute.String("llm.model", s.model))
+	s.recordUsage(ctx, Usage{
+		Tenant:           tenantOf(c),
+		ContactID:        message.ContactID,
+		Operation:        "vector_chat",
+		Model:            s.model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	})
+	if err == nil && len(resp.Choices) == 0 {
+		err = errors.New("completion returned no choices")
+	}
 	if err != nil {
-		fmt.Printf("ChatCompletion error: %v\n", err)
-		return c.SendString(err.Error())
+		slog.ErrorContext(ctx, "chat completion failed", "error", err)
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": err.Error(),
+		})
 	}
 
-	err = insertVector(s.llmClient, s.milvusClient, c, message.MessageText, "user")
+	err = s.embedAndStore(c, text, "user", message.ContactID)
 	if err != nil {
-		fmt.Printf("Insert user message error in Vector DB: %v\n", err)
+		slog.ErrorContext(ctx, "insert user message in vector DB failed", "error", err)
 		return c.SendString(err.Error())
 	}
 
-	err = insertVector(s.llmClient, s.milvusClient, c, resp.Choices[0].Message.Content, "llm")
+	err = s.embedAndStore(c, resp.Choices[0].Message.Content, "llm", message.ContactID)
 	if err != nil {
-		fmt.Printf("Insert llm message error in Vector DB: %v\n", err)
+		slog.ErrorContext(ctx, "insert llm message in vector DB failed", "error", err)
 		return c.SendString(err.Error())
 	}
 
-	fmt.Println(resp.Choices[0].Message.Content)
+	reply := vault.Restore(resp.Choices[0].Message.Content)
+	slog.DebugContext(ctx, "vector chat reply", "reply", reply)
 
-	return c.SendString(resp.Choices[0].Message.Content)
+	return c.SendString(reply)
 }
 
 func (s *MilvusService) vectorSearch(c *fiber.Ctx) error {
@@ -359,14 +440,16 @@ func (s *MilvusService) vectorSearch(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 	}
 
+	ctx := c.UserContext()
+	start := time.Now()
 	err := s.milvusClient.LoadCollection(
-		context.Background(),
+		ctx,
 		"messages",
 		false,
 	)
+	observe(ctx, "load_collection", start, err)
 	if err != nil {
-		log.Println("Failed to load collection:", err.Error())
-		return c.SendString(err.Error())
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 	}
 
 	sp, _ := entity.NewIndexIvfFlatSearchParam( // NewIndex*SearchParam func
@@ -380,18 +463,18 @@ func (s *MilvusService) vectorSearch(c *fiber.Ctx) error {
 		option.IgnoreGrowing = false
 	})
 
-	vector, err := embed(message.MessageText, s.llmClient)
+	vector, err := s.embed(c, s.redact(c, pii.NewVault(), message.MessageText), message.ContactID)
 	if err != nil {
-		fmt.Printf("Embedding error: %v\n", err)
-		return err
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 	}
 
+	start = time.Now()
 	searchResult, err := s.milvusClient.Search(
-		context.Background(), // ctx
-		"messages",           // CollectionName
-		[]string{},           // partitionNames
-		"",                   // expr
-		[]string{"message"},  // outputFields
+		ctx,                 // ctx
+		"messages",          // CollectionName
+		[]string{},          // partitionNames
+		"",                  // expr
+		[]string{"message"}, // outputFields
 		[]entity.Vector{entity.FloatVector(vector)}, // vectors
 		"message_vector", // vectorField
 		entity.L2,        // metricType
@@ -399,23 +482,24 @@ func (s *MilvusService) vectorSearch(c *fiber.Ctx) error {
 		sp,               // sp
 		opt,
 	)
+	observeSearch(start, err)
+	observe(ctx, "search", start, err)
 	if err != nil {
-		log.Fatal("fail to search collection:", err.Error())
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 	}
 
-	fmt.Printf("%#v\n", searchResult)
-
 	for _, sr := range searchResult {
-		fmt.Println(sr.IDs)
-		fmt.Println(sr.Scores)
+		slog.DebugContext(ctx, "vector search result", "results", sr.ResultCount, "scores", sr.Scores)
 	}
 
+	start = time.Now()
 	err = s.milvusClient.ReleaseCollection(
-		context.Background(), // ctx
-		"messages",           // CollectionName
+		ctx,        // ctx
+		"messages", // CollectionName
 	)
+	observe(ctx, "release_collection", start, err)
 	if err != nil {
-		log.Fatal("failed to release collection:", err.Error())
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 	}
 
 	return c.SendString("Collection loaded in memory!")
@@ -0,0 +1,62 @@
+package vectordb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arthurborgesdev/relationship-bot/telemetry"
+	"github.com/milvus-io/milvus-sdk-go/v2/entity"
+)
+
+// PurgeFilter selects the vectors inserted before Before for the tenants in
+// Tenants or, when Exclude is set, for every tenant not in Tenants.
+type PurgeFilter struct {
+	Tenants []string
+	Exclude bool
+	Before  time.Time
+}
+
+func (f PurgeFilter) expr() string {
+	quoted := make([]string, len(f.Tenants))
+	for i, tenant := range f.Tenants {
+		quoted[i] = strconv.Quote(tenant)
+	}
+
+	operator := "in"
+	if f.Exclude {
+		operator = "not in"
+	}
+
+	return fmt.Sprintf("%s %s [%s] && %s < %d", tenantField, operator, strings.Join(quoted, ", "), createdAtField, f.Before.Unix())
+}
+
+// PurgeVectors deletes the vectors matching the filter and returns how many
+// were deleted. Vectors inserted before tenants and timestamps were recorded
+// are never matched.
+func (s *MilvusService) PurgeVectors(ctx context.Context, filter PurgeFilter) (deleted int, err error) {
+	ctx, span := telemetry.Start(ctx, "milvus.purge", telemetry.KindClient)
+	defer func() { telemetry.End(span, err) }()
+
+	if err := s.milvusClient.LoadCollection(ctx, "messages", false); err != nil {
+		return 0, err
+	}
+
+	result, err := s.milvusClient.Query(ctx, "messages", []string{}, filter.expr(), []string{"message_id"})
+	if err != nil {
+		return 0, err
+	}
+
+	ids, ok := result.GetColumn("message_id").(*entity.ColumnInt64)
+	if !ok || ids.Len() == 0 {
+		return 0, nil
+	}
+
+	if err := s.milvusClient.DeleteByPks(ctx, "messages", "", ids); err != nil {
+		return 0, err
+	}
+
+	return ids.Len(), nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	openai "github.com/sashabaranov/go-openai"
+	"gorm.io/gorm"
+)
+
+// JobKindRestockAlert notifies the contacts waiting for a product that was
+// restocked.
+const JobKindRestockAlert = "restock_alert"
+
+const (
+	WaitlistStatusOffered  = "offered"
+	WaitlistStatusWaiting  = "waiting"
+	WaitlistStatusNotified = "notified"
+
+	waitlistOfferTTL = 30 * time.Minute
+)
+
+// WaitlistEntry is a contact's interest in a product variant out of stock.
+// The bot offers the waitlist first; the entry waits for the restock once
+// the contact accepts it.
+type WaitlistEntry struct {
+	gorm.Model
+	Tenant     string     `json:"tenant" gorm:"index"`
+	ContactID  uint       `json:"contact_id" gorm:"index"`
+	ProductID  uint       `json:"product_id" gorm:"index"`
+	Product    string     `json:"product"`
+	Flavor     string     `json:"flavor"`
+	Status     string     `json:"status" gorm:"index"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	NotifiedAt *time.Time `json:"notified_at"`
+}
+
+func productName(product, flavor string) string {
+	return strings.TrimSpace(product + " " + flavor)
+}
+
+// offerWaitlist tells the contact the product is out of stock and offers to
+// let them know when it is back.
+func (s *LLMService) offerWaitlist(ctx context.Context, contact *Contact, product *Products) (string, error) {
+	name := productName(product.Product, product.Flavor)
+	unavailable := fmt.Sprintf("%s está esgotado no momento", name)
+	if product.Quantity > 0 {
+		unavailable = fmt.Sprintf("só temos %d unidade(s) de %s no momento", product.Quantity, name)
+	}
+	if contact == nil {
+		return fmt.Sprintf("Poxa, %s.", unavailable), nil
+	}
+
+	var entries []WaitlistEntry
+	err := s.db.WithContext(ctx).Where("contact_id = ? AND product_id = ? AND status = ?", contact.ID, product.ID, WaitlistStatusWaiting).
+		Limit(1).Find(&entries).Error
+	if err != nil {
+		return "", err
+	}
+	if len(entries) > 0 {
+		return fmt.Sprintf("%s continua esgotado, mas você já está na lista de espera. Te aviso assim que chegar!", name), nil
+	}
+
+	// Only the last offer is answered.
+	err = s.db.WithContext(ctx).Where("contact_id = ? AND status = ?", contact.ID, WaitlistStatusOffered).Delete(&WaitlistEntry{}).Error
+	if err != nil {
+		return "", err
+	}
+	expires := s.scheduler.now().Add(waitlistOfferTTL)
+	entry := &WaitlistEntry{Tenant: contact.Tenant, ContactID: contact.ID, ProductID: product.ID, Product: product.Product, Flavor: product.Flavor,
+		Status: WaitlistStatusOffered, ExpiresAt: &expires}
+	if err := s.db.WithContext(ctx).Create(entry).Error; err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Poxa, %s. Quer que eu te avise quando chegar? Responda SIM ou NÃO.", unavailable), nil
+}
+
+// handleWaitlistReply answers a yes/no to the contact's waitlist offer. It
+// reports false when there is no offer or the message does not answer it.
+func (s *LLMService) handleWaitlistReply(ctx context.Context, contact *Contact, content string) (string, bool, error) {
+	var entries []WaitlistEntry
+	err := s.db.WithContext(ctx).Where("contact_id = ? AND status = ? AND expires_at > ?", contact.ID, WaitlistStatusOffered, s.scheduler.now()).
+		Order("id desc").Limit(1).Find(&entries).Error
+	if err != nil || len(entries) == 0 {
+		return "", false, err
+	}
+	entry := &entries[0]
+
+	switch parseOrderReply(content) {
+	case ReplyConfirm:
+		err := s.db.WithContext(ctx).Model(entry).Updates(map[string]interface{}{"status": WaitlistStatusWaiting, "expires_at": nil}).Error
+		if err != nil {
+			return "", false, err
+		}
+		slog.InfoContext(ctx, "contact added to waitlist", "contact_id", contact.ID, "product_id", entry.ProductID)
+		return fmt.Sprintf("Combinado! Te aviso assim que %s chegar.", productName(entry.Product, entry.Flavor)), true, nil
+	case ReplyDeny:
+		if err := s.db.WithContext(ctx).Delete(entry).Error; err != nil {
+			return "", false, err
+		}
+		return "Tudo bem! Se quiser outra coisa, é só falar.", true, nil
+	}
+	return "", false, nil
+}
+
+// scheduleRestockAlert notifies the waitlist of the product once its stock
+// goes up from previous.
+func (s *LLMService) scheduleRestockAlert(ctx context.Context, product *Products, previous int) error {
+	if product.Quantity <= 0 || product.Quantity <= previous {
+		return nil
+	}
+	var waiting int64
+	err := s.db.WithContext(ctx).Model(&WaitlistEntry{}).
+		Where("product_id = ? AND status = ?", product.ID, WaitlistStatusWaiting).Count(&waiting).Error
+	if err != nil || waiting == 0 {
+		return err
+	}
+	return s.scheduler.Schedule(ctx, &Job{Kind: JobKindRestockAlert, RunAt: s.scheduler.now(), Payload: strconv.FormatUint(uint64(product.ID), 10)})
+}
+
+// sendRestockAlerts notifies the contacts waiting for the product, in the
+// order they joined the waitlist, one per unit in stock. The others keep
+// waiting for the next restock.
+func (s *LLMService) sendRestockAlerts(ctx context.Context, job *Job) error {
+	id, err := strconv.ParseUint(job.Payload, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid product id %q", job.Payload)
+	}
+	product, err := s.repos.Products.Get(ctx, uint(id))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if product.Quantity <= 0 {
+		return nil
+	}
+
+	var entries []WaitlistEntry
+	err = s.db.WithContext(ctx).Where("product_id = ? AND status = ?", product.ID, WaitlistStatusWaiting).Order("id").Find(&entries).Error
+	if err != nil {
+		return err
+	}
+
+	name := productName(product.Product, product.Flavor)
+	notified := 0
+	for i := range entries {
+		if notified >= product.Quantity {
+			break
+		}
+		entry := &entries[i]
+		contact, err := s.repos.Contacts.Get(ctx, entry.ContactID)
+		if errors.Is(err, ErrNotFound) {
+			if err := s.db.WithContext(ctx).Delete(entry).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		channel, recipient, ok := contactAddress(contact)
+		if !ok {
+			slog.WarnContext(ctx, "waitlisted contact can not be reached", "contact_id", contact.ID, "product_id", product.ID)
+			continue
+		}
+
+		greeting := "Boa notícia!"
+		if contact.Name != "" {
+			greeting = "Boa notícia, " + contact.Name + "!"
+		}
+		text := fmt.Sprintf("%s %s chegou. Quer que eu separe para você? É só me dizer a quantidade.", greeting, name)
+
+		// A failure retries the job; the contacts already notified are not
+		// notified again.
+		if err := s.sender.Send(ctx, channel, recipient, text); err != nil {
+			return err
+		}
+		now := s.scheduler.now()
+		err = s.db.WithContext(ctx).Model(entry).Updates(map[string]interface{}{"status": WaitlistStatusNotified, "notified_at": now}).Error
+		if err != nil {
+			return err
+		}
+		if err := s.repos.Messages.Create(ctx, &Message{Content: text, Role: openai.ChatMessageRoleAssistant, ContactID: contact.ID, Channel: channel, Tenant: contact.Tenant}); err != nil {
+			return err
+		}
+		notified++
+	}
+
+	slog.InfoContext(ctx, "restock alerts sent", "product_id", product.ID, "contacts", notified, "waiting", len(entries)-notified)
+	return nil
+}
+
+// updateProduct handles PATCH /admin/productsdb/:id. A new quantity is
+// recorded as a stock adjustment; raising it notifies the waitlist.
+func (s *LLMService) updateProduct(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid product ID.")
+	}
+
+	product, err := s.repos.Products.Get(ctx, uint(id))
+	if errors.Is(err, ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var patch struct {
+		SKU         *string `json:"sku"`
+		Product     *string `json:"product"`
+		Flavor      *string `json:"flavor"`
+		Quantity    *int    `json:"quantity"`
+		Category    *string `json:"category"`
+		Description *string `json:"description"`
+	}
+	if err := c.BodyParser(&patch); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if patch.SKU != nil {
+		sku := strings.TrimSpace(*patch.SKU)
+		if taken, err := s.skuTaken(ctx, sku, product.ID); err != nil || taken {
+			return skuConflict(c, sku, err)
+		}
+		product.SKU = sku
+	}
+	if patch.Product != nil {
+		product.Product = strings.ToLower(*patch.Product)
+	}
+	if patch.Flavor != nil {
+		product.Flavor = strings.ToLower(*patch.Flavor)
+	}
+	if patch.Category != nil {
+		product.Category = strings.ToLower(*patch.Category)
+	}
+	if patch.Description != nil {
+		product.Description = *patch.Description
+	}
+	quantity := product.Quantity
+	if patch.Quantity != nil {
+		quantity = *patch.Quantity
+	}
+	principal, _ := currentPrincipal(c)
+	err = s.setStock(ctx, product, quantity, principal.Subject, "product updated")
+	if errors.Is(err, ErrInsufficientStock) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "quantity must not be negative",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(product)
+}
+
+// getWaitlist handles GET /admin/waitlist?product_id=, the contacts waiting
+// for a product or for every product.
+func (s *LLMService) getWaitlist(c *fiber.Ctx) error {
+	query := s.db.WithContext(c.UserContext()).Where("status = ?", WaitlistStatusWaiting).Order("id")
+	if productID := c.QueryInt("product_id"); productID > 0 {
+		query = query.Where("product_id = ?", productID)
+	}
+
+	var entries []WaitlistEntry
+	if err := query.Find(&entries).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(entries)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func TestWaitlist(t *testing.T) {
+	ctx := context.Background()
+	s, _, sender, _ := newTestService(t, time.Now())
+
+	product := &Products{Product: "pod", Flavor: "uva", Quantity: 0}
+	if err := s.repos.Products.Create(ctx, product); err != nil {
+		t.Fatal(err)
+	}
+	contact := &Contact{Tenant: defaultTenant, Name: "Ana", Identities: []ContactIdentity{{Tenant: defaultTenant, Channel: "whatsapp", ExternalID: "+5511999999999"}}}
+	if err := s.repos.Contacts.Create(ctx, contact); err != nil {
+		t.Fatal(err)
+	}
+
+	_, matched, placed, err := placeOrder(ctx, s.repos, contact.ID, "", Arguments{Products: []ExtractedProduct{{Item: "pod", Flavor: "uva", Quantity: 1}}})
+	if !errors.Is(err, ErrOutOfStock) || placed || matched.ID != product.ID {
+		t.Fatalf("Order of a product out of stock is not correct: %v, %v", placed, err)
+	}
+	if orders, _ := s.repos.Orders.List(ctx); len(orders) != 0 {
+		t.Errorf("Order was placed: %+v", orders)
+	}
+
+	reply, err := s.offerWaitlist(ctx, contact, matched)
+	if err != nil || !strings.Contains(reply, "esgotado") {
+		t.Fatalf("Waitlist was not offered: %q, %v", reply, err)
+	}
+	response, err := s.processMessage(ctx, &Message{Channel: "whatsapp", Sender: "+5511999999999", Content: "sim, por favor"})
+	if err != nil || !strings.Contains(response.reply, "Te aviso") {
+		t.Fatalf("Waitlist offer was not accepted: %q, %v", response.reply, err)
+	}
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("principal", Principal{Subject: "staff", Role: RoleStaff})
+		return c.Next()
+	})
+	s.RegisterAdminRoutes(app)
+	req := httptest.NewRequest("PATCH", "/productsdb/1", strings.NewReader(`{"quantity": 12}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil || resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Product was not updated: %v, %v", resp, err)
+	}
+
+	s.scheduler.RunDue(ctx)
+	sent := sender.Sent()
+	if len(sent) != 1 || sent[0].Recipient != "+5511999999999" || !strings.Contains(sent[0].Text, "pod uva chegou") {
+		t.Fatalf("Restock alert was not sent: %+v", sent)
+	}
+
+	var entry WaitlistEntry
+	s.db.First(&entry)
+	if entry.Status != WaitlistStatusNotified || entry.NotifiedAt == nil {
+		t.Errorf("Waitlist entry was not notified: %+v", entry)
+	}
+
+	// Raising the stock again notifies nobody.
+	req = httptest.NewRequest("PATCH", "/productsdb/1", strings.NewReader(`{"quantity": 20}`))
+	req.Header.Set("Content-Type", "application/json")
+	app.Test(req)
+	s.scheduler.RunDue(ctx)
+	if sent := sender.Sent(); len(sent) != 1 {
+		t.Errorf("Contact was notified twice: %+v", sent)
+	}
+}
+
+func TestRestockAlertsLimitedToStock(t *testing.T) {
+	ctx := context.Background()
+	s, _, sender, _ := newTestService(t, time.Now())
+
+	product := &Products{Product: "pod", Flavor: "uva", Quantity: 0}
+	if err := s.repos.Products.Create(ctx, product); err != nil {
+		t.Fatal(err)
+	}
+	for i, phone := range []string{"+5511999999991", "+5511999999992", "+5511999999993"} {
+		contact := &Contact{Tenant: defaultTenant, Identities: []ContactIdentity{{Tenant: defaultTenant, Channel: "whatsapp", ExternalID: phone}}}
+		if err := s.repos.Contacts.Create(ctx, contact); err != nil {
+			t.Fatal(err)
+		}
+		s.db.Create(&WaitlistEntry{Tenant: defaultTenant, ContactID: contact.ID, ProductID: product.ID, Status: WaitlistStatusWaiting, Model: gorm.Model{ID: uint(i + 1)}})
+	}
+	restock := func(quantity int) {
+		previous := product.Quantity
+		product.Quantity = quantity
+		if err := s.repos.Products.UpdateQuantity(ctx, product.ID, quantity); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.scheduleRestockAlert(ctx, product, previous); err != nil {
+			t.Fatal(err)
+		}
+		s.scheduler.RunDue(ctx)
+	}
+
+	// Only as many contacts as units in stock are notified, first come first
+	// served.
+	restock(2)
+	sent := sender.Sent()
+	if len(sent) != 2 || sent[0].Recipient != "+5511999999991" || sent[1].Recipient != "+5511999999992" {
+		t.Fatalf("Restock alerts are not correct: %+v", sent)
+	}
+	var waiting []WaitlistEntry
+	s.db.Where("status = ?", WaitlistStatusWaiting).Find(&waiting)
+	if len(waiting) != 1 || waiting[0].ID != 3 {
+		t.Errorf("Last contact is not waiting: %+v", waiting)
+	}
+
+	// The next restock notifies the contact still waiting.
+	restock(5)
+	if sent := sender.Sent(); len(sent) != 3 || sent[2].Recipient != "+5511999999993" {
+		t.Errorf("Contact still waiting was not notified: %+v", sent)
+	}
+}